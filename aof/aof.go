@@ -0,0 +1,301 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package aof writes the append only file, the log of the write commands, which
+// can be replayed to recover the dbs to a point in time.
+// https://redis.io/topics/persistence
+//
+// The file is the commands in the RESP arrays as sent by the clients:
+//
+//	"#TS:" + unix seconds + "\r\n", the time of the commands after it
+//	*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n, the db of the commands after it
+//	*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n
+//	...
+//
+// The time annotation is written before the first command of each second, and
+// SELECT before the command of another db. The commands committed together,
+// like the commands of EXEC, are wrapped by MULTI and EXEC.
+package aof
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/storage"
+)
+
+// fsync policies
+const (
+	FsyncAlways   = "always"   // fsync after each append
+	FsyncEverySec = "everysec" // fsync once a second
+	FsyncNo       = "no"       // never fsync, the OS flushes the file
+)
+
+// ErrRewriteInProgress is the error of BeginRewrite if a rewrite is running
+var ErrRewriteInProgress = errors.New("aof: rewrite in progress")
+
+// Command is a write command to log, with the index of the db it runs in
+type Command struct {
+	DB   int
+	Args [][]byte
+}
+
+// cursor is the state of a log written: the db selected and the time annotated
+type cursor struct {
+	db int   // -1 if no db is selected
+	ts int64 // unix seconds of the last annotation
+}
+
+// Log is the append only file. The commands are appended only if it is opened
+// as append only, otherwise it only rewrites the file.
+type Log struct {
+	mu         sync.Mutex
+	path       string
+	fsync      string
+	appendOnly bool
+
+	f     *os.File
+	file  cursor
+	dirty bool // written since the last fsync
+
+	rewrite   *bytes.Buffer // commands appended while rewriting, nil if not rewriting
+	rcursor   cursor
+	rewriteAt time.Time // time of the snapshots rewritten
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// Open returns the log of the file of path with the fsync policy, the file is
+// opened to append if appendOnly.
+func Open(path string, fsync string, appendOnly bool) (*Log, error) {
+	switch fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return nil, fmt.Errorf("aof: unknown fsync policy %q", fsync)
+	}
+
+	l := &Log{path: path, fsync: fsync, appendOnly: appendOnly, file: cursor{db: -1}}
+	if !appendOnly {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	if fsync == FsyncEverySec {
+		l.quit, l.done = make(chan struct{}), make(chan struct{})
+		go l.syncLoop()
+	}
+	return l, nil
+}
+
+// AppendOnly returns true if the commands are appended
+func (l *Log) AppendOnly() bool {
+	return l.appendOnly
+}
+
+// Path returns the path of the file
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append writes the commands committed together to the file, the commands are
+// buffered for the rewrite in progress too.
+func (l *Log) Append(cmds []Command) error {
+	if !l.appendOnly || len(cmds) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf bytes.Buffer
+	encode(&buf, &l.file, now, cmds)
+	if l.rewrite != nil {
+		encode(l.rewrite, &l.rcursor, now, cmds)
+	}
+
+	if _, err := l.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	l.dirty = true
+	if l.fsync == FsyncAlways {
+		return l.sync()
+	}
+	return nil
+}
+
+// sync fsyncs the file if it is written, l.mu must be locked
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.f.Sync()
+}
+
+// syncLoop fsyncs the file once a second until the log is closed
+func (l *Log) syncLoop() {
+	defer close(l.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if err := l.sync(); err != nil {
+				logx.Errorf("AOF fsync error: %v", err)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// Close fsyncs and closes the file
+func (l *Log) Close() error {
+	if !l.appendOnly {
+		return nil
+	}
+	if l.quit != nil {
+		close(l.quit)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// BeginRewrite starts a rewrite, the commands appended later are buffered until
+// Rewrite is done. The caller must hold the locks of all dbs, and take the
+// snapshots of the dbs for Rewrite at the same moment.
+func (l *Log) BeginRewrite() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rewrite != nil {
+		return ErrRewriteInProgress
+	}
+	l.rewrite = &bytes.Buffer{}
+	l.rcursor = cursor{db: -1}
+	l.rewriteAt = time.Now()
+	return nil
+}
+
+// Rewrite writes the keys of the snapshots dbs as commands to a temp file in the
+// same directory, then the commands buffered since BeginRewrite, and replaces
+// the file by it, so the file is either the old log or the complete new log.
+func (l *Log) Rewrite(dbs []*storage.LevelDB) error {
+	ended := false
+	defer func() {
+		if !ended {
+			l.mu.Lock()
+			l.rewrite = nil
+			l.mu.Unlock()
+		}
+	}()
+
+	f, err := os.Create(filepath.Join(filepath.Dir(l.path), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid())))
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	defer os.Remove(temp) // nothing to remove after renamed
+
+	err = WriteSnapshot(f, dbs, l.rewriteAt)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// the appends wait until the file is replaced
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ended = true
+	rewrite := l.rewrite
+	l.rewrite = nil
+
+	if _, err := f.Write(rewrite.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(temp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	if !l.appendOnly {
+		return f.Close()
+	}
+	l.f.Close()
+	l.f, l.file, l.dirty = f, l.rcursor, false
+	return nil
+}
+
+// encode writes the commands committed together to buf with the time annotation
+// and SELECT the commands need, c is the state of the log written.
+func encode(buf *bytes.Buffer, c *cursor, now int64, cmds []Command) {
+	if now != c.ts {
+		fmt.Fprintf(buf, "#TS:%d\r\n", now)
+		c.ts = now
+	}
+	WriteCommands(buf, &c.db, cmds)
+}
+
+// WriteCommands writes the commands committed together to buf, wrapped by MULTI
+// and EXEC if more than one, with SELECT before the command of a db other than
+// db, which is the db selected by the commands written before, -1 if none.
+func WriteCommands(buf *bytes.Buffer, db *int, cmds []Command) {
+	if len(cmds) > 1 {
+		writeCommand(buf, []byte("MULTI"))
+	}
+	for _, cmd := range cmds {
+		if cmd.DB != *db {
+			writeCommand(buf, []byte("SELECT"), []byte(strconv.Itoa(cmd.DB)))
+			*db = cmd.DB
+		}
+		writeCommand(buf, cmd.Args...)
+	}
+	if len(cmds) > 1 {
+		writeCommand(buf, []byte("EXEC"))
+	}
+}
+
+// writeCommand writes the command to w as a RESP array of bulk strings
+func writeCommand(w io.Writer, args ...[]byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n", len(arg))
+		buf.Write(arg)
+		buf.WriteString("\r\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ErrTruncated is the error of Read if the last command of the file is incomplete,
+// as the server stopped while writing it. The commands before it are read.
+var ErrTruncated = errors.New("aof: the last command is truncated")
+
+// Read reads the commands of the log of r in order, and calls f with each of them.
+// If until is not zero, the reading stops at the first time annotation later than
+// until, so the commands logged after until are not read. It stops at the first
+// error of f, which is returned.
+func Read(r io.Reader, until time.Time, f func(args [][]byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if b[0] == '#' { // annotation
+			line, err := readLine(br)
+			if err != nil {
+				return err
+			}
+			if ts := bytes.TrimPrefix(line, []byte("#TS:")); len(ts) != len(line) {
+				sec, err := strconv.ParseInt(string(ts), 10, 64)
+				if err != nil {
+					return fmt.Errorf("aof: wrong time annotation %q", line)
+				}
+				if !until.IsZero() && time.Unix(sec, 0).After(until) {
+					return nil
+				}
+			}
+			continue
+		}
+
+		args, err := ReadCommand(br)
+		if err != nil {
+			return err
+		}
+		if err := f(args); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadCommand reads a command as a RESP array of bulk strings, ErrTruncated is
+// returned if r ends in the middle of the command.
+func ReadCommand(br *bufio.Reader) ([][]byte, error) {
+	n, err := readHeader(br, '*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		size, err := readHeader(br, '$')
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(br, arg); err != nil {
+			return nil, truncated(err)
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("aof: wrong bulk string of %d bytes", size)
+		}
+		args[i] = arg[:size]
+	}
+	return args, nil
+}
+
+// CommandSize returns the bytes of the command written as a RESP array of bulk
+// strings, as it is written to the log.
+func CommandSize(args [][]byte) int {
+	n := len(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		n += len(fmt.Sprintf("$%d\r\n", len(arg))) + len(arg) + 2
+	}
+	return n
+}
+
+// readHeader reads the line of the array or bulk string header of prefix, returns
+// its length
+func readHeader(br *bufio.Reader, prefix byte) (int, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("aof: expect '%c', got %q", prefix, line)
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("aof: wrong length %q", line)
+	}
+	return n, nil
+}
+
+// readLine reads a line ended by \r\n, without the \r\n
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("aof: line %q is not ended by \\r\\n", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// truncated returns ErrTruncated for the end of file in the middle of a command
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
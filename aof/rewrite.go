@@ -0,0 +1,125 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// ItemsPerCommand is the max number of elements written by one command when the
+// keys are rewritten, so a big key does not make a huge command.
+const ItemsPerCommand = 64
+
+// WriteSnapshot writes the commands recreating the keys of the snapshots dbs to
+// w, taken at the time at, the dbs without keys are skipped.
+func WriteSnapshot(w io.Writer, dbs []*storage.LevelDB, at time.Time) error {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "#TS:%d\r\n", at.Unix()); err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		selected := false
+		err := db.Each(func(key []byte, tipe byte, at *time.Time) error {
+			if !selected {
+				if err := writeCommand(bw, []byte("SELECT"), []byte(strconv.Itoa(db.Index()))); err != nil {
+					return err
+				}
+				selected = true
+			}
+			return writeKey(bw, db, key, tipe, at)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeKey writes the commands recreating the key of tipe in db, with the expire
+// at if not nil
+func writeKey(w io.Writer, db *storage.LevelDB, key []byte, tipe byte, at *time.Time) error {
+	var name string
+	var items [][]byte // arguments after the key, itemSize per element
+	itemSize := 1
+
+	switch tipe {
+	case resp.String:
+		value, err := db.GetString(key)
+		if err != nil {
+			return err
+		}
+		if err := writeCommand(w, []byte("SET"), key, value); err != nil {
+			return err
+		}
+	case resp.List:
+		elements, err := db.GetListRange(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		name, items = "RPUSH", elements
+	case resp.Set:
+		members, err := db.GetFieldNames(key)
+		if err != nil {
+			return err
+		}
+		name, items = "SADD", members
+	case resp.Hash:
+		fields, err := db.GetHashAsArray(key)
+		if err != nil {
+			return err
+		}
+		name, itemSize = "HMSET", 2
+		for _, field := range fields {
+			items = append(items, field.Key, field.Value)
+		}
+	case resp.SortedSet:
+		elements, err := db.GetSkipRange(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		name, itemSize = "ZADD", 2
+		for _, element := range elements {
+			items = append(items, []byte(formatScore(element.Score)), element.Field)
+		}
+	}
+
+	for len(items) > 0 {
+		n := len(items)
+		if n > ItemsPerCommand*itemSize {
+			n = ItemsPerCommand * itemSize
+		}
+		args := append([][]byte{[]byte(name), key}, items[:n]...)
+		if err := writeCommand(w, args...); err != nil {
+			return err
+		}
+		items = items[n:]
+	}
+
+	if at == nil {
+		return nil
+	}
+	ms := at.UnixNano() / int64(time.Millisecond)
+	return writeCommand(w, []byte("PEXPIREAT"), key, []byte(strconv.FormatInt(ms, 10)))
+}
+
+// formatScore formats the score read by ZADD, infinity is inf or -inf
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
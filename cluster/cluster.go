@@ -0,0 +1,297 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors of the slot changes, in SlotError
+var (
+	ErrSlotBusy       = errors.New("is already busy")
+	ErrSlotUnassigned = errors.New("is already unassigned")
+	ErrNotOwner       = errors.New("is not served by myself")
+	ErrOwner          = errors.New("is already served by myself")
+)
+
+// SlotError is the error of a slot which can not be changed
+type SlotError struct {
+	Slot int
+	Err  error
+}
+
+func (e *SlotError) Error() string {
+	return fmt.Sprintf("cluster: slot %d %v", e.Slot, e.Err)
+}
+
+// Node is a node of the cluster
+type Node struct {
+	ID   string // 40 hex chars of the SHA1 of the address, so all nodes know the same ids
+	Host string
+	Port int
+}
+
+// newNode returns the node of the address "host:port"
+func newNode(addr string) (*Node, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: wrong node address %q", addr)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("cluster: wrong node port %q", addr)
+	}
+	n := &Node{Host: host, Port: port}
+	id := sha1.Sum([]byte(n.Addr()))
+	n.ID = hex.EncodeToString(id[:])
+	return n, nil
+}
+
+// Addr returns "host:port" of the node, as in the redirections
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// Cluster is the nodes of the cluster and the slots they serve, as the local node
+// knows. There is no gossip between the nodes: the slots are configured, and
+// changed by CLUSTER ADDSLOTS, DELSLOTS and SETSLOT on each node.
+type Cluster struct {
+	mu        sync.RWMutex
+	myself    *Node
+	nodes     []*Node       // in the order of the configuration
+	slots     [Slots]*Node  // node serving each slot, nil if the slot is not served
+	migrating map[int]*Node // slots of myself migrating to other nodes
+	importing map[int]*Node // slots of other nodes importing to myself
+}
+
+// New returns the cluster of nodes, each of them is "host:port slot ..." where a
+// slot is a number or a range first-last. myself is the address of the local
+// node, it is added if it is not in nodes.
+func New(myself string, nodes []string) (*Cluster, error) {
+	c := &Cluster{migrating: make(map[int]*Node), importing: make(map[int]*Node)}
+	for _, s := range nodes {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := newNode(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if c.node(n.ID) != nil {
+			return nil, fmt.Errorf("cluster: node %v is configured twice", n.Addr())
+		}
+		c.nodes = append(c.nodes, n)
+
+		for _, r := range fields[1:] {
+			first, last, err := parseRange(r)
+			if err != nil {
+				return nil, err
+			}
+			for slot := first; slot <= last; slot++ {
+				if c.slots[slot] != nil {
+					return nil, fmt.Errorf("cluster: slot %d is served by both %v and %v", slot, c.slots[slot].Addr(), n.Addr())
+				}
+				c.slots[slot] = n
+			}
+		}
+	}
+
+	me, err := newNode(myself)
+	if err != nil {
+		return nil, err
+	}
+	if c.myself = c.node(me.ID); c.myself == nil {
+		c.myself = me
+		c.nodes = append(c.nodes, me)
+	}
+	return c, nil
+}
+
+// parseRange parses the slot range first-last, or a single slot
+func parseRange(r string) (int, int, error) {
+	bounds := strings.SplitN(r, "-", 2)
+	first, err := strconv.Atoi(bounds[0])
+	last := first
+	if err == nil && len(bounds) == 2 {
+		last, err = strconv.Atoi(bounds[1])
+	}
+	if err != nil || first < 0 || last >= Slots || first > last {
+		return 0, 0, fmt.Errorf("cluster: wrong slot range %q", r)
+	}
+	return first, last, nil
+}
+
+// node returns the node of id, or nil
+func (c *Cluster) node(id string) *Node {
+	for _, n := range c.nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// Myself returns the local node
+func (c *Cluster) Myself() *Node {
+	return c.myself
+}
+
+// Node returns the node of id, or nil if the node is unknown
+func (c *Cluster) Node(id string) *Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.node(id)
+}
+
+// Nodes returns all nodes of the cluster
+func (c *Cluster) Nodes() []*Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]*Node{}, c.nodes...)
+}
+
+// Lookup returns the node serving the slot, nil if the slot is not served, and
+// the node the slot is migrating to, or importing from, if any.
+func (c *Cluster) Lookup(slot int) (owner, migrating, importing *Node) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.slots[slot], c.migrating[slot], c.importing[slot]
+}
+
+// Ranges returns the ranges of the slots served by n, in the order of slot
+func (c *Cluster) Ranges(n *Node) [][2]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ranges := [][2]int{}
+	for slot := 0; slot < Slots; slot++ {
+		if c.slots[slot] != n {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last][1] == slot-1 {
+			ranges[last][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// Assigned returns the number of slots served
+func (c *Cluster) Assigned() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	n := 0
+	for _, owner := range c.slots {
+		if owner != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Migrations returns the slots migrating to other nodes, and the slots importing
+// from other nodes
+func (c *Cluster) Migrations() (migrating, importing map[int]*Node) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	migrating, importing = make(map[int]*Node), make(map[int]*Node)
+	for slot, n := range c.migrating {
+		migrating[slot] = n
+	}
+	for slot, n := range c.importing {
+		importing[slot] = n
+	}
+	return migrating, importing
+}
+
+// AddSlots assigns the slots to myself, none is assigned if a slot is served.
+func (c *Cluster) AddSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, slot := range slots {
+		if c.slots[slot] != nil {
+			return &SlotError{slot, ErrSlotBusy}
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = c.myself
+		delete(c.importing, slot)
+	}
+	return nil
+}
+
+// DelSlots unassigns the slots, none is unassigned if a slot is not served.
+func (c *Cluster) DelSlots(slots []int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, slot := range slots {
+		if c.slots[slot] == nil {
+			return &SlotError{slot, ErrSlotUnassigned}
+		}
+	}
+	for _, slot := range slots {
+		c.slots[slot] = nil
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+	}
+	return nil
+}
+
+// Migrate marks the slot of myself migrating to n
+func (c *Cluster) Migrate(slot int, n *Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.slots[slot] != c.myself || n == c.myself {
+		return &SlotError{slot, ErrNotOwner}
+	}
+	c.migrating[slot] = n
+	return nil
+}
+
+// Import marks the slot importing from n to myself
+func (c *Cluster) Import(slot int, n *Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.slots[slot] == c.myself || n == c.myself {
+		return &SlotError{slot, ErrOwner}
+	}
+	c.importing[slot] = n
+	return nil
+}
+
+// Assign assigns the slot to n, the migration of the slot is done.
+func (c *Cluster) Assign(slot int, n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.slots[slot] = n
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// Stable clears the migration of the slot
+func (c *Cluster) Stable(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package cluster is the hash slots of the Redis Cluster protocol. The keys are
+// sharded to 16384 slots by the CRC16 of the key, and each slot is served by a
+// node of the cluster. The clients are redirected by MOVED to the node serving
+// the slot, or by ASK while the slot is migrating to another node.
+package cluster
+
+import "bytes"
+
+// Slots is the number of the hash slots
+const Slots = 16384
+
+// crcTable is the table of the CRC16 of Redis: CCITT (XMODEM), the polynomial
+// 0x1021, not reflected, with the initial value 0 and no final xor.
+var crcTable = makeCRCTable(0x1021)
+
+// makeCRCTable makes the table of the poly, not reflected
+func makeCRCTable(poly uint16) *[256]uint16 {
+	t := new([256]uint16)
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}
+
+// CRC16 returns crc updated with the bytes of p
+func CRC16(crc uint16, p []byte) uint16 {
+	for _, b := range p {
+		crc = crc<<8 ^ crcTable[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// KeySlot returns the hash slot of key. If the key has a hash tag, which is the
+// substring between the first '{' and the first '}' after it, and not empty, only
+// the tag is hashed, so the keys of the same tag are in the same slot.
+func KeySlot(key []byte) int {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(CRC16(0, key)) & (Slots - 1)
+}
@@ -9,10 +9,16 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/libgo/logx"
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/command"
+	"github.com/rod6/rodis/rdb"
 	"github.com/rod6/rodis/server"
 	"github.com/rod6/rodis/storage"
 )
@@ -32,12 +38,61 @@ func main() {
 		logx.Fatalf("Load/Parse config file error: %v", err)
 	}
 
-	err := storage.Open(server.Config.LevelDBPath, server.Config.LevelDB)
+	err := storage.Open(server.Config.LevelDBPath, server.Config.LevelDB, server.Config.CacheSize)
 	if err != nil {
 		logx.Fatalf("Open storage error: %v", err)
 	}
 	defer storage.Close()
 
+	// rodis -c rodis.toml migrate: migrates the keys in the legacy layout and exits
+	if flag.Arg(0) == "migrate" {
+		storage.Migrate()
+		return
+	}
+
+	// rodis -c rodis.toml import dump.rdb [replace]: imports the keys of the RDB file
+	// and exits, the existing keys are replaced if replace, or the import fails
+	if flag.Arg(0) == "import" {
+		n, err := rdb.LoadFile(flag.Arg(1), flag.Arg(2) == "replace")
+		if err != nil {
+			logx.Errorf("Import %v error after %d keys: %v", flag.Arg(1), n, err)
+			storage.Close() // not deferred by os.Exit
+			os.Exit(1)
+		}
+		logx.Infof("Imported %d keys from %v", n, flag.Arg(1))
+		return
+	}
+
+	// rodis -c rodis.toml replay [unixtime]: flushes all dbs, runs the commands of
+	// the AOF up to the unix time if given, for the point in time recovery, and exits
+	if flag.Arg(0) == "replay" {
+		var until time.Time
+		if flag.Arg(1) != "" {
+			sec, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+			if err != nil {
+				logx.Fatalf("Replay time %v is not a unix time", flag.Arg(1))
+			}
+			until = time.Unix(sec, 0)
+		}
+		for i := 0; i < 16; i++ {
+			if err := storage.Select(i).Flush(); err != nil {
+				logx.Fatalf("Flush db %d error: %v", i, err)
+			}
+		}
+
+		path := filepath.Join(server.Config.Dir, server.Config.AppendFilename)
+		n, err := command.Replay(path, until)
+		switch {
+		case err == aof.ErrTruncated:
+			logx.Warnf("Replayed %d commands from %v, the truncated last command is skipped", n, path)
+		case err != nil:
+			logx.Errorf("Replay %v error after %d commands: %v", path, n, err)
+		default:
+			logx.Infof("Replayed %d commands from %v", n, path)
+		}
+		return
+	}
+
 	rs, err := server.New(server.Config)
 	if err != nil {
 		logx.Fatalf("New server error: %v", err)
@@ -0,0 +1,169 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/rdb"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// command
+// -------
+// BGREWRITEAOF
+
+// logged is a write command appended to the AOF when its writes are committed
+type logged struct {
+	db int
+	v  Args // the command line
+}
+
+// relativeTTL is the commands which may set the expire relative to the time
+// they run, they are followed by PEXPIREAT of the expire set in the AOF.
+var relativeTTL = map[string]bool{
+	"expire":         true,
+	"pexpire":        true,
+	"psetex":         true,
+	"restore":        true,
+	"restore-asking": true,
+	"set":            true,
+	"setex":          true,
+}
+
+// run calls the command handler. The write command replied without error is
+// logged to the AOF, unless it logs itself.
+func (ex *Extras) run(cmd string, a *attr, v Args) error {
+	mark := ex.Buffer.Len()
+	err := a.f(v, ex)
+	if err != nil || a.flag&flagWrite == 0 || a.flag&flagSelfLog != 0 {
+		return err
+	}
+	if reply := ex.Buffer.Bytes()[mark:]; len(reply) > 0 && reply[0] == '-' {
+		return nil
+	}
+
+	ex.propagate(append(Args{[]byte(cmd)}, v...)...)
+	if relativeTTL[cmd] && ex.logging() {
+		at, err := ex.DB.GetExpireAt(v[0])
+		if err != nil {
+			return err
+		}
+		if at != nil {
+			ms := at.UnixNano() / int64(time.Millisecond)
+			ex.propagate([]byte("pexpireat"), v[0], []byte(strconv.FormatInt(ms, 10)))
+		}
+	}
+	return nil
+}
+
+// logging returns true if the write commands are logged to the AOF, or fed to
+// the replicas
+func (ex *Extras) logging() bool {
+	return ex.AOF != nil && ex.AOF.AppendOnly() || ex.Replication != nil && ex.Replication.Feeding()
+}
+
+// propagate logs the command line v run in ex.DB to the AOF and the replicas, it
+// is appended when the writes of the command are committed.
+func (ex *Extras) propagate(v ...[]byte) {
+	if !ex.logging() {
+		return
+	}
+	args := make(Args, len(v)) // v may refer to the buffer of reader, copy it
+	for i, arg := range v {
+		args[i] = append([]byte{}, arg...)
+	}
+	ex.logs = append(ex.logs, logged{ex.DB.Index(), args})
+}
+
+// journal appends the commands committed to the AOF, and feeds them to the replicas
+func (ex *Extras) journal() {
+	if len(ex.logs) == 0 {
+		return
+	}
+	cmds := make([]aof.Command, len(ex.logs))
+	for i, l := range ex.logs {
+		cmds[i] = aof.Command{DB: l.db, Args: l.v}
+	}
+	ex.logs = nil
+	if ex.AOF != nil {
+		if err := ex.AOF.Append(cmds); err != nil {
+			logx.Errorf("AOF append error: %v", err)
+		}
+	}
+	if ex.Replication != nil {
+		ex.Replication.Feed(cmds)
+	}
+}
+
+// bgrewriteaof: https://redis.io/commands/bgrewriteaof
+func bgrewriteaof(v Args, ex *Extras) error {
+	if ex.AOF == nil {
+		return resp.NewError(ErrAOFDisabled).WriteTo(ex.Buffer)
+	}
+
+	// the snapshots and the start of the rewrite buffer are of the same moment
+	unlock := lockAll(ex)
+	dbs, err := rdb.Snapshot()
+	if err != nil {
+		unlock()
+		return err
+	}
+	err = ex.AOF.BeginRewrite()
+	unlock()
+	if err != nil {
+		rdb.Release(dbs)
+		return resp.NewError(ErrRewriteInProgress).WriteTo(ex.Buffer)
+	}
+
+	go func() {
+		err := ex.AOF.Rewrite(dbs)
+		rdb.Release(dbs)
+		if err != nil {
+			logx.Errorf("Background AOF rewrite error: %v", err)
+			return
+		}
+		logx.Infof("Background AOF rewrite to %v terminated with success", ex.AOF.Path())
+	}()
+	return resp.SimpleString("Background append only file rewriting started").WriteTo(ex.Buffer)
+}
+
+// Replay runs the commands of the AOF file of path, up to the time until if it
+// is not zero, returns the number of commands run. It stops at the first command
+// replying an error. The commands are not logged again.
+func Replay(path string, until time.Time) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	ex := &Extras{DB: storage.Select(0), Buffer: &bytes.Buffer{}, Authed: true}
+	err = aof.Read(f, until, func(args [][]byte) error {
+		v := make(resp.Array, len(args))
+		for i, arg := range args {
+			v[i] = resp.BulkString(arg)
+		}
+		if err := Handle(v, ex); err != nil {
+			return err
+		}
+		if reply := ex.Buffer.Bytes(); len(reply) > 0 && reply[0] == '-' {
+			return fmt.Errorf("aof: command %d %q replies %s", n+1, args[0], bytes.TrimSpace(reply[1:]))
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
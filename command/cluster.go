@@ -0,0 +1,613 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rod6/rodis/cluster"
+	"github.com/rod6/rodis/rdb"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// command
+// -------
+// ASKING
+// CLUSTER
+// MIGRATE
+// RESTORE-ASKING
+
+// route returns the redirection of the command on keys in cluster mode, or false
+// if the command is served by myself. asking is true if the command follows
+// ASKING, or is served in an importing slot like RESTORE-ASKING.
+func route(ex *Extras, cmd string, keys [][]byte, asking bool) (resp.Error, bool) {
+	if len(keys) == 0 {
+		return "", false
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			return resp.NewError(ErrCrossSlot), true
+		}
+	}
+
+	owner, migrating, importing := ex.Cluster.Lookup(slot)
+	switch myself := ex.Cluster.Myself(); {
+	case cmd == "migrate" && (migrating != nil || importing != nil):
+		return "", false // the keys of the slot are moved by myself
+	case owner == myself && migrating == nil:
+		return "", false
+	case owner == myself:
+		// the keys missing may be migrated, the command is asked to the target
+		missing, err := missingKeys(ex.DB, keys)
+		switch {
+		case err != nil:
+			return storageError(err), true
+		case missing == 0:
+			return "", false
+		case missing == len(keys):
+			return resp.NewError(ErrFmtAsk, slot, migrating.Addr()), true
+		}
+		return resp.NewError(ErrTryAgain), true
+	case importing != nil && asking:
+		if len(keys) > 1 {
+			if missing, err := missingKeys(ex.DB, keys); err != nil {
+				return storageError(err), true
+			} else if missing > 0 { // the keys are not all imported yet
+				return resp.NewError(ErrTryAgain), true
+			}
+		}
+		return "", false
+	case owner == nil:
+		return resp.NewError(ErrClusterDown), true
+	}
+	return resp.NewError(ErrFmtMoved, slot, owner.Addr()), true
+}
+
+// missingKeys returns the number of keys not existing in db
+func missingKeys(db *storage.LevelDB, keys [][]byte) (int, error) {
+	unlock := db.LockKeys(keys, false)
+	defer unlock()
+
+	missing := 0
+	for _, key := range keys {
+		exist, _, err := db.Has(key)
+		if err != nil {
+			return 0, err
+		}
+		if !exist {
+			missing++
+		}
+	}
+	return missing, nil
+}
+
+// queuedKeys returns the keys of the commands queued in MULTI, they are served
+// by the node of the command queued next
+func (ex *Extras) queuedKeys() [][]byte {
+	keys := [][]byte{}
+	for _, q := range ex.queue {
+		if q.a.keys != nil {
+			keys = append(keys, q.a.keys(q.v)...)
+		}
+	}
+	return keys
+}
+
+// asking: https://redis.io/commands/asking
+func asking(v Args, ex *Extras) error {
+	if ex.Cluster == nil {
+		return resp.NewError(ErrClusterDisabled).WriteTo(ex.Buffer)
+	}
+	ex.asking = true
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// clusterx: https://redis.io/commands/cluster
+func clusterx(v Args, ex *Extras) error {
+	if ex.Cluster == nil {
+		return resp.NewError(ErrClusterDisabled).WriteTo(ex.Buffer)
+	}
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "cluster").WriteTo(ex.Buffer)
+	}
+
+	switch sub := strings.ToLower(string(v[0])); {
+	case sub == "addslots" && len(v) > 1, sub == "delslots" && len(v) > 1:
+		return clusterAddSlots(sub == "addslots", v[1:], ex)
+	case sub == "countkeysinslot" && len(v) == 2:
+		return clusterKeysInSlot(v[1], nil, ex)
+	case sub == "getkeysinslot" && len(v) == 3:
+		return clusterKeysInSlot(v[1], v[2], ex)
+	case sub == "info" && len(v) == 1:
+		return clusterInfo(ex)
+	case sub == "keyslot" && len(v) == 2:
+		return resp.Integer(cluster.KeySlot(v[1])).WriteTo(ex.Buffer)
+	case sub == "myid" && len(v) == 1:
+		return resp.BulkString(ex.Cluster.Myself().ID).WriteTo(ex.Buffer)
+	case sub == "nodes" && len(v) == 1:
+		return clusterNodes(ex)
+	case sub == "setslot" && (len(v) == 3 || len(v) == 4):
+		return clusterSetSlot(v[1:], ex)
+	case sub == "shards" && len(v) == 1:
+		return clusterShards(ex)
+	case sub == "slots" && len(v) == 1:
+		return clusterSlots(ex)
+	default:
+		return resp.NewError(ErrFmtUnknownSubcommand, string(v[0]), "CLUSTER").WriteTo(ex.Buffer)
+	}
+}
+
+// parseSlot returns the slot of the number, the error reply is returned if it is
+// invalid
+func parseSlot(b []byte) (int, resp.Value) {
+	slot, err := strconv.Atoi(string(b))
+	if err != nil || slot < 0 || slot >= cluster.Slots {
+		return 0, resp.NewError(ErrInvalidSlot)
+	}
+	return slot, nil
+}
+
+// slotError returns the reply of the error of cluster slot changes
+func slotError(err error) resp.Value {
+	se, ok := err.(*cluster.SlotError)
+	if !ok {
+		return resp.NewError(ErrServerUnknown)
+	}
+	switch se.Err {
+	case cluster.ErrSlotBusy:
+		return resp.NewError(ErrFmtSlotBusy, se.Slot)
+	case cluster.ErrSlotUnassigned:
+		return resp.NewError(ErrFmtSlotUnassigned, se.Slot)
+	case cluster.ErrNotOwner:
+		return resp.NewError(ErrFmtNotSlotOwner, se.Slot)
+	case cluster.ErrOwner:
+		return resp.NewError(ErrFmtSlotOwner, se.Slot)
+	}
+	return resp.NewError(ErrServerUnknown)
+}
+
+// keysInSlot returns the keys of the slot in db
+func keysInSlot(db *storage.LevelDB, slot int) ([][]byte, error) {
+	return db.Keys(nil, func(key []byte) bool {
+		return cluster.KeySlot(key) == slot
+	})
+}
+
+// clusterAddSlots: CLUSTER ADDSLOTS|DELSLOTS slot [slot ...]
+func clusterAddSlots(add bool, v Args, ex *Extras) error {
+	slots := make([]int, len(v))
+	for i, arg := range v {
+		slot, reply := parseSlot(arg)
+		if reply != nil {
+			return reply.WriteTo(ex.Buffer)
+		}
+		slots[i] = slot
+	}
+
+	var err error
+	if add {
+		err = ex.Cluster.AddSlots(slots)
+	} else {
+		err = ex.Cluster.DelSlots(slots)
+	}
+	if err != nil {
+		return slotError(err).WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// clusterKeysInSlot: CLUSTER COUNTKEYSINSLOT slot, or CLUSTER GETKEYSINSLOT slot
+// count if count is not nil. The keys of db are visited to find the keys of the
+// slot, as there is no index of the slots.
+func clusterKeysInSlot(s, count []byte, ex *Extras) error {
+	slot, reply := parseSlot(s)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	n := 0
+	if count != nil {
+		var err error
+		if n, err = strconv.Atoi(string(count)); err != nil || n < 0 {
+			return resp.NewError(ErrInvalidKeyCount).WriteTo(ex.Buffer)
+		}
+	}
+
+	keys, err := keysInSlot(ex.DB, slot)
+	if err != nil {
+		return err
+	}
+	if count == nil {
+		return resp.Integer(len(keys)).WriteTo(ex.Buffer)
+	}
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	arr := resp.Array{}
+	for _, key := range keys {
+		arr = append(arr, resp.BulkString(key))
+	}
+	return arr.WriteTo(ex.Buffer)
+}
+
+// clusterInfo: CLUSTER INFO
+func clusterInfo(ex *Extras) error {
+	nodes := ex.Cluster.Nodes()
+	size := 0
+	for _, n := range nodes {
+		if len(ex.Cluster.Ranges(n)) > 0 {
+			size++
+		}
+	}
+	assigned := ex.Cluster.Assigned()
+	state := "ok"
+	if assigned < cluster.Slots {
+		state = "fail"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_pfail:0\r\n")
+	fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", size)
+	fmt.Fprintf(&b, "cluster_current_epoch:0\r\n")
+	fmt.Fprintf(&b, "cluster_my_epoch:0\r\n")
+	return ex.reply(resp.Verbatim{Format: "txt", Text: []byte(b.String())})
+}
+
+// clusterNodes: CLUSTER NODES, the nodes are all masters connected, the slots
+// migrating and importing are listed for myself.
+func clusterNodes(ex *Extras) error {
+	myself := ex.Cluster.Myself()
+	migrating, importing := ex.Cluster.Migrations()
+
+	var b strings.Builder
+	for _, n := range ex.Cluster.Nodes() {
+		flags := "master"
+		if n == myself {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s@%d %s - 0 0 0 connected", n.ID, n.Addr(), n.Port+10000, flags)
+		for _, r := range ex.Cluster.Ranges(n) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if n == myself {
+			for _, slot := range sortedSlots(migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, migrating[slot].ID)
+			}
+			for _, slot := range sortedSlots(importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, importing[slot].ID)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return ex.reply(resp.Verbatim{Format: "txt", Text: []byte(b.String())})
+}
+
+// sortedSlots returns the slots of m in order
+func sortedSlots(m map[int]*cluster.Node) []int {
+	slots := []int{}
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// clusterSetSlot: CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node-id, or
+// CLUSTER SETSLOT slot STABLE
+func clusterSetSlot(v Args, ex *Extras) error {
+	slot, reply := parseSlot(v[0])
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	state := strings.ToLower(string(v[1]))
+	if state == "stable" && len(v) == 2 {
+		ex.Cluster.Stable(slot)
+		return resp.OkSimpleString.WriteTo(ex.Buffer)
+	}
+	if len(v) != 3 {
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+	n := ex.Cluster.Node(string(v[2]))
+	if n == nil {
+		return resp.NewError(ErrFmtUnknownNode, v[2]).WriteTo(ex.Buffer)
+	}
+
+	var err error
+	switch state {
+	case "importing":
+		err = ex.Cluster.Import(slot, n)
+	case "migrating":
+		err = ex.Cluster.Migrate(slot, n)
+	case "node":
+		myself := ex.Cluster.Myself()
+		if owner, _, _ := ex.Cluster.Lookup(slot); owner == myself && n != myself {
+			keys, err := keysInSlot(ex.DB, slot)
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				return resp.NewError(ErrFmtSlotNotEmpty, slot).WriteTo(ex.Buffer)
+			}
+		}
+		ex.Cluster.Assign(slot, n)
+	default:
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+	if err != nil {
+		return slotError(err).WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// clusterShards: CLUSTER SHARDS, each node is a shard of a master
+func clusterShards(ex *Extras) error {
+	arr := resp.Array{}
+	for _, n := range ex.Cluster.Nodes() {
+		slots := resp.Array{}
+		for _, r := range ex.Cluster.Ranges(n) {
+			slots = append(slots, resp.Integer(r[0]), resp.Integer(r[1]))
+		}
+		node := resp.Map{
+			resp.BulkString("id"), resp.BulkString(n.ID),
+			resp.BulkString("port"), resp.Integer(n.Port),
+			resp.BulkString("ip"), resp.BulkString(n.Host),
+			resp.BulkString("endpoint"), resp.BulkString(n.Host),
+			resp.BulkString("role"), resp.BulkString("master"),
+			resp.BulkString("replication-offset"), resp.ZeroInteger,
+			resp.BulkString("health"), resp.BulkString("online"),
+		}
+		arr = append(arr, resp.Map{resp.BulkString("slots"), slots, resp.BulkString("nodes"), resp.Array{node}})
+	}
+	return ex.reply(arr)
+}
+
+// clusterSlots: CLUSTER SLOTS, the ranges of slots in order
+func clusterSlots(ex *Extras) error {
+	ranges := resp.Array{}
+	starts := []int{}
+	for _, n := range ex.Cluster.Nodes() {
+		for _, r := range ex.Cluster.Ranges(n) {
+			node := resp.Array{resp.BulkString(n.Host), resp.Integer(n.Port), resp.BulkString(n.ID)}
+			ranges = append(ranges, resp.Array{resp.Integer(r[0]), resp.Integer(r[1]), node})
+			starts = append(starts, r[0])
+		}
+	}
+	sort.Sort(byStart{ranges, starts})
+	return ranges.WriteTo(ex.Buffer)
+}
+
+// byStart sorts the slot ranges by the start slot
+type byStart struct {
+	ranges resp.Array
+	starts []int
+}
+
+func (s byStart) Len() int           { return len(s.ranges) }
+func (s byStart) Less(i, j int) bool { return s.starts[i] < s.starts[j] }
+func (s byStart) Swap(i, j int) {
+	s.ranges[i], s.ranges[j] = s.ranges[j], s.ranges[i]
+	s.starts[i], s.starts[j] = s.starts[j], s.starts[i]
+}
+
+// migrateOptions is the options of MIGRATE
+type migrateOptions struct {
+	addr    string
+	db      []byte
+	timeout time.Duration
+	copy    bool
+	replace bool
+	auth    Args // AUTH command sent to the target, nil if no password
+	keys    Args
+}
+
+// parseMigrate parses the args of MIGRATE host port key|"" destination-db timeout
+// [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+func parseMigrate(v Args) (*migrateOptions, resp.Value) {
+	if len(v) < 5 {
+		return nil, resp.NewError(ErrFmtWrongNumberArgument, "migrate")
+	}
+	if _, err := strconv.Atoi(string(v[1])); err != nil {
+		return nil, resp.NewError(ErrNotValidInt)
+	}
+	if _, err := strconv.Atoi(string(v[3])); err != nil {
+		return nil, resp.NewError(ErrNotValidInt)
+	}
+	timeout, err := strconv.ParseInt(string(v[4]), 10, 64)
+	if err != nil {
+		return nil, resp.NewError(ErrNotValidInt)
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	opts := &migrateOptions{addr: net.JoinHostPort(string(v[0]), string(v[1])), db: v[3], timeout: time.Duration(timeout) * time.Millisecond}
+	for i := 5; i < len(v); i++ {
+		switch strings.ToLower(string(v[i])) {
+		case "copy":
+			opts.copy = true
+		case "replace":
+			opts.replace = true
+		case "auth":
+			if i+1 >= len(v) {
+				return nil, resp.NewError(ErrSyntax)
+			}
+			opts.auth = Args{[]byte("AUTH"), v[i+1]}
+			i++
+		case "auth2":
+			if i+2 >= len(v) {
+				return nil, resp.NewError(ErrSyntax)
+			}
+			opts.auth = Args{[]byte("AUTH"), v[i+1], v[i+2]}
+			i += 2
+		case "keys":
+			if len(v[2]) != 0 {
+				return nil, resp.NewError(ErrMigrateKeys)
+			}
+			opts.keys = v[i+1:]
+			i = len(v)
+		default:
+			return nil, resp.NewError(ErrSyntax)
+		}
+	}
+	if opts.keys == nil {
+		opts.keys = v[2:3]
+	}
+	return opts, nil
+}
+
+// migrateKeys is the keySpec of MIGRATE: the key, or the keys after KEYS
+func migrateKeys(v Args) [][]byte {
+	opts, reply := parseMigrate(v)
+	if reply != nil {
+		return nil
+	}
+	return opts.keys
+}
+
+// migrate: https://redis.io/commands/migrate, the keys are restored by RESTORE,
+// or RESTORE-ASKING in cluster mode, and the keys restored are deleted unless
+// COPY. The deletes are logged as DEL.
+func migrate(v Args, ex *Extras) error {
+	opts, reply := parseMigrate(v)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	restore := []byte("RESTORE")
+	if ex.Cluster != nil {
+		restore = []byte("RESTORE-ASKING")
+	}
+	cmds := []Args{}
+	if opts.auth != nil {
+		cmds = append(cmds, opts.auth)
+	}
+	cmds = append(cmds, Args{[]byte("SELECT"), opts.db})
+	setup := len(cmds) // the commands before RESTORE
+
+	keys := Args{}
+	for _, key := range opts.keys {
+		exist, tipe, err := ex.DB.Has(key)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			continue
+		}
+		at, err := ex.DB.GetExpireAt(key)
+		if err != nil {
+			return err
+		}
+		ttl := int64(0)
+		if at != nil {
+			if ttl = int64(time.Until(*at) / time.Millisecond); ttl < 1 {
+				ttl = 1
+			}
+		}
+		payload, err := rdb.Dump(ex.DB, key, tipe)
+		if err != nil {
+			return err
+		}
+		cmd := Args{restore, key, []byte(strconv.FormatInt(ttl, 10)), payload}
+		if opts.replace {
+			cmd = append(cmd, []byte("REPLACE"))
+		}
+		cmds = append(cmds, cmd)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return resp.SimpleString("NOKEY").WriteTo(ex.Buffer)
+	}
+
+	replies, ioErr := migrateTo(opts.addr, opts.timeout, cmds)
+	failure, setupFailed := "", false
+	migrated := Args{}
+	for i, line := range replies {
+		if !strings.HasPrefix(line, "-") {
+			if i >= setup && !setupFailed {
+				migrated = append(migrated, keys[i-setup])
+			}
+			continue
+		}
+		if failure == "" {
+			failure = line[1:]
+		}
+		if i < setup {
+			setupFailed = true
+		}
+	}
+
+	if !opts.copy && len(migrated) > 0 {
+		for _, key := range migrated {
+			if _, err := ex.DB.Delete(key); err != nil {
+				return err
+			}
+		}
+		ex.propagate(append(Args{[]byte("del")}, migrated...)...)
+	}
+
+	switch {
+	case failure != "":
+		return resp.NewError(ErrFmtMigrateTarget, failure).WriteTo(ex.Buffer)
+	case ioErr != nil:
+		return resp.NewError(ErrFmtMigrateIO, ioErr).WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// migrateTo sends the commands to the target of addr in a pipeline, and returns
+// the replies read, each is the line of a status or error reply
+func migrateTo(addr string, timeout time.Duration, cmds []Args) ([]string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	for _, cmd := range cmds {
+		arr := make(resp.Array, len(cmd))
+		for i, arg := range cmd {
+			arr[i] = resp.BulkString(arg)
+		}
+		arr.WriteTo(&buf)
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	replies := []string{}
+	br := bufio.NewReader(conn)
+	for range cmds {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, strings.TrimRight(line, "\r\n"))
+	}
+	return replies, nil
+}
@@ -10,8 +10,12 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/cluster"
 	"github.com/rod6/rodis/resp"
 	"github.com/rod6/rodis/storage"
 )
@@ -20,10 +24,41 @@ import (
 type Args [][]byte
 
 type Extras struct {
-	DB       *storage.LevelDB
-	Buffer   *bytes.Buffer
-	Authed   bool
-	Password string
+	DB          *storage.LevelDB
+	Buffer      *bytes.Buffer
+	Authed      bool
+	Password    string
+	PubSub      PubSub           // publish/subscribe of the connection
+	Replication Replication      // replication of the connection
+	DumpFile    string           // path of the RDB file written by SAVE and BGSAVE
+	AOF         *aof.Log         // append only file of the write commands, rewritten by BGREWRITEAOF
+	Cluster     *cluster.Cluster // hash slots served in cluster mode, nil if the cluster is disabled
+	Protocol    int              // RESP version negotiated by HELLO, 3 for the RESP3 types, otherwise RESP2
+
+	// Blocking is called when a command blocks the connection, the returned channel
+	// is closed if the client disconnects, and stop is called when the command
+	// is unblocked.
+	Blocking func() (disconnected <-chan struct{}, stop func())
+
+	// transaction
+	Multi   bool             // in MULTI, commands are queued until EXEC
+	Aborted bool             // error when queuing, EXEC will be aborted
+	Watcher *storage.Watcher // WATCHed keys
+	queue   []queued         // queued commands
+	locked  bool             // dbs are locked by EXEC
+
+	txs    map[int]*storage.LevelDB // write contexts of the write command by db index
+	failed error                    // storage error of the write contexts, nothing is committed
+	logs   []logged                 // write commands appended to the AOF when committed
+
+	asking bool // ASKING is sent, the next command is served in an importing slot
+}
+
+// queued command in MULTI
+type queued struct {
+	cmd string
+	a   *attr
+	v   Args // args without the command name
 }
 
 // commandFunc is handle function
@@ -33,113 +68,201 @@ type commandFunc func(v Args, ex *Extras) error
 
 // command map attr struct
 type attr struct {
-	f commandFunc // func for the command
-	c int         // arg count for the command
+	f    commandFunc // func for the command
+	c    int         // arg count for the command
+	flag int         // flags of the command
+	keys keySpec     // keys of the command, nil for the command on all keys
 }
 
+// keySpec returns the keys accessed by the command, v is args without the command name
+type keySpec func(v Args) [][]byte
+
+// command flags
+const (
+	flagRead    = 1 << iota // read only command, run with the read lock of its keys, or the db if no keys
+	flagWrite               // command may modify the db, run with the write lock of its keys, or the db if no keys
+	flagNoQueue             // command runs at once in MULTI, not queued
+	flagPubSub              // command is allowed in subscriber mode
+	flagCrossDB             // command accesses other dbs, it locks the dbs itself by lockDBs
+	flagBlock               // command may block, it locks the db itself by lockDBs
+	flagSelfLog             // command logs its writes to the AOF itself by ex.propagate, as replaying it may write otherwise
+	flagAsking              // command is served in an importing slot as if ASKING is sent
+
+	flagSelfLock = flagCrossDB | flagBlock
+)
+
 // commands, a map type with name as the key
 var commands = map[string]*attr{
 	// connection
-	"auth":    {auth, 2},
-	"echo":    {echo, 2},
-	"ping":    {ping, 1},
-	"command": {ping, 1},
-	"select":  {selectdb, 2},
+	"auth":    {auth, 2, 0, nil},
+	"echo":    {echo, 2, 0, nil},
+	"hello":   {hello, 0, flagPubSub, nil},
+	"ping":    {ping, 1, flagPubSub, nil},
+	"command": {ping, 1, 0, nil},
+	"select":  {selectdb, 2, 0, nil},
+
+	// cluster
+	"asking":         {asking, 1, 0, nil},
+	"cluster":        {clusterx, 0, flagRead, nil},
+	"migrate":        {migrate, 0, flagWrite | flagSelfLog, migrateKeys},
+	"restore-asking": {restore, 0, flagWrite | flagAsking, keyRange(1, 1, 1)},
+
+	// pubsub
+	"psubscribe":   {psubscribe, 0, flagPubSub, nil},
+	"publish":      {publish, 3, 0, nil},
+	"pubsub":       {pubsub, 0, 0, nil},
+	"punsubscribe": {punsubscribe, 0, flagPubSub, nil},
+	"subscribe":    {subscribe, 0, flagPubSub, nil},
+	"unsubscribe":  {unsubscribe, 0, flagPubSub, nil},
 
 	// server
-	"flushdb": {flushdb, 1},
+	"bgrewriteaof": {bgrewriteaof, 1, flagCrossDB, nil},
+	"bgsave":       {bgsave, 1, flagCrossDB, nil},
+	"dbsize":       {dbsize, 1, flagRead, nil},
+	"debug":        {debug, 0, flagCrossDB, nil},
+	"flushdb":      {flushdb, 1, flagWrite, nil},
+	"info":         {info, 0, 0, nil},
+	"lastsave":     {lastsave, 1, 0, nil},
+	"save":         {save, 1, flagCrossDB, nil},
+
+	// replication
+	"psync":     {psync, 3, flagCrossDB, nil},
+	"replconf":  {replconf, 0, 0, nil},
+	"replicaof": {replicaof, 3, 0, nil},
+	"role":      {role, 1, 0, nil},
+	"slaveof":   {replicaof, 3, 0, nil},
+
+	// transactions
+	"discard": {discard, 1, flagNoQueue, nil},
+	"exec":    {exec, 1, flagNoQueue, nil},
+	"multi":   {multi, 1, flagNoQueue, nil},
+	"unwatch": {unwatch, 1, 0, nil},
+	"watch":   {watch, 0, flagRead | flagNoQueue, keyRange(1, -1, 1)},
 
 	// keys
-	"del":       {del, 0},
-	"exists":    {exists, 0},
-	"expire":    {expire, 3},
-	"expireat":  {expireat, 3},
-	"pexpire":   {pexpire, 3},
-	"pexpireat": {pexpireat, 3},
-	"pttl":      {pttl, 2},
-	"ttl":       {ttl, 2},
-	"type":      {tipe, 2},
+	"copy":      {copyx, 0, flagWrite | flagCrossDB | flagSelfLog, keyRange(1, 2, 1)},
+	"del":       {del, 0, flagWrite, keyRange(1, -1, 1)},
+	"dump":      {dump, 2, flagRead, keyRange(1, 1, 1)},
+	"exists":    {exists, 0, flagRead, keyRange(1, -1, 1)},
+	"expire":    {expire, 3, flagWrite, keyRange(1, 1, 1)},
+	"expireat":  {expireat, 3, flagWrite, keyRange(1, 1, 1)},
+	"keys":      {keys, 2, flagRead, nil},
+	"move":      {move, 3, flagWrite | flagCrossDB | flagSelfLog, keyRange(1, 1, 1)},
+	"pexpire":   {pexpire, 3, flagWrite, keyRange(1, 1, 1)},
+	"pexpireat": {pexpireat, 3, flagWrite, keyRange(1, 1, 1)},
+	"pttl":      {pttl, 2, flagRead, keyRange(1, 1, 1)},
+	"randomkey": {randomkey, 1, flagRead, nil},
+	"rename":    {rename, 3, flagWrite, keyRange(1, 2, 1)},
+	"renamenx":  {renamenx, 3, flagWrite, keyRange(1, 2, 1)},
+	"restore":   {restore, 0, flagWrite, keyRange(1, 1, 1)},
+	"scan":      {scan, 0, flagRead, nil},
+	"ttl":       {ttl, 2, flagRead, keyRange(1, 1, 1)},
+	"type":      {tipe, 2, flagRead, keyRange(1, 1, 1)},
 
 	// strings
-	"append":      {appendx, 3},
-	"bitcount":    {bitcount, 0},
-	"bitop":       {bitop, 0},
-	"bitpos":      {bitpos, 0},
-	"decr":        {decr, 2},
-	"decrby":      {decrby, 3},
-	"get":         {get, 2},
-	"getbit":      {getbit, 3},
-	"getrange":    {getrange, 4},
-	"getset":      {getset, 3},
-	"incr":        {incr, 2},
-	"incrby":      {incrby, 3},
-	"incrbyfloat": {incrbyfloat, 3},
-	"mget":        {mget, 0},
-	"mset":        {mset, 0},
-	"msetnx":      {msetnx, 0},
-	"psetex":      {psetex, 4},
-	"set":         {set, 0},
-	"setbit":      {setbit, 4},
-	"setex":       {setex, 4},
-	"setnx":       {setnx, 3},
-	"setrange":    {setrange, 4},
-	"strlen":      {strlen, 2},
+	"append":      {appendx, 3, flagWrite, keyRange(1, 1, 1)},
+	"bitcount":    {bitcount, 0, flagRead, keyRange(1, 1, 1)},
+	"bitop":       {bitop, 0, flagWrite, keyRange(2, -1, 1)},
+	"bitpos":      {bitpos, 0, flagRead, keyRange(1, 1, 1)},
+	"decr":        {decr, 2, flagWrite, keyRange(1, 1, 1)},
+	"decrby":      {decrby, 3, flagWrite, keyRange(1, 1, 1)},
+	"get":         {get, 2, flagRead, keyRange(1, 1, 1)},
+	"getbit":      {getbit, 3, flagRead, keyRange(1, 1, 1)},
+	"getrange":    {getrange, 4, flagRead, keyRange(1, 1, 1)},
+	"getset":      {getset, 3, flagWrite, keyRange(1, 1, 1)},
+	"incr":        {incr, 2, flagWrite, keyRange(1, 1, 1)},
+	"incrby":      {incrby, 3, flagWrite, keyRange(1, 1, 1)},
+	"incrbyfloat": {incrbyfloat, 3, flagWrite, keyRange(1, 1, 1)},
+	"mget":        {mget, 0, flagRead, keyRange(1, -1, 1)},
+	"mset":        {mset, 0, flagWrite, keyRange(1, -1, 2)},
+	"msetnx":      {msetnx, 0, flagWrite, keyRange(1, -1, 2)},
+	"psetex":      {psetex, 4, flagWrite, keyRange(1, 1, 1)},
+	"set":         {set, 0, flagWrite, keyRange(1, 1, 1)},
+	"setbit":      {setbit, 4, flagWrite, keyRange(1, 1, 1)},
+	"setex":       {setex, 4, flagWrite, keyRange(1, 1, 1)},
+	"setnx":       {setnx, 3, flagWrite, keyRange(1, 1, 1)},
+	"setrange":    {setrange, 4, flagWrite, keyRange(1, 1, 1)},
+	"strlen":      {strlen, 2, flagRead, keyRange(1, 1, 1)},
 
 	// hashes
-	"hdel":         {hdel, 0},
-	"hexists":      {hexists, 3},
-	"hget":         {hget, 3},
-	"hgetall":      {hgetall, 2},
-	"hincrby":      {hincrby, 4},
-	"hincrbyfloat": {hincrbyfloat, 4},
-	"hkeys":        {hkeys, 2},
-	"hlen":         {hlen, 2},
-	"hmget":        {hmget, 0},
-	"hmset":        {hmset, 0},
-	"hset":         {hset, 4},
-	"hsetnx":       {hsetnx, 4},
-	"hstrlen":      {hstrlen, 3},
-	"hvals":        {hvals, 2},
+	"hdel":         {hdel, 0, flagWrite, keyRange(1, 1, 1)},
+	"hexists":      {hexists, 3, flagRead, keyRange(1, 1, 1)},
+	"hget":         {hget, 3, flagRead, keyRange(1, 1, 1)},
+	"hgetall":      {hgetall, 2, flagRead, keyRange(1, 1, 1)},
+	"hincrby":      {hincrby, 4, flagWrite, keyRange(1, 1, 1)},
+	"hincrbyfloat": {hincrbyfloat, 4, flagWrite, keyRange(1, 1, 1)},
+	"hkeys":        {hkeys, 2, flagRead, keyRange(1, 1, 1)},
+	"hlen":         {hlen, 2, flagRead, keyRange(1, 1, 1)},
+	"hmget":        {hmget, 0, flagRead, keyRange(1, 1, 1)},
+	"hmset":        {hmset, 0, flagWrite, keyRange(1, 1, 1)},
+	"hscan":        {hscan, 0, flagRead, keyRange(1, 1, 1)},
+	"hset":         {hset, 4, flagWrite, keyRange(1, 1, 1)},
+	"hsetnx":       {hsetnx, 4, flagWrite, keyRange(1, 1, 1)},
+	"hstrlen":      {hstrlen, 3, flagRead, keyRange(1, 1, 1)},
+	"hvals":        {hvals, 2, flagRead, keyRange(1, 1, 1)},
 
 	// lists
-	"lindex":    {lindex, 3},
-	"linsert":   {linsert, 5},
-	"llen":      {llen, 2},
-	"lpop":      {lpop, 2},
-	"lpush":     {lpush, 0},
-	"lpushx":    {lpushx, 0},
-	"lrange":    {lrange, 4},
-	"lset":      {lset, 4},
-	"ltrim":     {ltrim, 4},
-	"rpop":      {rpop, 2},
-	"rpush":     {rpush, 0},
-	"rpushx":    {rpushx, 0},
-	"lrem":      {lrem, 4},
-	"rpoplpush": {rpoplpush, 3},
+	"blmove":     {blmove, 6, flagWrite | flagBlock | flagSelfLog, keyRange(1, 2, 1)},
+	"blpop":      {blpop, 0, flagWrite | flagBlock | flagSelfLog, keyRange(1, -2, 1)},
+	"brpop":      {brpop, 0, flagWrite | flagBlock | flagSelfLog, keyRange(1, -2, 1)},
+	"brpoplpush": {brpoplpush, 4, flagWrite | flagBlock | flagSelfLog, keyRange(1, 2, 1)},
+	"lindex":     {lindex, 3, flagRead, keyRange(1, 1, 1)},
+	"linsert":    {linsert, 5, flagWrite, keyRange(1, 1, 1)},
+	"llen":       {llen, 2, flagRead, keyRange(1, 1, 1)},
+	"lpop":       {lpop, 2, flagWrite, keyRange(1, 1, 1)},
+	"lpush":      {lpush, 0, flagWrite, keyRange(1, 1, 1)},
+	"lpushx":     {lpushx, 0, flagWrite, keyRange(1, 1, 1)},
+	"lrange":     {lrange, 4, flagRead, keyRange(1, 1, 1)},
+	"lset":       {lset, 4, flagWrite, keyRange(1, 1, 1)},
+	"ltrim":      {ltrim, 4, flagWrite, keyRange(1, 1, 1)},
+	"rpop":       {rpop, 2, flagWrite, keyRange(1, 1, 1)},
+	"rpush":      {rpush, 0, flagWrite, keyRange(1, 1, 1)},
+	"rpushx":     {rpushx, 0, flagWrite, keyRange(1, 1, 1)},
+	"lrem":       {lrem, 4, flagWrite, keyRange(1, 1, 1)},
+	"rpoplpush":  {rpoplpush, 3, flagWrite, keyRange(1, 2, 1)},
 
 	// sets
-	"sadd":        {sadd, 0},
-	"sdiff":       {sdiff, 0},
-	"sdiffstore":  {sdiffstore, 0},
-	"sinter":      {sinter, 0},
-	"sinterstore": {sinterstore, 0},
-	"sismember":   {sismember, 3},
-	"smembers":    {smembers, 2},
-	"scard":       {scard, 2},
-	"srem":        {srem, 0},
-	"sunion":      {sunion, 0},
-	"sunionstore": {sunionstore, 0},
-	"smove":       {smove, 4},
-	"spop":        {spop, 2},
-	"srandmember": {srandmember, 2},
+	"sadd":        {sadd, 0, flagWrite, keyRange(1, 1, 1)},
+	"sdiff":       {sdiff, 0, flagRead, keyRange(1, -1, 1)},
+	"sdiffstore":  {sdiffstore, 0, flagWrite, keyRange(1, -1, 1)},
+	"sinter":      {sinter, 0, flagRead, keyRange(1, -1, 1)},
+	"sinterstore": {sinterstore, 0, flagWrite, keyRange(1, -1, 1)},
+	"sismember":   {sismember, 3, flagRead, keyRange(1, 1, 1)},
+	"smembers":    {smembers, 2, flagRead, keyRange(1, 1, 1)},
+	"scard":       {scard, 2, flagRead, keyRange(1, 1, 1)},
+	"srem":        {srem, 0, flagWrite, keyRange(1, 1, 1)},
+	"sscan":       {sscan, 0, flagRead, keyRange(1, 1, 1)},
+	"sunion":      {sunion, 0, flagRead, keyRange(1, -1, 1)},
+	"sunionstore": {sunionstore, 0, flagWrite, keyRange(1, -1, 1)},
+	"smove":       {smove, 4, flagWrite, keyRange(1, 2, 1)},
+	"spop":        {spop, 2, flagWrite | flagSelfLog, keyRange(1, 1, 1)},
+	"srandmember": {srandmember, 2, flagRead, keyRange(1, 1, 1)},
 
 	// zsets
-	"zadd":          {zadd, 0},
-	"zcard":         {zcard, 2},
-	"zrange":        {zrange, 0},
-	"zrangebyscore": {zrangebyscore, 0},
-	"zrank":         {zrank, 3},
-	"zrem":          {zrem, 3},
+	"zadd":             {zadd, 0, flagWrite, keyRange(1, 1, 1)},
+	"zcard":            {zcard, 2, flagRead, keyRange(1, 1, 1)},
+	"zcount":           {zcount, 4, flagRead, keyRange(1, 1, 1)},
+	"zdiff":            {zdiff, 0, flagRead, numKeys(1)},
+	"zincrby":          {zincrby, 4, flagWrite, keyRange(1, 1, 1)},
+	"zinter":           {zinter, 0, flagRead, numKeys(1)},
+	"zinterstore":      {zinterstore, 0, flagWrite, keysOf(keyRange(1, 1, 1), numKeys(2))},
+	"zlexcount":        {zlexcount, 4, flagRead, keyRange(1, 1, 1)},
+	"zpopmax":          {zpopmax, 0, flagWrite, keyRange(1, 1, 1)},
+	"zpopmin":          {zpopmin, 0, flagWrite, keyRange(1, 1, 1)},
+	"zrange":           {zrange, 0, flagRead, keyRange(1, 1, 1)},
+	"zrangebylex":      {zrangebylex, 0, flagRead, keyRange(1, 1, 1)},
+	"zrangebyscore":    {zrangebyscore, 0, flagRead, keyRange(1, 1, 1)},
+	"zrank":            {zrank, 3, flagRead, keyRange(1, 1, 1)},
+	"zrem":             {zrem, 0, flagWrite, keyRange(1, 1, 1)},
+	"zremrangebyrank":  {zremrangebyrank, 4, flagWrite, keyRange(1, 1, 1)},
+	"zremrangebyscore": {zremrangebyscore, 4, flagWrite, keyRange(1, 1, 1)},
+	"zrevrange":        {zrevrange, 0, flagRead, keyRange(1, 1, 1)},
+	"zrevrangebyscore": {zrevrangebyscore, 0, flagRead, keyRange(1, 1, 1)},
+	"zrevrank":         {zrevrank, 3, flagRead, keyRange(1, 1, 1)},
+	"zscan":            {zscan, 0, flagRead, keyRange(1, 1, 1)},
+	"zscore":           {zscore, 3, flagRead, keyRange(1, 1, 1)},
+	"zunion":           {zunion, 0, flagRead, numKeys(1)},
+	"zunionstore":      {zunionstore, 0, flagWrite, keysOf(keyRange(1, 1, 1), numKeys(2))},
 }
 
 // Get command handler
@@ -154,6 +277,8 @@ func findCmdFunc(c string) (*attr, error) {
 // Handle command
 func Handle(v resp.Array, ex *Extras) error {
 	ex.Buffer.Truncate(0) // Truncate all data in the buffer
+	asking := ex.asking
+	ex.asking = false // ASKING is for the next command only
 
 	if len(v) == 0 {
 		return resp.NewError(ErrFmtNoCommand).WriteTo(ex.Buffer)
@@ -167,20 +292,336 @@ func Handle(v resp.Array, ex *Extras) error {
 	cmd := strings.ToLower(string(Args[0]))
 	a, err := findCmdFunc(cmd)
 	if err != nil {
-		return resp.NewError(ErrFmtUnknownCommand, cmd).WriteTo(ex.Buffer)
+		return reject(ex, resp.NewError(ErrFmtUnknownCommand, cmd))
 	}
 
 	//a.c = 0 means to check the number in f
 	if a.c != 0 && len(v) != a.c {
-		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
+		return reject(ex, resp.NewError(ErrFmtWrongNumberArgument, cmd))
+	}
+
+	if !ex.Authed && ex.Password != "" && cmd != "auth" && cmd != "hello" {
+		return reject(ex, resp.NewError(ErrAuthed))
+	}
+
+	if ex.subscribed() && ex.Protocol != 3 && a.flag&flagPubSub == 0 {
+		return reject(ex, resp.NewError(ErrFmtSubscribeContext, cmd))
+	}
+
+	if err := storage.ReadOnly(); err != nil && a.flag&flagWrite != 0 {
+		return reject(ex, resp.NewError(ErrFmtReadOnly, err))
+	}
+
+	if ex.Replication != nil && ex.Replication.ReadOnly() && a.flag&flagWrite != 0 {
+		return reject(ex, resp.NewError(ErrReadOnlyReplica))
+	}
+
+	// redirect the command on keys not served by myself in cluster mode, the
+	// commands queued in MULTI are served by the same node
+	queue := ex.Multi && a.flag&flagNoQueue == 0
+	if ex.Cluster != nil && a.keys != nil {
+		keys := a.keys(Args[1:])
+		if queue {
+			keys = append(ex.queuedKeys(), keys...)
+		}
+		if e, redirected := route(ex, cmd, keys, asking || a.flag&flagAsking != 0); redirected {
+			return reject(ex, e)
+		}
 	}
 
-	if !ex.Authed && ex.Password != "" && cmd != "auth" {
-		return resp.NewError(ErrAuthed).WriteTo(ex.Buffer)
+	// queue the command in MULTI
+	if queue {
+		args := make([][]byte, len(Args)-1) // Args may refer to the buffer of reader, copy it
+		for i, arg := range Args[1:] {
+			args[i] = append([]byte{}, arg...)
+		}
+		ex.queue = append(ex.queue, queued{cmd, a, args})
+		return resp.QueuedSimpleString.WriteTo(ex.Buffer)
 	}
 
-	// call command handler
-	return a.f(Args[1:], ex)
+	// call command handler, the writes are committed before unlocked
+	unlock := lock(ex, a, Args[1:])
+	defer unlock()
+	return ex.call(cmd, a, Args[1:])
+}
+
+// call calls the command handler. The storage error of the command replaces its
+// reply, and the writes of the command are not committed.
+func (ex *Extras) call(cmd string, a *attr, v Args) error {
+	mark := ex.Buffer.Len()
+	ex.failed = nil
+	var err error
+	if a.flag&flagWrite == 0 {
+		err = a.f(v, ex)
+	} else {
+		err = ex.write(cmd, a, v)
+	}
+
+	if se, ok := err.(*storage.Error); ok && ex.failed == nil {
+		ex.failed = se
+	}
+	if ex.failed == nil {
+		return err
+	}
+	ex.Buffer.Truncate(mark)
+	return storageError(ex.failed).WriteTo(ex.Buffer)
+}
+
+// write runs the write command with the write contexts, which are committed
+// unless the command returns a storage error.
+func (ex *Extras) write(cmd string, a *attr, v Args) error {
+	ex.begin()
+	defer ex.end()
+	err := ex.run(cmd, a, v)
+	if se, ok := err.(*storage.Error); ok {
+		ex.failed = se
+	}
+	ex.commit()
+	return err
+}
+
+// reply writes v in the protocol of the connection, the RESP3 types are converted
+// to RESP2 unless the client opted in RESP3 by HELLO, and the nils are converted
+// to the null of RESP3 if it did.
+func (ex *Extras) reply(v resp.Value) error {
+	if ex.Protocol == 3 {
+		return resp.ToRESP3(v).WriteTo(ex.Buffer)
+	}
+	return resp.ToRESP2(v).WriteTo(ex.Buffer)
+}
+
+// storageError returns the reply of the storage error
+func storageError(err error) resp.Error {
+	se, ok := err.(*storage.Error)
+	if !ok {
+		return resp.NewError(ErrServerUnknown)
+	}
+	switch se.Kind {
+	case storage.KindReadOnly:
+		return resp.NewError(ErrFmtReadOnly, se.Err)
+	case storage.KindDiskFull:
+		return resp.NewError(ErrFmtDiskFull, se.Err)
+	case storage.KindCorruption:
+		return resp.NewError(ErrFmtCorruption, se.Err)
+	case storage.KindNotFound, storage.KindWrongMetadata:
+		return resp.NewError(ErrFmtBrokenKey, se)
+	}
+	return resp.NewError(ErrFmtStorageIO, se.Err)
+}
+
+// begin starts the write contexts of a write command, ex.DB and the dbs by use
+// are the write contexts, so the writes of the command are pending until commit.
+func (ex *Extras) begin() {
+	ex.txs = make(map[int]*storage.LevelDB)
+	ex.DB = ex.use(ex.DB)
+}
+
+// use returns the write context of db in a write command, otherwise db itself
+func (ex *Extras) use(db *storage.LevelDB) *storage.LevelDB {
+	if ex.txs == nil {
+		return db
+	}
+	tx, ok := ex.txs[db.Index()]
+	if !ok {
+		tx = db.Begin()
+		ex.txs[db.Index()] = tx
+	}
+	return tx
+}
+
+// commit writes the pending writes of the write contexts, one batch per db. It
+// is called before the keys are unlocked. Nothing is written if a write context
+// failed, the error is kept in ex.failed. The committed commands are appended to
+// the AOF and fed to the replicas.
+func (ex *Extras) commit() {
+	for _, tx := range ex.txs {
+		if err := tx.Err(); err != nil && ex.failed == nil {
+			ex.failed = err
+		}
+	}
+	if ex.failed != nil {
+		ex.logs = nil
+		return
+	}
+	for i := 0; i <= 15; i++ {
+		if tx, ok := ex.txs[i]; ok {
+			if err := tx.Commit(); err != nil {
+				ex.failed = err
+				ex.logs = nil
+				return
+			}
+		}
+	}
+	ex.journal()
+}
+
+// end ends the write contexts, the writes not committed are discarded
+func (ex *Extras) end() {
+	ex.txs = nil
+	ex.logs = nil
+	ex.DB = storage.Select(ex.DB.Index())
+}
+
+// keyRange returns the keySpec of the keys from the position first to last with
+// step, the positions are of the command line as the command name is at 0, and
+// the negative last counts from the end, -1 is the last argument.
+func keyRange(first, last, step int) keySpec {
+	return func(v Args) [][]byte {
+		end := last
+		if end < 0 {
+			end += len(v) + 1
+		}
+		keys := [][]byte{}
+		for i := first; i <= end && i <= len(v); i += step {
+			keys = append(keys, v[i-1])
+		}
+		return keys
+	}
+}
+
+// numKeys returns the keySpec of the keys after the number of keys at the position
+// pos, like ZUNION numkeys key [key ...]. No key is returned if the number is
+// invalid, the command replies the error.
+func numKeys(pos int) keySpec {
+	return func(v Args) [][]byte {
+		if len(v) < pos {
+			return nil
+		}
+		n, err := strconv.Atoi(string(v[pos-1]))
+		if err != nil || n < 0 || n > len(v)-pos {
+			return nil
+		}
+		return v[pos : pos+n]
+	}
+}
+
+// keysOf returns the keySpec of the keys of all specs
+func keysOf(specs ...keySpec) keySpec {
+	return func(v Args) [][]byte {
+		keys := [][]byte{}
+		for _, spec := range specs {
+			keys = append(keys, spec(v)...)
+		}
+		return keys
+	}
+}
+
+// reject replies the error of a command which can not be called, and aborts the
+// transaction in MULTI.
+func reject(ex *Extras, e resp.Error) error {
+	if ex.Multi {
+		ex.Aborted = true
+	}
+	return e.WriteTo(ex.Buffer)
+}
+
+// lock locks the keys of the command, or the db if the command has no keySpec,
+// as the command flag requires, returns the unlock function
+func lock(ex *Extras, a *attr, v Args) func() {
+	if a.flag&flagSelfLock != 0 {
+		return func() {}
+	}
+	if a.keys == nil {
+		return lockDB(ex.DB, a.flag, nil, false)
+	}
+	return lockDB(ex.DB, a.flag, a.keys(v), true)
+}
+
+// lockDB locks keys of the db, or the whole db if byKey is false, with the write
+// lock if flag has flagWrite. The blocked clients are served after the write is
+// unlocked, before the command replies.
+func lockDB(db *storage.LevelDB, flag int, keys [][]byte, byKey bool) func() {
+	write := flag&flagWrite != 0
+	var unlock func()
+	switch {
+	case flag&(flagRead|flagWrite) == 0:
+		return func() {}
+	case byKey:
+		unlock = db.LockKeys(keys, write)
+	case write:
+		db.Lock()
+		unlock = db.Unlock
+	default:
+		db.RLock()
+		unlock = db.RUnlock
+	}
+
+	if !write {
+		return unlock
+	}
+	return func() {
+		unlock()
+		db.ServeWaiters()
+	}
+}
+
+// dbLock is what to lock of a db: the keys, or the whole db
+type dbLock struct {
+	keys  [][]byte
+	whole bool
+}
+
+// dbLocks is what to lock of each db by db index
+type dbLocks map[int]*dbLock
+
+// add adds the keys of db to lock
+func (l dbLocks) add(db *storage.LevelDB, keys ...[]byte) {
+	if l[db.Index()] == nil {
+		l[db.Index()] = &dbLock{}
+	}
+	l[db.Index()].keys = append(l[db.Index()].keys, keys...)
+}
+
+// addWhole locks the whole db
+func (l dbLocks) addWhole(db *storage.LevelDB) {
+	l.add(db)
+	l[db.Index()].whole = true
+}
+
+// lockDBs locks keys of ex.DB and the other dbs for the command with flagSelfLock,
+// the writes of the command are committed before unlocked. Nothing is locked in
+// EXEC, which locks the keys of all queued commands.
+func lockDBs(ex *Extras, flag int, locks dbLocks) func() {
+	if ex.locked {
+		return func() {}
+	}
+	unlock := lockIndexes(locks, flag)
+	return func() {
+		ex.commit()
+		unlock()
+	}
+}
+
+// lockIndexes locks the dbs in the order of db index to avoid dead lock, returns
+// the unlock function
+func lockIndexes(locks dbLocks, flag int) func() {
+	indexes := []int{}
+	for i := range locks {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	unlocks := []func(){}
+	for _, i := range indexes {
+		l := locks[i]
+		unlocks = append(unlocks, lockDB(storage.Select(i), flag&^flagSelfLock, l.keys, !l.whole))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// Release releases the resources held by the connection, it should be called
+// when the connection is closed.
+func (ex *Extras) Release() {
+	ex.Multi = false
+	ex.queue = nil
+	ex.Aborted = false
+	if ex.Watcher != nil {
+		ex.Watcher.Unwatch()
+	}
 }
 
 // Errors
@@ -205,4 +646,64 @@ const (
 	ErrOffsetOutRange         = `ERR offset is out of range`
 	ErrNoSuchKey              = `ERR no such key`
 	ErrIndexOutRange          = `ERR index out of range`
+	ErrServerUnknown          = `ERR server unknown error`
+	ErrFmtReadOnly            = `READONLY You can't write against a read only server: %v`
+	ErrFmtDiskFull            = `ERR storage disk is full: %v`
+	ErrFmtCorruption          = `ERR storage data is corrupted: %v`
+	ErrFmtBrokenKey           = `ERR storage data of the key is broken: %v`
+	ErrFmtStorageIO           = `ERR storage I/O error: %v`
+	ErrMultiNested            = `ERR MULTI calls can not be nested`
+	ErrExecWithoutMulti       = `ERR EXEC without MULTI`
+	ErrDiscardWithoutMulti    = `ERR DISCARD without MULTI`
+	ErrWatchInMulti           = `ERR WATCH inside MULTI is not allowed`
+	ErrExecAbort              = `EXECABORT Transaction discarded because of previous errors.`
+	ErrFmtUnknownSubcommand   = `ERR Unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.`
+	ErrInvalidCursor          = `ERR invalid cursor`
+	ErrSameObject             = `ERR source and destination objects are the same`
+	ErrTimeoutNotValidFloat   = `ERR timeout is not a float or out of range`
+	ErrTimeoutNegative        = `ERR timeout is negative`
+	ErrFmtSubscribeContext    = `ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context`
+	ErrMinMaxNotFloat         = `ERR min or max is not a float`
+	ErrMinMaxNotLex           = `ERR min or max not valid string range item`
+	ErrScoreNaN               = `ERR resulting score is not a number (NaN)`
+	ErrWeightNotFloat         = `ERR weight value is not a float`
+	ErrFmtAtLeastOneKey       = `ERR at least 1 input key is needed for '%s' command`
+	ErrSaveInProgress         = `ERR Background save already in progress`
+	ErrFmtSave                = `ERR saving error: %v`
+	ErrFmtLoad                = `ERR Error trying to load the RDB dump: %v`
+	ErrInvalidTTL             = `ERR Invalid TTL value, must be >= 0`
+	ErrBusyKey                = `BUSYKEY Target key name already exists.`
+	ErrDumpPayload            = `ERR DUMP payload version or checksum are wrong`
+	ErrAOFDisabled            = `ERR Append only file is not configured`
+	ErrRewriteInProgress      = `ERR Background append only file rewriting already in progress`
+	ErrReadOnlyReplica        = `READONLY You can't write against a read only replica.`
+	ErrNoReplication          = `ERR replication is not available for the connection`
+	ErrChainedReplica         = `ERR a replica can not be synced by other replicas`
+	ErrInvalidMasterPort      = `ERR Invalid master port`
+	ErrFmtReplconfOption      = `ERR Unrecognized REPLCONF option: %s`
+	ErrClusterDisabled        = `ERR This instance has cluster support disabled`
+	ErrFmtMoved               = `MOVED %d %s`
+	ErrFmtAsk                 = `ASK %d %s`
+	ErrCrossSlot              = `CROSSSLOT Keys in request don't hash to the same slot`
+	ErrTryAgain               = `TRYAGAIN Multiple keys request during rehashing of slot`
+	ErrClusterDown            = `CLUSTERDOWN Hash slot not served`
+	ErrClusterSelect          = `ERR SELECT is not allowed in cluster mode`
+	ErrClusterMove            = `ERR MOVE is not allowed in cluster mode`
+	ErrClusterCopyDB          = `ERR Copying to another database is not allowed in cluster mode`
+	ErrInvalidSlot            = `ERR Invalid or out of range slot`
+	ErrInvalidKeyCount        = `ERR Invalid number of keys`
+	ErrFmtSlotBusy            = `ERR Slot %d is already busy`
+	ErrFmtSlotUnassigned      = `ERR Slot %d is already unassigned`
+	ErrFmtNotSlotOwner        = `ERR I'm not the owner of hash slot %d`
+	ErrFmtSlotOwner           = `ERR I'm already the owner of hash slot %d`
+	ErrFmtUnknownNode         = `ERR I don't know about node %s`
+	ErrFmtSlotNotEmpty        = `ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.`
+	ErrMigrateKeys            = `ERR When using MIGRATE KEYS option, the key argument must be set to the empty string`
+	ErrFmtMigrateTarget       = `ERR Target instance replied with error: %s`
+	ErrFmtMigrateIO           = `IOERR error or timeout migrating to target instance: %v`
+	ErrProtocolVersion        = `ERR Protocol version is not an integer or out of range`
+	ErrNoProto                = `NOPROTO unsupported protocol version`
+	ErrWrongPass              = `WRONGPASS invalid username-password pair or user is disabled.`
+	ErrFmtHelloOption         = `ERR Syntax error in HELLO option '%s'`
+	ErrHelloAuth              = `NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time`
 )
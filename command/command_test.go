@@ -0,0 +1,32 @@
+package command
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+func TestStorageError(t *testing.T) {
+	cause := errors.New("cause")
+	tests := []struct {
+		err   error
+		reply resp.Error
+	}{
+		{&storage.Error{Kind: storage.KindIO, Op: "get", Err: cause}, "ERR storage I/O error: cause"},
+		{&storage.Error{Kind: storage.KindDiskFull, Op: "commit", Err: syscall.ENOSPC}, "ERR storage disk is full: no space left on device"},
+		{&storage.Error{Kind: storage.KindCorruption, Op: "get", Err: cause}, "ERR storage data is corrupted: cause"},
+		{&storage.Error{Kind: storage.KindNotFound, Op: "get", Err: cause}, "ERR storage data of the key is broken: entry not found: get: cause"},
+		{&storage.Error{Kind: storage.KindWrongMetadata, Op: "metadata", Err: storage.ErrMetaFormat}, "ERR storage data of the key is broken: wrong metadata: metadata: Meta data format is wrong"},
+		{&storage.Error{Kind: storage.KindReadOnly, Op: "write", Err: &storage.Error{Kind: storage.KindDiskFull, Op: "commit", Err: syscall.ENOSPC}},
+			"READONLY You can't write against a read only server: disk is full: commit: no space left on device"},
+		{cause, "ERR server unknown error"},
+	}
+	for i, test := range tests {
+		if reply := storageError(test.err); reply != test.reply {
+			t.Errorf("storageError[%v](%v), Expect: %q, Get: %q", i, test.err, test.reply, reply)
+		}
+	}
+}
@@ -7,7 +7,9 @@
 package command
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/rod6/rodis/resp"
 	"github.com/rod6/rodis/storage"
@@ -16,11 +18,17 @@ import (
 // command
 // -------
 // AUTH
+// DBSIZE
 // ECHO
 // FLUSHDB
+// HELLO
+// INFO
 // PING
 // SELECT
 
+// redisVersion is the version of Redis whose commands are served, replied by HELLO
+const redisVersion = "6.0.0"
+
 // auth: https://redis.io/commands/auth
 func auth(v Args, ex *Extras) error {
 	if ex.Password == "" {
@@ -34,21 +42,148 @@ func auth(v Args, ex *Extras) error {
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
 
+// dbsize: https://redis.io/commands/dbsize
+func dbsize(v Args, ex *Extras) error {
+	return resp.Integer(ex.DB.DBSize()).WriteTo(ex.Buffer)
+}
+
 // echo: https://redis.io/commands/echo
 func echo(v Args, ex *Extras) error {
 	return resp.BulkString(v[0]).WriteTo(ex.Buffer)
 }
 
+// hello: https://redis.io/commands/hello
+func hello(v Args, ex *Extras) error {
+	protocol := ex.Protocol
+	if len(v) > 0 {
+		p, err := strconv.Atoi(string(v[0]))
+		if err != nil {
+			return resp.NewError(ErrProtocolVersion).WriteTo(ex.Buffer)
+		}
+		if p != 2 && p != 3 {
+			return resp.NewError(ErrNoProto).WriteTo(ex.Buffer)
+		}
+		protocol = p
+	}
+
+	authed := ex.Authed || ex.Password == ""
+	for i := 1; i < len(v); i++ {
+		switch option := strings.ToLower(string(v[i])); {
+		case option == "auth" && i+2 < len(v):
+			// there are no users but the default one, which has the password
+			if ex.Password != "" && (string(v[i+1]) != "default" || string(v[i+2]) != ex.Password) {
+				return resp.NewError(ErrWrongPass).WriteTo(ex.Buffer)
+			}
+			authed = true
+			i += 2
+		case option == "setname" && i+1 < len(v): // the name is accepted, but not kept
+			i++
+		default:
+			return resp.NewError(ErrFmtHelloOption, v[i]).WriteTo(ex.Buffer)
+		}
+	}
+	if !authed {
+		return resp.NewError(ErrHelloAuth).WriteTo(ex.Buffer)
+	}
+	ex.Authed = true
+	if protocol != 0 {
+		ex.Protocol = protocol
+	}
+
+	mode, role := "standalone", "master"
+	if ex.Cluster != nil {
+		mode = "cluster"
+	}
+	if ex.Replication != nil && ex.Replication.Replicating() {
+		role = "replica"
+	}
+	if protocol == 0 {
+		protocol = 2
+	}
+	return ex.reply(resp.Map{
+		resp.BulkString("server"), resp.BulkString("rodis"),
+		resp.BulkString("version"), resp.BulkString(redisVersion),
+		resp.BulkString("proto"), resp.Integer(protocol),
+		resp.BulkString("mode"), resp.BulkString(mode),
+		resp.BulkString("role"), resp.BulkString(role),
+		resp.BulkString("modules"), resp.EmptyArray,
+	})
+}
+
+// info: https://redis.io/commands/info, the sections server, stats and keyspace
+// are served. The stats have the expired keys and the rounds of the background
+// expire sweepers of all dbs.
+func info(v Args, ex *Extras) error {
+	if len(v) > 1 {
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+	section := "default"
+	if len(v) == 1 {
+		section = strings.ToLower(string(v[0]))
+	}
+	all := section == "default" || section == "all" || section == "everything"
+
+	sections := []string{}
+	if all || section == "server" {
+		mode := "standalone"
+		if ex.Cluster != nil {
+			mode = "cluster"
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Server\r\n")
+		fmt.Fprintf(&b, "redis_version:%s\r\n", redisVersion)
+		fmt.Fprintf(&b, "redis_mode:%s\r\n", mode)
+		sections = append(sections, b.String())
+	}
+	if all || section == "stats" {
+		var stats storage.ExpireStats
+		for i := 0; i < 16; i++ {
+			s := storage.Select(i).ExpireStats()
+			stats.Runs += s.Runs
+			stats.Scanned += s.Scanned
+			stats.Expired += s.Expired
+			stats.Stale += s.Stale
+			if s.LastRun.After(stats.LastRun) {
+				stats.LastRun, stats.LastDuration = s.LastRun, s.LastDuration
+			}
+		}
+		lastRun := int64(0)
+		if !stats.LastRun.IsZero() {
+			lastRun = stats.LastRun.Unix()
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Stats\r\n")
+		fmt.Fprintf(&b, "expired_keys:%d\r\n", stats.Expired)
+		fmt.Fprintf(&b, "expire_sweeps:%d\r\n", stats.Runs)
+		fmt.Fprintf(&b, "expire_scanned:%d\r\n", stats.Scanned)
+		fmt.Fprintf(&b, "expire_stale_entries:%d\r\n", stats.Stale)
+		fmt.Fprintf(&b, "expire_last_sweep:%d\r\n", lastRun)
+		fmt.Fprintf(&b, "expire_last_sweep_usec:%d\r\n", stats.LastDuration.Microseconds())
+		sections = append(sections, b.String())
+	}
+	if all || section == "keyspace" {
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Keyspace\r\n")
+		for i := 0; i < 16; i++ {
+			if n := storage.Select(i).DBSize(); n > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d\r\n", i, n)
+			}
+		}
+		sections = append(sections, b.String())
+	}
+	return ex.reply(resp.Verbatim{Format: "txt", Text: []byte(strings.Join(sections, "\r\n"))})
+}
+
 // ping: https://redis.io/commands/ping
 func ping(v Args, ex *Extras) error {
+	if ex.subscribed() && ex.Protocol != 3 { // in subscriber mode of RESP2, reply pong as a message
+		return resp.Array{resp.BulkString("pong"), resp.EmptyBulkString}.WriteTo(ex.Buffer)
+	}
 	return resp.PongSimpleString.WriteTo(ex.Buffer)
 }
 
 // flushdb: https://redis.io/commands/flushdb
 func flushdb(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	if err := ex.DB.Flush(); err != nil {
 		return err
 	}
@@ -66,6 +201,9 @@ func selectdb(v Args, ex *Extras) error {
 	if index < 0 || index > 15 {
 		return resp.NewError(ErrSelectInvalidIndex).WriteTo(ex.Buffer)
 	}
-	ex.DB = storage.Select(index)
+	if ex.Cluster != nil && index != 0 { // only db 0 is sharded
+		return resp.NewError(ErrClusterSelect).WriteTo(ex.Buffer)
+	}
+	ex.DB = ex.use(storage.Select(index))
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
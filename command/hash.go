@@ -9,7 +9,9 @@ package command
 import (
 	"strconv"
 
+	"github.com/rod6/rodis/glob"
 	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
 )
 
 // command
@@ -36,10 +38,10 @@ func hdel(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "hdel").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -51,7 +53,10 @@ func hdel(v Args, ex *Extras) error {
 	for _, field := range v[1:] {
 		fields = append(fields, []byte(field))
 	}
-	hash := ex.DB.GetFields(v[0], fields)
+	hash, err := ex.DB.GetFields(v[0], fields)
+	if err != nil {
+		return err
+	}
 
 	count := 0
 	for _, value := range hash {
@@ -59,21 +64,26 @@ func hdel(v Args, ex *Extras) error {
 			count++
 		}
 	}
-	ex.DB.DeleteFields(v[0], fields)
+	if err := ex.DB.DeleteFields(v[0], fields); err != nil {
+		return err
+	}
 	return resp.Integer(count).WriteTo(ex.Buffer)
 }
 
 // hexists -> https://redis.io/commands/hexist
 func hexists(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if keyExists && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	if len(hash[string(v[1])]) == 0 {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -82,20 +92,23 @@ func hexists(v Args, ex *Extras) error {
 
 // hget -> https://redis.io/commands/hget
 func hget(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if keyExists && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	if len(hash[string(v[1])]) == 0 {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 
 	return resp.BulkString(hash[string(v[1])]).WriteTo(ex.Buffer)
@@ -103,24 +116,27 @@ func hget(v Args, ex *Extras) error {
 
 // hgetall -> https://redis.io/commands/hgetall
 func hgetall(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
-		return resp.EmptyArray.WriteTo(ex.Buffer)
+		return ex.reply(resp.Map{})
 	}
 	if keyExists && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetHashAsArray(v[0])
-	arr := resp.Array{}
+	hash, err := ex.DB.GetHashAsArray(v[0])
+	if err != nil {
+		return err
+	}
+	arr := resp.Map{}
 
 	for _, field := range hash {
 		arr = append(arr, resp.BulkString(field.Key), resp.BulkString(field.Value))
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // hincrby -> https://redis.io/commands/hincrby
@@ -130,15 +146,18 @@ func hincrby(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if keyExists && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 
 	newVal := int64(0)
 	if len(hash[string(v[1])]) == 0 {
@@ -152,7 +171,9 @@ func hincrby(v Args, ex *Extras) error {
 	}
 	hash[string(v[1])] = []byte(strconv.FormatInt(newVal, 10))
 
-	ex.DB.PutHash(v[0], resp.Hash, hash)
+	if err := ex.DB.PutHash(v[0], resp.Hash, hash); err != nil {
+		return err
+	}
 	return resp.Integer(newVal).WriteTo(ex.Buffer)
 }
 
@@ -163,15 +184,18 @@ func hincrbyfloat(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 
 	newVal := 0.0
 	if len(hash[string(v[1])]) == 0 {
@@ -185,16 +209,18 @@ func hincrbyfloat(v Args, ex *Extras) error {
 	}
 	hash[string(v[1])] = []byte(strconv.FormatFloat(newVal, 'f', -1, 64))
 
-	ex.DB.PutHash(v[0], resp.Hash, hash)
+	if err := ex.DB.PutHash(v[0], resp.Hash, hash); err != nil {
+		return err
+	}
 	return resp.BulkString(hash[string(v[1])]).WriteTo(ex.Buffer)
 }
 
 // hkeys -> https://redis.io/commands/hkeys
 func hkeys(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -202,7 +228,10 @@ func hkeys(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	fields := ex.DB.GetFieldNames(v[0])
+	fields, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
 	arr := resp.Array{}
 
 	for _, field := range fields {
@@ -213,10 +242,10 @@ func hkeys(v Args, ex *Extras) error {
 
 // hvals -> https://redis.io/commands/hvals
 func hvals(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -224,7 +253,10 @@ func hvals(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetHashAsArray(v[0])
+	hash, err := ex.DB.GetHashAsArray(v[0])
+	if err != nil {
+		return err
+	}
 	arr := resp.Array{}
 
 	for _, field := range hash {
@@ -235,10 +267,10 @@ func hvals(v Args, ex *Extras) error {
 
 // hlen -> https://redis.io/commands/hlen
 func hlen(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !keyExists {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -246,7 +278,10 @@ func hlen(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	fields := ex.DB.GetFieldNames(v[0])
+	fields, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(len(fields)).WriteTo(ex.Buffer)
 }
 
@@ -256,10 +291,10 @@ func hmget(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "hmget").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	keyExists, tipe := ex.DB.Has(v[0])
+	keyExists, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if keyExists && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -268,7 +303,10 @@ func hmget(v Args, ex *Extras) error {
 	for _, f := range v[1:] {
 		fields = append(fields, f)
 	}
-	hash := ex.DB.GetFieldsAsArray(v[0], fields)
+	hash, err := ex.DB.GetFieldsAsArray(v[0], fields)
+	if err != nil {
+		return err
+	}
 
 	arr := resp.Array{}
 	for _, field := range hash {
@@ -278,7 +316,7 @@ func hmget(v Args, ex *Extras) error {
 			arr = append(arr, resp.BulkString(field.Value))
 		}
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // hmset -> https://redis.io/commands/hmset
@@ -287,10 +325,10 @@ func hmset(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "hmset").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -300,28 +338,74 @@ func hmset(v Args, ex *Extras) error {
 		hash[string(v[i])] = v[i+1]
 		i += 2
 	}
-	ex.DB.PutHash(v[0], resp.Hash, hash)
+	if err := ex.DB.PutHash(v[0], resp.Hash, hash); err != nil {
+		return err
+	}
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
 
+// hscan -> https://redis.io/commands/hscan
+func hscan(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "hscan").WriteTo(ex.Buffer)
+	}
+
+	opts, reply := parseScanOptions(v[1:], false)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return scanReply(0, resp.EmptyArray).WriteTo(ex.Buffer)
+	}
+	if tipe != resp.Hash {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	next, fields, err := ex.DB.ScanFields(v[0], opts.cursor, opts.count)
+	if err == storage.ErrInvalidCursor {
+		return resp.NewError(ErrInvalidCursor).WriteTo(ex.Buffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	arr := resp.Array{}
+	for _, field := range fields {
+		if opts.match == nil || glob.Match(opts.match, field.Key) {
+			arr = append(arr, resp.BulkString(field.Key), resp.BulkString(field.Value))
+		}
+	}
+	return scanReply(next, arr).WriteTo(ex.Buffer)
+}
+
 // hset -> https://redis.io/commands/hset
 func hset(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	fieldExists := false
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	if len(hash[string(v[1])]) != 0 {
 		fieldExists = true
 	}
 
 	hash[string(v[1])] = v[2]
-	ex.DB.PutHash(v[0], resp.Hash, hash)
+	if err := ex.DB.PutHash(v[0], resp.Hash, hash); err != nil {
+		return err
+	}
 
 	if !fieldExists {
 		return resp.OneInteger.WriteTo(ex.Buffer)
@@ -331,23 +415,28 @@ func hset(v Args, ex *Extras) error {
 
 // hsetnx -> https://redis.io/commands/hsetnx
 func hsetnx(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Hash {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	fieldExists := false
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	if len(hash[string(v[1])]) != 0 {
 		fieldExists = true
 	}
 
 	if !fieldExists {
 		hash[string(v[1])] = v[2]
-		ex.DB.PutHash(v[0], resp.Hash, hash)
+		if err := ex.DB.PutHash(v[0], resp.Hash, hash); err != nil {
+			return err
+		}
 		return resp.OneInteger.WriteTo(ex.Buffer)
 	}
 	return resp.ZeroInteger.WriteTo(ex.Buffer)
@@ -355,10 +444,10 @@ func hsetnx(v Args, ex *Extras) error {
 
 // hstrlen -> https://redis.io/commands/hstrlen
 func hstrlen(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -366,6 +455,9 @@ func hstrlen(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	return resp.Integer(len(hash[string(v[1])])).WriteTo(ex.Buffer)
 }
@@ -7,50 +7,149 @@
 package command
 
 import (
+	"bytes"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/rod6/rodis/glob"
+	"github.com/rod6/rodis/rdb"
 	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
 )
 
 // command
 // --------
+// COPY
 // DEL
+// DUMP
 // EXIST
 // EXPIRE
 // EXPIREAT
+// KEYS
+// MOVE
 // PEXPIRE
 // PEXPIREAT
 // PTTL
+// RANDOMKEY
+// RENAME
+// RENAMENX
+// RESTORE
+// SCAN
 // TTL
 // TYPE
 
+// copyx -> https://redis.io/commands/copy
+func copyx(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "copy").WriteTo(ex.Buffer)
+	}
+
+	dst := ex.DB
+	replace := false
+	for i := 2; i < len(v); i++ {
+		switch strings.ToLower(string(v[i])) {
+		case "db":
+			if i == len(v)-1 { // no value
+				return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+			}
+			db, reply := parseDB(v[i+1], ex)
+			if reply != nil {
+				return reply.WriteTo(ex.Buffer)
+			}
+			if ex.Cluster != nil && db.Index() != ex.DB.Index() {
+				return resp.NewError(ErrClusterCopyDB).WriteTo(ex.Buffer)
+			}
+			dst = db
+			i++
+		case "replace":
+			replace = true
+		default:
+			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		}
+	}
+
+	if dst == ex.DB && bytes.Equal(v[0], v[1]) {
+		return resp.NewError(ErrSameObject).WriteTo(ex.Buffer)
+	}
+
+	locks := dbLocks{}
+	locks.add(ex.DB, v[0])
+	locks.add(dst, v[1])
+	unlock := lockDBs(ex, flagWrite, locks)
+	defer unlock()
+
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.ZeroInteger.WriteTo(ex.Buffer)
+	}
+	exist, _, err = dst.Has(v[1])
+	if err != nil {
+		return err
+	}
+	if exist && !replace {
+		return resp.ZeroInteger.WriteTo(ex.Buffer)
+	}
+
+	if err := ex.DB.Copy(v[0], dst, v[1]); err != nil {
+		return err
+	}
+	ex.propagate(append(Args{[]byte("copy")}, v...)...)
+	return resp.OneInteger.WriteTo(ex.Buffer)
+}
+
+// parseDB returns the db of the index, the write context of the db in a write
+// command. The error reply is returned if the index is invalid.
+func parseDB(index []byte, ex *Extras) (*storage.LevelDB, resp.Value) {
+	i, err := strconv.Atoi(string(index))
+	if err != nil {
+		return nil, resp.NewError(ErrNotValidInt)
+	}
+	if i < 0 || i > 15 {
+		return nil, resp.NewError(ErrSelectInvalidIndex)
+	}
+	return ex.use(storage.Select(i)), nil
+}
+
 // del -> https://redis.io/commands/del
 func del(v Args, ex *Extras) error {
 	if len(v) == 0 {
 		return resp.NewError(ErrFmtWrongNumberArgument, "del").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	count := 0
 	for _, key := range v {
-		exist, tipe := ex.DB.Has(key)
+		exist, tipe, err := ex.DB.Has(key)
+		if err != nil {
+			return err
+		}
 		if !exist {
 			continue
 		}
 		switch tipe {
 		case resp.String:
-			ex.DB.DeleteString(key)
+			if err := ex.DB.DeleteString(key); err != nil {
+				return err
+			}
 		case resp.Hash:
-			ex.DB.DeleteHash(key)
+			if err := ex.DB.DeleteHash(key); err != nil {
+				return err
+			}
 		case resp.List:
-			ex.DB.DeleteList(key)
+			if err := ex.DB.DeleteList(key); err != nil {
+				return err
+			}
 		case resp.Set:
-			ex.DB.DeleteHash(key)
+			if err := ex.DB.DeleteHash(key); err != nil {
+				return err
+			}
 		case resp.SortedSet:
-			ex.DB.DeleteSkip(key)
+			if err := ex.DB.DeleteSkip(key); err != nil {
+				return err
+			}
 		}
 
 		count++
@@ -58,18 +157,34 @@ func del(v Args, ex *Extras) error {
 	return resp.Integer(count).WriteTo(ex.Buffer)
 }
 
+// dump -> https://redis.io/commands/dump
+func dump(v Args, ex *Extras) error {
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return ex.reply(resp.NilBulkString)
+	}
+	payload, err := rdb.Dump(ex.DB, v[0], tipe)
+	if err != nil {
+		return err
+	}
+	return resp.BulkString(payload).WriteTo(ex.Buffer)
+}
+
 // exists -> https://redis.io/commands/exists
 func exists(v Args, ex *Extras) error {
 	if len(v) == 0 {
 		return resp.NewError(ErrFmtWrongNumberArgument, "exists").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
 	count := 0
 	for _, key := range v {
-		exist, _ := ex.DB.Has(key)
+		exist, _, err := ex.DB.Has(key)
+		if err != nil {
+			return err
+		}
 		if !exist {
 			continue
 		}
@@ -85,17 +200,19 @@ func expire(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
 	at := time.Now().Add(time.Duration(expire) * time.Second)
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OneInteger.WriteTo(ex.Buffer)
 }
@@ -107,21 +224,81 @@ func expireat(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
 	at := time.Unix(expireat, 0)
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OneInteger.WriteTo(ex.Buffer)
 }
 
+// keys -> https://redis.io/commands/keys
+func keys(v Args, ex *Extras) error {
+	pattern := v[0]
+	keys, err := ex.DB.Keys(glob.Prefix(pattern), func(key []byte) bool {
+		return glob.Match(pattern, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	arr := resp.Array{}
+	for _, key := range keys {
+		arr = append(arr, resp.BulkString(key))
+	}
+	return arr.WriteTo(ex.Buffer)
+}
+
+// move -> https://redis.io/commands/move
+func move(v Args, ex *Extras) error {
+	if ex.Cluster != nil {
+		return resp.NewError(ErrClusterMove).WriteTo(ex.Buffer)
+	}
+	dst, reply := parseDB(v[1], ex)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	if dst == ex.DB {
+		return resp.NewError(ErrSameObject).WriteTo(ex.Buffer)
+	}
+
+	locks := dbLocks{}
+	locks.add(ex.DB, v[0])
+	locks.add(dst, v[0])
+	unlock := lockDBs(ex, flagWrite, locks)
+	defer unlock()
+
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.ZeroInteger.WriteTo(ex.Buffer)
+	}
+	exist, _, err = dst.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist {
+		return resp.ZeroInteger.WriteTo(ex.Buffer)
+	}
+
+	if err := ex.DB.Rename(v[0], dst, v[0]); err != nil {
+		return err
+	}
+	ex.propagate([]byte("move"), v[0], v[1])
+	return resp.OneInteger.WriteTo(ex.Buffer)
+}
+
 // pexpire -> https://redis.io/commands/pexpire
 func pexpire(v Args, ex *Extras) error {
 	pexpire, err := strconv.ParseInt(string(v[1]), 10, 32)
@@ -129,55 +306,62 @@ func pexpire(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
 	at := time.Now().Add(time.Duration(pexpire) * time.Millisecond)
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OneInteger.WriteTo(ex.Buffer)
 }
 
-// pexpireat -> https://redis.io/commands/expireat
+// pexpireat -> https://redis.io/commands/pexpireat
 func pexpireat(v Args, ex *Extras) error {
 	pexpireat, err := strconv.ParseInt(string(v[1]), 10, 64)
 	if err != nil {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
-	at := time.Unix(0, pexpireat)
-	ex.DB.SetExpireAt(v[0], &at)
+	at := time.Unix(0, pexpireat*int64(time.Millisecond))
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OneInteger.WriteTo(ex.Buffer)
 }
 
 // pttl -> https://redis.io/commands/pttl
 func pttl(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.NegativeOneInteger.WriteTo(ex.Buffer)
 	}
 
-	at := ex.DB.GetExpireAt(v[0])
+	at, err := ex.DB.GetExpireAt(v[0])
+	if err != nil {
+		return err
+	}
 	if at == nil {
 		return resp.NegativeOneInteger.WriteTo(ex.Buffer)
 	}
@@ -187,18 +371,223 @@ func pttl(v Args, ex *Extras) error {
 	return resp.Integer(ttl).WriteTo(ex.Buffer)
 }
 
+// randomkey -> https://redis.io/commands/randomkey
+func randomkey(v Args, ex *Extras) error {
+	key, err := ex.DB.RandomKey()
+	if err != nil {
+		return err
+	}
+	return resp.BulkString(key).WriteTo(ex.Buffer)
+}
+
+// rename -> https://redis.io/commands/rename
+func rename(v Args, ex *Extras) error {
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.NewError(ErrNoSuchKey).WriteTo(ex.Buffer)
+	}
+
+	if !bytes.Equal(v[0], v[1]) {
+		if err := ex.DB.Rename(v[0], ex.DB, v[1]); err != nil {
+			return err
+		}
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// renamenx -> https://redis.io/commands/renamenx
+func renamenx(v Args, ex *Extras) error {
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.NewError(ErrNoSuchKey).WriteTo(ex.Buffer)
+	}
+	exist, _, err = ex.DB.Has(v[1])
+	if err != nil {
+		return err
+	}
+	if exist {
+		return resp.ZeroInteger.WriteTo(ex.Buffer)
+	}
+
+	if err := ex.DB.Rename(v[0], ex.DB, v[1]); err != nil {
+		return err
+	}
+	return resp.OneInteger.WriteTo(ex.Buffer)
+}
+
+// restore -> https://redis.io/commands/restore, IDLETIME and FREQ are ignored
+func restore(v Args, ex *Extras) error {
+	if len(v) < 3 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "restore").WriteTo(ex.Buffer)
+	}
+	ttl, err := strconv.ParseInt(string(v[1]), 10, 64)
+	if err != nil {
+		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+	}
+	if ttl < 0 {
+		return resp.NewError(ErrInvalidTTL).WriteTo(ex.Buffer)
+	}
+
+	replace, absttl := false, false
+	for i := 3; i < len(v); i++ {
+		switch strings.ToLower(string(v[i])) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absttl = true
+		case "idletime", "freq":
+			if i == len(v)-1 { // no value
+				return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+			}
+			if _, err := strconv.ParseInt(string(v[i+1]), 10, 64); err != nil {
+				return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+			}
+			i++
+		default:
+			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		}
+	}
+
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && !replace {
+		return resp.NewError(ErrBusyKey).WriteTo(ex.Buffer)
+	}
+	e, err := rdb.Restore(v[2])
+	if err != nil {
+		return resp.NewError(ErrDumpPayload).WriteTo(ex.Buffer)
+	}
+
+	if ttl > 0 {
+		at := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		if absttl {
+			at = time.Unix(0, ttl*int64(time.Millisecond))
+		}
+		if !at.After(time.Now()) { // expired, the key is deleted
+			if _, err := ex.DB.Delete(v[0]); err != nil {
+				return err
+			}
+			return resp.OkSimpleString.WriteTo(ex.Buffer)
+		}
+		e.ExpireAt = &at
+	}
+	if _, err := ex.DB.Delete(v[0]); err != nil {
+		return err
+	}
+	e.Key = v[0]
+	if err := rdb.PutEntry(ex.DB, e); err != nil {
+		return err
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// scan -> https://redis.io/commands/scan
+func scan(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "scan").WriteTo(ex.Buffer)
+	}
+
+	opts, reply := parseScanOptions(v, true)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	next, keys, err := ex.DB.Scan(opts.cursor, opts.count, func(key []byte, tipe byte) bool {
+		if opts.tipe != "" && resp.TypeString[tipe] != opts.tipe {
+			return false
+		}
+		return opts.match == nil || glob.Match(opts.match, key)
+	})
+	if err == storage.ErrInvalidCursor {
+		return resp.NewError(ErrInvalidCursor).WriteTo(ex.Buffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	arr := resp.Array{}
+	for _, key := range keys {
+		arr = append(arr, resp.BulkString(key))
+	}
+	return scanReply(next, arr).WriteTo(ex.Buffer)
+}
+
+// scanOptions is the options of SCAN/HSCAN/SSCAN/ZSCAN
+type scanOptions struct {
+	cursor uint64
+	match  []byte // nil to match all
+	count  int
+	tipe   string // type name to filter keys by, empty for all types, SCAN only
+}
+
+// parseScanOptions parses cursor [MATCH pattern] [COUNT count] [TYPE type], the
+// error reply is returned if the options are invalid.
+func parseScanOptions(v Args, withType bool) (*scanOptions, resp.Value) {
+	cursor, err := strconv.ParseUint(string(v[0]), 10, 64)
+	if err != nil {
+		return nil, resp.NewError(ErrInvalidCursor)
+	}
+
+	opts := &scanOptions{cursor: cursor, count: 10}
+	for i := 1; i < len(v); i += 2 {
+		if i == len(v)-1 { // no value
+			return nil, resp.NewError(ErrSyntax)
+		}
+		switch strings.ToLower(string(v[i])) {
+		case "match":
+			opts.match = v[i+1]
+			if string(opts.match) == "*" { // no need to match
+				opts.match = nil
+			}
+		case "count":
+			count, err := strconv.Atoi(string(v[i+1]))
+			if err != nil {
+				return nil, resp.NewError(ErrNotValidInt)
+			}
+			if count < 1 {
+				return nil, resp.NewError(ErrSyntax)
+			}
+			opts.count = count
+		case "type":
+			if !withType {
+				return nil, resp.NewError(ErrSyntax)
+			}
+			opts.tipe = strings.ToLower(string(v[i+1]))
+		default:
+			return nil, resp.NewError(ErrSyntax)
+		}
+	}
+	return opts, nil
+}
+
+// scanReply is the reply of SCAN/HSCAN/SSCAN/ZSCAN: the next cursor and the elements
+func scanReply(next uint64, arr resp.Array) resp.Array {
+	return resp.Array{resp.BulkString(strconv.FormatUint(next, 10)), arr}
+}
+
 // ttl -> https://redis.io/commands/ttl
 func ttl(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.NegativeOneInteger.WriteTo(ex.Buffer)
 	}
 
-	at := ex.DB.GetExpireAt(v[0])
+	at, err := ex.DB.GetExpireAt(v[0])
+	if err != nil {
+		return err
+	}
 	if at == nil {
 		return resp.NegativeOneInteger.WriteTo(ex.Buffer)
 	}
@@ -210,10 +599,10 @@ func ttl(v Args, ex *Extras) error {
 
 // tipe -> https://redis.io/commands/type
 func tipe(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 
 	if !exist {
 		return resp.SimpleString(resp.TypeString[resp.None]).WriteTo(ex.Buffer)
@@ -7,14 +7,20 @@
 package command
 
 import (
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rod6/rodis/resp"
 )
 
 // command
 // --------
+// BLMOVE
+// BLPOP
+// BRPOP
+// BRPOPLPUSH
 // LINDEX
 // LINSERT
 // LLEN
@@ -30,14 +36,215 @@ import (
 // RPUSH
 // RPUSHX
 
+// blmove -> https://redis.io/commands/blmove
+func blmove(v Args, ex *Extras) error {
+	from, to := strings.ToLower(string(v[2])), strings.ToLower(string(v[3]))
+	if from != "left" && from != "right" || to != "left" && to != "right" {
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+	timeout, reply := parseTimeout(v[4])
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	return block(ex, v[:1], v[:2], timeout, func() (bool, error) {
+		return popPush(v[0], v[1], from == "left", to == "left", ex)
+	})
+}
+
+// blpop -> https://redis.io/commands/blpop
+func blpop(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "blpop").WriteTo(ex.Buffer)
+	}
+	return blockingPop(v, true, ex)
+}
+
+// brpop -> https://redis.io/commands/brpop
+func brpop(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "brpop").WriteTo(ex.Buffer)
+	}
+	return blockingPop(v, false, ex)
+}
+
+// brpoplpush -> https://redis.io/commands/brpoplpush
+func brpoplpush(v Args, ex *Extras) error {
+	timeout, reply := parseTimeout(v[2])
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	return block(ex, v[:1], v[:2], timeout, func() (bool, error) {
+		return popPush(v[0], v[1], false, true, ex)
+	})
+}
+
+// blockingPop pops the first element of the first non-empty list, v is keys and timeout
+func blockingPop(v Args, head bool, ex *Extras) error {
+	timeout, reply := parseTimeout(v[len(v)-1])
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	keys := v[:len(v)-1]
+
+	return block(ex, keys, keys, timeout, func() (bool, error) {
+		for _, key := range keys {
+			exist, tipe, err := ex.DB.Has(key)
+			if err != nil {
+				return false, err
+			}
+			if !exist {
+				continue
+			}
+			if tipe != resp.List {
+				return true, resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+			}
+
+			var val []byte
+			if head {
+				val, err = ex.DB.PopListHead(key)
+				if err != nil {
+					return false, err
+				}
+				ex.propagate([]byte("lpop"), key)
+			} else {
+				val, err = ex.DB.PopListTail(key)
+				if err != nil {
+					return false, err
+				}
+				ex.propagate([]byte("rpop"), key)
+			}
+			return true, resp.Array{resp.BulkString(key), resp.BulkString(val)}.WriteTo(ex.Buffer)
+		}
+		return false, nil
+	})
+}
+
+// popPush pops an element from source and pushes it to destination, the element
+// is replied. It returns false if source does not exist.
+func popPush(source, destination []byte, fromHead, toHead bool, ex *Extras) (bool, error) {
+	exist, tipe, err := ex.DB.Has(source)
+	if err != nil {
+		return false, err
+	}
+	if !exist {
+		return false, nil
+	}
+	if tipe != resp.List {
+		return true, resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+	exist, tipe, err = ex.DB.Has(destination)
+	if err != nil {
+		return false, err
+	}
+	if exist && tipe != resp.List {
+		return true, resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	var val []byte
+	if fromHead {
+		val, err = ex.DB.PopListHead(source)
+		if err != nil {
+			return false, err
+		}
+		ex.propagate([]byte("lpop"), source)
+	} else {
+		val, err = ex.DB.PopListTail(source)
+		if err != nil {
+			return false, err
+		}
+		ex.propagate([]byte("rpop"), source)
+	}
+	if toHead {
+		if _, err := ex.DB.PushListHead(destination, resp.List, val); err != nil {
+			return false, err
+		}
+		ex.propagate([]byte("lpush"), destination, val)
+	} else {
+		if _, err := ex.DB.PushListTail(destination, resp.List, val); err != nil {
+			return false, err
+		}
+		ex.propagate([]byte("rpush"), destination, val)
+	}
+	return true, resp.BulkString(val).WriteTo(ex.Buffer)
+}
+
+// parseTimeout parses the timeout in seconds of blocking commands, 0 is forever
+func parseTimeout(b []byte) (time.Duration, resp.Value) {
+	timeout, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(timeout) || math.IsInf(timeout, 0) {
+		return 0, resp.NewError(ErrTimeoutNotValidFloat)
+	}
+	if timeout < 0 {
+		return 0, resp.NewError(ErrTimeoutNegative)
+	}
+	return time.Duration(timeout * float64(time.Second)), nil
+}
+
+// block calls serve with the locks locked, which replies and returns true if the
+// command can be served. Otherwise the connection waits until serve succeeds after
+// the lists of keys are pushed, or the timeout expires, or the client disconnects.
+// In EXEC, it never waits. The storage error of serve is returned by it.
+func block(ex *Extras, keys [][]byte, locks [][]byte, timeout time.Duration, serve func() (bool, error)) error {
+	l := dbLocks{}
+	l.add(ex.DB, locks...)
+	unlock := lockDBs(ex, flagWrite, l)
+	served, err := serve()
+	if served || err != nil || ex.locked {
+		unlock()
+		if !served && err == nil {
+			return ex.reply(resp.NilArray)
+		}
+		return err
+	}
+
+	// wait with the lock held, so no push is missed
+	db := ex.DB
+	w := db.Wait(keys, locks, func() bool {
+		defer ex.commit() // before the waiter is unlocked
+		served, err = serve()
+		return served || err != nil
+	})
+	unlock()
+
+	var disconnected <-chan struct{}
+	if ex.Blocking != nil {
+		var stop func()
+		disconnected, stop = ex.Blocking()
+		defer stop()
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-w.Served():
+		return err
+	case <-expired:
+	case <-disconnected:
+	}
+
+	unlock = lockDBs(ex, flagWrite, l)
+	defer unlock()
+	if db.Unwait(w) { // served before the wait ends
+		return err
+	}
+	return ex.reply(resp.NilArray)
+}
+
 // lindex -> https://redis.io/commands/lindex
 func lindex(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
@@ -48,16 +255,25 @@ func lindex(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	l := ex.DB.GetListLength(v[0])
+	l, err := ex.DB.GetListLength(v[0])
+	if err != nil {
+		return err
+	}
 	if index > int(l)-1 || index < (-1)*int(l) {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 
 	val := []byte{}
 	if index >= 0 {
-		val = ex.DB.GetLindexFromHead(v[0], uint32(index))
+		val, err = ex.DB.GetLindexFromHead(v[0], uint32(index))
+		if err != nil {
+			return err
+		}
 	} else {
-		val = ex.DB.GetLindexFromTail(v[0], uint32(-1*index-1))
+		val, err = ex.DB.GetLindexFromTail(v[0], uint32(-1*index-1))
+		if err != nil {
+			return err
+		}
 	}
 	return resp.BulkString(val).WriteTo(ex.Buffer)
 }
@@ -69,10 +285,10 @@ func linsert(v Args, ex *Extras) error {
 		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -80,16 +296,19 @@ func linsert(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	l := ex.DB.InsertList(v[0], d, v[2], v[3])
+	l, err := ex.DB.InsertList(v[0], d, v[2], v[3])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(l).WriteTo(ex.Buffer)
 }
 
 // llen -> https://redis.io/commands/llen
 func llen(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -97,26 +316,32 @@ func llen(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	l := ex.DB.GetListLength(v[0])
+	l, err := ex.DB.GetListLength(v[0])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(l).WriteTo(ex.Buffer)
 }
 
 // lpop -> https://redis.io/commands/lpop
 func lpop(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.PopListHead(v[0])
+	val, err := ex.DB.PopListHead(v[0])
+	if err != nil {
+		return err
+	}
 	if len(val) == 0 {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 
 	return resp.BulkString(val).WriteTo(ex.Buffer)
@@ -128,17 +353,20 @@ func lpush(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "lpush").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	var length uint32
 	for _, val := range v[1:] {
-		length = ex.DB.PushListHead(v[0], resp.List, val)
+		length, err = ex.DB.PushListHead(v[0], resp.List, val)
+		if err != nil {
+			return err
+		}
 	}
 	return resp.Integer(length).WriteTo(ex.Buffer)
 }
@@ -149,10 +377,10 @@ func lpushx(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "lpushx").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -162,17 +390,20 @@ func lpushx(v Args, ex *Extras) error {
 
 	var length uint32
 	for _, val := range v[1:] {
-		length = ex.DB.PushListHead(v[0], resp.List, val)
+		length, err = ex.DB.PushListHead(v[0], resp.List, val)
+		if err != nil {
+			return err
+		}
 	}
 	return resp.Integer(length).WriteTo(ex.Buffer)
 }
 
 // lrange -> https://redis.io/commands/lrange
 func lrange(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -190,7 +421,10 @@ func lrange(v Args, ex *Extras) error {
 	}
 
 	arr := resp.Array{}
-	elements := ex.DB.GetListRange(v[0], start, end)
+	elements, err := ex.DB.GetListRange(v[0], start, end)
+	if err != nil {
+		return err
+	}
 
 	for _, element := range elements {
 		arr = append(arr, resp.BulkString(element))
@@ -200,10 +434,10 @@ func lrange(v Args, ex *Extras) error {
 
 // lrem -> https://redis.io/commands/lrem
 func lrem(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -220,16 +454,19 @@ func lrem(v Args, ex *Extras) error {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
-	r := ex.DB.RemList(v[0], count, v[2])
+	r, err := ex.DB.RemList(v[0], count, v[2])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(r).WriteTo(ex.Buffer)
 }
 
 // lset -> https://redis.io/commands/lset
 func lset(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.NewError(ErrNoSuchKey).WriteTo(ex.Buffer)
 	}
@@ -242,19 +479,22 @@ func lset(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	err = ex.DB.SetListElement(v[0], index, v[2])
+	ok, err := ex.DB.SetListElement(v[0], index, v[2])
 	if err != nil {
-		resp.NewError(ErrIndexOutRange).WriteTo(ex.Buffer)
+		return err
+	}
+	if !ok {
+		return resp.NewError(ErrIndexOutRange).WriteTo(ex.Buffer)
 	}
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
 
 // ltrim -> https://redis.io/commands/ltrim
 func ltrim(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -271,26 +511,31 @@ func ltrim(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.TrimList(v[0], start, end)
+	if err := ex.DB.TrimList(v[0], start, end); err != nil {
+		return err
+	}
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
 
 // rpop -> https://redis.io/commands/rpop
 func rpop(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.PopListTail(v[0])
+	val, err := ex.DB.PopListTail(v[0])
+	if err != nil {
+		return err
+	}
 	if len(val) == 0 {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 
 	return resp.BulkString(val).WriteTo(ex.Buffer)
@@ -298,31 +543,39 @@ func rpop(v Args, ex *Extras) error {
 
 // rpoplpush -> https://redis.io/commands/rpoplpush
 func rpoplpush(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	// check source
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	// check dest
-	exist, tipe = ex.DB.Has(v[1])
+	exist, tipe, err = ex.DB.Has(v[1])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	// rpop
-	val := ex.DB.PopListTail(v[0])
+	val, err := ex.DB.PopListTail(v[0])
+	if err != nil {
+		return err
+	}
 	if len(val) == 0 {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	// lpush
-	ex.DB.PushListHead(v[1], resp.List, val)
+	if _, err := ex.DB.PushListHead(v[1], resp.List, val); err != nil {
+		return err
+	}
 
 	return resp.BulkString(val).WriteTo(ex.Buffer)
 }
@@ -333,17 +586,20 @@ func rpush(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "rpush").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.List {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	var length uint32
 	for _, val := range v[1:] {
-		length = ex.DB.PushListTail(v[0], resp.List, val)
+		length, err = ex.DB.PushListTail(v[0], resp.List, val)
+		if err != nil {
+			return err
+		}
 	}
 	return resp.Integer(length).WriteTo(ex.Buffer)
 }
@@ -354,10 +610,10 @@ func rpushx(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "rpushx").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -367,7 +623,10 @@ func rpushx(v Args, ex *Extras) error {
 
 	var length uint32
 	for _, val := range v[1:] {
-		length = ex.DB.PushListTail(v[0], resp.List, val)
+		length, err = ex.DB.PushListTail(v[0], resp.List, val)
+		if err != nil {
+			return err
+		}
 	}
 	return resp.Integer(length).WriteTo(ex.Buffer)
 }
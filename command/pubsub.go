@@ -0,0 +1,151 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"strings"
+
+	"github.com/rod6/rodis/resp"
+)
+
+// command
+// ------------
+// PSUBSCRIBE
+// PUBLISH
+// PUBSUB
+// PUNSUBSCRIBE
+// SUBSCRIBE
+// UNSUBSCRIBE
+
+// PubSub is the publish/subscribe of a connection, it is provided by the server,
+// which delivers the published messages to the subscribers.
+type PubSub interface {
+	Subscribe(channel []byte) int    // subscribes the channel, returns the count of subscriptions
+	Unsubscribe(channel []byte) int  // unsubscribes the channel, returns the count of subscriptions
+	PSubscribe(pattern []byte) int   // subscribes the pattern, returns the count of subscriptions
+	PUnsubscribe(pattern []byte) int // unsubscribes the pattern, returns the count of subscriptions
+	Channels() [][]byte              // channels subscribed by the connection
+	Patterns() [][]byte              // patterns subscribed by the connection
+	Subscriptions() int              // count of channels and patterns subscribed by the connection
+
+	Publish(channel, message []byte) int    // publishes the message, returns the count of receivers
+	ActiveChannels(pattern []byte) [][]byte // channels with subscribers, filtered by pattern if not nil
+	NumSub(channel []byte) int              // count of subscribers of the channel
+	NumPat() int                            // count of patterns subscribed by all connections
+}
+
+// subscribed returns true if the connection is in subscriber mode
+func (ex *Extras) subscribed() bool {
+	return ex.PubSub != nil && ex.PubSub.Subscriptions() > 0
+}
+
+// psubscribe -> https://redis.io/commands/psubscribe
+func psubscribe(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "psubscribe").WriteTo(ex.Buffer)
+	}
+
+	for _, pattern := range v {
+		n := ex.PubSub.PSubscribe(pattern)
+		if err := ex.reply(subscription("psubscribe", pattern, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publish -> https://redis.io/commands/publish
+func publish(v Args, ex *Extras) error {
+	return resp.Integer(ex.PubSub.Publish(v[0], v[1])).WriteTo(ex.Buffer)
+}
+
+// pubsub -> https://redis.io/commands/pubsub
+func pubsub(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "pubsub").WriteTo(ex.Buffer)
+	}
+
+	switch sub := strings.ToLower(string(v[0])); {
+	case sub == "channels" && len(v) <= 2:
+		var pattern []byte
+		if len(v) == 2 {
+			pattern = v[1]
+		}
+		arr := resp.Array{}
+		for _, channel := range ex.PubSub.ActiveChannels(pattern) {
+			arr = append(arr, resp.BulkString(channel))
+		}
+		return arr.WriteTo(ex.Buffer)
+	case sub == "numsub":
+		m := resp.Map{}
+		for _, channel := range v[1:] {
+			m = append(m, resp.BulkString(channel), resp.Integer(ex.PubSub.NumSub(channel)))
+		}
+		return ex.reply(m)
+	case sub == "numpat" && len(v) == 1:
+		return resp.Integer(ex.PubSub.NumPat()).WriteTo(ex.Buffer)
+	default:
+		return resp.NewError(ErrFmtUnknownSubcommand, string(v[0]), "PUBSUB").WriteTo(ex.Buffer)
+	}
+}
+
+// punsubscribe -> https://redis.io/commands/punsubscribe
+func punsubscribe(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		v = ex.PubSub.Patterns()
+	}
+	if len(v) == 0 {
+		return ex.reply(subscription("punsubscribe", nil, ex.PubSub.Subscriptions()))
+	}
+
+	for _, pattern := range v {
+		n := ex.PubSub.PUnsubscribe(pattern)
+		if err := ex.reply(subscription("punsubscribe", pattern, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribe -> https://redis.io/commands/subscribe
+func subscribe(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "subscribe").WriteTo(ex.Buffer)
+	}
+
+	for _, channel := range v {
+		n := ex.PubSub.Subscribe(channel)
+		if err := ex.reply(subscription("subscribe", channel, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe -> https://redis.io/commands/unsubscribe
+func unsubscribe(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		v = ex.PubSub.Channels()
+	}
+	if len(v) == 0 {
+		return ex.reply(subscription("unsubscribe", nil, ex.PubSub.Subscriptions()))
+	}
+
+	for _, channel := range v {
+		n := ex.PubSub.Unsubscribe(channel)
+		if err := ex.reply(subscription("unsubscribe", channel, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscription is the reply of (un)subscribing a channel or pattern, it is pushed
+// as the published messages in RESP3
+func subscription(kind string, name []byte, n int) resp.Push {
+	return resp.Push{resp.BulkString(kind), resp.BulkString(name), resp.Integer(n)}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/rdb"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// command
+// -------
+// PSYNC
+// REPLCONF
+// REPLICAOF
+// ROLE
+// SLAVEOF
+
+// Replication is the master-replica replication of a connection, it is provided
+// by the server, which streams the committed write commands to the replicas, or
+// replicates its master.
+type Replication interface {
+	ReplicaOf(host, port string) bool // replicates the master, or stops if host is empty; returns false if it replicates the master already
+	Role() resp.Array                 // reply of ROLE
+	Replicating() bool                // the server is a replica
+	ReadOnly() bool                   // the server is a read only replica
+
+	Feeding() bool           // the committed write commands are fed to the replicas
+	Feed(cmds []aof.Command) // feeds the write commands committed together to the replicas
+
+	// PartialSync streams the commands from the offset to the connection if the
+	// replication of replid has it, returns the replid of the server and true.
+	PartialSync(replid string, offset int64) (string, bool)
+	// FullSync sends the snapshots dbs to the connection, then streams the commands
+	// from the returned offset. The caller holds the locks of all dbs, the dbs are
+	// released by it.
+	FullSync(dbs []*storage.LevelDB) (string, int64)
+	ListeningPort(port int) // listening port of the replica of the connection
+	Ack(offset int64)       // offset processed by the replica of the connection
+}
+
+// replicated returns the error reply if the connection has no replication
+func replicated(ex *Extras) resp.Value {
+	if ex.Replication == nil {
+		return resp.NewError(ErrNoReplication)
+	}
+	return nil
+}
+
+// psync: https://redis.io/commands/psync
+func psync(v Args, ex *Extras) error {
+	if reply := replicated(ex); reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	if ex.Replication.Replicating() {
+		return resp.NewError(ErrChainedReplica).WriteTo(ex.Buffer)
+	}
+	offset, err := strconv.ParseInt(string(v[1]), 10, 64)
+	if err != nil {
+		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+	}
+
+	if replid, ok := ex.Replication.PartialSync(string(v[0]), offset); ok {
+		return resp.SimpleString("CONTINUE " + replid).WriteTo(ex.Buffer)
+	}
+
+	// the snapshots and the offset of the stream are of the same moment
+	unlock := lockAll(ex)
+	dbs, err := rdb.Snapshot()
+	if err != nil {
+		unlock()
+		return err
+	}
+	replid, from := ex.Replication.FullSync(dbs)
+	unlock()
+	return resp.SimpleString(fmt.Sprintf("FULLRESYNC %s %d", replid, from)).WriteTo(ex.Buffer)
+}
+
+// replconf: https://redis.io/commands/replconf, the command of the replica, the
+// ACK is not replied.
+func replconf(v Args, ex *Extras) error {
+	if reply := replicated(ex); reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	if len(v)%2 != 0 {
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+
+	for i := 0; i < len(v); i += 2 {
+		switch option := strings.ToLower(string(v[i])); option {
+		case "ack":
+			offset, err := strconv.ParseInt(string(v[i+1]), 10, 64)
+			if err != nil {
+				return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+			}
+			ex.Replication.Ack(offset)
+			return nil
+		case "listening-port":
+			port, err := strconv.Atoi(string(v[i+1]))
+			if err != nil {
+				return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+			}
+			ex.Replication.ListeningPort(port)
+		case "capa", "ip-address", "getack":
+		default:
+			return resp.NewError(ErrFmtReplconfOption, option).WriteTo(ex.Buffer)
+		}
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// replicaof: https://redis.io/commands/replicaof
+func replicaof(v Args, ex *Extras) error {
+	if reply := replicated(ex); reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	host, port := string(v[0]), string(v[1])
+	if strings.ToLower(host) == "no" && strings.ToLower(port) == "one" {
+		ex.Replication.ReplicaOf("", "")
+		return resp.OkSimpleString.WriteTo(ex.Buffer)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return resp.NewError(ErrInvalidMasterPort).WriteTo(ex.Buffer)
+	}
+
+	if !ex.Replication.ReplicaOf(host, port) {
+		return resp.SimpleString("OK Already connected to specified master").WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// role: https://redis.io/commands/role
+func role(v Args, ex *Extras) error {
+	if reply := replicated(ex); reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	return ex.Replication.Role().WriteTo(ex.Buffer)
+}
+
+// LoadSync flushes all dbs and loads the RDB file of path, which is sent by the
+// master in the full sync of the replica, with all dbs locked.
+func LoadSync(path string) (int, error) {
+	unlock := lockAll(&Extras{})
+	defer unlock()
+
+	for i := 0; i < 16; i++ {
+		if err := storage.Select(i).Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return rdb.LoadFile(path, true)
+}
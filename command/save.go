@@ -0,0 +1,193 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/rdb"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// command
+// -------
+// BGSAVE
+// DEBUG RELOAD
+// LASTSAVE
+// SAVE
+
+// saver is the state of the RDB saves, one save runs at a time
+var saver = struct {
+	sync.Mutex
+	saving   bool
+	lastSave time.Time // time of the last successful save, the start time if none
+}{lastSave: time.Now()}
+
+// beginSave marks a save running, returns false if a save is running
+func beginSave() bool {
+	saver.Lock()
+	defer saver.Unlock()
+	if saver.saving {
+		return false
+	}
+	saver.saving = true
+	return true
+}
+
+// endSave marks the save done, the time of the successful save is kept for LASTSAVE
+func endSave(ok bool) {
+	saver.Lock()
+	defer saver.Unlock()
+	saver.saving = false
+	if ok {
+		saver.lastSave = time.Now()
+	}
+}
+
+// lockAll locks all dbs for write, returns the unlock function
+func lockAll(ex *Extras) func() {
+	locks := dbLocks{}
+	for i := 0; i < 16; i++ {
+		locks.addWhole(storage.Select(i))
+	}
+	return lockDBs(ex, flagWrite, locks)
+}
+
+// snapshot returns the snapshot handles of all dbs, taken with all dbs locked
+func snapshot(ex *Extras) ([]*storage.LevelDB, error) {
+	unlock := lockAll(ex)
+	defer unlock()
+	return rdb.Snapshot()
+}
+
+// bgsave: https://redis.io/commands/bgsave
+func bgsave(v Args, ex *Extras) error {
+	if !beginSave() {
+		return resp.NewError(ErrSaveInProgress).WriteTo(ex.Buffer)
+	}
+	dbs, err := snapshot(ex)
+	if err != nil {
+		endSave(false)
+		return err
+	}
+
+	go func() {
+		err := rdb.Save(ex.DumpFile, dbs)
+		rdb.Release(dbs)
+		endSave(err == nil)
+		if err != nil {
+			logx.Errorf("Background saving error: %v", err)
+			return
+		}
+		logx.Infof("Background saving to %v terminated with success", ex.DumpFile)
+	}()
+	return resp.SimpleString("Background saving started").WriteTo(ex.Buffer)
+}
+
+// debug: https://redis.io/commands/debug, only RELOAD and SET-ACTIVE-EXPIRE are
+// supported
+func debug(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "debug").WriteTo(ex.Buffer)
+	}
+	switch strings.ToLower(string(v[0])) {
+	case "reload":
+		return debugReload(v, ex)
+	case "set-active-expire":
+		// DEBUG SET-ACTIVE-EXPIRE 0|1: pauses or resumes the expire sweepers
+		if len(v) != 2 || string(v[1]) != "0" && string(v[1]) != "1" {
+			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		}
+		storage.SetActiveExpire(string(v[1]) == "1")
+		return resp.OkSimpleString.WriteTo(ex.Buffer)
+	}
+	return resp.NewError(ErrFmtUnknownSubcommand, v[0], "DEBUG").WriteTo(ex.Buffer)
+}
+
+// debugReload runs DEBUG RELOAD
+func debugReload(v Args, ex *Extras) error {
+	// DEBUG RELOAD [MERGE] [NOFLUSH] [NOSAVE]: saves the RDB file unless NOSAVE,
+	// flushes all dbs unless NOFLUSH, and loads the RDB file. The existing keys
+	// are replaced by MERGE, otherwise the load fails at the first existing key.
+	save, flush, replace := true, true, false
+	for _, arg := range v[1:] {
+		switch strings.ToLower(string(arg)) {
+		case "merge":
+			replace = true
+		case "noflush":
+			flush = false
+		case "nosave":
+			save = false
+		default:
+			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		}
+	}
+
+	if !beginSave() {
+		return resp.NewError(ErrSaveInProgress).WriteTo(ex.Buffer)
+	}
+	saved := false
+	defer func() { endSave(saved) }()
+
+	unlock := lockAll(ex)
+	defer unlock()
+
+	if save {
+		dbs, err := rdb.Snapshot()
+		if err != nil {
+			return err
+		}
+		err = rdb.Save(ex.DumpFile, dbs)
+		rdb.Release(dbs)
+		if err != nil {
+			return resp.NewError(ErrFmtSave, err).WriteTo(ex.Buffer)
+		}
+		saved = true
+	}
+	if flush {
+		for i := 0; i < 16; i++ {
+			if err := storage.Select(i).Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := rdb.LoadFile(ex.DumpFile, replace); err != nil {
+		return resp.NewError(ErrFmtLoad, err).WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// lastsave: https://redis.io/commands/lastsave
+func lastsave(v Args, ex *Extras) error {
+	saver.Lock()
+	defer saver.Unlock()
+	return resp.Integer(saver.lastSave.Unix()).WriteTo(ex.Buffer)
+}
+
+// save: https://redis.io/commands/save
+func save(v Args, ex *Extras) error {
+	if !beginSave() {
+		return resp.NewError(ErrSaveInProgress).WriteTo(ex.Buffer)
+	}
+	dbs, err := snapshot(ex)
+	if err != nil {
+		endSave(false)
+		return err
+	}
+
+	err = rdb.Save(ex.DumpFile, dbs)
+	rdb.Release(dbs)
+	endSave(err == nil)
+	if err != nil {
+		return resp.NewError(ErrFmtSave, err).WriteTo(ex.Buffer)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
@@ -9,7 +9,9 @@ package command
 import (
 	"math/rand"
 
+	"github.com/rod6/rodis/glob"
 	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
 )
 
 // command
@@ -26,6 +28,7 @@ import (
 // SPOP         (partly done, no count support)
 // SRANDMEMBER  (partly done, no count support)
 // SREM
+// SSCAN
 // SUNION
 // SUNIONSTORE
 
@@ -35,10 +38,10 @@ func sadd(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sadd").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Set {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -47,7 +50,9 @@ func sadd(v Args, ex *Extras) error {
 	for _, s := range v[1:] {
 		hash[string(s)] = []byte("set")
 	}
-	ex.DB.PutHash(v[0], resp.Set, hash)
+	if err := ex.DB.PutHash(v[0], resp.Set, hash); err != nil {
+		return err
+	}
 	// TODO: sadd returns the number that added to the set
 	// Now, we return the number of Args, will update later.
 	return resp.Integer(len(v[1:])).WriteTo(ex.Buffer)
@@ -55,10 +60,10 @@ func sadd(v Args, ex *Extras) error {
 
 // scard -> https://redis.io/commands/scard
 func scard(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -66,7 +71,10 @@ func scard(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	elements := ex.DB.GetFieldNames(v[0])
+	elements, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(len(elements)).WriteTo(ex.Buffer)
 }
 
@@ -76,31 +84,37 @@ func sdiff(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sdiff").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
 	for i, s := range v {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if i == 0 && !exist { // first key not exists, return empty
-			return resp.EmptyArray.WriteTo(ex.Buffer)
+			return ex.reply(resp.RESPSet{})
 		}
 		if exist && tipe != resp.Set {
 			return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 		}
 	}
 
-	set0 := ex.DB.GetHash(v[0])
+	set0, err := ex.DB.GetHash(v[0])
+	if err != nil {
+		return err
+	}
 	for _, s := range v[1:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range setx {
 			delete(set0, element)
 		}
 	}
-	arr := resp.Array{}
+	arr := resp.RESPSet{}
 	for element := range set0 {
 		arr = append(arr, resp.BulkString(element))
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // sdiffstore -> https://redis.io/commands/sdiffstore
@@ -109,11 +123,11 @@ func sdiffstore(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sdiffstore").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	for i, s := range v[1:] {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if i == 0 && !exist { // first key not exists, return empty
 			return resp.ZeroInteger.WriteTo(ex.Buffer)
 		}
@@ -122,20 +136,27 @@ func sdiffstore(v Args, ex *Extras) error {
 		}
 	}
 
-	exist, _ := ex.DB.Has(v[0])
-	if exist {
-		del(v[0:0], ex)
+	set0, err := ex.DB.GetHash(v[1])
+	if err != nil {
+		return err
 	}
-
-	set0 := ex.DB.GetHash(v[1])
 	for _, s := range v[2:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range setx {
 			delete(set0, element)
 		}
 	}
+
+	if _, err := ex.DB.Delete(v[0]); err != nil {
+		return err
+	}
 	if len(set0) > 0 {
-		ex.DB.PutHash(v[0], resp.Set, set0)
+		if err := ex.DB.PutHash(v[0], resp.Set, set0); err != nil {
+			return err
+		}
 	}
 	return resp.Integer(len(set0)).WriteTo(ex.Buffer)
 }
@@ -146,13 +167,13 @@ func sinter(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sinter").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
 	for _, s := range v {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if !exist { // first key not exists, return empty
-			return resp.EmptyArray.WriteTo(ex.Buffer)
+			return ex.reply(resp.RESPSet{})
 		}
 		if tipe != resp.Set {
 			return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
@@ -160,9 +181,15 @@ func sinter(v Args, ex *Extras) error {
 	}
 
 	// inter
-	set0 := ex.DB.GetHash(v[0])
+	set0, err := ex.DB.GetHash(v[0])
+	if err != nil {
+		return err
+	}
 	for _, s := range v[1:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range set0 {
 			if _, ok := setx[element]; !ok {
 				delete(set0, element)
@@ -170,11 +197,11 @@ func sinter(v Args, ex *Extras) error {
 		}
 	}
 
-	arr := resp.Array{}
+	arr := resp.RESPSet{}
 	for element := range set0 {
 		arr = append(arr, resp.BulkString(element))
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // sinterstore -> https://redis.io/commands/sinterstore
@@ -183,11 +210,11 @@ func sinterstore(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sinterstore").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	for i, s := range v[1:] {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if i == 0 && !exist { // first key not exists, return empty
 			return resp.ZeroInteger.WriteTo(ex.Buffer)
 		}
@@ -196,15 +223,16 @@ func sinterstore(v Args, ex *Extras) error {
 		}
 	}
 
-	exist, _ := ex.DB.Has(v[0])
-	if exist {
-		del(v[0:0], ex)
-	}
-
 	// inter
-	set0 := ex.DB.GetHash(v[0])
+	set0, err := ex.DB.GetHash(v[0])
+	if err != nil {
+		return err
+	}
 	for _, s := range v[1:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range set0 {
 			if _, ok := setx[element]; !ok {
 				delete(set0, element)
@@ -212,18 +240,23 @@ func sinterstore(v Args, ex *Extras) error {
 		}
 	}
 
+	if _, err := ex.DB.Delete(v[0]); err != nil {
+		return err
+	}
 	if len(set0) > 0 {
-		ex.DB.PutHash(v[0], resp.Set, set0)
+		if err := ex.DB.PutHash(v[0], resp.Set, set0); err != nil {
+			return err
+		}
 	}
 	return resp.Integer(len(set0)).WriteTo(ex.Buffer)
 }
 
 // sismember -> https://redis.io/commands/sismember
 func sismember(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -231,7 +264,10 @@ func sismember(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[1]})
+	if err != nil {
+		return err
+	}
 	if _, ok := hash[string(v[1])]; !ok {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -240,59 +276,72 @@ func sismember(v Args, ex *Extras) error {
 
 // smembers -> https://redis.io/commands/smembers
 func smembers(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.EmptyArray.WriteTo(ex.Buffer)
+		return ex.reply(resp.RESPSet{})
 	}
 	if tipe != resp.Set {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	elements := ex.DB.GetFieldNames(v[0])
-	arr := resp.Array{}
+	elements, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
+	arr := resp.RESPSet{}
 
 	for _, element := range elements {
 		arr = append(arr, resp.BulkString(element))
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // smove -> https://redis.io/commands/smove
 func smove(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 	if tipe != resp.Set {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
-	exist, tipe = ex.DB.Has(v[1])
+	exist, tipe, err = ex.DB.Has(v[1])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.Set {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	hash := ex.DB.GetFields(v[0], [][]byte{v[2]})
+	hash, err := ex.DB.GetFields(v[0], [][]byte{v[2]})
+	if err != nil {
+		return err
+	}
 	if _, ok := hash[string(v[2])]; !ok {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
-	ex.DB.DeleteFields(v[0], [][]byte{v[2]})
+	if err := ex.DB.DeleteFields(v[0], [][]byte{v[2]}); err != nil {
+		return err
+	}
 
-	ex.DB.PutHash(v[1], resp.Set, hash)
+	if err := ex.DB.PutHash(v[1], resp.Set, hash); err != nil {
+		return err
+	}
 	return resp.OneInteger.WriteTo(ex.Buffer)
 }
 
 // spop -> https://redis.io/commands/spop
 func spop(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -300,19 +349,25 @@ func spop(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	elements := ex.DB.GetFieldNames(v[0])
+	elements, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
 
 	i := rand.Intn(len(elements))
-	ex.DB.DeleteFields(v[0], [][]byte{elements[i]})
+	if err := ex.DB.DeleteFields(v[0], [][]byte{elements[i]}); err != nil {
+		return err
+	}
+	ex.propagate([]byte("srem"), v[0], elements[i])
 	return resp.BulkString(elements[i]).WriteTo(ex.Buffer)
 }
 
 // srandmember -> https://redis.io/commands/srandmember
 func srandmember(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
@@ -320,7 +375,10 @@ func srandmember(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	elements := ex.DB.GetFieldNames(v[0])
+	elements, err := ex.DB.GetFieldNames(v[0])
+	if err != nil {
+		return err
+	}
 
 	i := rand.Intn(len(elements))
 	return resp.BulkString(elements[i]).WriteTo(ex.Buffer)
@@ -332,10 +390,10 @@ func srem(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "srem").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -347,7 +405,10 @@ func srem(v Args, ex *Extras) error {
 	for _, element := range v[1:] {
 		elements = append(elements, []byte(element))
 	}
-	hash := ex.DB.GetFields(v[0], elements)
+	hash, err := ex.DB.GetFields(v[0], elements)
+	if err != nil {
+		return err
+	}
 
 	count := 0
 	for _, value := range hash {
@@ -355,40 +416,87 @@ func srem(v Args, ex *Extras) error {
 			count++
 		}
 	}
-	ex.DB.DeleteFields(v[0], elements)
+	if err := ex.DB.DeleteFields(v[0], elements); err != nil {
+		return err
+	}
 	return resp.Integer(count).WriteTo(ex.Buffer)
 }
 
+// sscan -> https://redis.io/commands/sscan
+func sscan(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "sscan").WriteTo(ex.Buffer)
+	}
+
+	opts, reply := parseScanOptions(v[1:], false)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return scanReply(0, resp.EmptyArray).WriteTo(ex.Buffer)
+	}
+	if tipe != resp.Set {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	next, fields, err := ex.DB.ScanFields(v[0], opts.cursor, opts.count)
+	if err == storage.ErrInvalidCursor {
+		return resp.NewError(ErrInvalidCursor).WriteTo(ex.Buffer)
+	}
+	if err != nil {
+		return err
+	}
+
+	arr := resp.Array{}
+	for _, field := range fields {
+		if opts.match == nil || glob.Match(opts.match, field.Key) {
+			arr = append(arr, resp.BulkString(field.Key))
+		}
+	}
+	return scanReply(next, arr).WriteTo(ex.Buffer)
+}
+
 // sunion -> https://redis.io/commands/sunion
 func sunion(v Args, ex *Extras) error {
 	if len(v) < 1 {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sunion").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
 	for _, s := range v {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if exist && tipe != resp.Set {
 			return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 		}
 	}
 
 	// union
-	set0 := ex.DB.GetHash(v[0])
+	set0, err := ex.DB.GetHash(v[0])
+	if err != nil {
+		return err
+	}
 	for _, s := range v[1:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range setx {
 			set0[element] = setx[element]
 		}
 	}
 
-	arr := resp.Array{}
+	arr := resp.RESPSet{}
 	for element := range set0 {
 		arr = append(arr, resp.BulkString(element))
 	}
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // sunionstore -> https://redis.io/commands/sunionstore
@@ -397,32 +505,38 @@ func sunionstore(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "sunionstore").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	for _, s := range v[1:] {
-		exist, tipe := ex.DB.Has(s)
+		exist, tipe, err := ex.DB.Has(s)
+		if err != nil {
+			return err
+		}
 		if exist && tipe != resp.Set {
 			return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 		}
 	}
 
-	exist, _ := ex.DB.Has(v[0])
-	if exist {
-		del(v[0:0], ex)
-	}
-
 	// union
-	set0 := ex.DB.GetHash(v[0])
+	set0, err := ex.DB.GetHash(v[0])
+	if err != nil {
+		return err
+	}
 	for _, s := range v[1:] {
-		setx := ex.DB.GetHash(s)
+		setx, err := ex.DB.GetHash(s)
+		if err != nil {
+			return err
+		}
 		for element := range setx {
 			set0[element] = setx[element]
 		}
 	}
 
+	if _, err := ex.DB.Delete(v[0]); err != nil {
+		return err
+	}
 	if len(set0) > 0 {
-		ex.DB.PutHash(v[0], resp.Set, set0)
+		if err := ex.DB.PutHash(v[0], resp.Set, set0); err != nil {
+			return err
+		}
 	}
 	return resp.Integer(len(set0)).WriteTo(ex.Buffer)
 }
@@ -45,24 +45,29 @@ const STRLIMIT = 536870912 // 512M
 
 // appendx -> https://redis.io/commands/append
 func appendx(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	val := []byte("")
 	if exist {
-		val = ex.DB.GetString(v[0])
+		val, err = ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 	}
 	if len(val)+len(v[1]) > STRLIMIT {
 		return resp.NewError(ErrStringExccedLimit).WriteTo(ex.Buffer)
 	}
 
 	val = append(val, v[1]...)
-	ex.DB.PutString(v[0], val)
+	if err := ex.DB.PutString(v[0], val); err != nil {
+		return err
+	}
 	return resp.Integer(len(val)).WriteTo(ex.Buffer)
 }
 
@@ -72,10 +77,10 @@ func bitcount(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "bitcount").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -87,11 +92,13 @@ func bitcount(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtSyntax).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 
 	start := 0
 	end := len(val)
-	var err error
 
 	if len(v) == 3 {
 		start, err = strconv.Atoi(string(v[1]))
@@ -124,9 +131,6 @@ func bitop(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "bitop").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	op := strings.ToLower(string(v[0]))
 
 	switch op {
@@ -134,7 +138,10 @@ func bitop(v Args, ex *Extras) error {
 		if len(v) > 3 {
 			return resp.NewError(ErrBitOPNotError).WriteTo(ex.Buffer)
 		}
-		exist, tipe := ex.DB.Has(v[2])
+		exist, tipe, err := ex.DB.Has(v[2])
+		if err != nil {
+			return err
+		}
 		if !exist {
 			return resp.ZeroInteger.WriteTo(ex.Buffer)
 		}
@@ -142,23 +149,34 @@ func bitop(v Args, ex *Extras) error {
 			return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 		}
 
-		val := ex.DB.GetString(v[2])
+		val, err := ex.DB.GetString(v[2])
+		if err != nil {
+			return err
+		}
 		destValue := make([]byte, len(val))
 		for i, b := range val {
 			destValue[i] = ^b
 		}
 
-		ex.DB.PutString(v[1], destValue)
+		if err := ex.DB.PutString(v[1], destValue); err != nil {
+			return err
+		}
 		return resp.Integer(len(destValue)).WriteTo(ex.Buffer)
 
 	case "or", "and", "xor":
 		var destValue []byte = nil
 		for _, b := range v[2:] {
-			exist, tipe := ex.DB.Has(b)
+			exist, tipe, err := ex.DB.Has(b)
+			if err != nil {
+				return err
+			}
 			if exist && tipe != resp.String {
 				return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 			}
-			val := ex.DB.GetString(b)
+			val, err := ex.DB.GetString(b)
+			if err != nil {
+				return err
+			}
 			if exist && len(destValue) < len(val) {
 				if len(destValue) == 0 { // loop first step
 					destValue = append(destValue, val...)
@@ -182,7 +200,9 @@ func bitop(v Args, ex *Extras) error {
 				}
 			}
 		}
-		ex.DB.PutString(v[1], destValue)
+		if err := ex.DB.PutString(v[1], destValue); err != nil {
+			return err
+		}
 		return resp.Integer(len(destValue)).WriteTo(ex.Buffer)
 
 	default:
@@ -204,10 +224,10 @@ func bitpos(v Args, ex *Extras) error {
 	set := arg == 1   // set bit pos
 	clear := arg == 0 // clear bit pos
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -226,7 +246,10 @@ func bitpos(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtSyntax).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 	// Get the range.
 	start := 0
 	end := len(val)
@@ -312,26 +335,29 @@ func decrby(v Args, ex *Extras) error {
 
 // get -> https://redis.io/commands/get
 func get(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 	return resp.BulkString(val).WriteTo(ex.Buffer)
 }
 
 // getbit -> https://redis.io/commands/getbit
 func getbit(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -339,7 +365,10 @@ func getbit(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 
 	offset, err := strconv.Atoi(string(v[1]))
 	if err != nil {
@@ -369,10 +398,10 @@ func getrange(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyBulkString.WriteTo(ex.Buffer)
 	}
@@ -380,7 +409,10 @@ func getrange(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 	start, end = calcRange(start, end, len(val))
 	if end <= start {
 		return resp.EmptyBulkString.WriteTo(ex.Buffer)
@@ -395,22 +427,27 @@ func getset(v Args, ex *Extras) error {
 		return resp.NewError(ErrStringExccedLimit).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 	var oldValue []byte
 	if exist {
-		oldValue = ex.DB.GetString(v[0])
+		oldValue, err = ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 	}
 
-	ex.DB.PutString(v[0], v[1])
+	if err := ex.DB.PutString(v[0], v[1]); err != nil {
+		return err
+	}
 
 	if !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	return resp.BulkString(oldValue).WriteTo(ex.Buffer)
 }
@@ -436,10 +473,10 @@ func incrbyfloat(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidFloat).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -448,7 +485,10 @@ func incrbyfloat(v Args, ex *Extras) error {
 	if !exist {
 		newVal += by
 	} else {
-		val := ex.DB.GetString(v[0])
+		val, err := ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 		f, err := strconv.ParseFloat(string(val), 64)
 		if err != nil {
 			return resp.NewError(ErrNotValidFloat).WriteTo(ex.Buffer)
@@ -457,7 +497,9 @@ func incrbyfloat(v Args, ex *Extras) error {
 	}
 
 	s := []byte(strconv.FormatFloat(newVal, 'f', -1, 64))
-	ex.DB.PutString(v[0], s)
+	if err := ex.DB.PutString(v[0], s); err != nil {
+		return err
+	}
 	return resp.BulkString(s).WriteTo(ex.Buffer)
 }
 
@@ -467,21 +509,24 @@ func mget(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "mget").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
 	arr := make(resp.Array, len(v))
 	for i, g := range v {
-		exist, tipe := ex.DB.Has(g)
+		exist, tipe, err := ex.DB.Has(g)
+		if err != nil {
+			return err
+		}
 		if !exist || tipe != resp.String {
 			arr[i] = resp.NilBulkString
 		} else {
-			val := ex.DB.GetString(g)
+			val, err := ex.DB.GetString(g)
+			if err != nil {
+				return err
+			}
 			arr[i] = resp.BulkString(val)
 		}
 	}
 
-	return arr.WriteTo(ex.Buffer)
+	return ex.reply(arr)
 }
 
 // mset -> https://redis.io/commands/mset
@@ -490,11 +535,10 @@ func mset(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "mset").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	for i := 0; i < len(v); {
-		ex.DB.PutString(v[i], v[i+1])
+		if err := ex.DB.PutString(v[i], v[i+1]); err != nil {
+			return err
+		}
 		i += 2
 	}
 
@@ -507,11 +551,11 @@ func msetnx(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "msetnx").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	for i := 0; i < len(v); {
-		exist, _ := ex.DB.Has(v[i])
+		exist, _, err := ex.DB.Has(v[i])
+		if err != nil {
+			return err
+		}
 		if exist {
 			return resp.ZeroInteger.WriteTo(ex.Buffer) // If any key exist, return 0
 		}
@@ -519,7 +563,9 @@ func msetnx(v Args, ex *Extras) error {
 	}
 
 	for i := 0; i < len(v); { // every key does not exist, put all into level db.
-		ex.DB.PutString(v[i], v[i+1])
+		if err := ex.DB.PutString(v[i], v[i+1]); err != nil {
+			return err
+		}
 		i += 2
 	}
 
@@ -533,13 +579,14 @@ func psetex(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	at := time.Now().Add(time.Duration(expire) * time.Millisecond)
 
-	ex.DB.PutString(v[0], v[2])
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.PutString(v[0], v[2]); err != nil {
+		return err
+	}
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
@@ -550,12 +597,13 @@ func set(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "set").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	if len(v) == 2 {
-		ex.DB.PutString(v[0], v[1])
-		ex.DB.ClearExpireAt(v[0])
+		if err := ex.DB.PutString(v[0], v[1]); err != nil {
+			return err
+		}
+		if err := ex.DB.ClearExpireAt(v[0]); err != nil {
+			return err
+		}
 		return resp.OkSimpleString.WriteTo(ex.Buffer)
 	}
 
@@ -596,19 +644,24 @@ func set(v Args, ex *Extras) error {
 		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
 	}
 
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if optionNx && exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if optionXx && !exist {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return ex.reply(resp.NilBulkString)
 	}
 	if len(v[1]) > STRLIMIT {
 		return resp.NewError(ErrStringExccedLimit).WriteTo(ex.Buffer)
 	}
 
 	if !optionEx {
-		ex.DB.PutString(v[0], v[1])
+		if err := ex.DB.PutString(v[0], v[1]); err != nil {
+			return err
+		}
 		return resp.OkSimpleString.WriteTo(ex.Buffer)
 	}
 
@@ -620,8 +673,12 @@ func set(v Args, ex *Extras) error {
 		at = time.Now().Add(time.Duration(expireVal) * time.Millisecond)
 	}
 
-	ex.DB.PutString(v[0], v[1])
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.PutString(v[0], v[1]); err != nil {
+		return err
+	}
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
@@ -645,17 +702,20 @@ func setbit(v Args, ex *Extras) error {
 		return resp.NewError(ErrBitValueInvalid).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	val := []byte("")
 	if exist {
-		val = ex.DB.GetString(v[0])
+		val, err = ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 	}
 
 	if uint32(len(val)) < byten+1 {
@@ -673,7 +733,9 @@ func setbit(v Args, ex *Extras) error {
 		val[byten] = val[byten] | set
 	}
 
-	ex.DB.PutString(v[0], val)
+	if err := ex.DB.PutString(v[0], val); err != nil {
+		return err
+	}
 	return resp.Integer(k).WriteTo(ex.Buffer)
 }
 
@@ -684,28 +746,31 @@ func setex(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
 	at := time.Now().Add(time.Duration(expire) * time.Second)
 
-	ex.DB.PutString(v[0], v[2])
-	ex.DB.SetExpireAt(v[0], &at)
+	if err := ex.DB.PutString(v[0], v[2]); err != nil {
+		return err
+	}
+	if err := ex.DB.SetExpireAt(v[0], &at); err != nil {
+		return err
+	}
 
 	return resp.OkSimpleString.WriteTo(ex.Buffer)
 }
 
 // setnx -> https://redis.io/commands/setnx
 func setnx(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, _ := ex.DB.Has(v[0])
+	exist, _, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
 
-	ex.DB.PutString(v[0], v[1])
+	if err := ex.DB.PutString(v[0], v[1]); err != nil {
+		return err
+	}
 	return resp.OneInteger.WriteTo(ex.Buffer)
 
 }
@@ -724,17 +789,20 @@ func setrange(v Args, ex *Extras) error {
 		return resp.NewError(ErrStringExccedLimit).WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
 	val := []byte("")
 	if exist {
-		val = ex.DB.GetString(v[0])
+		val, err = ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(val) < offset+len(v[2]) {
@@ -742,16 +810,18 @@ func setrange(v Args, ex *Extras) error {
 	}
 	copy(val[offset:], v[2])
 
-	ex.DB.PutString(v[0], val)
+	if err := ex.DB.PutString(v[0], val); err != nil {
+		return err
+	}
 	return resp.Integer(len(val)).WriteTo(ex.Buffer)
 }
 
 // strlen -> https://redis.io/commands/strlen
 func strlen(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.ZeroInteger.WriteTo(ex.Buffer)
 	}
@@ -759,7 +829,10 @@ func strlen(v Args, ex *Extras) error {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	val := ex.DB.GetString(v[0])
+	val, err := ex.DB.GetString(v[0])
+	if err != nil {
+		return err
+	}
 	return resp.Integer(len(val)).WriteTo(ex.Buffer)
 }
 
@@ -846,10 +919,10 @@ func calcRange(start, end, len int) (int, int) {
 }
 
 func incrdecrHelper(v Args, ex *Extras, by int64) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.String {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
@@ -858,7 +931,10 @@ func incrdecrHelper(v Args, ex *Extras, by int64) error {
 	if !exist {
 		newVal += by
 	} else {
-		val := ex.DB.GetString(v[0])
+		val, err := ex.DB.GetString(v[0])
+		if err != nil {
+			return err
+		}
 		i, err := strconv.ParseInt(string(val), 10, 64)
 		if err != nil {
 			return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
@@ -866,6 +942,8 @@ func incrdecrHelper(v Args, ex *Extras, by int64) error {
 		newVal = i + by
 	}
 
-	ex.DB.PutString(v[0], []byte(strconv.FormatInt(newVal, 10)))
+	if err := ex.DB.PutString(v[0], []byte(strconv.FormatInt(newVal, 10))); err != nil {
+		return err
+	}
 	return resp.Integer(newVal).WriteTo(ex.Buffer)
 }
@@ -0,0 +1,140 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package command is to handle the command from client.
+package command
+
+import (
+	"strconv"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// command
+// ------------
+// DISCARD
+// EXEC
+// MULTI
+// UNWATCH
+// WATCH
+
+// discard -> https://redis.io/commands/discard
+func discard(v Args, ex *Extras) error {
+	if !ex.Multi {
+		return resp.NewError(ErrDiscardWithoutMulti).WriteTo(ex.Buffer)
+	}
+
+	ex.Release()
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// exec -> https://redis.io/commands/exec
+func exec(v Args, ex *Extras) error {
+	if !ex.Multi {
+		return resp.NewError(ErrExecWithoutMulti).WriteTo(ex.Buffer)
+	}
+
+	queue := ex.queue
+	defer ex.Release() // EXEC always unwatches all keys
+
+	if ex.Aborted {
+		return resp.NewError(ErrExecAbort).WriteTo(ex.Buffer)
+	}
+
+	unlock := lockTransaction(ex.DB, queue)
+	defer unlock()
+	ex.locked = true
+	defer func() { ex.locked = false }()
+	ex.begin() // the writes of all commands are committed in one batch per db
+	defer ex.end()
+
+	if ex.Watcher != nil && ex.Watcher.Dirty() {
+		return ex.reply(resp.NilArray)
+	}
+
+	if err := resp.WriteArrayHeader(ex.Buffer, len(queue)); err != nil {
+		return err
+	}
+	for _, q := range queue {
+		if err := ex.run(q.cmd, q.a, q.v); err != nil {
+			if _, ok := err.(*storage.Error); ok { // the transaction is not committed
+				return err
+			}
+			if err := resp.NewError(ErrServerUnknown).WriteTo(ex.Buffer); err != nil {
+				return err
+			}
+		}
+	}
+	ex.commit()
+	return nil
+}
+
+// multi -> https://redis.io/commands/multi
+func multi(v Args, ex *Extras) error {
+	if ex.Multi {
+		return resp.NewError(ErrMultiNested).WriteTo(ex.Buffer)
+	}
+
+	ex.Multi = true
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// unwatch -> https://redis.io/commands/unwatch
+func unwatch(v Args, ex *Extras) error {
+	if ex.Watcher != nil {
+		ex.Watcher.Unwatch()
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// watch -> https://redis.io/commands/watch
+func watch(v Args, ex *Extras) error {
+	if len(v) == 0 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "watch").WriteTo(ex.Buffer)
+	}
+	if ex.Multi {
+		return resp.NewError(ErrWatchInMulti).WriteTo(ex.Buffer)
+	}
+
+	if ex.Watcher == nil {
+		ex.Watcher = storage.NewWatcher()
+	}
+	for _, key := range v {
+		ex.DB.Watch(ex.Watcher, key)
+	}
+	return resp.OkSimpleString.WriteTo(ex.Buffer)
+}
+
+// lockTransaction locks the keys of the queued commands in the db they run, which
+// is changed by SELECT, or the whole db for the commands on all keys. The write
+// lock is used if any command writes, and all dbs are locked as a whole if any
+// command accesses other dbs.
+func lockTransaction(db *storage.LevelDB, queue []queued) func() {
+	locks := dbLocks{}
+	locks.add(db)
+	flag := 0
+	for _, q := range queue {
+		flag |= q.a.flag
+
+		switch {
+		case q.cmd == "select":
+			if i, err := strconv.Atoi(string(q.v[0])); err == nil && i >= 0 && i <= 15 {
+				db = storage.Select(i)
+				locks.add(db)
+			}
+		case q.a.flag&flagCrossDB != 0:
+			for i := 0; i <= 15; i++ {
+				locks.addWhole(storage.Select(i))
+			}
+		case q.a.flag&(flagRead|flagWrite) == 0:
+		case q.a.keys == nil:
+			locks.addWhole(db)
+		default:
+			locks.add(db, q.a.keys(q.v)...)
+		}
+	}
+	return lockIndexes(locks, flag)
+}
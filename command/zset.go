@@ -7,20 +7,42 @@
 package command
 
 import (
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/rod6/rodis/glob"
 	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
 )
 
 // command
 // ------------
 // ZADD
 // ZCARD
+// ZCOUNT
+// ZDIFF
+// ZINCRBY
+// ZINTER
+// ZINTERSTORE
+// ZLEXCOUNT
+// ZPOPMAX
+// ZPOPMIN
 // ZRANGE
+// ZRANGEBYLEX
 // ZRANGEBYSCORE
 // ZRANK
 // ZREM
+// ZREMRANGEBYRANK
+// ZREMRANGEBYSCORE
+// ZREVRANGE
+// ZREVRANGEBYSCORE
+// ZREVRANK
+// ZSCAN
+// ZSCORE
+// ZUNION
+// ZUNIONSTORE
 
 // zadd -> https://redis.io/commands/zadd
 func zadd(v Args, ex *Extras) error {
@@ -28,44 +50,224 @@ func zadd(v Args, ex *Extras) error {
 		return resp.NewError(ErrFmtWrongNumberArgument, "zadd").WriteTo(ex.Buffer)
 	}
 
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
-
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.SortedSet {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	for i := 1; i < len(v); {
+	// parse all scores first, nothing is added if any score is invalid
+	scores := make([]float64, 0, len(v)/2)
+	for i := 1; i < len(v); i += 2 {
 		score, err := strconv.ParseFloat(string(v[i]), 64)
-		if err != nil {
+		if err != nil || math.IsNaN(score) {
 			return resp.NewError(ErrNotValidFloat).WriteTo(ex.Buffer)
 		}
-		field := v[i+1]
+		scores = append(scores, score)
+	}
 
-		ex.DB.AddSkipField(v[0], resp.SortedSet, field, score)
-		i += 2
+	added := 0
+	for i, score := range scores {
+		ok, err := ex.DB.AddSkipField(v[0], resp.SortedSet, v[2*i+2], score)
+		if err != nil {
+			return err
+		}
+		if ok {
+			added++
+		}
 	}
-	return resp.Integer(len(v) / 2).WriteTo(ex.Buffer)
+	return resp.Integer(added).WriteTo(ex.Buffer)
 }
 
 // zcard -> https://redis.io/commands/zcard
 func zcard(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	n, err := ex.DB.GetSkipLength(v[0])
+	if err != nil {
+		return err
+	}
+	return resp.Integer(n).WriteTo(ex.Buffer)
+}
+
+// zcount -> https://redis.io/commands/zcount
+func zcount(v Args, ex *Extras) error {
+	min, minex, err := parseScoreBound(v[1])
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
+	}
+	max, maxex, err := parseScoreBound(v[2])
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	n, err := ex.DB.GetSkipCountByScore(v[0], min, minex, max, maxex)
+	if err != nil {
+		return err
+	}
+	return resp.Integer(n).WriteTo(ex.Buffer)
+}
+
+// zdiff -> https://redis.io/commands/zdiff
+func zdiff(v Args, ex *Extras) error {
+	return zcombine(v, ex, "zdiff", combineDiff)
+}
+
+// zincrby -> https://redis.io/commands/zincrby
+func zincrby(v Args, ex *Extras) error {
+	incr, err := strconv.ParseFloat(string(v[1]), 64)
+	if err != nil || math.IsNaN(incr) {
+		return resp.NewError(ErrNotValidFloat).WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	score, _, err := ex.DB.GetSkipScore(v[0], v[2])
+	if err != nil {
+		return err
+	}
+	score += incr
+	if math.IsNaN(score) { // +inf + -inf
+		return resp.NewError(ErrScoreNaN).WriteTo(ex.Buffer)
+	}
+
+	if _, err := ex.DB.AddSkipField(v[0], resp.SortedSet, v[2], score); err != nil {
+		return err
+	}
+	return ex.reply(resp.Double(score))
+}
+
+// zinter -> https://redis.io/commands/zinter
+func zinter(v Args, ex *Extras) error {
+	return zcombine(v, ex, "zinter", combineInter)
+}
+
+// zinterstore -> https://redis.io/commands/zinterstore
+func zinterstore(v Args, ex *Extras) error {
+	return zstore(v, ex, "zinterstore", combineInter)
+}
+
+// zlexcount -> https://redis.io/commands/zlexcount
+func zlexcount(v Args, ex *Extras) error {
+	min, minex, ok := parseLexBound(v[1])
+	if !ok {
+		return resp.NewError(ErrMinMaxNotLex).WriteTo(ex.Buffer)
+	}
+	max, maxex, ok := parseLexBound(v[2])
+	if !ok {
+		return resp.NewError(ErrMinMaxNotLex).WriteTo(ex.Buffer)
+	}
 
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.SortedSet {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	return resp.Integer(ex.DB.GetSkipLength(v[0])).WriteTo(ex.Buffer)
+	n, err := ex.DB.GetSkipCountByLex(v[0], min, minex, max, maxex)
+	if err != nil {
+		return err
+	}
+	return resp.Integer(n).WriteTo(ex.Buffer)
+}
+
+// zpopmax -> https://redis.io/commands/zpopmax
+func zpopmax(v Args, ex *Extras) error {
+	return zpop(v, ex, "zpopmax", true)
+}
+
+// zpopmin -> https://redis.io/commands/zpopmin
+func zpopmin(v Args, ex *Extras) error {
+	return zpop(v, ex, "zpopmin", false)
+}
+
+// zpop pops count elements with the lowest scores, or the highest if max
+func zpop(v Args, ex *Extras, cmd string, max bool) error {
+	if len(v) != 1 && len(v) != 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
+	}
+
+	count := 1
+	if len(v) == 2 {
+		c, err := strconv.Atoi(string(v[1]))
+		if err != nil {
+			return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+		}
+		count = c
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist || count <= 0 {
+		return resp.EmptyArray.WriteTo(ex.Buffer)
+	}
+	if tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	var elements []storage.SkipListElement
+	if max {
+		elements, err = ex.DB.GetSkipRevRange(v[0], 0, count-1)
+		if err != nil {
+			return err
+		}
+	} else {
+		elements, err = ex.DB.GetSkipRange(v[0], 0, count-1)
+		if err != nil {
+			return err
+		}
+	}
+	for _, element := range elements {
+		if _, err := ex.DB.DeleteSkipField(v[0], element.Field); err != nil {
+			return err
+		}
+	}
+	if len(v) == 1 && len(elements) == 1 && ex.Protocol == 3 { // a single element is not paired without count
+		return ex.reply(resp.Array{resp.BulkString(elements[0].Field), resp.Double(elements[0].Score)})
+	}
+	return elementsReply(ex, elements, true)
 }
 
 // zrange -> https://redis.io/commands/zrange
 func zrange(v Args, ex *Extras) error {
+	return zrangeByRank(v, ex, "zrange", false)
+}
+
+// zrevrange -> https://redis.io/commands/zrevrange
+func zrevrange(v Args, ex *Extras) error {
+	return zrangeByRank(v, ex, "zrevrange", true)
+}
+
+// zrangeByRank replies the elements between start and stop index
+func zrangeByRank(v Args, ex *Extras, cmd string, rev bool) error {
 	if len(v) != 3 && len(v) != 4 {
-		return resp.NewError(ErrFmtWrongNumberArgument, "range").WriteTo(ex.Buffer)
+		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
 	}
 
 	withscores := false
@@ -76,17 +278,209 @@ func zrange(v Args, ex *Extras) error {
 		withscores = true
 	}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
+	start, err := strconv.Atoi(string(v[1]))
+	if err != nil {
+		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+	}
+	end, err := strconv.Atoi(string(v[2]))
+	if err != nil {
+		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
+	}
 
-	exist, tipe := ex.DB.Has(v[0])
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return resp.EmptyArray.WriteTo(ex.Buffer)
 	}
+	if tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	var elements []storage.SkipListElement
+	if rev {
+		elements, err = ex.DB.GetSkipRevRange(v[0], start, end)
+		if err != nil {
+			return err
+		}
+	} else {
+		elements, err = ex.DB.GetSkipRange(v[0], start, end)
+		if err != nil {
+			return err
+		}
+	}
+	return elementsReply(ex, elements, withscores)
+}
+
+// zrangebylex -> https://redis.io/commands/zrangebylex
+func zrangebylex(v Args, ex *Extras) error {
+	if len(v) < 3 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "zrangebylex").WriteTo(ex.Buffer)
+	}
+
+	min, minex, ok := parseLexBound(v[1])
+	if !ok {
+		return resp.NewError(ErrMinMaxNotLex).WriteTo(ex.Buffer)
+	}
+	max, maxex, ok := parseLexBound(v[2])
+	if !ok {
+		return resp.NewError(ErrMinMaxNotLex).WriteTo(ex.Buffer)
+	}
+	opts, reply := parseRangeOptions(v[3:], false)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.EmptyArray.WriteTo(ex.Buffer)
+	}
+	if tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	elements, err := ex.DB.GetSkipRangeByLex(v[0], min, minex, max, maxex)
+	if err != nil {
+		return err
+	}
+	return elementsReply(ex, opts.limit(elements), false)
+}
+
+// zrangebyscore -> https://redis.io/commands/zrangebyscore
+func zrangebyscore(v Args, ex *Extras) error {
+	return zrangeByScore(v, ex, "zrangebyscore", false)
+}
+
+// zrevrangebyscore -> https://redis.io/commands/zrevrangebyscore
+func zrevrangebyscore(v Args, ex *Extras) error {
+	return zrangeByScore(v, ex, "zrevrangebyscore", true)
+}
+
+// zrangeByScore replies the elements between min and max score, the max
+// comes first if rev.
+func zrangeByScore(v Args, ex *Extras, cmd string, rev bool) error {
+	if len(v) < 3 {
+		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
+	}
+
+	minb, maxb := v[1], v[2]
+	if rev {
+		minb, maxb = maxb, minb
+	}
+	min, minex, err := parseScoreBound(minb)
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
+	}
+	max, maxex, err := parseScoreBound(maxb)
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
+	}
+	opts, reply := parseRangeOptions(v[3:], true)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return resp.EmptyArray.WriteTo(ex.Buffer)
+	}
+	if tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	var elements []storage.SkipListElement
+	if rev {
+		elements, err = ex.DB.GetSkipRevRangeByScore(v[0], max, maxex, min, minex)
+		if err != nil {
+			return err
+		}
+	} else {
+		elements, err = ex.DB.GetSkipRangeByScore(v[0], min, minex, max, maxex)
+		if err != nil {
+			return err
+		}
+	}
+	return elementsReply(ex, opts.limit(elements), opts.withscores)
+}
+
+// zrank -> https://redis.io/commands/zrank
+func zrank(v Args, ex *Extras) error {
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	r, ok, err := ex.DB.GetSkipFieldRank(v[0], v[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ex.reply(resp.NilBulkString)
+	}
+	return resp.Integer(r).WriteTo(ex.Buffer)
+}
+
+// zrevrank -> https://redis.io/commands/zrevrank
+func zrevrank(v Args, ex *Extras) error {
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
+
+	r, ok, err := ex.DB.GetSkipFieldRank(v[0], v[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ex.reply(resp.NilBulkString)
+	}
+	l, err := ex.DB.GetSkipLength(v[0])
+	if err != nil {
+		return err
+	}
+	return resp.Integer(int(l) - 1 - r).WriteTo(ex.Buffer)
+}
+
+// zrem -> https://redis.io/commands/zrem
+func zrem(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "zrem").WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
 	if exist && tipe != resp.SortedSet {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
+	r := 0
+	for _, field := range v[1:] {
+		n, err := ex.DB.DeleteSkipField(v[0], field)
+		if err != nil {
+			return err
+		}
+		r += n
+	}
+	return resp.Integer(r).WriteTo(ex.Buffer)
+}
+
+// zremrangebyrank -> https://redis.io/commands/zremrangebyrank
+func zremrangebyrank(v Args, ex *Extras) error {
 	start, err := strconv.Atoi(string(v[1]))
 	if err != nil {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
@@ -96,115 +490,454 @@ func zrange(v Args, ex *Extras) error {
 		return resp.NewError(ErrNotValidInt).WriteTo(ex.Buffer)
 	}
 
-	arr := resp.Array{}
-	elements := ex.DB.GetSkipRange(v[0], start, end)
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
 
+	elements, err := ex.DB.GetSkipRange(v[0], start, end)
+	if err != nil {
+		return err
+	}
+	r := 0
 	for _, element := range elements {
-		arr = append(arr, resp.BulkString(element.Field))
-		if withscores {
-			arr = append(arr, resp.BulkString(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+		n, err := ex.DB.DeleteSkipField(v[0], element.Field)
+		if err != nil {
+			return err
 		}
+		r += n
 	}
-	return arr.WriteTo(ex.Buffer)
+	return resp.Integer(r).WriteTo(ex.Buffer)
 }
 
-// zrangebyscore -> https://redis.io/commands/zrangebyscore
-func zrangebyscore(v Args, ex *Extras) error {
-	if len(v) != 3 && len(v) != 4 {
-		return resp.NewError(ErrFmtWrongNumberArgument, "zrangebyscore").WriteTo(ex.Buffer)
+// zremrangebyscore -> https://redis.io/commands/zremrangebyscore
+func zremrangebyscore(v Args, ex *Extras) error {
+	min, minex, err := parseScoreBound(v[1])
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
+	}
+	max, maxex, err := parseScoreBound(v[2])
+	if err != nil {
+		return resp.NewError(ErrMinMaxNotFloat).WriteTo(ex.Buffer)
 	}
 
-	minex := false
-	maxex := false
-	min := float64(0.0)
-	max := float64(0.0)
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
+	}
+	if exist && tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	}
 
-	minb := v[1]
-	if v[1][0] == '(' {
-		minex = true
-		minb = v[1][1:]
-		if len(minb) == 0 {
-			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	elements, err := ex.DB.GetSkipRangeByScore(v[0], min, minex, max, maxex)
+	if err != nil {
+		return err
+	}
+	r := 0
+	for _, element := range elements {
+		n, err := ex.DB.DeleteSkipField(v[0], element.Field)
+		if err != nil {
+			return err
 		}
+		r += n
 	}
-	score, err := strconv.ParseFloat(string(minb), 64)
+	return resp.Integer(r).WriteTo(ex.Buffer)
+}
+
+// zscan -> https://redis.io/commands/zscan
+func zscan(v Args, ex *Extras) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, "zscan").WriteTo(ex.Buffer)
+	}
+
+	opts, reply := parseScanOptions(v[1:], false)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	exist, tipe, err := ex.DB.Has(v[0])
 	if err != nil {
-		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		return err
+	}
+	if !exist {
+		return scanReply(0, resp.EmptyArray).WriteTo(ex.Buffer)
+	}
+	if tipe != resp.SortedSet {
+		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
-	min = score
 
-	maxb := v[2]
-	if v[2][0] == '(' {
-		maxex = true
-		maxb = v[2][1:]
-		if len(maxb) == 0 {
-			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
-		}
+	next, elements, err := ex.DB.ScanSkip(v[0], opts.cursor, opts.count)
+	if err == storage.ErrInvalidCursor {
+		return resp.NewError(ErrInvalidCursor).WriteTo(ex.Buffer)
 	}
-	score, err = strconv.ParseFloat(string(maxb), 64)
 	if err != nil {
-		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+		return err
 	}
-	max = score
 
-	withscores := false
-	if len(v) == 4 {
-		if strings.ToLower(string(v[3])) != "withscores" {
-			return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	arr := resp.Array{}
+	for _, element := range elements {
+		if opts.match == nil || glob.Match(opts.match, element.Field) {
+			arr = append(arr, resp.BulkString(element.Field), resp.BulkString(formatScore(element.Score)))
 		}
-		withscores = true
 	}
+	return scanReply(next, arr).WriteTo(ex.Buffer)
+}
 
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
-
-	exist, tipe := ex.DB.Has(v[0])
-	if !exist {
-		return resp.EmptyArray.WriteTo(ex.Buffer)
+// zscore -> https://redis.io/commands/zscore
+func zscore(v Args, ex *Extras) error {
+	exist, tipe, err := ex.DB.Has(v[0])
+	if err != nil {
+		return err
 	}
 	if exist && tipe != resp.SortedSet {
 		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
 	}
 
-	arr := resp.Array{}
-	elements := ex.DB.GetSkipRangeByScore(v[0], min, minex, max, maxex)
+	score, ok, err := ex.DB.GetSkipScore(v[0], v[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ex.reply(resp.NilBulkString)
+	}
+	return ex.reply(resp.Double(score))
+}
 
+// zunion -> https://redis.io/commands/zunion
+func zunion(v Args, ex *Extras) error {
+	return zcombine(v, ex, "zunion", combineUnion)
+}
+
+// zunionstore -> https://redis.io/commands/zunionstore
+func zunionstore(v Args, ex *Extras) error {
+	return zstore(v, ex, "zunionstore", combineUnion)
+}
+
+// zcombine replies the combination of the input zsets
+func zcombine(v Args, ex *Extras, cmd string, op int) error {
+	if len(v) < 2 {
+		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
+	}
+
+	keys, opts, reply := parseCombineOptions(v, cmd, op)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	elements, reply, err := combine(ex.DB, keys, op, opts)
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	return elementsReply(ex, elements, opts.withscores)
+}
+
+// zstore stores the combination of the input zsets to the destination, which
+// is replaced.
+func zstore(v Args, ex *Extras, cmd string, op int) error {
+	if len(v) < 3 {
+		return resp.NewError(ErrFmtWrongNumberArgument, cmd).WriteTo(ex.Buffer)
+	}
+
+	keys, opts, reply := parseCombineOptions(v[1:], cmd, op)
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+	if opts.withscores {
+		return resp.NewError(ErrSyntax).WriteTo(ex.Buffer)
+	}
+
+	elements, reply, err := combine(ex.DB, keys, op, opts)
+	if err != nil {
+		return err
+	}
+	if reply != nil {
+		return reply.WriteTo(ex.Buffer)
+	}
+
+	if _, err := ex.DB.Delete(v[0]); err != nil {
+		return err
+	}
 	for _, element := range elements {
-		arr = append(arr, resp.BulkString(element.Field))
-		if withscores {
-			arr = append(arr, resp.BulkString(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+		if _, err := ex.DB.AddSkipField(v[0], resp.SortedSet, element.Field, element.Score); err != nil {
+			return err
 		}
 	}
-	return arr.WriteTo(ex.Buffer)
+	return resp.Integer(len(elements)).WriteTo(ex.Buffer)
 }
 
-// zrank -> https://redis.io/commands/zrank
-func zrank(v Args, ex *Extras) error {
-	ex.DB.RLock()
-	defer ex.DB.RUnlock()
+// combine operations
+const (
+	combineUnion = iota
+	combineInter
+	combineDiff
+)
 
-	exist, tipe := ex.DB.Has(v[0])
-	if exist && tipe != resp.SortedSet {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
-	}
+// combineOptions is the options of ZUNION, ZINTER and ZDIFF
+type combineOptions struct {
+	weights    []float64
+	aggregate  string // sum, min or max
+	withscores bool
+}
+
+// parseCombineOptions parses numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM|MIN|MAX] [WITHSCORES], ZDIFF accepts WITHSCORES only.
+func parseCombineOptions(v Args, cmd string, op int) (Args, combineOptions, resp.Value) {
+	opts := combineOptions{aggregate: "sum"}
 
-	r, err := ex.DB.GetSkipFieldRank(v[0], v[1])
+	numkeys, err := strconv.Atoi(string(v[0]))
 	if err != nil {
-		return resp.NilBulkString.WriteTo(ex.Buffer)
+		return nil, opts, resp.NewError(ErrNotValidInt)
 	}
-	return resp.Integer(r).WriteTo(ex.Buffer)
+	if numkeys <= 0 {
+		return nil, opts, resp.NewError(ErrFmtAtLeastOneKey, cmd)
+	}
+	if numkeys > len(v)-1 {
+		return nil, opts, resp.NewError(ErrSyntax)
+	}
+	keys := v[1 : 1+numkeys]
+
+	opts.weights = make([]float64, numkeys)
+	for i := range opts.weights {
+		opts.weights[i] = 1
+	}
+
+	v = v[1+numkeys:]
+	for i := 0; i < len(v); i++ {
+		switch option := strings.ToLower(string(v[i])); {
+		case option == "withscores" && !strings.HasSuffix(cmd, "store"):
+			opts.withscores = true
+		case option == "weights" && op != combineDiff:
+			if i+numkeys >= len(v) {
+				return nil, opts, resp.NewError(ErrSyntax)
+			}
+			for j := range opts.weights {
+				weight, err := strconv.ParseFloat(string(v[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return nil, opts, resp.NewError(ErrWeightNotFloat)
+				}
+				opts.weights[j] = weight
+			}
+			i += numkeys
+		case option == "aggregate" && op != combineDiff:
+			if i+1 >= len(v) {
+				return nil, opts, resp.NewError(ErrSyntax)
+			}
+			switch aggregate := strings.ToLower(string(v[i+1])); aggregate {
+			case "sum", "min", "max":
+				opts.aggregate = aggregate
+			default:
+				return nil, opts, resp.NewError(ErrSyntax)
+			}
+			i++
+		default:
+			return nil, opts, resp.NewError(ErrSyntax)
+		}
+	}
+	return keys, opts, nil
 }
 
-// zrem -> https://redis.io/commands/zrem
-func zrem(v Args, ex *Extras) error {
-	ex.DB.Lock()
-	defer ex.DB.Unlock()
+// combine reads the input zsets, and combines them by op. The sets are accepted
+// as zsets with all scores 1. The result is in score order. The error reply is
+// returned for the wrong type, and the storage error of db is returned.
+func combine(db *storage.LevelDB, keys Args, op int, opts combineOptions) ([]storage.SkipListElement, resp.Value, error) {
+	inputs := make([][]storage.SkipListElement, len(keys))
+	for i, key := range keys {
+		exist, tipe, err := db.Has(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exist {
+			continue
+		}
+		switch tipe {
+		case resp.SortedSet:
+			if inputs[i], err = db.GetSkipRange(key, 0, -1); err != nil {
+				return nil, nil, err
+			}
+		case resp.Set:
+			members, err := db.GetHash(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			for field := range members {
+				inputs[i] = append(inputs[i], storage.SkipListElement{Field: []byte(field), Score: 1})
+			}
+		default:
+			return nil, resp.NewError(ErrWrongType), nil
+		}
+	}
 
-	exist, tipe := ex.DB.Has(v[0])
-	if exist && tipe != resp.SortedSet {
-		return resp.NewError(ErrWrongType).WriteTo(ex.Buffer)
+	weighted := func(i int) map[string]float64 {
+		m := make(map[string]float64, len(inputs[i]))
+		for _, element := range inputs[i] {
+			score := element.Score * opts.weights[i]
+			if math.IsNaN(score) { // inf * 0
+				score = 0
+			}
+			m[string(element.Field)] = score
+		}
+		return m
 	}
 
-	r := ex.DB.DeleteSkipField(v[0], v[1])
-	return resp.Integer(r).WriteTo(ex.Buffer)
+	result := weighted(0)
+	for i := 1; i < len(inputs); i++ {
+		m := weighted(i)
+		switch op {
+		case combineUnion:
+			for field, score := range m {
+				if s, ok := result[field]; ok {
+					score = aggregate(opts.aggregate, s, score)
+				}
+				result[field] = score
+			}
+		case combineInter:
+			for field, s := range result {
+				if score, ok := m[field]; ok {
+					result[field] = aggregate(opts.aggregate, s, score)
+				} else {
+					delete(result, field)
+				}
+			}
+		case combineDiff:
+			for field := range m {
+				delete(result, field)
+			}
+		}
+	}
+
+	elements := make([]storage.SkipListElement, 0, len(result))
+	for field, score := range result {
+		elements = append(elements, storage.SkipListElement{Field: []byte(field), Score: score})
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		if elements[i].Score != elements[j].Score {
+			return elements[i].Score < elements[j].Score
+		}
+		return string(elements[i].Field) < string(elements[j].Field)
+	})
+	return elements, nil, nil
+}
+
+// aggregate aggregates the scores of a field in the inputs
+func aggregate(aggregate string, a float64, b float64) float64 {
+	switch aggregate {
+	case "min":
+		return math.Min(a, b)
+	case "max":
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0 // inf + -inf
+}
+
+// rangeOptions is the options of ZRANGEBYSCORE and ZRANGEBYLEX
+type rangeOptions struct {
+	withscores bool
+	offset     int
+	count      int // negative count means all elements after offset
+}
+
+// parseRangeOptions parses [WITHSCORES] [LIMIT offset count], WITHSCORES is
+// accepted only if withscores is true.
+func parseRangeOptions(v Args, withscores bool) (rangeOptions, resp.Value) {
+	opts := rangeOptions{count: -1}
+	for i := 0; i < len(v); i++ {
+		switch strings.ToLower(string(v[i])) {
+		case "withscores":
+			if !withscores {
+				return opts, resp.NewError(ErrSyntax)
+			}
+			opts.withscores = true
+		case "limit":
+			if i+2 >= len(v) {
+				return opts, resp.NewError(ErrSyntax)
+			}
+			offset, err := strconv.Atoi(string(v[i+1]))
+			if err != nil {
+				return opts, resp.NewError(ErrNotValidInt)
+			}
+			count, err := strconv.Atoi(string(v[i+2]))
+			if err != nil {
+				return opts, resp.NewError(ErrNotValidInt)
+			}
+			opts.offset, opts.count = offset, count
+			i += 2
+		default:
+			return opts, resp.NewError(ErrSyntax)
+		}
+	}
+	return opts, nil
+}
+
+// limit returns the elements in the LIMIT of the options
+func (opts rangeOptions) limit(elements []storage.SkipListElement) []storage.SkipListElement {
+	if opts.offset < 0 || opts.offset >= len(elements) {
+		return nil
+	}
+	elements = elements[opts.offset:]
+	if opts.count >= 0 && opts.count < len(elements) {
+		elements = elements[:opts.count]
+	}
+	return elements
+}
+
+// parseScoreBound parses min or max of score range, the '(' prefix means exclusive
+func parseScoreBound(b []byte) (float64, bool, error) {
+	exclusive := false
+	if len(b) > 0 && b[0] == '(' {
+		exclusive = true
+		b = b[1:]
+	}
+	score, err := strconv.ParseFloat(string(b), 64)
+	if err == nil && math.IsNaN(score) {
+		err = strconv.ErrSyntax
+	}
+	return score, exclusive, err
+}
+
+// parseLexBound parses min or max of lex range: '[' inclusive, '(' exclusive, and
+// '-' or '+' for the unbounded, which returns nil.
+func parseLexBound(b []byte) ([]byte, bool, bool) {
+	if len(b) == 0 {
+		return nil, false, false
+	}
+	switch b[0] {
+	case '-', '+':
+		return nil, false, len(b) == 1
+	case '[':
+		return append([]byte{}, b[1:]...), false, true
+	case '(':
+		return append([]byte{}, b[1:]...), true, true
+	}
+	return nil, false, false
+}
+
+// elementsReply replies the fields of elements, followed by scores if withscores.
+// In RESP3 the field and the score of each element are paired in an array.
+func elementsReply(ex *Extras, elements []storage.SkipListElement, withscores bool) error {
+	arr := resp.Array{}
+	for _, element := range elements {
+		switch {
+		case !withscores:
+			arr = append(arr, resp.BulkString(element.Field))
+		case ex.Protocol == 3:
+			arr = append(arr, resp.Array{resp.BulkString(element.Field), resp.Double(element.Score)})
+		default:
+			arr = append(arr, resp.BulkString(element.Field), resp.Double(element.Score))
+		}
+	}
+	return ex.reply(arr)
+}
+
+// formatScore formats score as redis does, infinity is inf or -inf
+func formatScore(score float64) string {
+	return resp.Double(score).String()
 }
@@ -0,0 +1,36 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+// crcTable is the table of the CRC64 of Redis: the Jones polynomial, reflected,
+// with the initial value 0 and no final xor. hash/crc64 can not be used, as it
+// inverts the initial and final values.
+var crcTable = makeCRCTable(0x95ac9329ac4bc9b5)
+
+// makeCRCTable makes the table of the reflected poly
+func makeCRCTable(poly uint64) *[256]uint64 {
+	t := new([256]uint64)
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}
+
+// CRC64 returns crc updated with the bytes of p
+func CRC64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
@@ -0,0 +1,511 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// more opcodes and value types of the RDB files by Redis, the values of modules
+// and streams are not supported.
+const (
+	opSlotInfo     byte = 0xF4
+	opFunction2    byte = 0xF5
+	opModuleAux    byte = 0xF7
+	opIdle         byte = 0xF8
+	opFreq         byte = 0xF9
+	typeQuicklist  byte = 14
+	typeHashLP     byte = 16
+	typeZSetLP     byte = 17
+	typeQuicklist2 byte = 18
+	typeSetLP      byte = 20
+)
+
+// the special encodings of strings, the low 6 bits of the length byte 0xC0
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var (
+	ErrWrongMagic    = errors.New("rdb: wrong signature")
+	ErrWrongChecksum = errors.New("rdb: wrong checksum")
+)
+
+// Entry is a key read from the RDB file with its value: String of string, List
+// of list, Members of set, Fields of hash, or Elements of sorted set.
+type Entry struct {
+	DB       int
+	Key      []byte
+	Type     byte // resp.String, resp.List, resp.Set, resp.Hash or resp.SortedSet
+	ExpireAt *time.Time
+
+	String   []byte
+	List     [][]byte
+	Members  [][]byte
+	Fields   []storage.Field
+	Elements []storage.SkipListElement
+}
+
+// Decoder reads the RDB format from a reader, with the CRC64 of the bytes read
+type Decoder struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+}
+
+// NewDecoder returns the decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// read reads len(p) bytes, the end of file is io.ErrUnexpectedEOF
+func (d *Decoder) read(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	d.crc = CRC64(d.crc, p)
+	return nil
+}
+
+// readByte reads one byte
+func (d *Decoder) readByte() (byte, error) {
+	b := make([]byte, 1)
+	err := d.read(b)
+	return b[0], err
+}
+
+// readBytes reads n bytes
+func (d *Decoder) readBytes(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("rdb: length %d is too large", n)
+	}
+	b := make([]byte, n)
+	return b, d.read(b)
+}
+
+// readLength reads the length, or the special encoding of a string if encoded
+func (d *Decoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case b>>6 == 0:
+		return uint64(b & 0x3F), false, nil
+	case b>>6 == 1:
+		next, err := d.readByte()
+		return uint64(b&0x3F)<<8 | uint64(next), false, err
+	case b == len32Bit:
+		p, err := d.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case b == len64Bit:
+		p, err := d.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	case b>>6 == 3:
+		return uint64(b & 0x3F), true, nil
+	}
+	return 0, false, fmt.Errorf("rdb: unknown length encoding 0x%02x", b)
+}
+
+// readLen reads a length which must not be a special encoding
+func (d *Decoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = fmt.Errorf("rdb: unexpected string encoding %d", n)
+	}
+	return n, err
+}
+
+// readString reads a string, the integers are returned as the decimal strings
+func (d *Decoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return d.readBytes(n)
+	}
+
+	switch n {
+	case encInt8:
+		b, err := d.readByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case encInt16:
+		p, err := d.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p))))), nil
+	case encInt32:
+		p, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p))))), nil
+	case encLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := d.readBytes(clen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, int(ulen))
+	}
+	return nil, fmt.Errorf("rdb: unknown string encoding %d", n)
+}
+
+// readDoubleString reads the score of the sorted set of the type resp.SortedSet,
+// as a string of its length byte, 253 for NaN, 254 for +inf and 255 for -inf
+func (d *Decoder) readDoubleString() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := d.readBytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(p), 64)
+}
+
+// readDouble reads the binary score of the sorted set of TypeZSet2
+func (d *Decoder) readDouble() (float64, error) {
+	p, err := d.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(p)), nil
+}
+
+// readStrings reads n strings
+func (d *Decoder) readStrings(n uint64) ([][]byte, error) {
+	ss := [][]byte{}
+	for i := uint64(0); i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+// readHeader reads the magic string and the version
+func (d *Decoder) readHeader() error {
+	p, err := d.readBytes(9)
+	if err != nil {
+		return err
+	}
+	if string(p[:5]) != "REDIS" {
+		return ErrWrongMagic
+	}
+	d.version, err = strconv.Atoi(string(p[5:]))
+	if err != nil {
+		return ErrWrongMagic
+	}
+	return nil
+}
+
+// readFooter reads the checksum after OpEOF, the checksum 0 is not checked as
+// the checksum is disabled by Redis. There is no checksum before version 5.
+func (d *Decoder) readFooter() error {
+	if d.version < 5 {
+		return nil
+	}
+	crc := d.crc
+	p, err := d.readBytes(8)
+	if err != nil {
+		return err
+	}
+	if sum := binary.LittleEndian.Uint64(p); sum != 0 && sum != crc {
+		return ErrWrongChecksum
+	}
+	return nil
+}
+
+// Decode reads the RDB file, and calls f with the keys in the file. It stops at
+// the first error of f, which is returned.
+func (d *Decoder) Decode(f func(e *Entry) error) error {
+	if err := d.readHeader(); err != nil {
+		return err
+	}
+
+	db := 0
+	var at *time.Time
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case OpEOF:
+			return d.readFooter()
+		case OpSelectDB:
+			n, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			db = int(n)
+		case OpResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLen(); err != nil {
+					return err
+				}
+			}
+		case OpAux:
+			if _, err := d.readStrings(2); err != nil {
+				return err
+			}
+		case opFunction2:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+		case opIdle:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return err
+			}
+		case OpExpireTimeMs:
+			p, err := d.readBytes(8)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(0, int64(binary.LittleEndian.Uint64(p))*int64(time.Millisecond))
+			at = &t
+		case OpExpireTime:
+			p, err := d.readBytes(4)
+			if err != nil {
+				return err
+			}
+			t := time.Unix(int64(binary.LittleEndian.Uint32(p)), 0)
+			at = &t
+		case opModuleAux:
+			return errors.New("rdb: the module data is not supported")
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			e := &Entry{DB: db, Key: key, ExpireAt: at}
+			if err := d.readValue(op, e); err != nil {
+				return fmt.Errorf("%v of key %q", err, key)
+			}
+			at = nil
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readValue reads the value of tipe to e
+func (d *Decoder) readValue(tipe byte, e *Entry) error {
+	var err error
+	var ss [][]byte
+	switch tipe {
+	case resp.String:
+		e.Type = resp.String
+		e.String, err = d.readString()
+		return err
+	case resp.List, resp.Set:
+		n, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		ss, err = d.readStrings(n)
+	case resp.Hash:
+		n, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		ss, err = d.readStrings(2 * n)
+	case resp.SortedSet, TypeZSet2:
+		return d.readZSet(tipe, e)
+	case resp.Zipmap:
+		ss, err = d.readEncoded(zipmapEntries)
+	case resp.Ziplist, resp.SortedSetInZiplist, resp.HashmapInZiplist:
+		ss, err = d.readEncoded(ziplistEntries)
+	case resp.Intset:
+		ss, err = d.readEncoded(intsetEntries)
+	case typeHashLP, typeZSetLP, typeSetLP:
+		ss, err = d.readEncoded(listpackEntries)
+	case typeQuicklist, typeQuicklist2:
+		ss, err = d.readQuicklist(tipe)
+	default:
+		return fmt.Errorf("rdb: value type %d is not supported", tipe)
+	}
+	if err != nil {
+		return err
+	}
+	return e.set(tipe, ss)
+}
+
+// readZSet reads the sorted set of the type resp.SortedSet or TypeZSet2
+func (d *Decoder) readZSet(tipe byte, e *Entry) error {
+	n, err := d.readLen()
+	if err != nil {
+		return err
+	}
+	e.Type = resp.SortedSet
+	for i := uint64(0); i < n; i++ {
+		field, err := d.readString()
+		if err != nil {
+			return err
+		}
+		var score float64
+		if tipe == TypeZSet2 {
+			score, err = d.readDouble()
+		} else {
+			score, err = d.readDoubleString()
+		}
+		if err != nil {
+			return err
+		}
+		e.Elements = append(e.Elements, storage.SkipListElement{Field: field, Score: score})
+	}
+	return nil
+}
+
+// readEncoded reads a string encoded as a ziplist, listpack, intset or zipmap,
+// returns its entries by decode
+func (d *Decoder) readEncoded(decode func(p []byte) ([][]byte, error)) ([][]byte, error) {
+	p, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return decode(p)
+}
+
+// readQuicklist reads the nodes of the quicklist: the ziplists of typeQuicklist,
+// or the listpacks or plain elements of typeQuicklist2
+func (d *Decoder) readQuicklist(tipe byte) ([][]byte, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return nil, err
+	}
+	ss := [][]byte{}
+	for i := uint64(0); i < n; i++ {
+		container := uint64(2) // packed
+		if tipe == typeQuicklist2 {
+			if container, err = d.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		p, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		var entries [][]byte
+		switch {
+		case container == 1: // plain
+			entries = [][]byte{p}
+		case tipe == typeQuicklist:
+			entries, err = ziplistEntries(p)
+		default:
+			entries, err = listpackEntries(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, entries...)
+	}
+	return ss, nil
+}
+
+// empty returns true if the value of e has no element, which is not a key
+func (e *Entry) empty() bool {
+	switch e.Type {
+	case resp.List:
+		return len(e.List) == 0
+	case resp.Set:
+		return len(e.Members) == 0
+	case resp.Hash:
+		return len(e.Fields) == 0
+	case resp.SortedSet:
+		return len(e.Elements) == 0
+	}
+	return false
+}
+
+// set sets the value of e by the strings of the value of tipe
+func (e *Entry) set(tipe byte, ss [][]byte) error {
+	switch tipe {
+	case resp.List, resp.Ziplist, typeQuicklist, typeQuicklist2:
+		e.Type = resp.List
+		e.List = ss
+	case resp.Set, resp.Intset, typeSetLP:
+		e.Type = resp.Set
+		e.Members = ss
+	case resp.Hash, resp.Zipmap, resp.HashmapInZiplist, typeHashLP:
+		if len(ss)%2 != 0 {
+			return errors.New("rdb: wrong number of hash entries")
+		}
+		e.Type = resp.Hash
+		for i := 0; i < len(ss); i += 2 {
+			e.Fields = append(e.Fields, storage.Field{Key: ss[i], Value: ss[i+1]})
+		}
+	case resp.SortedSetInZiplist, typeZSetLP:
+		if len(ss)%2 != 0 {
+			return errors.New("rdb: wrong number of sorted set entries")
+		}
+		e.Type = resp.SortedSet
+		for i := 0; i < len(ss); i += 2 {
+			score, err := strconv.ParseFloat(string(ss[i+1]), 64)
+			if err != nil {
+				return err
+			}
+			e.Elements = append(e.Elements, storage.SkipListElement{Field: ss[i], Score: score})
+		}
+	}
+	return nil
+}
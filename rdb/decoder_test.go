@@ -0,0 +1,250 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+)
+
+// rdbFile returns the RDB file of version with the records, and the end and the
+// checksum
+func rdbFile(version string, records ...string) []byte {
+	p := []byte("REDIS" + version + strings.Join(records, "") + "\xff")
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, CRC64(0, p))
+	return append(p, sum...)
+}
+
+// str returns the string of the RDB format with a length of 6 or 14 bits
+func str(s string) string {
+	if len(s) < 64 {
+		return string(rune(len(s))) + s
+	}
+	return string([]byte{0x40 | byte(len(s)>>8), byte(len(s))}) + s
+}
+
+// decodeAll returns the entries of the RDB file p
+func decodeAll(p []byte) ([]*Entry, error) {
+	entries := []*Entry{}
+	err := NewDecoder(bytes.NewReader(p)).Decode(func(e *Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// format returns the entry as a string to compare
+func format(e *Entry) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%d %s %d", e.DB, e.Key, e.Type)
+	if e.ExpireAt != nil {
+		fmt.Fprintf(b, " expire %d", e.ExpireAt.UnixNano()/int64(time.Millisecond))
+	}
+	switch e.Type {
+	case resp.String:
+		fmt.Fprintf(b, " %q", e.String)
+	case resp.List:
+		fmt.Fprintf(b, " %q", e.List)
+	case resp.Set:
+		fmt.Fprintf(b, " %q", e.Members)
+	case resp.Hash:
+		for _, f := range e.Fields {
+			fmt.Fprintf(b, " %s=%s", f.Key, f.Value)
+		}
+	case resp.SortedSet:
+		for _, element := range e.Elements {
+			fmt.Fprintf(b, " %s=%v", element.Field, element.Score)
+		}
+	}
+	return b.String()
+}
+
+// fixture is the RDB file of all the value types and encodings, with the keys
+// expected
+func fixture() ([]byte, []string) {
+	score := make([]byte, 8)
+	binary.LittleEndian.PutUint64(score, math.Float64bits(-2.5))
+	long := strings.Repeat("a", 100)
+
+	p := rdbFile("0011",
+		"\xfa"+str("redis-ver")+str("7.2.0"),       // aux
+		"\xfa"+str("ctime")+"\xc2\x00\x00\x00\x65", // aux of an integer
+		"\xf5"+str("#!lua name=lib"),               // function
+		"\xfe\x00\xfb\x0b\x02",                     // db 0, resize
+		"\x00"+str("s")+str("string"),
+		"\x00"+str("i8")+"\xc0\xfb",
+		"\x00"+str("i16")+"\xc1\x2c\x01",
+		"\x00"+str("i32")+"\xc2\xa0\x86\x01\x00",
+		"\x00"+str("lzf")+"\xc3\x08\x40\x62"+"\x00a\xe0\x56\x00\x01bc",
+		"\xfc\x00\x68\xe5\xcf\x8b\x01\x00\x00"+"\x01"+str("l")+"\x02"+str("a")+str("b"), // expire ms
+		"\xfd\x00\x00\x00\x01"+"\x02"+str("set")+"\x02"+str("x")+"\xc0\x01",             // expire seconds
+		"\x03"+str("zset")+"\x02"+str("m")+"\x031.5"+str("n")+"\xfe",
+		"\x04"+str("hash")+"\x01"+str("f")+str("v"),
+		"\x05"+str("zset2")+"\x01"+str("m")+string(score),
+		"\xf8\x05\xf9\x03", // idle and freq of the next key
+		"\x09"+str("zipmap")+str("\x01\x01a\x01\x001\xff"),
+		"\x0a"+str("ziplist")+str(string(ziplist("\x00\x01a", "\x03\xf2"))),
+		"\x0b"+str("intset")+str("\x02\x00\x00\x00\x02\x00\x00\x00\xff\xff\x2c\x01"),
+		"\xfe\x03", // db 3
+		"\x0c"+str("zsetzl")+str(string(ziplist("\x00\x01m", "\x03\xf3", "\x02\x01n", "\x03\x030.5"))),
+		"\x0d"+str("hashzl")+str(string(ziplist("\x00\x01f", "\x03\x01v"))),
+		"\x0e"+str("quicklist")+"\x02"+str(string(ziplist("\x00\x01a")))+str(string(ziplist("\x00\x01b", "\x03\xf4"))),
+		"\x10"+str("hashlp")+str(string(listpack("\x81f\x02", "\x81v\x02"))),
+		"\x11"+str("zsetlp")+str(string(listpack("\x81m\x02", "\x07\x01"))),
+		"\x12"+str("quicklist2")+"\x02"+"\x02"+str(string(listpack("\x81a\x02", "\x0c\x01")))+"\x01"+str(long),
+		"\x14"+str("setlp")+str(string(listpack("\x81x\x02", "\xc3\xe8\x02"))),
+	)
+	return p, []string{
+		`0 s 0 "string"`,
+		`0 i8 0 "-5"`,
+		`0 i16 0 "300"`,
+		`0 i32 0 "100000"`,
+		`0 lzf 0 "` + strings.Repeat("a", 96) + `bc"`,
+		`0 l 1 expire 1700000000000 ["a" "b"]`,
+		`0 set 2 expire 16777216000 ["x" "1"]`,
+		`0 zset 3 m=1.5 n=+Inf`,
+		`0 hash 4 f=v`,
+		`0 zset2 3 m=-2.5`,
+		`0 zipmap 4 a=1`,
+		`0 ziplist 1 ["a" "1"]`,
+		`0 intset 2 ["-1" "300"]`,
+		`3 zsetzl 3 m=2 n=0.5`,
+		`3 hashzl 4 f=v`,
+		`3 quicklist 1 ["a" "b" "3"]`,
+		`3 hashlp 4 f=v`,
+		`3 zsetlp 3 m=7`,
+		`3 quicklist2 1 ["a" "12" "` + long + `"]`,
+		`3 setlp 2 ["x" "1000"]`,
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p, expect := fixture()
+	entries, err := decodeAll(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := []string{}
+	for _, e := range entries {
+		get = append(get, format(e))
+	}
+	if strings.Join(get, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Decode, Expect:\n%v\nGet:\n%v", strings.Join(expect, "\n"), strings.Join(get, "\n"))
+	}
+}
+
+func TestDecodeChecksum(t *testing.T) {
+	p := rdbFile("0009", "\xfe\x00\x00"+str("a")+str("1"))
+	if _, err := decodeAll(p); err != nil {
+		t.Errorf("Decode, Expect: nil, Get: %v", err)
+	}
+
+	p[len(p)-1] ^= 1
+	if _, err := decodeAll(p); err != ErrWrongChecksum {
+		t.Errorf("Decode(wrong checksum), Expect: %v, Get: %v", ErrWrongChecksum, err)
+	}
+	copy(p[len(p)-8:], make([]byte, 8)) // the checksum is disabled
+	if _, err := decodeAll(p); err != nil {
+		t.Errorf("Decode(checksum 0), Expect: nil, Get: %v", err)
+	}
+
+	// no checksum before version 5
+	p = []byte("REDIS0004\xfe\x00\x00" + str("a") + str("1") + "\xff")
+	if _, err := decodeAll(p); err != nil {
+		t.Errorf("Decode(version 4), Expect: nil, Get: %v", err)
+	}
+}
+
+// TestDecodeMalformed checks the truncated and corrupted files are errors, not
+// panics.
+func TestDecodeMalformed(t *testing.T) {
+	decode := func(p []byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		_, err = decodeAll(p)
+		return err
+	}
+
+	p, _ := fixture()
+	for n := 0; n < len(p); n++ {
+		if err := decode(p[:n]); err == nil || !strings.HasPrefix(err.Error(), io.ErrUnexpectedEOF.Error()) {
+			t.Fatalf("Decode(%v of %v bytes), Expect: unexpected EOF, Get: %v", n, len(p), err)
+		}
+	}
+
+	tests := []struct {
+		p      []byte
+		expect string
+	}{
+		{[]byte("RODIS0009"), "rdb: wrong signature"},
+		{[]byte("REDISxxxx"), "rdb: wrong signature"},
+		{rdbFile("0009", "\x00"+str("a")+"\xc4"), "rdb: unknown string encoding 4 of key \"a\""},
+		{rdbFile("0009", "\x00"+str("a")+"\xc3\x02\x05\x01ab"), "rdb: wrong value encoding of key \"a\""},
+		{rdbFile("0009", "\x00"+str("a")+"\x82"), "rdb: unknown length encoding 0x82 of key \"a\""},
+		{rdbFile("0009", "\x01"+str("a")+"\xc0"), "rdb: unexpected string encoding 0 of key \"a\""},
+		{rdbFile("0009", "\x00"+str("a")+"\x81\x00\x00\x00\x01\x00\x00\x00\x00"), "rdb: length 4294967296 is too large of key \"a\""},
+		{rdbFile("0009", "\x06"+str("a")), "rdb: value type 6 is not supported of key \"a\""},
+		{rdbFile("0009", "\x0d"+str("h")+str(string(ziplist("\x00\x01f")))), "rdb: wrong number of hash entries of key \"h\""},
+		{rdbFile("0009", "\x0c"+str("z")+str(string(ziplist("\x00\x01m", "\x03\x01x")))), "strconv.ParseFloat: parsing \"x\": invalid syntax of key \"z\""},
+		{rdbFile("0009", "\x03"+str("z")+"\x01"+str("m")+"\x03abc"), "strconv.ParseFloat: parsing \"abc\": invalid syntax of key \"z\""},
+		{rdbFile("0009", "\x0a"+str("l")+str("\x01\x02")), "rdb: wrong value encoding of key \"l\""},
+		{rdbFile("0009", "\xf7"), "rdb: the module data is not supported"},
+	}
+	for i, test := range tests {
+		if err := decode(test.p); err == nil || err.Error() != test.expect {
+			t.Errorf("Decode[%v](%q), Expect: %v, Get: %v", i, test.p, test.expect, err)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	// DUMP of the integer 10 by Redis, from https://redis.io/commands/dump
+	e, err := Restore([]byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"))
+	if err != nil || format(e) != `0  0 "10"` {
+		t.Errorf("Restore(DUMP of Redis), Expect: 10, Get: %v, %v", e, err)
+	}
+
+	payload := func(value string, version uint16) []byte {
+		p := make([]byte, 10)
+		binary.LittleEndian.PutUint16(p, version)
+		p = append([]byte(value), p[:2]...)
+		sum := make([]byte, 8)
+		binary.LittleEndian.PutUint64(sum, CRC64(0, p))
+		return append(p, sum...)
+	}
+	tests := []struct {
+		p      []byte
+		expect string
+	}{
+		{payload("\x0b"+str("\x02\x00\x00\x00\x01\x00\x00\x00\x07\x00"), 9), `0  2 ["7"]`},
+		{payload("\x12\x01\x01"+str("x"), MaxVersion), `0  1 ["x"]`},
+		{payload("\x00"+str("a"), MaxVersion+1), "rdb: wrong payload version or checksum"},
+		{payload("\x00"+str("a"), 9)[:12], "rdb: wrong payload version or checksum"},
+		{[]byte("\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\x0b"), "rdb: wrong payload version or checksum"},
+		{payload("\x00"+str("a")+"x", 9), "rdb: wrong value encoding"}, // bytes left
+		{payload("\x01\x00", 9), "rdb: wrong value encoding"},          // empty list
+		{payload("\x00\x05a", 9), "unexpected EOF"},
+	}
+	for i, test := range tests {
+		e, err := Restore(test.p)
+		get := ""
+		if err != nil {
+			get = err.Error()
+		} else {
+			get = format(e)
+		}
+		if get != test.expect {
+			t.Errorf("Restore[%v](%q), Expect: %v, Get: %v", i, test.p, test.expect, get)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/rod6/rodis/storage"
+)
+
+// ErrWrongPayload is the error of Restore if the payload is not by Dump
+var ErrWrongPayload = errors.New("rdb: wrong payload version or checksum")
+
+// Dump returns the serialized value of the key of tipe in db as the DUMP of Redis:
+//
+//	value type + value + RDB version (2 bytes) + CRC64 of the bytes before (8 bytes)
+//
+// the version and CRC64 are little endian. The storage error of db is returned.
+func Dump(db *storage.LevelDB, key []byte, tipe byte) ([]byte, error) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.writeType(tipe)
+	if err := e.writeValue(db, key, tipe); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, 10)
+	binary.LittleEndian.PutUint16(footer, Version)
+	e.write(footer[:2])
+	binary.LittleEndian.PutUint64(footer[2:], e.crc)
+	e.write(footer[2:])
+	return buf.Bytes(), nil
+}
+
+// Restore returns the entry of the value serialized by Dump, or by Redis of a
+// version up to MaxVersion, Key and DB of the entry are not set.
+func Restore(payload []byte) (*Entry, error) {
+	if len(payload) < 11 {
+		return nil, ErrWrongPayload
+	}
+	n := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[n:])
+	if version > MaxVersion || CRC64(0, payload[:n+2]) != binary.LittleEndian.Uint64(payload[n+2:]) {
+		return nil, ErrWrongPayload
+	}
+
+	d := NewDecoder(bytes.NewReader(payload[:n]))
+	d.version = int(version)
+	tipe, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := d.readValue(tipe, e); err != nil {
+		return nil, err
+	}
+	if _, err := d.r.ReadByte(); err == nil || e.empty() { // bytes left, or no element
+		return nil, errEncoding
+	}
+	return e, nil
+}
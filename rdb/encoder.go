@@ -0,0 +1,184 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// Encoder writes the RDB format to a writer, with the CRC64 of the bytes written.
+// The first error of the writer is kept, and the later writes are skipped.
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+// NewEncoder returns the encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Err returns the first error of the writer, or of the storage read by WriteKey
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+// write writes p and updates the CRC64
+func (e *Encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	if _, err := e.w.Write(p); err != nil {
+		e.err = err
+		return
+	}
+	e.crc = CRC64(e.crc, p)
+}
+
+// writeByte writes one byte
+func (e *Encoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+// writeLength writes the encoded length
+func (e *Encoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.writeByte(len6Bit | byte(n))
+	case n < 1<<14:
+		e.write([]byte{len14Bit | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		b := make([]byte, 5)
+		b[0] = len32Bit
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		e.write(b)
+	default:
+		b := make([]byte, 9)
+		b[0] = len64Bit
+		binary.BigEndian.PutUint64(b[1:], n)
+		e.write(b)
+	}
+}
+
+// writeString writes the length and bytes of s
+func (e *Encoder) writeString(s []byte) {
+	e.writeLength(uint64(len(s)))
+	e.write(s)
+}
+
+// writeDouble writes the binary double of the sorted set of TypeZSet2
+func (e *Encoder) writeDouble(f float64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+	e.write(b)
+}
+
+// WriteHeader writes the magic string and the version
+func (e *Encoder) WriteHeader() {
+	e.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+}
+
+// WriteSelectDB writes the start of the keys of the db of index
+func (e *Encoder) WriteSelectDB(index int) {
+	e.writeByte(OpSelectDB)
+	e.writeLength(uint64(index))
+}
+
+// WriteExpireAt writes the expire of the next key
+func (e *Encoder) WriteExpireAt(at time.Time) {
+	b := make([]byte, 9)
+	b[0] = OpExpireTimeMs
+	binary.LittleEndian.PutUint64(b[1:], uint64(at.UnixNano()/int64(time.Millisecond)))
+	e.write(b)
+}
+
+// WriteKey writes the key of tipe in db with its value, the storage error of db
+// is kept as the error of the writer.
+func (e *Encoder) WriteKey(db *storage.LevelDB, key []byte, tipe byte) {
+	e.writeType(tipe)
+	e.writeString(key)
+	if err := e.writeValue(db, key, tipe); err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// writeType writes the value type of tipe
+func (e *Encoder) writeType(tipe byte) {
+	switch tipe {
+	case resp.SortedSet:
+		e.writeByte(TypeZSet2)
+	default:
+		e.writeByte(tipe)
+	}
+}
+
+// writeValue writes the value of the key of tipe in db, it returns the storage
+// error of db.
+func (e *Encoder) writeValue(db *storage.LevelDB, key []byte, tipe byte) error {
+	switch tipe {
+	case resp.String:
+		value, err := db.GetString(key)
+		if err != nil {
+			return err
+		}
+		e.writeString(value)
+	case resp.List:
+		elements, err := db.GetListRange(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		e.writeLength(uint64(len(elements)))
+		for _, element := range elements {
+			e.writeString(element)
+		}
+	case resp.Set:
+		members, err := db.GetFieldNames(key)
+		if err != nil {
+			return err
+		}
+		e.writeLength(uint64(len(members)))
+		for _, member := range members {
+			e.writeString(member)
+		}
+	case resp.Hash:
+		fields, err := db.GetHashAsArray(key)
+		if err != nil {
+			return err
+		}
+		e.writeLength(uint64(len(fields)))
+		for _, field := range fields {
+			e.writeString(field.Key)
+			e.writeString(field.Value)
+		}
+	case resp.SortedSet:
+		elements, err := db.GetSkipRange(key, 0, -1)
+		if err != nil {
+			return err
+		}
+		e.writeLength(uint64(len(elements)))
+		for _, element := range elements {
+			e.writeString(element.Field)
+			e.writeDouble(element.Score)
+		}
+	}
+	return nil
+}
+
+// WriteFooter writes the end of file and the CRC64 of the bytes before
+func (e *Encoder) WriteFooter() {
+	e.writeByte(OpEOF)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, e.crc)
+	e.write(b)
+}
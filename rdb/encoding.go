@@ -0,0 +1,278 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// The compact encodings of the small values in the RDB files of Redis, they are
+// decoded to the entries as strings, the integers as the decimal strings.
+
+var errEncoding = errors.New("rdb: wrong value encoding")
+
+// ziplistEntries decodes the ziplist:
+//
+//	zlbytes (4 bytes) + zltail (4 bytes) + zllen (2 bytes) + entries + 0xFF
+//
+// an entry is prevlen (1 byte, or 0xFE + 4 bytes) + encoding + data. The entries
+// must be ended by 0xFF, so a truncated ziplist is an error.
+func ziplistEntries(p []byte) ([][]byte, error) {
+	if len(p) < 11 {
+		return nil, errEncoding
+	}
+	entries := [][]byte{}
+	i := 10
+	for i < len(p) && p[i] != 0xFF {
+		if p[i] == 0xFE {
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(p) {
+			return nil, errEncoding
+		}
+
+		b := p[i]
+		var n, size int // string length, or the size of the integer
+		switch {
+		case b>>6 == 0:
+			n, i = int(b&0x3F), i+1
+		case b>>6 == 1 && i+1 < len(p):
+			n, i = int(b&0x3F)<<8|int(p[i+1]), i+2
+		case b == 0x80 && i+4 < len(p):
+			n, i = int(binary.BigEndian.Uint32(p[i+1:])), i+5
+		case b == 0xC0:
+			size = 2
+		case b == 0xD0:
+			size = 4
+		case b == 0xE0:
+			size = 8
+		case b == 0xF0:
+			size = 3
+		case b == 0xFE:
+			size = 1
+		case b >= 0xF1 && b <= 0xFD: // immediate 0 to 12
+			entries, i = append(entries, []byte(strconv.Itoa(int(b&0x0F)-1))), i+1
+			continue
+		default:
+			return nil, errEncoding
+		}
+
+		if size != 0 {
+			i++
+			if i+size > len(p) {
+				return nil, errEncoding
+			}
+			entries, i = append(entries, []byte(strconv.FormatInt(intLE(p[i:i+size]), 10))), i+size
+			continue
+		}
+		if n < 0 || i+n > len(p) {
+			return nil, errEncoding
+		}
+		entries, i = append(entries, p[i:i+n]), i+n
+	}
+	if i >= len(p) { // no end
+		return nil, errEncoding
+	}
+	return entries, nil
+}
+
+// listpackEntries decodes the listpack:
+//
+//	total bytes (4 bytes) + number of elements (2 bytes) + entries + 0xFF
+//
+// an entry is encoding + data + backlen, backlen is the size of encoding + data
+func listpackEntries(p []byte) ([][]byte, error) {
+	if len(p) < 7 {
+		return nil, errEncoding
+	}
+	entries := [][]byte{}
+	i := 6
+	for i < len(p) && p[i] != 0xFF {
+		b := p[i]
+		start := i
+		var n, size, head int // string length, or the size of the integer, size of encoding
+		switch {
+		case b>>7 == 0: // 7 bits uint
+			entries = append(entries, []byte(strconv.Itoa(int(b&0x7F))))
+			head = 1
+		case b>>6 == 2: // 6 bits string length
+			n, head = int(b&0x3F), 1
+		case b>>5 == 6 && i+1 < len(p): // 13 bits int
+			v := int(b&0x1F)<<8 | int(p[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			entries = append(entries, []byte(strconv.Itoa(v)))
+			head = 2
+		case b>>4 == 14 && i+1 < len(p): // 12 bits string length
+			n, head = int(b&0x0F)<<8|int(p[i+1]), 2
+		case b == 0xF0 && i+4 < len(p): // 32 bits string length
+			n, head = int(binary.LittleEndian.Uint32(p[i+1:])), 5
+		case b == 0xF1:
+			size, head = 2, 1
+		case b == 0xF2:
+			size, head = 3, 1
+		case b == 0xF3:
+			size, head = 4, 1
+		case b == 0xF4:
+			size, head = 8, 1
+		default:
+			return nil, errEncoding
+		}
+
+		i += head
+		switch {
+		case size != 0:
+			if i+size > len(p) {
+				return nil, errEncoding
+			}
+			entries = append(entries, []byte(strconv.FormatInt(intLE(p[i:i+size]), 10)))
+			i += size
+		case b>>7 != 0 && b>>5 != 6:
+			if n < 0 || i+n > len(p) {
+				return nil, errEncoding
+			}
+			entries = append(entries, p[i:i+n])
+			i += n
+		}
+		i += backlenSize(i - start)
+	}
+	if i >= len(p) { // no end
+		return nil, errEncoding
+	}
+	return entries, nil
+}
+
+// backlenSize returns the size of the backlen of the listpack entry of size
+func backlenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries decodes the intset:
+//
+//	encoding (4 bytes, 2, 4 or 8) + length (4 bytes) + integers
+func intsetEntries(p []byte) ([][]byte, error) {
+	if len(p) < 8 {
+		return nil, errEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(p))
+	n := int(binary.LittleEndian.Uint32(p[4:]))
+	if size != 2 && size != 4 && size != 8 || n < 0 || len(p) < 8+n*size {
+		return nil, errEncoding
+	}
+
+	entries := [][]byte{}
+	for i := 0; i < n; i++ {
+		entries = append(entries, []byte(strconv.FormatInt(intLE(p[8+i*size:8+(i+1)*size]), 10)))
+	}
+	return entries, nil
+}
+
+// zipmapEntries decodes the zipmap:
+//
+//	zmlen (1 byte) + (len + key + len + free (1 byte) + value + free bytes)... + 0xFF
+//
+// a len is 1 byte, or 0xFE + 4 bytes
+func zipmapEntries(p []byte) ([][]byte, error) {
+	entries := [][]byte{}
+	i := 1
+	for i < len(p) && p[i] != 0xFF {
+		for j := 0; j < 2; j++ {
+			if i >= len(p) {
+				return nil, errEncoding
+			}
+			n := int(p[i])
+			i++
+			if n == 0xFE {
+				if i+4 > len(p) {
+					return nil, errEncoding
+				}
+				n, i = int(binary.LittleEndian.Uint32(p[i:])), i+4
+			}
+			free := 0
+			if j == 1 { // value
+				if i >= len(p) {
+					return nil, errEncoding
+				}
+				free, i = int(p[i]), i+1
+			}
+			if n < 0 || i+n > len(p) {
+				return nil, errEncoding
+			}
+			entries, i = append(entries, p[i:i+n]), i+n+free
+		}
+	}
+	if i >= len(p) { // no end
+		return nil, errEncoding
+	}
+	return entries, nil
+}
+
+// intLE decodes the little endian signed integer of 1 to 8 bytes
+func intLE(p []byte) int64 {
+	var v uint64
+	for i := len(p) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(p[i])
+	}
+	shift := uint(64 - 8*len(p))
+	return int64(v<<shift) >> shift
+}
+
+// lzfDecompress decompresses the LZF compressed string of n bytes
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 { // literal run of ctrl+1 bytes
+			if i+ctrl+1 > len(in) {
+				return nil, errEncoding
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+
+		// back reference of length+2 bytes
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, errEncoding
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errEncoding
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errEncoding
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, errEncoding
+	}
+	return out, nil
+}
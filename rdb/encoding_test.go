@@ -0,0 +1,256 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The fixtures are written by hand after the encodings of Redis: ziplist.c,
+// listpack.c, intset.c, zipmap.c and lzf_d.c.
+
+// ziplist returns the ziplist of the raw entries, with the header and the end
+func ziplist(entries ...string) []byte {
+	body := strings.Join(entries, "")
+	p := make([]byte, 10)
+	binary.LittleEndian.PutUint32(p, uint32(10+len(body)+1))
+	binary.LittleEndian.PutUint32(p[4:], uint32(10+len(body)-len(entries[len(entries)-1])))
+	binary.LittleEndian.PutUint16(p[8:], uint16(len(entries)))
+	return append(append(p, body...), 0xFF)
+}
+
+// listpack returns the listpack of the raw entries, with the header and the end
+func listpack(entries ...string) []byte {
+	body := strings.Join(entries, "")
+	p := make([]byte, 6)
+	binary.LittleEndian.PutUint32(p, uint32(6+len(body)+1))
+	binary.LittleEndian.PutUint16(p[4:], uint16(len(entries)))
+	return append(append(p, body...), 0xFF)
+}
+
+func checkEntries(t *testing.T, name string, entries [][]byte, err error, expect []string) {
+	t.Helper()
+	if err != nil {
+		t.Errorf("%v, Expect: %q, Get: %v", name, expect, err)
+		return
+	}
+	get := []string{}
+	for _, e := range entries {
+		get = append(get, string(e))
+	}
+	if fmt.Sprintf("%q", get) != fmt.Sprintf("%q", expect) {
+		t.Errorf("%v, Expect: %q, Get: %q", name, expect, get)
+	}
+}
+
+func TestZiplist(t *testing.T) {
+	long := strings.Repeat("l", 300)
+	p := ziplist(
+		"\x00\x05hello",            // 6 bits string
+		"\x07\xfd",                 // immediate 12
+		"\x02\xf1",                 // immediate 0
+		"\x02\xc0\x2c\x01",         // int16 300
+		"\x04\xfe\xff",             // int8 -1
+		"\x03\xd0\xa0\x86\x01\x00", // int32 100000
+		"\x06\xf0\xfe\xff\xff",     // int24 -2
+		"\x05\xe0\x00\x00\x00\x00\x00\x01\x00\x00",    // int64 1<<40
+		"\x0a\x41\x2c"+long,                           // 14 bits string
+		"\xfe\x2f\x01\x00\x00\x80\x00\x00\x00\x03abc", // prevlen of 5 bytes, 32 bits string
+		"\x0d\x00", // empty string
+	)
+	entries, err := ziplistEntries(p)
+	checkEntries(t, "ziplistEntries", entries, err, []string{"hello", "12", "0", "300", "-1", "100000", "-2", "1099511627776", long, "abc", ""})
+
+	entries, err = ziplistEntries([]byte{11, 0, 0, 0, 10, 0, 0, 0, 0, 0, 0xFF})
+	checkEntries(t, "ziplistEntries(empty)", entries, err, []string{})
+}
+
+func TestListpack(t *testing.T) {
+	s100, s200 := strings.Repeat("m", 100), strings.Repeat("n", 200)
+	p := listpack(
+		"\x05\x01",                 // 7 bits uint 5
+		"\x7f\x01",                 // 7 bits uint 127
+		"\x83abc\x04",              // 6 bits string
+		"\xdf\xff\x02",             // 13 bits int -1
+		"\xc3\xe8\x02",             // 13 bits int 1000
+		"\xe0\x64"+s100+"\x66",     // 12 bits string
+		"\xe0\xc8"+s200+"\x01\xca", // 12 bits string, backlen of 2 bytes
+		"\xf1\x18\xfc\x03",         // int16 -1000
+		"\xf2\xa0\x86\x01\x04",     // int24 100000
+		"\xf3\x00\x00\x00\x80\x05", // int32 -2147483648
+		"\xf4\xff\xff\xff\xff\xff\xff\xff\x7f\x09", // int64 max
+		"\xf0\x03\x00\x00\x00xyz\x08",              // 32 bits string
+		"\x80\x01",                                 // empty string
+	)
+	entries, err := listpackEntries(p)
+	checkEntries(t, "listpackEntries", entries, err, []string{"5", "127", "abc", "-1", "1000", s100, s200, "-1000", "100000", "-2147483648", "9223372036854775807", "xyz", ""})
+
+	entries, err = listpackEntries([]byte{7, 0, 0, 0, 0, 0, 0xFF})
+	checkEntries(t, "listpackEntries(empty)", entries, err, []string{})
+}
+
+func TestBacklenSize(t *testing.T) {
+	tests := []struct{ size, n int }{{1, 1}, {127, 1}, {128, 2}, {16382, 2}, {16383, 3}, {2097151, 4}, {268435455, 5}}
+	for _, test := range tests {
+		if n := backlenSize(test.size); n != test.n {
+			t.Errorf("backlenSize(%v), Expect: %v, Get: %v", test.size, test.n, n)
+		}
+	}
+}
+
+func TestIntset(t *testing.T) {
+	tests := []struct {
+		p      string
+		expect []string
+	}{
+		{"\x02\x00\x00\x00\x03\x00\x00\x00\xff\xff\x02\x00\x2c\x01", []string{"-1", "2", "300"}},
+		{"\x04\x00\x00\x00\x02\x00\x00\x00\x60\x79\xfe\xff\xa0\x86\x01\x00", []string{"-100000", "100000"}},
+		{"\x08\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00", []string{"1099511627776"}},
+		{"\x02\x00\x00\x00\x00\x00\x00\x00", []string{}},
+	}
+	for i, test := range tests {
+		entries, err := intsetEntries([]byte(test.p))
+		checkEntries(t, fmt.Sprintf("intsetEntries[%v]", i), entries, err, test.expect)
+	}
+}
+
+func TestZipmap(t *testing.T) {
+	long := strings.Repeat("k", 300)
+	p := "\x03" +
+		"\x01a\x01\x001" + // a => 1
+		"\x02bb\x01\x02x\x00\x00" + // bb => x, with 2 free bytes
+		"\xfe\x2c\x01\x00\x00" + long + "\x00\x00" + // long => "", the length of 5 bytes
+		"\xff"
+	entries, err := zipmapEntries([]byte(p))
+	checkEntries(t, "zipmapEntries", entries, err, []string{"a", "1", "bb", "x", long, ""})
+}
+
+func TestLZF(t *testing.T) {
+	tests := []struct {
+		in     string
+		expect string
+	}{
+		{"\x02abc", "abc"},                                     // literal run
+		{"\x02abc\x20\x02", "abcabc"},                          // back reference of 3 bytes
+		{"\x00a\xe0\x00\x00\x01bc", "aaaaaaaaaabc"},            // overlapped back reference of 9 bytes
+		{"\x01ab\xe0\x05\x01", "ab" + strings.Repeat("ab", 7)}, // back reference of 14 bytes
+	}
+	for i, test := range tests {
+		out, err := lzfDecompress([]byte(test.in), len(test.expect))
+		if err != nil || string(out) != test.expect {
+			t.Errorf("lzfDecompress[%v](%q), Expect: %q, Get: %q, %v", i, test.in, test.expect, out, err)
+		}
+	}
+}
+
+func TestIntLE(t *testing.T) {
+	tests := []struct {
+		p      string
+		expect int64
+	}{
+		{"\x7f", 127},
+		{"\x80", -128},
+		{"\xff\x7f", 32767},
+		{"\x00\x80", -32768},
+		{"\xff\xff\x7f", 8388607},
+		{"\x00\x00\x80", -8388608},
+		{"\x00\x00\x00\x00\x00\x00\x00\x80", -9223372036854775808},
+	}
+	for _, test := range tests {
+		if v := intLE([]byte(test.p)); v != test.expect {
+			t.Errorf("intLE(%q), Expect: %v, Get: %v", test.p, test.expect, v)
+		}
+	}
+}
+
+// TestMalformed checks the truncated and corrupted encodings are errors, not
+// panics or entries out of the input.
+func TestMalformed(t *testing.T) {
+	decoders := map[string]func(p []byte) ([][]byte, error){
+		"ziplist":  ziplistEntries,
+		"listpack": listpackEntries,
+		"intset":   intsetEntries,
+		"zipmap":   zipmapEntries,
+	}
+	tests := []struct {
+		decoder string
+		p       []byte
+	}{
+		{"ziplist", []byte{}},
+		{"ziplist", ziplist("\x00\x05hel")[:15]},            // string out of the input
+		{"ziplist", ziplist("\x00\x05hello")[:11]},          // encoding cut
+		{"ziplist", ziplist("\xfe\x01\x00")[:12]},           // prevlen of 5 bytes cut
+		{"ziplist", ziplist("\x00\x41")[:12]},               // 14 bits length cut
+		{"ziplist", ziplist("\x00\x80\x00\x00")},            // 32 bits length cut
+		{"ziplist", ziplist("\x00\x80\xff\xff\xff\xffabc")}, // 32 bits length out of the input
+		{"ziplist", ziplist("\x00\xc0\x01")},                // int16 cut
+		{"ziplist", ziplist("\x00\xe0\x01\x02\x03")},        // int64 cut
+		{"ziplist", ziplist("\x00\xf0")},                    // int24 cut
+		{"ziplist", ziplist("\x00\xc1\x00\x00")},            // unknown encoding
+		{"ziplist", ziplist("\x00\x01a")[:12]},              // no end
+		{"listpack", []byte{}},
+		{"listpack", listpack("\x85ab\x03")},                  // string out of the input
+		{"listpack", listpack("\xf5\x01")},                    // unknown encoding
+		{"listpack", listpack("\xf4\x01\x02")},                // int64 cut
+		{"listpack", listpack("\xf0\x10")},                    // 32 bits length cut
+		{"listpack", listpack("\xf0\xff\xff\xff\x7fabc\x08")}, // 32 bits length out of the input
+		{"listpack", listpack("\xc1")},                        // 13 bits int cut
+		{"listpack", listpack("\xe1")},                        // 12 bits length cut
+		{"listpack", listpack("\x81a\x02")[:9]},               // no end
+		{"intset", []byte("\x02\x00\x00\x00")},
+		{"intset", []byte("\x03\x00\x00\x00\x01\x00\x00\x00\x01\x02\x03")}, // wrong size
+		{"intset", []byte("\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00")},     // integers cut
+		{"intset", []byte("\x08\x00\x00\x00\xff\xff\xff\x7f\x01\x00")},     // length out of the input
+		{"zipmap", []byte("\x01\x01a")},                                    // value missing
+		{"zipmap", []byte("\x01\x01a\x01\x001")},                           // no end
+		{"zipmap", []byte("\x01\x01a\x01")},                                // free missing
+		{"zipmap", []byte("\x01\x05a\x01\x00b\xff")},                       // key out of the input
+		{"zipmap", []byte("\x01\x01a\x05\x00b\xff")},                       // value out of the input
+		{"zipmap", []byte("\x01\xfe\x01\x00")},                             // length of 5 bytes cut
+		{"zipmap", []byte("\x01\xfe\xff\xff\xff\xffa\xff")},                // length of 5 bytes out of the input
+	}
+	for i, test := range tests {
+		var entries [][]byte
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			entries, err = decoders[test.decoder](test.p)
+		}()
+		if err != errEncoding {
+			t.Errorf("%vEntries[%v](%q), Expect: %v, Get: %q, %v", test.decoder, i, test.p, errEncoding, entries, err)
+		}
+	}
+
+	lzf := []struct {
+		in string
+		n  int
+	}{
+		{"\x05abc", 6},         // literal run out of the input
+		{"\x20\x00", 2},        // back reference before the output
+		{"\x02abc\x20\x05", 6}, // back reference out of the output
+		{"\x02abc\xe0", 12},    // length cut
+		{"\x02abc\x20", 6},     // offset cut
+		{"\x02abc", 4},         // wrong length
+		{"\x02abc\x20\x02", 5},
+	}
+	for i, test := range lzf {
+		var out []byte
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			out, err = lzfDecompress([]byte(test.in), test.n)
+		}()
+		if err != errEncoding {
+			t.Errorf("lzfDecompress[%v](%q, %v), Expect: %v, Get: %q, %v", i, test.in, test.n, errEncoding, out, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// LoadBatch is the max number of keys written by Load in one batch
+const LoadBatch = 256
+
+// ErrFmtDuplicateKey is the error of Load if a key in the file exists
+const ErrFmtDuplicateKey = "rdb: duplicate key %q in db %d"
+
+// LoadFile loads the keys of the RDB file of path, see Load
+func LoadFile(path string, replace bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return Load(f, replace)
+}
+
+// Load writes the keys read from the RDB format of r to the dbs, LoadBatch keys
+// per batch, returns the number of keys loaded. The key existing in the db is
+// replaced if replace, otherwise the load fails. The keys expired, and the empty
+// lists, sets, hashes and sorted sets are skipped.
+// The caller must hold the locks of all dbs, the batches written are kept if
+// the load fails.
+func Load(r io.Reader, replace bool) (int, error) {
+	var tx *storage.LevelDB
+	pending, loaded := 0, 0
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		err := tx.Commit()
+		if err == nil {
+			loaded += pending
+		}
+		tx, pending = nil, 0
+		return err
+	}
+
+	now := time.Now()
+	err := NewDecoder(r).Decode(func(e *Entry) error {
+		if e.DB < 0 || e.DB > 15 {
+			return fmt.Errorf("rdb: db index %d is out of range", e.DB)
+		}
+		if e.ExpireAt != nil && !e.ExpireAt.After(now) || e.empty() {
+			return nil
+		}
+		if tx != nil && (tx.Index() != e.DB || pending == LoadBatch) {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+		if tx == nil {
+			tx = storage.Select(e.DB).Begin()
+		}
+
+		pending++
+		existed, err := tx.Delete(e.Key)
+		if err != nil {
+			return err
+		}
+		if existed && !replace {
+			return fmt.Errorf(ErrFmtDuplicateKey, e.Key, e.DB)
+		}
+		return PutEntry(tx, e)
+	})
+	if err != nil {
+		return loaded, err
+	}
+	return loaded, commit()
+}
+
+// PutEntry writes the key of e to db, the key must not exist in db. The storage
+// error of db is returned.
+func PutEntry(db *storage.LevelDB, e *Entry) error {
+	var err error
+	switch e.Type {
+	case resp.String:
+		err = db.PutString(e.Key, e.String)
+	case resp.List:
+		for _, element := range e.List {
+			if _, err = db.PushListTail(e.Key, resp.List, element); err != nil {
+				break
+			}
+		}
+	case resp.Set:
+		set := make(map[string][]byte)
+		for _, member := range e.Members {
+			set[string(member)] = []byte("set")
+		}
+		err = db.PutHash(e.Key, resp.Set, set)
+	case resp.Hash:
+		hash := make(map[string][]byte)
+		for _, field := range e.Fields {
+			hash[string(field.Key)] = field.Value
+		}
+		err = db.PutHash(e.Key, resp.Hash, hash)
+	case resp.SortedSet:
+		for _, element := range e.Elements {
+			if _, err = db.AddSkipField(e.Key, resp.SortedSet, element.Field, element.Score); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil || e.ExpireAt == nil {
+		return err
+	}
+	return db.SetExpireAt(e.Key, e.ExpireAt)
+}
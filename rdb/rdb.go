@@ -0,0 +1,54 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+// Package rdb reads and writes the dbs in the Redis RDB file format.
+// https://github.com/sripathikrishnan/redis-rdb-tools/wiki/Redis-RDB-Dump-File-Format
+//
+// Save and Write write the dbs as a RDB file of Version, Dump serializes a key as
+// the DUMP of Redis. The Decoder reads the RDB files written by Redis up to
+// MaxVersion, with the compact encodings of ziplist, listpack, intset and zipmap,
+// into entries. Load and LoadFile write the entries of a RDB file to the dbs, and
+// Restore decodes a value serialized by Dump or by Redis.
+//
+// A RDB file is:
+//
+//	"REDIS" + 4 digits version
+//	for each db: OpSelectDB + length of db index, then the keys of the db:
+//	    [OpExpireTimeMs + 8 bytes little endian unix milliseconds]
+//	    value type (1 byte) + key (string) + value
+//	OpEOF + CRC64 of all bytes before (8 bytes little endian)
+//
+// The lengths are encoded by the 2 high bits of the first byte: 00 for 6 bits,
+// 01 for 14 bits, 0x80 for 32 bits big endian and 0x81 for 64 bits big endian.
+// A string is its length and bytes.
+package rdb
+
+// Version is the RDB version written by rodis
+const Version = 9
+
+// MaxVersion is the max RDB version of the values read by Restore
+const MaxVersion = 12
+
+// Opcodes
+const (
+	OpAux          byte = 0xFA
+	OpResizeDB     byte = 0xFB
+	OpExpireTimeMs byte = 0xFC
+	OpExpireTime   byte = 0xFD
+	OpSelectDB     byte = 0xFE
+	OpEOF          byte = 0xFF
+)
+
+// TypeZSet2 is the value type of sorted set with binary scores, the other value
+// types written are the same as the types of rodis, see resp/redis.go.
+const TypeZSet2 byte = 5
+
+// encodings of the length
+const (
+	len6Bit  byte = 0x00
+	len14Bit byte = 0x40
+	len32Bit byte = 0x80
+	len64Bit byte = 0x81
+)
@@ -0,0 +1,93 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package rdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rod6/rodis/storage"
+)
+
+// Snapshot returns the snapshot handles of the 16 dbs, the caller must hold the
+// locks of all dbs, so the snapshots are of the same moment.
+func Snapshot() ([]*storage.LevelDB, error) {
+	dbs := []*storage.LevelDB{}
+	for i := 0; i < 16; i++ {
+		db, err := storage.Select(i).Snapshot()
+		if err != nil {
+			Release(dbs)
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// Release releases the snapshot handles
+func Release(dbs []*storage.LevelDB) {
+	for _, db := range dbs {
+		db.Release()
+	}
+}
+
+// Save writes the keys of dbs to the RDB file of path. The file is written to a
+// temp file in the same directory first, and renamed to path when it is synced,
+// so path is either the old file or the complete new file.
+func Save(path string, dbs []*storage.LevelDB) error {
+	f, err := os.Create(filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid())))
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	defer os.Remove(temp) // nothing to remove after renamed
+
+	w := bufio.NewWriter(f)
+	err = Write(w, dbs)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Write writes the keys of dbs in the RDB format to w, the dbs without keys are
+// skipped.
+func Write(w io.Writer, dbs []*storage.LevelDB) error {
+	e := NewEncoder(w)
+	e.WriteHeader()
+	for _, db := range dbs {
+		selected := false
+		err := db.Each(func(key []byte, tipe byte, at *time.Time) error {
+			if !selected {
+				e.WriteSelectDB(db.Index())
+				selected = true
+			}
+			if at != nil {
+				e.WriteExpireAt(*at)
+			}
+			e.WriteKey(db, key, tipe)
+			return e.Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	e.WriteFooter()
+	return e.Err()
+}
@@ -17,155 +17,297 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
 )
 
-func Parse(reader *bufio.Reader) (RESPType, Value, error) {
-	prefix, err := reader.ReadByte()
-	if err != nil {
-		return WrongType, nil, err
-	}
-
-	switch prefix {
-	case '+': // Simple String
-		return parseSimpleString(reader)
-	case '-': // Error
-		return parseError(reader)
-	case ':': // Integer
-		return parseInteger(reader)
-	case '$': // Bulk String
-		return parseBulkString(reader)
-	case '*': // Array
-		return parseArray(reader)
-	default: // Inline Command
-		if err := reader.UnreadByte(); err != nil {
-			return WrongType, nil, err
-		}
-		return parseInlineCommand(reader)
-	}
+// Default limits of the requests, as Redis
+const (
+	DefaultMaxBulkLen      = 512 << 20   // proto-max-bulk-len, bytes of a bulk string
+	DefaultMaxMultiBulkLen = 1024 * 1024 // arguments of a request
+)
+
+const (
+	maxInlineLen = 64 << 10 // bytes of an inline request, or the line of a header
+	bulkChunk    = 64 << 10 // a larger bulk string is read as it arrives, not allocated by its length
+)
+
+// ProtocolError is the error of a malformed request. The rest of the input can not
+// be parsed after it, so the connection is closed once it is replied.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
 }
 
-func readLine(reader *bufio.Reader) ([]byte, error) {
-	line := []byte{}
-	more := true
+// Protocol errors, as Redis
+const (
+	errTooBigInline     = ProtocolError("too big inline request")
+	errTooBigMultiBulk  = ProtocolError("too big mbulk count string")
+	errInvalidMultiBulk = ProtocolError("invalid multibulk length")
+	errTooBigBulk       = ProtocolError("too big bulk count string")
+	errInvalidBulk      = ProtocolError("invalid bulk length")
+	errBulkEnd          = ProtocolError("expected '\\r\\n' after bulk string")
+	errUnbalancedQuotes = ProtocolError("unbalanced quotes in request")
+)
+
+// Parser parses the requests of a client, and validates them by the limits
+type Parser struct {
+	reader          *bufio.Reader
+	maxBulkLen      int64
+	maxMultiBulkLen int64
+}
 
-	for more {
-		buf, isPrefix, err := reader.ReadLine()
+// NewParser returns the parser of the requests read from reader, with the max bytes
+// of a bulk string and the max arguments of a request.
+func NewParser(reader *bufio.Reader, maxBulkLen, maxMultiBulkLen int64) *Parser {
+	return &Parser{reader: reader, maxBulkLen: maxBulkLen, maxMultiBulkLen: maxMultiBulkLen}
+}
+
+// Parse reads the next request: an array of bulk strings, or an inline command of
+// arguments separated by spaces. The empty requests are skipped as Redis does. A
+// ProtocolError is returned for a malformed request.
+func (p *Parser) Parse() (Array, error) {
+	for {
+		prefix, err := p.reader.Peek(1)
 		if err != nil {
 			return nil, err
 		}
 
-		line = append(line, buf...)
-		more = isPrefix
+		var arr Array
+		if prefix[0] == '*' {
+			p.reader.Discard(1)
+			arr, err = p.parseMultiBulk()
+		} else {
+			arr, err = p.parseInline()
+		}
+		if err != nil || len(arr) > 0 {
+			return arr, err
+		}
 	}
-
-	return line, nil
 }
 
-func readInt(reader *bufio.Reader) (int64, error) {
-	line, err := readLine(reader)
+// parseMultiBulk parses an array of bulk strings after the '*'. The array is not
+// allocated by the length of the client, but grows as the bulk strings are read.
+func (p *Parser) parseMultiBulk() (Array, error) {
+	line, err := p.readLine(errTooBigMultiBulk)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	sign := int64(1)
-	if line[0] == '-' {
-		sign = -1
-		line = line[1:]
+	n, ok := parseLength(line)
+	if !ok || n > p.maxMultiBulkLen {
+		return nil, errInvalidMultiBulk
 	}
-
-	i := int64(0)
-	for _, c := range line {
-		i = i*10 + int64(c-'0')
+	if n <= 0 {
+		return Array{}, nil
 	}
 
-	return i * sign, nil
+	size := n
+	if size > 1024 {
+		size = 1024
+	}
+	arr := make(Array, 0, size)
+	for int64(len(arr)) < n {
+		b, err := p.parseBulkString()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, b)
+	}
+	return arr, nil
 }
 
-func parseSimpleString(reader *bufio.Reader) (RESPType, SimpleString, error) {
-	line, err := readLine(reader)
+// parseBulkString parses a bulk string of the array
+func (p *Parser) parseBulkString() (BulkString, error) {
+	prefix, err := p.reader.ReadByte()
 	if err != nil {
-		return SimpleStringType, SimpleString(""), err
+		return nil, err
+	}
+	if prefix != '$' {
+		return nil, ProtocolError(fmt.Sprintf("expected '$', got '%c'", prefix))
 	}
 
-	return SimpleStringType, SimpleString(line), nil
-}
-
-func parseInteger(reader *bufio.Reader) (RESPType, Integer, error) {
-	i, err := readInt(reader)
+	line, err := p.readLine(errTooBigBulk)
 	if err != nil {
-		return IntegerType, Integer(0), err
+		return nil, err
+	}
+	n, ok := parseLength(line)
+	if !ok || n < 0 || n > p.maxBulkLen {
+		return nil, errInvalidBulk
 	}
 
-	return IntegerType, Integer(i), nil
-}
-
-func parseError(reader *bufio.Reader) (RESPType, Error, error) {
-	line, err := readLine(reader)
+	var b []byte
+	if n+2 <= bulkChunk {
+		b = make([]byte, n+2)
+		_, err = io.ReadFull(p.reader, b)
+	} else {
+		var buf bytes.Buffer
+		buf.Grow(bulkChunk)
+		var read int64
+		read, err = buf.ReadFrom(io.LimitReader(p.reader, n+2))
+		if err == nil && read < n+2 {
+			err = io.ErrUnexpectedEOF
+		}
+		b = buf.Bytes()
+	}
 	if err != nil {
-		return ErrorType, Error(""), err
+		return nil, err
 	}
-
-	return ErrorType, Error(line), nil
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, errBulkEnd
+	}
+	return BulkString(b[:n]), nil
 }
 
-func parseBulkString(reader *bufio.Reader) (RESPType, BulkString, error) {
-	i, err := readInt(reader)
+// parseInline parses an inline command, ended by '\n' or "\r\n"
+func (p *Parser) parseInline() (Array, error) {
+	line, err := p.readLine(errTooBigInline)
 	if err != nil {
-		return BulkStringType, BulkString(nil), err
+		return nil, err
 	}
-
-	if i == -1 {
-		return BulkStringType, BulkString(nil), nil
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
 	}
+	return splitArgs(line)
+}
 
-	b, err := reader.Peek(int(i))
-	if err != nil {
-		return BulkStringType, BulkString(nil), err
+// readLine reads a line without the '\n', tooBig is returned if it is longer than
+// maxInlineLen.
+func (p *Parser) readLine(tooBig ProtocolError) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := p.reader.ReadSlice('\n')
+		if len(line)+len(b) > maxInlineLen+1 {
+			return nil, tooBig
+		}
+		switch err {
+		case nil:
+			if line == nil {
+				return b[:len(b)-1], nil // b is valid until the next read
+			}
+			return append(line, b[:len(b)-1]...), nil
+		case bufio.ErrBufferFull:
+			line = append(line, b...)
+		default:
+			return nil, err
+		}
 	}
-	reader.Discard(int(i) + 2) // +2 for \r\n
-
-	return BulkStringType, BulkString(b), nil
 }
 
-func parseArray(reader *bufio.Reader) (RESPType, Array, error) {
-	i, err := readInt(reader)
-	if err != nil {
-		return ArrayType, Array(nil), err
+// parseLength parses the length of a header line ended by '\r'. Only the decimal
+// digits, with an optional '-' and no leading zeros, are accepted as Redis does.
+func parseLength(line []byte) (int64, bool) {
+	if len(line) < 2 || line[len(line)-1] != '\r' {
+		return 0, false
 	}
-
-	if i == -1 {
-		return ArrayType, Array(nil), nil
+	digits := line[:len(line)-1]
+	if digits[0] == '-' {
+		digits = digits[1:]
 	}
-
-	arr := make(Array, i)
-	for i := range arr {
-		_, v, err := Parse(reader)
-		if err != nil {
-			return ArrayType, Array(nil), err
+	if len(digits) == 0 || digits[0] == '0' && len(digits) > 1 {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
 		}
-		arr[i] = v
 	}
-	return ArrayType, arr, nil
+	n, err := strconv.ParseInt(string(line[:len(line)-1]), 10, 64)
+	return n, err == nil
 }
 
-func parseInlineCommand(reader *bufio.Reader) (RESPType, Array, error) {
-	line, err := readLine(reader)
-	if err != nil {
-		return ArrayType, Array(nil), err
-	}
+// splitArgs splits an inline command as Redis. The arguments are separated by the
+// spaces, and may be quoted: a double quoted argument has the escapes \n, \r, \t,
+// \b, \a and \xHH, and a single quoted one has \' only. A closing quote must be
+// followed by a space or the end of line.
+func splitArgs(line []byte) (Array, error) {
+	arr := Array{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return arr, nil
+		}
+
+		arg := BulkString{}
+		inDouble, inSingle := false, false
+		for done := false; !done; i++ {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
 
-	var arr Array
-	start := 0
-	for i := start; i < len(line); i++ {
-		switch line[i] {
-		case ' ':
-			if i != start {
-				arr = append(arr, append(BulkString(nil), line[start:i]...))
-				start = i
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					h, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					arg = append(arg, byte(h))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					arg = append(arg, unescape(line[i]))
+				} else if c == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case isSpace(c):
+				done = true
+			case c == '"':
+				inDouble = true
+			case c == '\'':
+				inSingle = true
+			default:
+				arg = append(arg, c)
 			}
-			start++
 		}
+		arr = append(arr, arg)
 	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
 
-	return ArrayType, arr, nil
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// unescape returns the byte of the escape \c in a double quoted argument
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return c
 }
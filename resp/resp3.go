@@ -0,0 +1,188 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The RESP3 types are replied to the clients which opted in by HELLO 3, they are
+// converted to the RESP2 types by ToRESP2 for the other clients.
+
+// RESP3 Map, the keys and the values are alternated as in the RESP2 reply
+type Map []Value
+
+func (m Map) WriteTo(w *bytes.Buffer) error {
+	return writeAggregate(w, '%', len(m)/2, m)
+}
+
+// RESP3 Set, named RESPSet as Set is the value type of the set
+type RESPSet []Value
+
+func (s RESPSet) WriteTo(w *bytes.Buffer) error {
+	return writeAggregate(w, '~', len(s), s)
+}
+
+// RESP3 Push, the out of band data as the published messages
+type Push []Value
+
+func (p Push) WriteTo(w *bytes.Buffer) error {
+	return writeAggregate(w, '>', len(p), p)
+}
+
+// writeAggregate writes the header of the aggregate type with n entries, and the values
+func writeAggregate(w *bytes.Buffer, prefix byte, n int, values []Value) error {
+	if _, err := fmt.Fprintf(w, "%c%d\r\n", prefix, n); err != nil {
+		return err
+	}
+	for _, v := range values {
+		if err := v.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RESP3 Double
+type Double float64
+
+func (d Double) WriteTo(w *bytes.Buffer) error {
+	_, err := fmt.Fprintf(w, ",%s\r\n", d)
+	return err
+}
+
+// String formats the double as Redis: inf, -inf, nan, or the shortest decimal
+func (d Double) String() string {
+	switch f := float64(d); {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	default:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+}
+
+// RESP3 Boolean
+type Boolean bool
+
+func (b Boolean) WriteTo(w *bytes.Buffer) error {
+	if b {
+		w.WriteString("#t\r\n")
+	} else {
+		w.WriteString("#f\r\n")
+	}
+	return nil
+}
+
+// RESP3 Null, which replaces the nil bulk string and the nil array of RESP2
+type Null struct{}
+
+func (Null) WriteTo(w *bytes.Buffer) error {
+	w.WriteString("_\r\n")
+	return nil
+}
+
+// RESP3 BigNumber, the decimal digits of an integer out of the range of Integer
+type BigNumber string
+
+func (n BigNumber) WriteTo(w *bytes.Buffer) error {
+	_, err := fmt.Fprintf(w, "(%s\r\n", n)
+	return err
+}
+
+// RESP3 Verbatim string, the text of the format: "txt" for the plain text, or "mkd"
+// for the markdown
+type Verbatim struct {
+	Format string
+	Text   []byte
+}
+
+func (v Verbatim) WriteTo(w *bytes.Buffer) error {
+	if _, err := fmt.Fprintf(w, "=%d\r\n%s:", len(v.Text)+4, v.Format); err != nil {
+		return err
+	}
+	w.Write(v.Text)
+	w.WriteString("\r\n")
+	return nil
+}
+
+// ToRESP2 converts the RESP3 types in v to the RESP2 types as Redis does: the map
+// is flattened to an array of keys and values, the set and the push to arrays, the
+// double, the big number and the verbatim string to bulk strings, the boolean to
+// integer 1 or 0, and the null to the nil bulk string.
+func ToRESP2(v Value) Value {
+	switch t := v.(type) {
+	case Array:
+		if t == nil {
+			return t
+		}
+		return toRESP2Array(t)
+	case Map:
+		return toRESP2Array(t)
+	case RESPSet:
+		return toRESP2Array(t)
+	case Push:
+		return toRESP2Array(t)
+	case Double:
+		return BulkString(t.String())
+	case Boolean:
+		if t {
+			return OneInteger
+		}
+		return ZeroInteger
+	case Null:
+		return NilBulkString
+	case BigNumber:
+		return BulkString(t)
+	case Verbatim:
+		return BulkString(t.Text)
+	}
+	return v
+}
+
+func toRESP2Array(values []Value) Array {
+	a := make(Array, len(values))
+	for i, v := range values {
+		a[i] = ToRESP2(v)
+	}
+	return a
+}
+
+// ToRESP3 converts the nil bulk strings and the nil arrays in v to Null
+func ToRESP3(v Value) Value {
+	switch t := v.(type) {
+	case BulkString:
+		if t == nil {
+			return Null{}
+		}
+	case Array:
+		if t == nil {
+			return Null{}
+		}
+		return Array(toRESP3Values(t))
+	case Map:
+		return Map(toRESP3Values(t))
+	case RESPSet:
+		return RESPSet(toRESP3Values(t))
+	case Push:
+		return Push(toRESP3Values(t))
+	}
+	return v
+}
+
+func toRESP3Values(values []Value) []Value {
+	a := make([]Value, len(values))
+	for i, v := range values {
+		a[i] = ToRESP3(v)
+	}
+	return a
+}
@@ -0,0 +1,189 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// parseAll parses the requests of input until an error, by the limits of 16 bytes
+// of a bulk string and 4 arguments. If split, input is read one byte at a time by
+// a buffer of 16 bytes.
+func parseAll(input string, split bool) ([][]string, error) {
+	var reader *bufio.Reader
+	if split {
+		reader = bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(input)), 16)
+	} else {
+		reader = bufio.NewReader(strings.NewReader(input))
+	}
+	p := NewParser(reader, 16, 4)
+	requests := [][]string{}
+	for {
+		arr, err := p.Parse()
+		if err != nil {
+			return requests, err
+		}
+		request := []string{}
+		for _, v := range arr {
+			request = append(request, string(v.(BulkString)))
+		}
+		requests = append(requests, request)
+	}
+}
+
+func TestParse(t *testing.T) {
+	long := strings.Repeat("1", maxInlineLen+1)
+	tests := []struct {
+		input    string
+		requests [][]string
+		err      error
+	}{
+		// requests
+		{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", [][]string{{"GET", "a"}}, io.EOF},
+		{"*1\r\n$0\r\n\r\n", [][]string{{""}}, io.EOF},
+		{"*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\n\r\n\r\n", [][]string{{"PING"}, {"ECHO", "\r\n"}}, io.EOF},
+		{"PING\r\nECHO a\n", [][]string{{"PING"}, {"ECHO", "a"}}, io.EOF},
+		{"SET \"a b\" 'c'\r\n", [][]string{{"SET", "a b", "c"}}, io.EOF},
+		{"\r\n\n  \r\n*0\r\n*-1\r\nPING\r\n", [][]string{{"PING"}}, io.EOF},
+
+		// malformed lengths
+		{"*x\r\n", [][]string{}, errInvalidMultiBulk},
+		{"*01\r\n", [][]string{}, errInvalidMultiBulk},
+		{"*1\n", [][]string{}, errInvalidMultiBulk},
+		{"*\r\n", [][]string{}, errInvalidMultiBulk},
+		{"*1\r\n$x\r\n", [][]string{}, errInvalidBulk},
+		{"*1\r\n$-1\r\n", [][]string{}, errInvalidBulk},
+		{"*1\r\n$1 \r\na\r\n", [][]string{}, errInvalidBulk},
+		{"*1\r\n+OK\r\n", [][]string{}, ProtocolError("expected '$', got '+'")},
+		{"*1\r\n$3\r\nGETX\r\n", [][]string{}, errBulkEnd},
+
+		// limits
+		{"*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n", [][]string{{"a", "b", "c", "d"}}, io.EOF},
+		{"*5\r\n", [][]string{}, errInvalidMultiBulk},
+		{"*1\r\n$16\r\n0123456789abcdef\r\n", [][]string{{"0123456789abcdef"}}, io.EOF},
+		{"*1\r\n$17\r\n0123456789abcdefg\r\n", [][]string{}, errInvalidBulk},
+		{"*" + long + "\r\n", [][]string{}, errTooBigMultiBulk},
+		{"*1\r\n$" + long + "\r\n", [][]string{}, errTooBigBulk},
+		{long + "\r\n", [][]string{}, errTooBigInline},
+
+		// unbalanced quotes
+		{"SET \"a\r\n", [][]string{}, errUnbalancedQuotes},
+		{"SET 'a\r\n", [][]string{}, errUnbalancedQuotes},
+		{"SET \"a\"b\r\n", [][]string{}, errUnbalancedQuotes},
+		{"PING\r\nSET 'a'b\r\n", [][]string{{"PING"}}, errUnbalancedQuotes},
+
+		// truncated
+		{"*2\r\n$3\r\nGET\r\n", [][]string{}, io.EOF},
+		{"*1\r\n$3\r\nGE", [][]string{}, io.ErrUnexpectedEOF},
+		{"*1\r\n$3", [][]string{}, io.EOF},
+		{"PING", [][]string{}, io.EOF},
+	}
+	for i, test := range tests {
+		for _, split := range []bool{false, true} {
+			requests, err := parseAll(test.input, split)
+			if err != test.err || !reflect.DeepEqual(requests, test.requests) {
+				t.Errorf("Parse[%v](%q) split %v, Expect: %q, %v, Get: %q, %v", i, test.input, split, test.requests, test.err, requests, err)
+			}
+		}
+	}
+}
+
+// TestParseLargeBulk checks a bulk string larger than bulkChunk is read as it
+// arrives, by the default limits.
+func TestParseLargeBulk(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), bulkChunk/10+10)
+	input := "*2\r\n$3\r\nSET\r\n$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n"
+
+	reader := bufio.NewReader(iotest.HalfReader(strings.NewReader(input)))
+	arr, err := NewParser(reader, DefaultMaxBulkLen, DefaultMaxMultiBulkLen).Parse()
+	if err != nil || len(arr) != 2 || !bytes.Equal(arr[1].(BulkString), value) {
+		t.Errorf("Parse of large bulk, Expect: %v bytes, Get: %v, %v", len(value), len(arr), err)
+	}
+
+	for _, input := range []string{input[:len(input)-10], input[:len(input)-2] + "\n\n"} {
+		reader := bufio.NewReader(strings.NewReader(input))
+		if _, err := NewParser(reader, DefaultMaxBulkLen, DefaultMaxMultiBulkLen).Parse(); err != io.ErrUnexpectedEOF && err != errBulkEnd {
+			t.Errorf("Parse of broken large bulk, Expect: %v or %v, Get: %v", io.ErrUnexpectedEOF, errBulkEnd, err)
+		}
+	}
+}
+
+func TestParseLength(t *testing.T) {
+	tests := []struct {
+		line string
+		n    int64
+		ok   bool
+	}{
+		{"3\r", 3, true},
+		{"0\r", 0, true},
+		{"-1\r", -1, true},
+		{"1024\r", 1024, true},
+		{"9223372036854775807\r", 9223372036854775807, true},
+		{"9223372036854775808\r", 0, false},
+		{"3", 0, false},
+		{"\r", 0, false},
+		{"-\r", 0, false},
+		{"01\r", 0, false},
+		{"+3\r", 0, false},
+		{" 3\r", 0, false},
+		{"3x\r", 0, false},
+		{"3\r\r", 0, false},
+	}
+	for i, test := range tests {
+		if n, ok := parseLength([]byte(test.line)); ok != test.ok || ok && n != test.n {
+			t.Errorf("parseLength[%v](%q), Expect: %v, %v, Get: %v, %v", i, test.line, test.n, test.ok, n, ok)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  error
+	}{
+		{"", []string{}, nil},
+		{" \t ", []string{}, nil},
+		{"  a  b\t c ", []string{"a", "b", "c"}, nil},
+		{`"a b" c`, []string{"a b", "c"}, nil},
+		{`""`, []string{""}, nil},
+		{`"\x41\x4a\n\"\\"`, []string{"AJ\n\"\\"}, nil},
+		{`"\x4g"`, []string{"x4g"}, nil},
+		{`'a\'b'`, []string{"a'b"}, nil},
+		{`'a\nb'`, []string{`a\nb`}, nil},
+		{`a"b c"`, []string{"ab c"}, nil},
+		{`"a`, nil, errUnbalancedQuotes},
+		{`'a`, nil, errUnbalancedQuotes},
+		{`"a"b`, nil, errUnbalancedQuotes},
+		{`'a'b`, nil, errUnbalancedQuotes},
+		{`"a\"`, nil, errUnbalancedQuotes},
+	}
+	for i, test := range tests {
+		arr, err := splitArgs([]byte(test.line))
+		var args []string
+		if arr != nil {
+			args = []string{}
+			for _, v := range arr {
+				args = append(args, string(v.(BulkString)))
+			}
+		}
+		if err != test.err || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs[%v](%q), Expect: %q, %v, Get: %q, %v", i, test.line, test.args, test.err, args, err)
+		}
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	var err error = errInvalidBulk
+	if err.Error() != "Protocol error: invalid bulk length" {
+		t.Errorf("ProtocolError.Error, Expect: Protocol error: invalid bulk length, Get: %v", err.Error())
+	}
+	if _, ok := err.(ProtocolError); !ok {
+		t.Errorf("ProtocolError, Expect: a ProtocolError, Get: %T", err)
+	}
+}
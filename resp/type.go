@@ -10,18 +10,6 @@ import (
 	"fmt"
 )
 
-type RESPType int
-
-// RESP types
-const (
-	WrongType = iota // wrong input
-	SimpleStringType
-	ErrorType
-	IntegerType
-	BulkStringType
-	ArrayType
-)
-
 // Value interface: WriteTo
 type Value interface {
 	WriteTo(*bytes.Buffer) error
@@ -40,9 +28,10 @@ func (s SimpleString) String() string {
 	return string(s)
 }
 
-// OkSimpleString & PongSimpleString
+// OkSimpleString & PongSimpleString & QueuedSimpleString
 const OkSimpleString = SimpleString("OK")
 const PongSimpleString = SimpleString("PONG")
+const QueuedSimpleString = SimpleString("QUEUED")
 
 // RESP Integer
 type Integer int64
@@ -111,8 +100,18 @@ var (
 // RESP Array
 type Array []Value
 
-// EmptyArray
-var EmptyArray = Array{}
+// EmptyArray & NilArray
+var (
+	EmptyArray = Array{}
+	NilArray   = Array(nil)
+)
+
+// WriteArrayHeader writes the header of an array with n elements, the elements
+// should be written to the buffer by the caller.
+func WriteArrayHeader(w *bytes.Buffer, n int) error {
+	_, err := fmt.Fprintf(w, "*%d\r\n", n)
+	return err
+}
 
 // WriteTo buffer
 func (a Array) WriteTo(w *bytes.Buffer) error {
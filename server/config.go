@@ -6,8 +6,12 @@
 package server
 
 import (
+	"net"
+
 	"github.com/BurntSushi/toml"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	"github.com/rod6/rodis/resp"
 )
 
 type ServerConfig struct {
@@ -20,15 +24,59 @@ type ServerConfig struct {
 
 	LogLevel string
 
+	ProtoMaxBulkLen      int64 // max bytes of a bulk string of the requests, 512MB by default
+	ProtoMaxMultiBulkLen int64 // max arguments of a request, 1048576 by default
+
 	LevelDBPath string
 	LevelDB     *opt.Options
+
+	CacheSize int // number of decoded records cached per db, 0 disables the cache
+
+	Dir        string // directory of the RDB file, the working directory by default
+	DBFilename string // name of the RDB file, dump.rdb by default
+
+	AppendOnly     bool   // log the write commands to the AOF
+	AppendFilename string // name of the AOF in Dir, appendonly.aof by default
+	AppendFsync    string // fsync policy of the AOF: always, everysec or no, everysec by default
+
+	ReplicaOf       string // "host port" of the master replicated at start
+	MasterAuth      string // password of the master
+	ReplicaReadOnly bool   // the replica rejects the write commands, true by default
+	ReplBacklogSize int    // bytes of the replication backlog, 1MB by default
+
+	ClusterEnabled  bool     // serve the hash slots of the cluster, only db 0 is used
+	ClusterAnnounce string   // "host:port" of this node in ClusterNodes, 127.0.0.1 and the port of Listen by default
+	ClusterNodes    []string // "host:port slot|first-last ..." of each node, the slots served at start
 }
 
 var Config ServerConfig
 
 func LoadConfig(path string) error {
+	Config.ReplicaReadOnly = true // kept if not in the file
 	if _, err := toml.DecodeFile(path, &Config); err != nil {
 		return err
 	}
+	if Config.ProtoMaxBulkLen <= 0 {
+		Config.ProtoMaxBulkLen = resp.DefaultMaxBulkLen
+	}
+	if Config.ProtoMaxMultiBulkLen <= 0 {
+		Config.ProtoMaxMultiBulkLen = resp.DefaultMaxMultiBulkLen
+	}
+	if Config.DBFilename == "" {
+		Config.DBFilename = "dump.rdb"
+	}
+	if Config.AppendFilename == "" {
+		Config.AppendFilename = "appendonly.aof"
+	}
+	if Config.AppendFsync == "" {
+		Config.AppendFsync = "everysec"
+	}
+	if Config.ReplBacklogSize <= 0 {
+		Config.ReplBacklogSize = 1 << 20
+	}
+	if Config.ClusterAnnounce == "" {
+		_, port, _ := net.SplitHostPort(Config.Listen)
+		Config.ClusterAnnounce = net.JoinHostPort("127.0.0.1", port)
+	}
 	return nil
 }
@@ -10,7 +10,10 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/libgo/logx"
 	"github.com/pborman/uuid"
@@ -25,20 +28,40 @@ type rodisConn struct {
 	db     *storage.LevelDB
 	conn   net.Conn
 	reader *bufio.Reader
+	parser *resp.Parser
 	server *rodisServer
 	buffer bytes.Buffer
 	authed bool
 	extras *command.Extras
+
+	wmu      sync.Mutex          // serializes the writes of replies and pushed messages
+	pushes   chan resp.Push      // messages to push to the subscriber
+	done     chan struct{}       // closed when the connection is closed
+	once     sync.Once           // close the connection only once
+	channels map[string]struct{} // subscribed channels, guarded by the hub
+	patterns map[string]struct{} // subscribed patterns, guarded by the hub
+	replPort int                 // listening port of the replica of the connection
 }
 
+// pushQueueSize is the max number of pending messages of a subscriber, the
+// subscriber is disconnected if it can not keep up.
+const pushQueueSize = 1024
+
 func newConnection(conn net.Conn, rs *rodisServer) {
 	uuid := uuid.New()
+	reader := bufio.NewReader(conn)
 	rc := &rodisConn{
 		uuid:   uuid,
 		db:     storage.Select(0),
 		conn:   conn,
-		reader: bufio.NewReader(conn),
+		reader: reader,
+		parser: resp.NewParser(reader, rs.cfg.ProtoMaxBulkLen, rs.cfg.ProtoMaxMultiBulkLen),
 		server: rs,
+
+		pushes:   make(chan resp.Push, pushQueueSize),
+		done:     make(chan struct{}),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
 	}
 
 	if rs.cfg.RequirePass == "" {
@@ -46,10 +69,16 @@ func newConnection(conn net.Conn, rs *rodisServer) {
 	}
 
 	rc.extras = &command.Extras{
-		DB:       rc.db,
-		Buffer:   &rc.buffer,
-		Authed:   rc.authed,
-		Password: rs.cfg.RequirePass,
+		DB:          rc.db,
+		Buffer:      &rc.buffer,
+		Authed:      rc.authed,
+		Password:    rs.cfg.RequirePass,
+		PubSub:      rc,
+		Replication: rc,
+		DumpFile:    filepath.Join(rs.cfg.Dir, rs.cfg.DBFilename),
+		AOF:         rs.aof,
+		Cluster:     rs.cluster,
+		Blocking:    rc.blocking,
 	}
 
 	rc.server.mu.Lock()
@@ -58,12 +87,13 @@ func newConnection(conn net.Conn, rs *rodisServer) {
 
 	logx.Debugf("New connection: %v", uuid)
 
+	go rc.pushLoop()
 	go rc.handle()
 }
 
 func (rc *rodisConn) handle() {
 	for {
-		respType, respValue, err := resp.Parse(rc.reader)
+		cmd, err := rc.parser.Parse()
 		if err != nil {
 			select {
 			case <-rc.server.quit: // Server is quit, rc.close() is called.
@@ -72,37 +102,47 @@ func (rc *rodisConn) handle() {
 				break
 			}
 
-			if err == io.EOF { // Client close the connection
+			if pe, ok := err.(resp.ProtocolError); ok { // The rest of input can not be parsed
+				logx.Debugf("Connection %v protocol error: %v", rc.uuid, pe)
+				rc.wmu.Lock()
+				rc.conn.Write([]byte("-ERR " + pe.Error() + "\r\n"))
+				rc.wmu.Unlock()
+				rc.close()
+				return
+			} else if err == io.EOF || err == io.ErrUnexpectedEOF { // Client close the connection
 				logx.Debugf("Client close connection %v.", rc.uuid)
 				rc.close()
 				return
+			} else if ne, ok := err.(net.Error); ok && !ne.Temporary() { // Connection is broken or closed
+				logx.Debugf("Connection %v is broken: %v", rc.uuid, err)
+				rc.close()
+				return
 			} else {
 				logx.Errorf("Connection %v error: %v", rc.uuid, err)
 				continue // Other error, should continue the connection
 			}
 		}
 
-		rc.response(respType, respValue)
+		rc.response(cmd)
 	}
 }
 
-func (rc *rodisConn) response(respType resp.RESPType, respValue resp.Value) {
+func (rc *rodisConn) response(cmd resp.Array) {
+	// hold the write lock while handling, so the messages published after a
+	// subscription are pushed after the reply of the subscription.
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+
 	defer func() {
 		if err := recover(); err != nil {
 			stack := make([]byte, 2048)
 			stack = stack[:runtime.Stack(stack, false)]
-			logx.Errorf("Panic in handling connection %v, command is %v, err is %s\n%s", rc.uuid, respValue, err, stack)
+			logx.Errorf("Panic in handling connection %v, command is %v, err is %s\n%s", rc.uuid, cmd, err, stack)
 			rc.conn.Write([]byte("-ERR server unknown error\r\n"))
 		}
 	}()
 
-	if respType != resp.ArrayType { // All command from client should be RESPArrayType
-		logx.Errorf("Connection %v get a WRONG format command from client.", rc.uuid)
-		rc.conn.Write([]byte("-ERR wrong input format\r\n"))
-		return
-	}
-
-	err := command.Handle(respValue.(resp.Array), rc.extras)
+	err := command.Handle(cmd, rc.extras)
 	if err != nil {
 		logx.Errorf("Connection %v get a server error: %v", rc.uuid, err)
 		rc.conn.Write([]byte("-ERR server unknown error\r\n"))
@@ -112,7 +152,71 @@ func (rc *rodisConn) response(respType resp.RESPType, respValue resp.Value) {
 	rc.conn.Write(rc.buffer.Bytes())
 }
 
+// blocking watches the connection while a command is blocked, the returned channel
+// is closed if the client disconnects. The watching stops when the client sends
+// more data, or stop is called, which must be called before reading the next command.
+func (rc *rodisConn) blocking() (<-chan struct{}, func()) {
+	disconnected := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		_, err := rc.reader.Peek(1)
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			return // client is alive, or stopped
+		}
+		close(disconnected)
+	}()
+
+	return disconnected, func() {
+		rc.conn.SetReadDeadline(time.Now()) // interrupt the peek
+		<-exited
+		rc.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// push queues the message to the subscriber, it never blocks the publisher.
+func (rc *rodisConn) push(message resp.Push) {
+	select {
+	case rc.pushes <- message:
+	default:
+		logx.Warnf("Connection %v can not keep up with the published messages, close it.", rc.uuid)
+		rc.conn.Close()
+	}
+}
+
+// pushLoop writes the pushed messages to the subscriber until the connection is
+// closed. The messages are arrays in RESP2, the protocol is changed by HELLO with
+// the write lock held.
+func (rc *rodisConn) pushLoop() {
+	var buffer bytes.Buffer
+	for {
+		select {
+		case <-rc.done:
+			return
+		case message := <-rc.pushes:
+			rc.wmu.Lock()
+			buffer.Reset()
+			if rc.extras.Protocol == 3 {
+				message.WriteTo(&buffer)
+			} else {
+				resp.ToRESP2(message).WriteTo(&buffer)
+			}
+			rc.conn.Write(buffer.Bytes())
+			rc.wmu.Unlock()
+		}
+	}
+}
+
 func (rc *rodisConn) close() {
+	rc.once.Do(rc.doClose)
+}
+
+func (rc *rodisConn) doClose() {
+	close(rc.done)
+	rc.unsubscribeAll()
+	rc.server.repl.detach(rc)
+	rc.extras.Release()
+
 	err := rc.conn.Close()
 	if err != nil {
 		logx.Debugf("Connection %v close error: %v", rc.uuid, err)
@@ -0,0 +1,198 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package server
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/rod6/rodis/glob"
+	"github.com/rod6/rodis/resp"
+)
+
+// pubsubHub keeps the subscriptions of all connections and delivers the published
+// messages to the subscribers.
+type pubsubHub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*rodisConn]struct{} // channel -> subscribers
+	patterns map[string]map[*rodisConn]struct{} // pattern -> subscribers
+}
+
+func newPubsubHub() *pubsubHub {
+	return &pubsubHub{
+		channels: make(map[string]map[*rodisConn]struct{}),
+		patterns: make(map[string]map[*rodisConn]struct{}),
+	}
+}
+
+// subscribe adds rc to subscribers of name, subs is channels or patterns of the hub
+func (h *pubsubHub) subscribe(subs map[string]map[*rodisConn]struct{}, rc *rodisConn, name []byte) {
+	conns, ok := subs[string(name)]
+	if !ok {
+		conns = make(map[*rodisConn]struct{})
+		subs[string(name)] = conns
+	}
+	conns[rc] = struct{}{}
+}
+
+// unsubscribe removes rc from subscribers of name
+func (h *pubsubHub) unsubscribe(subs map[string]map[*rodisConn]struct{}, rc *rodisConn, name []byte) {
+	conns := subs[string(name)]
+	delete(conns, rc)
+	if len(conns) == 0 {
+		delete(subs, string(name))
+	}
+}
+
+// publish delivers the message to the subscribers of the channel and the matched
+// patterns, returns the count of receivers.
+func (h *pubsubHub) publish(channel, message []byte) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// the messages are encoded by the subscribers later, the args may refer to the
+	// buffer of reader
+	channel, message = append([]byte{}, channel...), append([]byte{}, message...)
+
+	n := 0
+	if conns, ok := h.channels[string(channel)]; ok {
+		m := resp.Push{resp.BulkString("message"), resp.BulkString(channel), resp.BulkString(message)}
+		for rc := range conns {
+			rc.push(m)
+			n++
+		}
+	}
+
+	for pattern, conns := range h.patterns {
+		if !glob.Match([]byte(pattern), channel) {
+			continue
+		}
+		m := resp.Push{resp.BulkString("pmessage"), resp.BulkString(pattern), resp.BulkString(channel), resp.BulkString(message)}
+		for rc := range conns {
+			rc.push(m)
+			n++
+		}
+	}
+	return n
+}
+
+// PubSub of the connection, implements command.PubSub
+
+func (rc *rodisConn) Subscribe(channel []byte) int {
+	h := rc.server.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subscribe(h.channels, rc, channel)
+	rc.channels[string(channel)] = struct{}{}
+	return len(rc.channels) + len(rc.patterns)
+}
+
+func (rc *rodisConn) Unsubscribe(channel []byte) int {
+	h := rc.server.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribe(h.channels, rc, channel)
+	delete(rc.channels, string(channel))
+	return len(rc.channels) + len(rc.patterns)
+}
+
+func (rc *rodisConn) PSubscribe(pattern []byte) int {
+	h := rc.server.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.subscribe(h.patterns, rc, pattern)
+	rc.patterns[string(pattern)] = struct{}{}
+	return len(rc.channels) + len(rc.patterns)
+}
+
+func (rc *rodisConn) PUnsubscribe(pattern []byte) int {
+	h := rc.server.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribe(h.patterns, rc, pattern)
+	delete(rc.patterns, string(pattern))
+	return len(rc.channels) + len(rc.patterns)
+}
+
+func (rc *rodisConn) Channels() [][]byte {
+	rc.server.hub.mu.RLock()
+	defer rc.server.hub.mu.RUnlock()
+	return sortedNames(rc.channels)
+}
+
+func (rc *rodisConn) Patterns() [][]byte {
+	rc.server.hub.mu.RLock()
+	defer rc.server.hub.mu.RUnlock()
+	return sortedNames(rc.patterns)
+}
+
+func (rc *rodisConn) Subscriptions() int {
+	rc.server.hub.mu.RLock()
+	defer rc.server.hub.mu.RUnlock()
+	return len(rc.channels) + len(rc.patterns)
+}
+
+func (rc *rodisConn) Publish(channel, message []byte) int {
+	return rc.server.hub.publish(channel, message)
+}
+
+func (rc *rodisConn) ActiveChannels(pattern []byte) [][]byte {
+	h := rc.server.hub
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	channels := [][]byte{}
+	for channel := range h.channels {
+		if pattern == nil || glob.Match(pattern, []byte(channel)) {
+			channels = append(channels, []byte(channel))
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return bytes.Compare(channels[i], channels[j]) < 0 })
+	return channels
+}
+
+func (rc *rodisConn) NumSub(channel []byte) int {
+	rc.server.hub.mu.RLock()
+	defer rc.server.hub.mu.RUnlock()
+	return len(rc.server.hub.channels[string(channel)])
+}
+
+func (rc *rodisConn) NumPat() int {
+	rc.server.hub.mu.RLock()
+	defer rc.server.hub.mu.RUnlock()
+	return len(rc.server.hub.patterns)
+}
+
+// unsubscribeAll removes all subscriptions of the connection, when it is closed
+func (rc *rodisConn) unsubscribeAll() {
+	h := rc.server.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for channel := range rc.channels {
+		h.unsubscribe(h.channels, rc, []byte(channel))
+	}
+	for pattern := range rc.patterns {
+		h.unsubscribe(h.patterns, rc, []byte(pattern))
+	}
+	rc.channels = make(map[string]struct{})
+	rc.patterns = make(map[string]struct{})
+}
+
+// sortedNames returns the keys of the set in order
+func sortedNames(set map[string]struct{}) [][]byte {
+	names := [][]byte{}
+	for name := range set {
+		names = append(names, []byte(name))
+	}
+	sort.Slice(names, func(i, j int) bool { return bytes.Compare(names[i], names[j]) < 0 })
+	return names
+}
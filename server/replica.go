@@ -0,0 +1,306 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/command"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// replTimeout is the timeout of the master link, the master PINGs the replicas
+// in a shorter period
+const replTimeout = 60 * time.Second
+
+// replAckPeriod is the period of REPLCONF ACK sent to the master
+const replAckPeriod = time.Second
+
+// master link states, as ROLE of Redis
+const (
+	linkConnect    = "connect"    // waits to connect the master
+	linkConnecting = "connecting" // handshaking with the master
+	linkSync       = "sync"       // receiving the dbs from the master
+	linkConnected  = "connected"  // the commands are streamed
+)
+
+// masterLink is the link of the replica to its master, it reconnects until it is
+// closed.
+type masterLink struct {
+	host  string
+	port  string
+	state string // guarded by the replication
+
+	ex *command.Extras // runs the commands of the master, kept for the partial resync
+
+	mu   sync.Mutex
+	conn net.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newMasterLink(host, port string) *masterLink {
+	return &masterLink{host: host, port: port, state: linkConnect, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// close stops the link, and waits until it is done
+func (l *masterLink) close() {
+	l.mu.Lock()
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.mu.Unlock()
+	<-l.done
+}
+
+// dial connects the master, it fails if the link is closed
+func (l *masterLink) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(l.host, l.port), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.stop:
+		conn.Close()
+		return nil, errors.New("the link is closed")
+	default:
+	}
+	l.conn = conn
+	return conn, nil
+}
+
+// replicate syncs with the master of l, and reconnects a second later when the
+// link breaks, until l is closed
+func (r *replication) replicate(l *masterLink) {
+	defer close(l.done)
+	for {
+		err := r.syncMaster(l)
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		logx.Warnf("Replication of master %v:%v error: %v, reconnect in a second", l.host, l.port, err)
+		r.setState(l, linkConnect)
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// setState sets the state of the link
+func (r *replication) setState(l *masterLink, state string) {
+	r.mu.Lock()
+	l.state = state
+	r.mu.Unlock()
+}
+
+// syncMaster connects the master, syncs the dbs by PSYNC, and runs the commands
+// streamed until the link breaks
+func (r *replication) syncMaster(l *masterLink) error {
+	conn, err := l.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	r.setState(l, linkConnecting)
+
+	send := func(args ...string) (string, error) {
+		v := resp.Array{}
+		for _, arg := range args {
+			v = append(v, resp.BulkString(arg))
+		}
+		var buf bytes.Buffer
+		v.WriteTo(&buf)
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return "", err
+		}
+		line, err := readReplyLine(br)
+		if err == nil && strings.HasPrefix(line, "-") {
+			err = fmt.Errorf("%v replies %v", args[0], line[1:])
+		}
+		return line, err
+	}
+
+	if auth := r.rs.cfg.MasterAuth; auth != "" {
+		if _, err := send("AUTH", auth); err != nil {
+			return err
+		}
+	}
+	if _, err := send("PING"); err != nil {
+		return err
+	}
+	_, port, _ := net.SplitHostPort(r.rs.cfg.Listen)
+	if _, err := send("REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+	if _, err := send("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	replid, offset := r.replid, r.offset
+	r.mu.Unlock()
+	if l.ex == nil {
+		replid, offset = "?", -2 // never synced
+	}
+	line, err := send("PSYNC", replid, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+
+	switch fields := strings.Fields(line); {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("wrong PSYNC reply %v", line)
+		}
+		r.setState(l, linkSync)
+		if err := r.loadSnapshot(br, conn); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.replid, r.offset = fields[1], offset
+		r.mu.Unlock()
+		l.ex = &command.Extras{DB: storage.Select(0), Buffer: &bytes.Buffer{}, Authed: true, AOF: r.rs.aof}
+		logx.Infof("Full sync with master %v:%v is done", l.host, l.port)
+	case len(fields) > 0 && fields[0] == "+CONTINUE":
+		if len(fields) == 2 {
+			r.mu.Lock()
+			r.replid = fields[1]
+			r.mu.Unlock()
+		}
+		logx.Infof("Partial resync with master %v:%v from offset %d", l.host, l.port, offset)
+	default:
+		return fmt.Errorf("wrong PSYNC reply %v", line)
+	}
+	r.setState(l, linkConnected)
+
+	stopAck := make(chan struct{})
+	defer close(stopAck)
+	go r.ackLoop(conn, stopAck)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		args, err := aof.ReadCommand(br)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+		v := make(resp.Array, len(args))
+		for i, arg := range args {
+			v[i] = resp.BulkString(arg)
+		}
+		if err := command.Handle(v, l.ex); err != nil {
+			return err
+		}
+		if reply := l.ex.Buffer.Bytes(); len(reply) > 0 && reply[0] == '-' {
+			logx.Warnf("Command %q of master %v:%v replies %s", args[0], l.host, l.port, bytes.TrimSpace(reply[1:]))
+		}
+
+		r.mu.Lock()
+		r.offset += int64(aof.CommandSize(args))
+		r.mu.Unlock()
+	}
+}
+
+// loadSnapshot receives the RDB file from the master to a temp file, and loads
+// it to the dbs which are flushed
+func (r *replication) loadSnapshot(br *bufio.Reader, conn net.Conn) error {
+	var line string
+	for line == "" { // the empty lines are sent by the master preparing the file
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		l, err := readReplyLine(br)
+		if err != nil {
+			return err
+		}
+		line = l
+	}
+	if !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("wrong bulk string of RDB %q", line)
+	}
+	size, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("wrong bulk string of RDB %q", line)
+	}
+
+	f, err := os.Create(filepath.Join(r.rs.cfg.Dir, fmt.Sprintf("temp-%d-sync.rdb", os.Getpid())))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	conn.SetReadDeadline(time.Time{})
+	_, err = io.CopyN(f, br, size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := command.LoadSync(f.Name())
+	if err != nil {
+		return err
+	}
+	logx.Infof("Loaded %d keys from master", n)
+	return nil
+}
+
+// ackLoop sends REPLCONF ACK with the offset processed to the master until stop
+// is closed
+func (r *replication) ackLoop(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			offset := strconv.FormatInt(r.offset, 10)
+			r.mu.Unlock()
+
+			var buf bytes.Buffer
+			resp.Array{resp.BulkString("REPLCONF"), resp.BulkString("ACK"), resp.BulkString(offset)}.WriteTo(&buf)
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readReplyLine reads a line of the reply of the master, without the ending CRLF
+func readReplyLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,414 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/rdb"
+	"github.com/rod6/rodis/resp"
+	"github.com/rod6/rodis/storage"
+)
+
+// streamChunk is the max bytes of the stream written to a replica at once
+const streamChunk = 64 * 1024
+
+// replPingPeriod is the period of PING fed to the replicas, so they know the
+// master is alive
+const replPingPeriod = 10 * time.Second
+
+// replication is the master-replica replication of the server. As a master, the
+// committed write commands are fed to the backlog, and streamed to each replica
+// from its offset. As a replica, the master link syncs the dbs from the master,
+// and runs the commands streamed.
+type replication struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // broadcast when the stream is fed or a replica is detached
+	rs       *rodisServer
+	replid   string   // id of the stream
+	offset   int64    // bytes of the stream fed, or received from the master
+	db       int      // db selected in the stream, -1 to select it again
+	backlog  *backlog // nil until a replica syncs
+	replicas map[*rodisConn]*replicaState
+	link     *masterLink // link to the master if the server is a replica
+	quit     chan struct{}
+}
+
+// replicaState is the state of a replica connected to the master
+type replicaState struct {
+	addr     string // address of the replica, with its listening port
+	ack      int64  // offset acknowledged by the replica
+	detached bool   // the connection is closed
+}
+
+func newReplication(rs *rodisServer) *replication {
+	r := &replication{rs: rs, replid: newReplID(), db: -1, replicas: make(map[*rodisConn]*replicaState), quit: make(chan struct{})}
+	r.cond = sync.NewCond(&r.mu)
+	go r.pingLoop()
+	return r
+}
+
+// newReplID returns a random id of 40 hex chars
+func newReplID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// feed writes the commands committed together to the stream
+func (r *replication) feed(cmds []aof.Command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		return
+	}
+	var buf bytes.Buffer
+	aof.WriteCommands(&buf, &r.db, cmds)
+	r.write(buf.Bytes())
+}
+
+// write writes p to the stream, r.mu must be locked
+func (r *replication) write(p []byte) {
+	r.backlog.write(p)
+	r.offset += int64(len(p))
+	r.cond.Broadcast()
+}
+
+// pingLoop feeds PING to the replicas periodically until the server is closed
+func (r *replication) pingLoop() {
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+
+	ping := []byte("*1\r\n$4\r\nPING\r\n")
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.backlog != nil && len(r.replicas) > 0 {
+				r.write(ping)
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// attach adds rc as a replica, r.mu must be locked
+func (r *replication) attach(rc *rodisConn) *replicaState {
+	host, _, _ := net.SplitHostPort(rc.conn.RemoteAddr().String())
+	st := &replicaState{addr: net.JoinHostPort(host, strconv.Itoa(rc.replPort))}
+	r.replicas[rc] = st
+	return st
+}
+
+// detach removes the replica of rc when the connection is closed
+func (r *replication) detach(rc *rodisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.replicas[rc]; ok {
+		st.detached = true
+		delete(r.replicas, rc)
+		r.cond.Broadcast()
+	}
+}
+
+// partialSync streams the commands from offset to rc if the backlog has them,
+// offset is the next byte wanted by the replica as PSYNC of Redis.
+func (r *replication) partialSync(rc *rodisConn, replid string, offset int64) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	from := offset - 1
+	if r.link != nil || replid != r.replid || r.backlog == nil || from < r.backlog.start || from > r.backlog.end {
+		return "", false
+	}
+
+	st := r.attach(rc)
+	go r.stream(rc, st, from)
+	logx.Infof("Partial resync of replica %v from offset %d", st.addr, from)
+	return r.replid, true
+}
+
+// fullSync sends the snapshots dbs to rc, then streams the commands from the
+// returned offset. The caller must hold the locks of all dbs.
+func (r *replication) fullSync(rc *rodisConn, dbs []*storage.LevelDB) (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backlog == nil {
+		r.backlog = newBacklog(r.rs.cfg.ReplBacklogSize, r.offset)
+	}
+	r.db = -1 // the replica has no db selected
+
+	st := r.attach(rc)
+	go func(from int64) {
+		if err := r.sendSnapshot(rc, dbs); err != nil {
+			logx.Errorf("Full sync of replica %v error: %v", st.addr, err)
+			rc.conn.Close()
+			return
+		}
+		logx.Infof("Full sync of replica %v is done", st.addr)
+		r.stream(rc, st, from)
+	}(r.offset)
+	return r.replid, r.offset
+}
+
+// sendSnapshot writes the snapshots dbs to a temp RDB file, and sends it to rc as
+// a bulk string without the ending CRLF. The dbs are released.
+func (r *replication) sendSnapshot(rc *rodisConn, dbs []*storage.LevelDB) error {
+	f, err := os.Create(filepath.Join(r.rs.cfg.Dir, fmt.Sprintf("temp-sync-%d-%s.rdb", os.Getpid(), rc.uuid)))
+	if err != nil {
+		rdb.Release(dbs)
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = rdb.Write(w, dbs)
+	rdb.Release(dbs)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the reply of PSYNC is written before, as it holds rc.wmu
+	rc.wmu.Lock()
+	defer rc.wmu.Unlock()
+	if _, err := fmt.Fprintf(rc.conn, "$%d\r\n", size); err != nil {
+		return err
+	}
+	_, err = io.Copy(rc.conn, f)
+	return err
+}
+
+// stream writes the stream from offset to the replica of rc until it is detached.
+// The replica falling behind the backlog is disconnected.
+func (r *replication) stream(rc *rodisConn, st *replicaState, offset int64) {
+	for {
+		r.mu.Lock()
+		for !st.detached && offset == r.offset {
+			r.cond.Wait()
+		}
+		if st.detached {
+			r.mu.Unlock()
+			return
+		}
+		var data []byte
+		ok := r.backlog != nil
+		if ok {
+			data, ok = r.backlog.read(offset, streamChunk)
+		}
+		r.mu.Unlock()
+
+		if !ok {
+			logx.Warnf("Replica %v falls behind the backlog, disconnect it", st.addr)
+			rc.conn.Close()
+			return
+		}
+		rc.wmu.Lock()
+		_, err := rc.conn.Write(data)
+		rc.wmu.Unlock()
+		if err != nil {
+			rc.conn.Close()
+			return
+		}
+		offset += int64(len(data))
+	}
+}
+
+// ack keeps the offset acknowledged by the replica of rc
+func (r *replication) ack(rc *rodisConn, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if st, ok := r.replicas[rc]; ok {
+		st.ack = offset
+	}
+}
+
+// replicaOf starts replicating the master of host and port, or stops if host is
+// empty, returns false if it replicates the master already. The replicas are
+// disconnected when the server becomes a replica.
+func (r *replication) replicaOf(host, port string) bool {
+	r.mu.Lock()
+	old := r.link
+	if host == "" {
+		if old != nil {
+			r.link = nil
+			r.replid = newReplID() // the dbs may change from the master's now
+			logx.Infof("Stop replicating master %v:%v, the server is a master", old.host, old.port)
+		}
+		r.mu.Unlock()
+		if old != nil {
+			old.close()
+		}
+		return true
+	}
+	if old != nil && old.host == host && old.port == port {
+		r.mu.Unlock()
+		return false
+	}
+
+	l := newMasterLink(host, port)
+	r.link = l
+	r.backlog = nil
+	replicas := []*rodisConn{}
+	for rc := range r.replicas {
+		replicas = append(replicas, rc)
+	}
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	for _, rc := range replicas {
+		rc.conn.Close()
+	}
+	logx.Infof("Start replicating master %v:%v", host, port)
+	go r.replicate(l)
+	return true
+}
+
+// role returns the reply of ROLE
+func (r *replication) role() resp.Array {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.link != nil {
+		port, _ := strconv.Atoi(r.link.port)
+		return resp.Array{resp.BulkString("slave"), resp.BulkString(r.link.host), resp.Integer(port),
+			resp.BulkString(r.link.state), resp.Integer(r.offset)}
+	}
+
+	replicas := resp.Array{}
+	for _, st := range r.replicas {
+		host, port, _ := net.SplitHostPort(st.addr)
+		replicas = append(replicas, resp.Array{resp.BulkString(host), resp.BulkString(port),
+			resp.BulkString(strconv.FormatInt(st.ack, 10))})
+	}
+	return resp.Array{resp.BulkString("master"), resp.Integer(r.offset), replicas}
+}
+
+// close stops replicating the master, and the PING of the replicas
+func (r *replication) close() {
+	close(r.quit)
+	r.mu.Lock()
+	l := r.link
+	r.link = nil
+	r.mu.Unlock()
+	if l != nil {
+		l.close()
+	}
+}
+
+// backlog keeps the latest bytes of the stream in a ring buffer, for the partial
+// resync of the replicas, and the stream to them.
+type backlog struct {
+	buf   []byte
+	start int64 // offset of the first byte kept
+	end   int64 // offset after the last byte
+}
+
+func newBacklog(size int, offset int64) *backlog {
+	return &backlog{buf: make([]byte, size), start: offset, end: offset}
+}
+
+// write appends p to the backlog, the oldest bytes are dropped if it is full
+func (b *backlog) write(p []byte) {
+	size := int64(len(b.buf))
+	for len(p) > 0 {
+		n := copy(b.buf[b.end%size:], p)
+		p = p[n:]
+		b.end += int64(n)
+	}
+	if b.end-b.start > size {
+		b.start = b.end - size
+	}
+}
+
+// read returns at most max bytes from offset, false if the backlog does not have
+// the offset.
+func (b *backlog) read(offset int64, max int) ([]byte, bool) {
+	if offset < b.start || offset > b.end {
+		return nil, false
+	}
+	n := b.end - offset
+	if n > int64(max) {
+		n = int64(max)
+	}
+	data := make([]byte, n)
+	copied := copy(data, b.buf[offset%int64(len(b.buf)):])
+	copy(data[copied:], b.buf)
+	return data, true
+}
+
+// Replication of the connection, implements command.Replication
+
+func (rc *rodisConn) ReplicaOf(host, port string) bool {
+	return rc.server.repl.replicaOf(host, port)
+}
+
+func (rc *rodisConn) Role() resp.Array {
+	return rc.server.repl.role()
+}
+
+func (rc *rodisConn) Replicating() bool {
+	r := rc.server.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.link != nil
+}
+
+func (rc *rodisConn) ReadOnly() bool {
+	return rc.server.cfg.ReplicaReadOnly && rc.Replicating()
+}
+
+func (rc *rodisConn) Feeding() bool {
+	r := rc.server.repl
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlog != nil
+}
+
+func (rc *rodisConn) Feed(cmds []aof.Command) {
+	rc.server.repl.feed(cmds)
+}
+
+func (rc *rodisConn) PartialSync(replid string, offset int64) (string, bool) {
+	return rc.server.repl.partialSync(rc, replid, offset)
+}
+
+func (rc *rodisConn) FullSync(dbs []*storage.LevelDB) (string, int64) {
+	return rc.server.repl.fullSync(rc, dbs)
+}
+
+func (rc *rodisConn) ListeningPort(port int) {
+	rc.replPort = port
+}
+
+func (rc *rodisConn) Ack(offset int64) {
+	rc.server.repl.ack(rc, offset)
+}
@@ -7,22 +7,45 @@ package server
 
 import (
 	"net"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/libgo/logx"
+	"github.com/rod6/rodis/aof"
+	"github.com/rod6/rodis/cluster"
 )
 
 type rodisServer struct {
 	cfg      *ServerConfig
 	listener net.Listener
 	conns    map[string]*rodisConn
+	hub      *pubsubHub
+	aof      *aof.Log
+	repl     *replication
+	cluster  *cluster.Cluster
 	mu       sync.Mutex
 	started  bool
 	quit     chan bool
 }
 
 func New(config ServerConfig) (*rodisServer, error) {
-	return &rodisServer{cfg: &config, conns: make(map[string]*rodisConn), quit: make(chan bool)}, nil
+	log, err := aof.Open(filepath.Join(config.Dir, config.AppendFilename), config.AppendFsync, config.AppendOnly)
+	if err != nil {
+		return nil, err
+	}
+	rs := &rodisServer{cfg: &config, conns: make(map[string]*rodisConn), hub: newPubsubHub(), aof: log, quit: make(chan bool)}
+	if config.ClusterEnabled {
+		if rs.cluster, err = cluster.New(config.ClusterAnnounce, config.ClusterNodes); err != nil {
+			log.Close()
+			return nil, err
+		}
+	}
+	rs.repl = newReplication(rs)
+	if fields := strings.Fields(config.ReplicaOf); len(fields) == 2 {
+		rs.repl.replicaOf(fields[0], fields[1])
+	}
+	return rs, nil
 }
 
 func (rs *rodisServer) Run() {
@@ -64,5 +87,9 @@ func (rs *rodisServer) Close() {
 		}
 		rs.started = false
 	}
+	rs.repl.close()
+	if err := rs.aof.Close(); err != nil {
+		logx.Errorf("Close AOF error: %v", err)
+	}
 	logx.Info("Server is down.")
 }
@@ -0,0 +1,195 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// writeBatch collects the writes of a write context. The reads and iterators of
+// the context see the pending writes over the written data.
+type writeBatch struct {
+	batch   *leveldb.Batch
+	pending map[string][]byte   // nil value for deleted key
+	err     *Error              // the error failed the context, nothing is committed
+	flushed uint64              // the flushed generation written by Flush, 0 if none
+	keys    map[string]keyCount // the keys counted, applied to the key counter after commit
+	commit  []func()            // run after the pending writes are committed
+	before  []*LevelDB          // the write contexts of other dbs committed first
+}
+
+// newWriteBatch returns an empty writeBatch
+func newWriteBatch() *writeBatch {
+	return &writeBatch{batch: new(leveldb.Batch), pending: make(map[string][]byte)}
+}
+
+// Put implements leveldb.BatchReplay
+func (wb *writeBatch) Put(key, value []byte) {
+	wb.batch.Put(key, value)
+	wb.pending[string(key)] = append([]byte{}, value...)
+}
+
+// Delete implements leveldb.BatchReplay
+func (wb *writeBatch) Delete(key []byte) {
+	wb.batch.Delete(key)
+	wb.pending[string(key)] = nil
+}
+
+// Begin returns a write context of the leveldb: the writes by the context are
+// pending, and seen by the reads of the context, until Commit writes them in one
+// batch, so a command is applied atomically even if the server crashes. The caller
+// must hold the locks of the keys written, until the context is committed.
+func (ldb *LevelDB) Begin() *LevelDB {
+	return &LevelDB{database: ldb.database, wb: newWriteBatch()}
+}
+
+// Commit writes the pending writes of the write context in one batch, the context
+// is empty after Commit and can be used for more writes. The write contexts queued
+// by commitFirst are committed first, and the hooks queued by afterCommit run after,
+// even if the context wrote nothing itself. Nothing is written if an operation of
+// the context failed, the error is returned.
+func (ldb *LevelDB) Commit() error {
+	if ldb.wb == nil {
+		return nil
+	}
+	wb := ldb.wb
+	ldb.wb = newWriteBatch()
+	if wb.err != nil {
+		return wb.err
+	}
+	for _, tx := range wb.before {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if wb.batch.Len() != 0 {
+		if err := writable("commit"); err != nil {
+			return err
+		}
+		err := ldb.db.Write(wb.batch, nil)
+		ldb.evict(wb.batch)
+		if err != nil {
+			e := newError("commit", err) // not ldb.error, the context is reset already
+			fallback(e)
+			return e
+		}
+	}
+	for _, f := range wb.commit {
+		f()
+	}
+	return nil
+}
+
+// afterCommit runs f after the pending writes are committed, it is dropped if the
+// context fails. Out of a write context, the writes are done and f runs at once.
+func (ldb *LevelDB) afterCommit(f func()) {
+	if ldb.wb == nil {
+		f()
+		return
+	}
+	ldb.wb.commit = append(ldb.wb.commit, f)
+}
+
+// commitFirst makes the pending writes of the write context dst committed before
+// the writes of ldb, dst is committed at once if ldb is not a write context, and
+// the error of the commit is returned.
+func (ldb *LevelDB) commitFirst(dst *LevelDB) error {
+	switch {
+	case dst.wb == nil:
+	case ldb.wb != nil:
+		ldb.wb.before = append(ldb.wb.before, dst)
+	default:
+		return dst.Commit()
+	}
+	return nil
+}
+
+// Err returns the error failed the write context, nil if no operation of the
+// context failed.
+func (ldb *LevelDB) Err() error {
+	if ldb.wb == nil || ldb.wb.err == nil {
+		return nil
+	}
+	return ldb.wb.err
+}
+
+// GetWriteBatch implements RodisData, it returns the pending writes of the write
+// context, nil if ldb is not a write context.
+func (ldb *LevelDB) GetWriteBatch() *leveldb.Batch {
+	if ldb.wb == nil {
+		return nil
+	}
+	return ldb.wb.batch
+}
+
+// update runs f with a write context and commits it, so the writes of f are
+// applied atomically, returns the error of the commit. The write context of ldb is
+// joined if it is one, and it is committed by the caller.
+func (ldb *LevelDB) update(f func(tx *LevelDB)) error {
+	if ldb.wb != nil {
+		f(ldb)
+		return nil
+	}
+	tx := ldb.Begin()
+	f(tx)
+	return tx.Commit()
+}
+
+// lookup reads the key, from the pending writes first in a write context, or
+// from the snapshot of a snapshot handle
+func (ldb *LevelDB) lookup(key []byte) ([]byte, bool) {
+	if ldb.wb != nil {
+		if value, ok := ldb.wb.pending[string(key)]; ok {
+			return value, value != nil
+		}
+	}
+
+	get := ldb.db.Get
+	if ldb.snap != nil {
+		get = ldb.snap.s.Get
+	}
+	value, err := get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false
+	}
+	if err != nil {
+		ldb.raise("get", err)
+	}
+	return value, true
+}
+
+// write writes the batch, or appends it to the pending writes in a write context
+func (ldb *LevelDB) write(batch *leveldb.Batch) {
+	if ldb.wb != nil {
+		if err := batch.Replay(ldb.wb); err != nil {
+			ldb.raise("write", err)
+		}
+		return
+	}
+
+	ldb.writeNow("write", batch)
+}
+
+// writeNow writes the batch to leveldb at once even in a write context, for the
+// writes not changing the data of keys, like the reservation of generations.
+func (ldb *LevelDB) writeNow(op string, batch *leveldb.Batch) {
+	if err := writable(op); err != nil {
+		ldb.raise(op, err)
+	}
+	err := ldb.db.Write(batch, nil)
+	ldb.evict(batch)
+	if err != nil {
+		ldb.raise(op, err)
+	}
+}
+
+// evict evicts the records written by the batch from the cache, it is called
+// after the batch is written.
+func (ldb *LevelDB) evict(batch *leveldb.Batch) {
+	if ldb.cache != nil {
+		batch.Replay(ldb.cache)
+	}
+}
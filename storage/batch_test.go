@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+)
+
+// TestCommitEmpty checks a write context writing nothing itself still commits the
+// context of another db queued first, and runs and clears its hooks.
+func TestCommitEmpty(t *testing.T) {
+	src, dst := openTest(t), openTest(t)
+
+	txSrc, txDst := src.Begin(), dst.Begin()
+	if err := txDst.PutString([]byte("a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	txSrc.commitFirst(txDst)
+	ran := 0
+	txSrc.afterCommit(func() { ran++ })
+	if err := txSrc.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.GetString([]byte("a")); err != nil || string(v) != "a" {
+		t.Errorf("GetString(a) of dst, Expect: a, Get: %q, %v", v, err)
+	}
+	if err := txSrc.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 1 {
+		t.Errorf("hook runs after two commits, Expect: 1, Get: %d", ran)
+	}
+}
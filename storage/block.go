@@ -0,0 +1,149 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"sync"
+)
+
+// ListWaiter is a connection blocked by BLPOP and so on, waiting for the elements
+// pushed to any of the lists. When elements are pushed, the waiters of the list
+// are served one by one, in the order they started to wait.
+type ListWaiter struct {
+	keys   [][]byte
+	locks  [][]byte    // keys locked to serve the waiter
+	serve  func() bool // serves the waiter, returns false if the lists are empty
+	served chan struct{}
+	queued bool
+}
+
+// listWaiters is the wait queues of lists, keyed by the list key
+type listWaiters struct {
+	mu     sync.Mutex
+	queues map[string][]*ListWaiter
+	ready  map[string]struct{} // keys pushed with waiters, to be served
+}
+
+// Served returns the channel closed when the waiter is served
+func (w *ListWaiter) Served() <-chan struct{} {
+	return w.served
+}
+
+// Wait adds a waiter at the end of the wait queues of the keys, serve is called
+// by ServeWaiters with locks locked when any of the lists is pushed. It should be
+// called with locks locked, so no push is missed between the check of the lists
+// and the wait.
+func (ldb *LevelDB) Wait(keys [][]byte, locks [][]byte, serve func() bool) *ListWaiter {
+	ldb.waiters.mu.Lock()
+	defer ldb.waiters.mu.Unlock()
+
+	w := &ListWaiter{serve: serve, served: make(chan struct{}), queued: true}
+	for _, key := range locks {
+		w.locks = append(w.locks, append([]byte{}, key...))
+	}
+	for _, key := range keys {
+		w.keys = append(w.keys, append([]byte{}, key...))
+		ldb.waiters.queues[string(key)] = append(ldb.waiters.queues[string(key)], w)
+	}
+	return w
+}
+
+// Unwait removes the waiter from the wait queues, it returns true if the waiter
+// was served already. It should be called with the locks of the waiter locked.
+func (ldb *LevelDB) Unwait(w *ListWaiter) bool {
+	ldb.waiters.mu.Lock()
+	defer ldb.waiters.mu.Unlock()
+
+	if !w.queued {
+		return true
+	}
+	ldb.dequeue(w)
+	return false
+}
+
+// dequeue removes the waiter from the wait queues, the caller should hold the mutex
+func (ldb *LevelDB) dequeue(w *ListWaiter) {
+	for _, key := range w.keys {
+		queue := ldb.waiters.queues[string(key)]
+		for i, e := range queue {
+			if e == w {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(ldb.waiters.queues, string(key))
+		} else {
+			ldb.waiters.queues[string(key)] = queue
+		}
+	}
+	w.queued = false
+}
+
+// signal marks the list ready to serve the waiters, it is called when an element
+// is pushed to the list.
+func (ldb *LevelDB) signal(key []byte) {
+	ldb.waiters.mu.Lock()
+	defer ldb.waiters.mu.Unlock()
+
+	if _, ok := ldb.waiters.queues[string(key)]; ok {
+		ldb.waiters.ready[string(key)] = struct{}{}
+	}
+}
+
+// ServeWaiters serves the waiters of the pushed lists, in the order they started
+// to wait, until the lists are empty. It should be called after the command pushing
+// the lists is done and unlocked, as the locks of each waiter are locked to serve it.
+func (ldb *LevelDB) ServeWaiters() {
+	for {
+		w := ldb.nextWaiter()
+		if w == nil {
+			return
+		}
+		unlock := ldb.LockKeys(w.locks, true)
+		ldb.serveWaiter(w)
+		unlock()
+	}
+}
+
+// serveWaiter serves the waiter if it is still waiting, it should be called with
+// the locks of the waiter locked.
+func (ldb *LevelDB) serveWaiter(w *ListWaiter) {
+	ldb.waiters.mu.Lock()
+	queued := w.queued
+	ldb.waiters.mu.Unlock()
+	if !queued { // served or unwaited by others
+		return
+	}
+
+	if !w.serve() { // the list is empty, its waiters need to wait more
+		ldb.waiters.mu.Lock()
+		for _, key := range w.keys {
+			delete(ldb.waiters.ready, string(key))
+		}
+		ldb.waiters.mu.Unlock()
+		return
+	}
+
+	ldb.waiters.mu.Lock()
+	ldb.dequeue(w)
+	ldb.waiters.mu.Unlock()
+	close(w.served)
+}
+
+// nextWaiter returns the first waiter of a ready list, or nil if no list is ready
+func (ldb *LevelDB) nextWaiter() *ListWaiter {
+	ldb.waiters.mu.Lock()
+	defer ldb.waiters.mu.Unlock()
+
+	for key := range ldb.waiters.ready {
+		if queue := ldb.waiters.queues[key]; len(queue) != 0 {
+			return queue[0]
+		}
+		delete(ldb.waiters.ready, key)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+// recordCache is the LRU cache of the decoded records of one leveldb, like the
+// metadata, the list and skiplist attributes and nodes, by their leveldb keys.
+// It caches the written data only: the records are evicted when they are written
+// to leveldb, and the records with pending writes are read from the write context.
+// The evictions are counted by the stripes of the record keys, hashed as the key
+// locks, so a record read is dropped by the evictions in its stripe only.
+// The nil recordCache caches nothing.
+type recordCache struct {
+	mu    sync.Mutex
+	size  int
+	lru   *list.List // front is the most recently used
+	items map[string]*list.Element
+	seqs  [LockStripes]uint64 // increased by every eviction of the keys of the stripe
+}
+
+// recordKind is the kind of the decoded records. The records of the keys not
+// existing share the value keys of generation 0, like the attributes of list and
+// skiplist, so a record is cached with its kind.
+type recordKind byte
+
+const (
+	recordMetadata recordKind = iota
+	recordListAttr
+	recordListElement
+	recordSkipAttr
+	recordSkipNode
+	recordDequeAttr
+	recordDequeElement
+)
+
+// cacheItem is the decoded record in recordCache
+type cacheItem struct {
+	key   string
+	kind  recordKind
+	value interface{}
+}
+
+// newRecordCache returns the cache of at most size records, nil if size is not
+// positive.
+func newRecordCache(size int) *recordCache {
+	if size <= 0 {
+		return nil
+	}
+	return &recordCache{size: size, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the record of key and kind, and the sequence of evictions of the
+// stripe of key, the record read from leveldb is added with the sequence by add.
+func (c *recordCache) get(key []byte, kind recordKind) (interface{}, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seq := c.seqs[stripe(key)]
+	e, ok := c.items[string(key)]
+	if !ok || e.Value.(*cacheItem).kind != kind {
+		return nil, seq, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheItem).value, seq, true
+}
+
+// add adds the record read from leveldb after get returned seq. It is dropped if
+// a record of the stripe is evicted since then, as the record read may be stale.
+func (c *recordCache) add(key []byte, kind recordKind, value interface{}, seq uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq != c.seqs[stripe(key)] {
+		return
+	}
+	if e, ok := c.items[string(key)]; ok {
+		e.Value = &cacheItem{string(key), kind, value}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[string(key)] = c.lru.PushFront(&cacheItem{string(key), kind, value})
+	if c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*cacheItem).key)
+	}
+}
+
+// evict removes the record of key
+func (c *recordCache) evict(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seqs[stripe(key)]++
+	if e, ok := c.items[string(key)]; ok {
+		c.lru.Remove(e)
+		delete(c.items, string(key))
+	}
+}
+
+// purge removes all records
+func (c *recordCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.seqs {
+		c.seqs[i]++
+	}
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// Put implements leveldb.BatchReplay, the written record is evicted
+func (c *recordCache) Put(key, value []byte) {
+	c.evict(key)
+}
+
+// Delete implements leveldb.BatchReplay, the deleted record is evicted
+func (c *recordCache) Delete(key []byte) {
+	c.evict(key)
+}
+
+// metadata returns the metadata of the meta key, nil if the key does not exist
+func (ldb *LevelDB) metadata(metaKey []byte) []byte {
+	return ldb.cached(metaKey, recordMetadata, func(value []byte) interface{} {
+		return value
+	}).([]byte)
+}
+
+// cached returns the record of key and kind decoded by decode, from the cache if
+// it is cached. The record with pending writes is decoded from the write context,
+// and not cached, so is the record read by a snapshot handle. The cached record
+// is shared, the caller must not modify it.
+func (ldb *LevelDB) cached(key []byte, kind recordKind, decode func(value []byte) interface{}) interface{} {
+	if ldb.wb != nil {
+		if value, ok := ldb.wb.pending[string(key)]; ok {
+			return decode(value)
+		}
+	}
+
+	if ldb.snap != nil {
+		return decode(ldb.get(key))
+	}
+
+	record, seq, ok := ldb.cache.get(key, kind)
+	if ok {
+		return record
+	}
+	record = decode(ldb.get(key))
+	ldb.cache.add(key, kind, record, seq)
+	return record
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/rod6/rodis/resp"
+)
+
+func TestCacheHit(t *testing.T) {
+	db := openTest(t)
+	key := []byte("list")
+	if _, err := db.PushListTail(key, resp.List, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	attrKey := db.encodeDequeAttrKey(key)
+	if _, _, ok := db.cache.get(attrKey, recordDequeAttr); ok {
+		t.Fatalf("get after write, Expect: evicted, Get: cached")
+	}
+
+	// the record read is cached, and the cached one is returned
+	if n, err := db.GetListLength(key); err != nil || n != 1 {
+		t.Fatalf("GetListLength, Expect: 1, Get: %v, %v", n, err)
+	}
+	record, _, ok := db.cache.get(attrKey, recordDequeAttr)
+	if !ok || record.(dequeAttr).length() != 1 {
+		t.Fatalf("get after read, Expect: cached length 1, Get: %v, %v", record, ok)
+	}
+	db.cache.add(attrKey, recordDequeAttr, dequeAttr{0, 5}, db.cache.seqs[stripe(attrKey)])
+	if n, err := db.GetListLength(key); err != nil || n != 5 {
+		t.Fatalf("GetListLength of cached length 5, Expect: 5, Get: %v, %v", n, err)
+	}
+	if _, _, ok := db.cache.get(attrKey, recordListAttr); ok {
+		t.Errorf("get of other kind, Expect: not cached, Get: cached")
+	}
+	db.cache.evict(attrKey)
+	if _, err := db.GetListLength(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records written are evicted, by a write context only when committed
+	tx := db.Begin()
+	if _, err := tx.PushListTail(key, resp.List, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tx.GetListLength(key); err != nil || n != 2 {
+		t.Errorf("GetListLength of the write context, Expect: 2, Get: %v, %v", n, err)
+	}
+	if _, _, ok := db.cache.get(attrKey, recordDequeAttr); !ok {
+		t.Errorf("get before commit, Expect: cached, Get: evicted")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.GetListLength(key); err != nil || n != 2 {
+		t.Errorf("GetListLength after commit, Expect: 2, Get: %v, %v", n, err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.GetListLength(key); err != nil || n != 0 {
+		t.Errorf("GetListLength after Flush, Expect: 0, Get: %v, %v", n, err)
+	}
+}
+
+func TestCacheFill(t *testing.T) {
+	c := newRecordCache(16)
+	key := []byte("a")
+	other := []byte("b")
+	for stripe(other) == stripe(key) {
+		other = append(other, 'b')
+	}
+
+	// the fill is dropped by the eviction of key, or of all records
+	_, seq, _ := c.get(key, recordMetadata)
+	c.evict(key)
+	c.add(key, recordMetadata, []byte("stale"), seq)
+	if _, _, ok := c.get(key, recordMetadata); ok {
+		t.Errorf("add after evict, Expect: dropped, Get: cached")
+	}
+	_, seq, _ = c.get(key, recordMetadata)
+	c.purge()
+	c.add(key, recordMetadata, []byte("stale"), seq)
+	if _, _, ok := c.get(key, recordMetadata); ok {
+		t.Errorf("add after purge, Expect: dropped, Get: cached")
+	}
+
+	// but not by the eviction of a key of other stripe
+	_, seq, _ = c.get(key, recordMetadata)
+	c.evict(other)
+	c.add(key, recordMetadata, []byte("v"), seq)
+	if v, _, ok := c.get(key, recordMetadata); !ok || string(v.([]byte)) != "v" {
+		t.Errorf("add after evict of other stripe, Expect: v, Get: %v, %v", v, ok)
+	}
+
+	// the least recently used record is removed
+	for i := 0; i < 16; i++ {
+		k := []byte(fmt.Sprint(i))
+		_, seq, _ := c.get(k, recordMetadata)
+		c.add(k, recordMetadata, k, seq)
+	}
+	if _, _, ok := c.get(key, recordMetadata); ok || c.lru.Len() != 16 {
+		t.Errorf("add over size, Expect: %s removed and 16 records, Get: %v, %v", key, ok, c.lru.Len())
+	}
+}
+
+// TestCacheRace writes the list while the list is read, so the fills race with
+// the evictions, the cache must not keep a stale record after the writes.
+func TestCacheRace(t *testing.T) {
+	db := openTest(t)
+	keys := [][]byte{[]byte("list1"), []byte("list2")}
+	const pushes = 500
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, key := range keys {
+					if _, err := db.GetListLength(key); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for _, key := range keys {
+		writers.Add(1)
+		go func(key []byte) {
+			defer writers.Done()
+			for i := 0; i < pushes; i++ {
+				if _, err := db.PushListTail(key, resp.List, []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(key)
+	}
+	writers.Wait()
+	close(done)
+	wg.Wait()
+
+	for _, key := range keys {
+		if n, err := db.GetListLength(key); err != nil || n != pushes {
+			t.Errorf("GetListLength(%s) after the writes, Expect: %v, Get: %v, %v", key, pushes, n, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Copy copies key with its expire to dstKey of dst, which may be ldb itself. The
+// existing dstKey is replaced. All entries of dstKey are written in one batch.
+func (ldb *LevelDB) Copy(key []byte, dst *LevelDB, dstKey []byte) (err error) {
+	defer catch(&err)
+	return ldb.transfer(key, dst, dstKey, false)
+}
+
+// Rename moves key with its expire to dstKey of dst, which may be ldb itself. The
+// existing dstKey is replaced. If dst is ldb, the key is renamed in one batch.
+// Otherwise the dbs are separate leveldbs, which can not be written in one batch:
+// dstKey is written in one batch, and key is deleted from ldb in another one. The
+// write context of dst is committed before the one of ldb, so a crash or a failed
+// commit between the batches leaves the key in both dbs, never in neither.
+func (ldb *LevelDB) Rename(key []byte, dst *LevelDB, dstKey []byte) (err error) {
+	defer catch(&err)
+	return ldb.transfer(key, dst, dstKey, true)
+}
+
+// transfer copies or moves key to dstKey of dst. dstKey is written with a new
+// generation, the value keys of the replaced dstKey and the removed key are left
+// to the garbage collector. The error of committing dst first is returned, key is
+// not removed then.
+func (ldb *LevelDB) transfer(key []byte, dst *LevelDB, dstKey []byte, remove bool) error {
+	exist, tipe := ldb.has(encodeMetaKey(key))
+	if !exist {
+		return nil
+	}
+	ldb.migrateKey(key)
+	dst.migrateKey(dstKey)
+
+	metadata := ldb.liveMetadata(key)
+	src := ldb.entries(key, metadata)
+
+	dst.touch(dstKey)
+	dst.keyCreated(dstKey)
+	if remove {
+		ldb.touch(key)
+		ldb.keyDeleted(key)
+	}
+
+	current := withEncoding(encodeMetadata(tipe, dst.nextGeneration()), metadataEncoding(metadata))
+	batch := new(leveldb.Batch)
+	if old := dst.liveMetadata(dstKey); old != nil {
+		batch.Put(encodeGarbageKey(valuePrefix(dstKey, old)), nil)
+	}
+	if at := dst.get(encodeExpireKey(dstKey)); len(at) != 0 {
+		batch.Delete(encodeExpireKey(dstKey))
+		batch.Delete(encodeExpireIndexKey(expireIndexAt(at), dstKey))
+	}
+	if remove && dst == ldb {
+		ldb.removeEntries(batch, key, metadata, src)
+	}
+	batch.Put(encodeMetaKey(dstKey), current)
+	for _, e := range src {
+		batch.Put(e.rename(dstKey, current), e.value)
+	}
+	dst.write(batch)
+
+	if remove && dst != ldb {
+		batch := new(leveldb.Batch)
+		ldb.removeEntries(batch, key, metadata, src)
+		if err := ldb.commitFirst(dst); err != nil {
+			return err
+		}
+		ldb.write(batch)
+	}
+
+	if tipe == resp.List {
+		dst.signal(dstKey)
+	}
+	return nil
+}
+
+// removeEntries adds the deletion of the entries of key to batch, the value keys
+// are queued to the garbage collector.
+func (ldb *LevelDB) removeEntries(batch *leveldb.Batch, key []byte, metadata []byte, entries []entry) {
+	batch.Put(encodeGarbageKey(valuePrefix(key, metadata)), nil)
+	batch.Delete(encodeMetaKey(key))
+	for _, e := range entries {
+		if e.kind != entryValue {
+			batch.Delete(e.key)
+		}
+	}
+}
+
+// entry is a leveldb entry of a key, the kind decides how it is encoded for another key
+type entry struct {
+	kind   int
+	key    []byte
+	suffix []byte // suffix of the value key after the value prefix
+	value  []byte
+}
+
+// kinds of entry
+const (
+	entryValue  = iota // value keys
+	entryExpire        // -SYSExpire|key
+	entryIndex         // -SYSExpireAt|at|key
+)
+
+// entries returns the entries of key with metadata: values, expire and the expire
+// index
+func (ldb *LevelDB) entries(key []byte, metadata []byte) []entry {
+	entries := []entry{}
+
+	prefix := valuePrefix(key, metadata)
+	iter := ldb.newIterator(util.BytesPrefix(prefix))
+	for iter.Next() {
+		k := append([]byte{}, iter.Key()...)
+		entries = append(entries, entry{entryValue, k, k[len(prefix):], append([]byte{}, iter.Value()...)})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ldb.raise("iterate", err)
+	}
+
+	if at := ldb.get(encodeExpireKey(key)); len(at) != 0 {
+		entries = append(entries, entry{entryExpire, encodeExpireKey(key), nil, at})
+		entries = append(entries, entry{entryIndex, encodeExpireIndexKey(expireIndexAt(at), key), nil, nil})
+	}
+	return entries
+}
+
+// rename returns the leveldb key of the entry for dstKey with metadata
+func (e entry) rename(dstKey []byte, metadata []byte) []byte {
+	switch e.kind {
+	case entryExpire:
+		return encodeExpireKey(dstKey)
+	case entryIndex:
+		at := e.key[len(encodeExpireIndexKey(nil, nil)):][:8]
+		return encodeExpireIndexKey(at, dstKey)
+	}
+	return append(valuePrefix(dstKey, metadata), e.suffix...)
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRenameCrossDB checks the key renamed to another db is committed there first,
+// and is kept in the source db if the commit of the other db fails.
+func TestRenameCrossDB(t *testing.T) {
+	src, dst := openTest(t), openTest(t)
+	at := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b"} {
+		if err := src.PutString([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.SetExpireAt([]byte(key), &at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the write context of the source db is committed first, as the commands
+	// commit by the db index
+	txSrc, txDst := src.Begin(), dst.Begin()
+	if err := txSrc.Rename([]byte("a"), txDst, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txSrc.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dst.GetString([]byte("a")); err != nil || string(v) != "a" {
+		t.Errorf("GetString(a) of dst, Expect: a, Get: %q, %v", v, err)
+	}
+	if e, err := dst.GetExpireAt([]byte("a")); err != nil || e == nil || e.UnixNano()/1e6 != at.UnixNano()/1e6 {
+		t.Errorf("GetExpireAt(a) of dst, Expect: %v, Get: %v, %v", at, e, err)
+	}
+	if exist, _, err := src.Has([]byte("a")); err != nil || exist {
+		t.Errorf("Has(a) of src, Expect: false, Get: %v, %v", exist, err)
+	}
+	if err := txDst.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txSrc, txDst = src.Begin(), dst.Begin()
+	if err := txSrc.Rename([]byte("b"), txDst, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	txDst.wb.err = &Error{Kind: KindIO, Op: "write", Err: errors.New("closed")}
+	if err := txSrc.Commit(); err == nil {
+		t.Fatal("Commit after the failed dst, Expect: error, Get: nil")
+	}
+	if v, err := src.GetString([]byte("b")); err != nil || string(v) != "b" {
+		t.Errorf("GetString(b) of src after the failed dst, Expect: b, Get: %q, %v", v, err)
+	}
+	if exist, _, err := dst.Has([]byte("b")); err != nil || exist {
+		t.Errorf("Has(b) of dst after the failed dst, Expect: false, Get: %v, %v", exist, err)
+	}
+}
+
+// TestRenameFailedDst checks Rename out of a write context returns the error of
+// committing the other db, and keeps the key in the source db.
+func TestRenameFailedDst(t *testing.T) {
+	src, dst := openTest(t), openTest(t)
+	if err := src.PutString([]byte("a"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	txDst := dst.Begin()
+	txDst.wb.err = &Error{Kind: KindIO, Op: "write", Err: errors.New("closed")}
+	if err := src.Rename([]byte("a"), txDst, []byte("a")); err == nil {
+		t.Fatal("Rename to the failed dst, Expect: error, Get: nil")
+	}
+	if v, err := src.GetString([]byte("a")); err != nil || string(v) != "a" {
+		t.Errorf("GetString(a) of src after the failed dst, Expect: a, Get: %q, %v", v, err)
+	}
+	if exist, _, err := dst.Has([]byte("a")); err != nil || exist {
+		t.Errorf("Has(a) of dst after the failed dst, Expect: false, Get: %v, %v", exist, err)
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The deque encoding of list stores the elements by signed sequence numbers from
+// head to tail, so an element is addressed by its index without walking the list.
+// The new lists are in the deque encoding, the lists in the linked encoding are
+// read and written as is. A list falls back to the linked encoding when LREM or
+// LINSERT would move more than DequeChunk elements in the middle of it.
+
+const (
+	dequeAttrField    byte = 0x00
+	dequeElementField byte = 0x01
+)
+
+// DequeChunk is the max number of elements read at once by LREM and LINSERT, which
+// walk the list in chunks instead of loading it. It is also the max number of
+// elements they move in the deque encoding.
+const DequeChunk = 128
+
+// dequeAttr is the decoded attributes of the deque: the elements are of the
+// sequences from head to tail, tail not included.
+type dequeAttr struct {
+	head, tail int64
+}
+
+// length returns the number of elements
+func (a dequeAttr) length() int {
+	return int(a.tail - a.head)
+}
+
+// isDeque returns true if the list of key is in the deque encoding, or does not
+// exist, as a new list is created in the deque encoding.
+func (ldb *LevelDB) isDeque(key []byte) bool {
+	metadata := ldb.liveMetadata(key)
+	return metadata == nil || metadataEncoding(metadata) == ListDeque
+}
+
+// putDequeMetadata writes the metadata of a new list in the deque encoding
+func (ldb *LevelDB) putDequeMetadata(key []byte, tipe byte) {
+	ldb.put(encodeMetaKey(key), withEncoding(ldb.newMetadata(key, tipe), ListDeque))
+}
+
+// encodeDequeAttrKey encodes the key of the deque attributes
+func (ldb *LevelDB) encodeDequeAttrKey(key []byte) []byte {
+	return ldb.encodeFieldKey(key, []byte{dequeAttrField})
+}
+
+// encodeDequeElementKey encodes the key of the element of seq, the sign bit of
+// seq is flipped, so the elements sort by seq.
+func encodeDequeElementKey(prefix []byte, seq int64) []byte {
+	k := make([]byte, len(prefix)+1+8)
+	copy(k, prefix)
+	k[len(prefix)] = dequeElementField
+	binary.BigEndian.PutUint64(k[len(prefix)+1:], uint64(seq)^(1<<63))
+	return k
+}
+
+// getDequeAttr returns the attributes of the deque, zero if the list does not exist
+func (ldb *LevelDB) getDequeAttr(key []byte) dequeAttr {
+	return ldb.cached(ldb.encodeDequeAttrKey(key), recordDequeAttr, decodeDequeAttr).(dequeAttr)
+}
+
+// decodeDequeAttr decodes the deque attributes record
+func decodeDequeAttr(m []byte) interface{} {
+	if len(m) < 16 { // no attr or invalid
+		return dequeAttr{}
+	}
+	return dequeAttr{int64(binary.BigEndian.Uint64(m)), int64(binary.BigEndian.Uint64(m[8:]))}
+}
+
+// putDequeAttr writes the attributes of the deque
+func (ldb *LevelDB) putDequeAttr(key []byte, attr dequeAttr) {
+	m := make([]byte, 16)
+	binary.BigEndian.PutUint64(m, uint64(attr.head))
+	binary.BigEndian.PutUint64(m[8:], uint64(attr.tail))
+	ldb.put(ldb.encodeDequeAttrKey(key), m)
+}
+
+// getDequeElement returns the element of seq
+func (ldb *LevelDB) getDequeElement(key []byte, seq int64) []byte {
+	return ldb.cached(encodeDequeElementKey(ldb.valuePrefix(key), seq), recordDequeElement, func(value []byte) interface{} {
+		return value
+	}).([]byte)
+}
+
+// putDequeElement writes the element of seq
+func (ldb *LevelDB) putDequeElement(key []byte, seq int64, v []byte) {
+	ldb.put(encodeDequeElementKey(ldb.valuePrefix(key), seq), v)
+}
+
+// deleteDequeElements deletes the elements of the sequences from first to last,
+// last not included.
+func (ldb *LevelDB) deleteDequeElements(key []byte, first, last int64) {
+	prefix := ldb.valuePrefix(key)
+	keys := [][]byte{}
+	for seq := first; seq < last; seq++ {
+		keys = append(keys, encodeDequeElementKey(prefix, seq))
+	}
+	ldb.delete(keys)
+}
+
+// dequeElements returns the elements from index start to end, both included,
+// they must be in the list.
+func (ldb *LevelDB) dequeElements(key []byte, attr dequeAttr, start, end int) [][]byte {
+	prefix := ldb.valuePrefix(key)
+	r := &util.Range{
+		Start: encodeDequeElementKey(prefix, attr.head+int64(start)),
+		Limit: encodeDequeElementKey(prefix, attr.head+int64(end)+1),
+	}
+
+	elements := [][]byte{}
+	iter := ldb.newIterator(r)
+	for iter.Next() {
+		elements = append(elements, append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ldb.raise("iterate", err)
+	}
+	return elements
+}
+
+// dequePush pushes v to the head or tail, returns the length of the list
+func (ldb *LevelDB) dequePush(key []byte, tipe byte, v []byte, head bool) uint32 {
+	attr := ldb.getDequeAttr(key)
+	if attr.length() == 0 { // empty list
+		ldb.putDequeMetadata(key, tipe)
+		attr = dequeAttr{}
+	}
+
+	if head {
+		attr.head--
+		ldb.putDequeElement(key, attr.head, v)
+	} else {
+		ldb.putDequeElement(key, attr.tail, v)
+		attr.tail++
+	}
+	ldb.putDequeAttr(key, attr)
+	ldb.signal(key)
+	return uint32(attr.length())
+}
+
+// dequePop pops the element from the head or tail, nil if the list is empty
+func (ldb *LevelDB) dequePop(key []byte, head bool) []byte {
+	attr := ldb.getDequeAttr(key)
+	if attr.length() == 0 {
+		return nil
+	}
+
+	seq := attr.tail - 1
+	if head {
+		seq = attr.head
+	}
+	v := ldb.getDequeElement(key, seq)
+	elementKey := encodeDequeElementKey(ldb.valuePrefix(key), seq)
+
+	if attr.length() == 1 {
+		ldb.keyDeleted(key)
+		ldb.delete([][]byte{encodeMetaKey(key), elementKey, ldb.encodeDequeAttrKey(key)})
+		ldb.clearExpireAt(key)
+		return v
+	}
+
+	ldb.delete([][]byte{elementKey})
+	if head {
+		attr.head++
+	} else {
+		attr.tail--
+	}
+	ldb.putDequeAttr(key, attr)
+	return v
+}
+
+// dequeIndex returns the element of index from the head, or from the tail if
+// fromTail, nil if the index is out of range.
+func (ldb *LevelDB) dequeIndex(key []byte, index uint32, fromTail bool) []byte {
+	attr := ldb.getDequeAttr(key)
+	if int64(index) >= int64(attr.length()) {
+		return nil
+	}
+	if fromTail {
+		return ldb.getDequeElement(key, attr.tail-1-int64(index))
+	}
+	return ldb.getDequeElement(key, attr.head+int64(index))
+}
+
+// dequeSet sets the element of index, the negative index counts from the tail.
+// It returns false if the index is out of range.
+func (ldb *LevelDB) dequeSet(key []byte, index int, v []byte) bool {
+	attr := ldb.getDequeAttr(key)
+	if index < 0 {
+		index += attr.length()
+	}
+	if index < 0 || index >= attr.length() {
+		return false
+	}
+	ldb.putDequeElement(key, attr.head+int64(index), v)
+	return true
+}
+
+// dequeRange returns the elements from start to end as LRANGE
+func (ldb *LevelDB) dequeRange(key []byte, start, end int) [][]byte {
+	attr := ldb.getDequeAttr(key)
+	start, end, ok := listRange(attr.length(), start, end)
+	if !ok {
+		return [][]byte{}
+	}
+	return ldb.dequeElements(key, attr, start, end)
+}
+
+// dequeTrim trims the list to the elements from start to end as LTRIM
+func (ldb *LevelDB) dequeTrim(key []byte, start, end int) {
+	attr := ldb.getDequeAttr(key)
+	start, end, ok := listRange(attr.length(), start, end)
+	if !ok {
+		ldb.deleteList(key)
+		return
+	}
+
+	head, tail := attr.head+int64(start), attr.head+int64(end)+1
+	ldb.deleteDequeElements(key, attr.head, head)
+	ldb.deleteDequeElements(key, tail, attr.tail)
+	ldb.putDequeAttr(key, dequeAttr{head, tail})
+}
+
+// dequeWalk calls f with the index and the element from index from to index to,
+// both included, backward if from is after to, until f returns false. The elements
+// are read by chunks of DequeChunk, so the list is not loaded in memory. A chunk
+// is read before f is called with its elements, f may write the elements walked.
+func (ldb *LevelDB) dequeWalk(key []byte, attr dequeAttr, from, to int, f func(i int, v []byte) bool) {
+	if from <= to {
+		for from <= to {
+			end := from + DequeChunk - 1
+			if end > to {
+				end = to
+			}
+			for j, v := range ldb.dequeElements(key, attr, from, end) {
+				if !f(from+j, v) {
+					return
+				}
+			}
+			from = end + 1
+		}
+		return
+	}
+
+	for from >= to {
+		start := from - DequeChunk + 1
+		if start < to {
+			start = to
+		}
+		elements := ldb.dequeElements(key, attr, start, from)
+		for j := len(elements) - 1; j >= 0; j-- {
+			if !f(start+j, elements[j]) {
+				return
+			}
+		}
+		from = start - 1
+	}
+}
+
+// dequeRem removes at most abs(count) elements equal to value, from the head if
+// count is positive, or from the tail. It returns the number of removed elements.
+// The matches are found from the head or the tail until count is reached, then
+// the elements between the first and the last match are compacted to the side
+// with less elements to move. If more than DequeChunk elements would be moved,
+// the list is converted to the linked encoding and done is false, the removal is
+// left to the linked encoding.
+func (ldb *LevelDB) dequeRem(key []byte, count int, value []byte) (r int, done bool) {
+	attr := ldb.getDequeAttr(key)
+	n := attr.length()
+	if n == 0 || count == 0 {
+		return 0, true
+	}
+
+	first, last := n, -1
+	from, to := 0, n-1
+	if count < 0 {
+		from, to = n-1, 0
+	}
+	ldb.dequeWalk(key, attr, from, to, func(i int, v []byte) bool {
+		if bytes.Equal(v, value) {
+			r++
+			if i < first {
+				first = i
+			}
+			if i > last {
+				last = i
+			}
+		}
+		return r != abs(count)
+	})
+	if r == 0 {
+		return 0, true
+	}
+	if r == n {
+		ldb.deleteList(key)
+		return r, true
+	}
+	if last+1 > DequeChunk && n-first > DequeChunk {
+		ldb.dequeToLinked(key, attr)
+		return 0, false
+	}
+
+	// all the elements equal to value from first to last are removed
+	removed := func(i int, v []byte) bool {
+		return i >= first && i <= last && bytes.Equal(v, value)
+	}
+	if last+1 <= n-first { // the elements from the head to last are moved to the tail
+		seq := attr.head + int64(last)
+		ldb.dequeWalk(key, attr, last, 0, func(i int, v []byte) bool {
+			if !removed(i, v) {
+				if seq != attr.head+int64(i) {
+					ldb.putDequeElement(key, seq, v)
+				}
+				seq--
+			}
+			return true
+		})
+		ldb.deleteDequeElements(key, attr.head, seq+1)
+		ldb.putDequeAttr(key, dequeAttr{seq + 1, attr.tail})
+		return r, true
+	}
+
+	// the elements from first to the tail are moved to the head
+	seq := attr.head + int64(first)
+	ldb.dequeWalk(key, attr, first, n-1, func(i int, v []byte) bool {
+		if !removed(i, v) {
+			if seq != attr.head+int64(i) {
+				ldb.putDequeElement(key, seq, v)
+			}
+			seq++
+		}
+		return true
+	})
+	ldb.deleteDequeElements(key, seq, attr.tail)
+	ldb.putDequeAttr(key, dequeAttr{attr.head, seq})
+	return r, true
+}
+
+// dequeInsert inserts value before or after the first element equal to pivot,
+// returns the length of the list, or -1 if pivot is not found. The list is walked
+// until the pivot, then the side of the pivot with less elements is moved by one.
+// If more than DequeChunk elements would be moved, the list is converted to the
+// linked encoding and done is false, the insertion is left to the linked encoding.
+func (ldb *LevelDB) dequeInsert(key []byte, d string, pivot []byte, value []byte) (length int, done bool) {
+	attr := ldb.getDequeAttr(key)
+	n := attr.length()
+	if n == 0 {
+		return -1, true
+	}
+
+	p := -1
+	ldb.dequeWalk(key, attr, 0, n-1, func(i int, v []byte) bool {
+		if bytes.Equal(v, pivot) {
+			p = i
+		}
+		return p == -1
+	})
+	if p == -1 {
+		return -1, true
+	}
+	if d == "after" {
+		p++
+	}
+	if p > DequeChunk && n-p > DequeChunk {
+		ldb.dequeToLinked(key, attr)
+		return 0, false
+	}
+
+	if p <= n-p { // grow at the head, the elements before p are moved
+		if p > 0 {
+			ldb.dequeWalk(key, attr, 0, p-1, func(i int, v []byte) bool {
+				ldb.putDequeElement(key, attr.head+int64(i)-1, v)
+				return true
+			})
+		}
+		ldb.putDequeElement(key, attr.head+int64(p)-1, value)
+		ldb.putDequeAttr(key, dequeAttr{attr.head - 1, attr.tail})
+	} else { // grow at the tail, the elements from p are moved
+		if p < n {
+			ldb.dequeWalk(key, attr, n-1, p, func(i int, v []byte) bool {
+				ldb.putDequeElement(key, attr.head+int64(i)+1, v)
+				return true
+			})
+		}
+		ldb.putDequeElement(key, attr.head+int64(p), value)
+		ldb.putDequeAttr(key, dequeAttr{attr.head, attr.tail + 1})
+	}
+	return n + 1, true
+}
+
+// dequeToLinked converts the list of key to the linked encoding, the elements are
+// linked in the order of the deque by the ids from 1 to the length. They are
+// written once with a new generation, and the deque elements are left to the
+// garbage collector. Then the middle insertions and removals write O(1) records,
+// while LINDEX, LSET and LRANGE walk the links.
+func (ldb *LevelDB) dequeToLinked(key []byte, attr dequeAttr) {
+	metadata := ldb.liveMetadata(key)
+	linked := encodeMetadata(metadata[1], ldb.nextGeneration())
+	prefix := valuePrefix(key, linked)
+	elementKey := func(id uint32) []byte {
+		k := make([]byte, len(prefix)+4)
+		copy(k, prefix)
+		binary.BigEndian.PutUint32(k[len(prefix):], id)
+		return k
+	}
+
+	n := uint32(attr.length())
+	ldb.dequeWalk(key, attr, 0, int(n)-1, func(i int, v []byte) bool {
+		id := uint32(i) + 1
+		next, prev := id%n+1, (id+n-2)%n+1
+		ldb.put(elementKey(id), encodeListElement(next, prev, v))
+		return true
+	})
+	ldb.put(elementKey(0), encodeListAttr(n, 1, n, n))
+	ldb.write(garbage(key, metadata))
+	ldb.put(encodeMetaKey(key), linked)
+}
+
+// listRange normalizes start and end of a list of length l as LRANGE, it returns
+// false if the range is empty.
+func listRange(l, start, end int) (int, int, bool) {
+	if start < 0 {
+		start = l + start
+	}
+	if end < 0 {
+		end = l + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= l {
+		end = l - 1
+	}
+	if start >= l || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
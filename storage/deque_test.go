@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// listModel is the list as a slice, to check the deque by
+type listModel []string
+
+func (m listModel) rem(count int, value string) (listModel, int) {
+	removed := 0
+	keep := make([]bool, len(m))
+	for i := range m {
+		j := i
+		if count < 0 {
+			j = len(m) - 1 - i
+		}
+		if m[j] == value && removed < abs(count) {
+			removed++
+			continue
+		}
+		keep[j] = true
+	}
+	r := listModel{}
+	for i, e := range m {
+		if keep[i] {
+			r = append(r, e)
+		}
+	}
+	return r, removed
+}
+
+func (m listModel) insert(d string, pivot, value string) (listModel, int) {
+	for i, e := range m {
+		if e != pivot {
+			continue
+		}
+		if d == "after" {
+			i++
+		}
+		r := append(listModel{}, m[:i]...)
+		r = append(r, value)
+		return append(r, m[i:]...), len(m) + 1
+	}
+	return m, -1
+}
+
+// checkDeque checks the list is the model, and the elements of a list still in
+// the deque encoding are stored by the sequences from head to tail only.
+func checkDeque(t *testing.T, db *LevelDB, key []byte, m listModel, op string) {
+	t.Helper()
+	elements, err := db.GetListRange(key, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%s", elements) != fmt.Sprint(m) {
+		t.Fatalf("%v, Expect: %v, Get: %s", op, m, elements)
+	}
+	if len(m) == 0 || !db.isDeque(key) {
+		return
+	}
+
+	attr := db.getDequeAttr(key)
+	prefix := db.valuePrefix(key)
+	iter := db.db.NewIterator(util.BytesPrefix(append(prefix, dequeElementField)), nil)
+	n := 0
+	for iter.Next() {
+		if seq := attr.head + int64(n); !bytes.Equal(iter.Key(), encodeDequeElementKey(prefix, seq)) {
+			t.Fatalf("%v, Expect: element of seq %v, Get: %q", op, seq, iter.Key())
+		}
+		n++
+	}
+	iter.Release()
+	if n != len(m) || attr.length() != len(m) {
+		t.Fatalf("%v, Expect: %v elements, Get: %v stored, length %v", op, len(m), n, attr.length())
+	}
+}
+
+func TestDequeRemInsert(t *testing.T) {
+	db := openTest(t)
+	rnd := rand.New(rand.NewSource(1))
+	values := []string{"a", "b", "c", "d"}
+
+	for _, size := range []int{1, 5, DequeChunk - 1, DequeChunk*2 + 3} {
+		key := []byte(fmt.Sprintf("list:%d", size))
+		m := listModel{}
+		for i := 0; i < size; i++ {
+			v := values[rnd.Intn(len(values))]
+			if _, err := db.PushListTail(key, resp.List, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			m = append(m, v)
+		}
+
+		for round := 0; round < 200 && len(m) > 0; round++ {
+			// the operations run in a write context as the commands, or at once
+			tx := db
+			if round%2 == 0 {
+				tx = db.Begin()
+			}
+
+			var op string
+			var n, expect int
+			var err error
+			value := values[rnd.Intn(len(values))]
+			if rnd.Intn(3) == 0 {
+				count := rnd.Intn(7) - 3
+				op = fmt.Sprintf("RemList(%s, %v, %v)", key, count, value)
+				n, err = tx.RemList(key, count, []byte(value))
+				m, expect = m.rem(count, value)
+			} else {
+				d := []string{"before", "after"}[rnd.Intn(2)]
+				pivot := values[rnd.Intn(len(values))]
+				op = fmt.Sprintf("InsertList(%s, %v, %v, %v)", key, d, pivot, value)
+				n, err = tx.InsertList(key, d, []byte(pivot), []byte(value))
+				m, expect = m.insert(d, pivot, value)
+			}
+			if err == nil {
+				err = tx.Commit()
+			}
+			if err != nil {
+				t.Fatalf("%v, %v", op, err)
+			}
+			if n != expect {
+				t.Fatalf("%v, Expect: %v, Get: %v", op, expect, n)
+			}
+			checkDeque(t, db, key, m, op)
+		}
+	}
+}
+
+func TestDequeWalk(t *testing.T) {
+	db := openTest(t)
+	key := []byte("list")
+	n := DequeChunk*2 + 1
+	for i := 0; i < n; i++ {
+		if _, err := db.PushListTail(key, resp.List, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attr := db.getDequeAttr(key)
+
+	tests := []struct {
+		from, to, stop int
+	}{
+		{0, n - 1, -1},
+		{n - 1, 0, -1},
+		{3, 3, -1},
+		{DequeChunk + 5, 2, 10},
+		{1, n - 2, DequeChunk + 1},
+	}
+	for _, test := range tests {
+		walked := []int{}
+		err := guard(func() error {
+			db.dequeWalk(key, attr, test.from, test.to, func(i int, v []byte) bool {
+				if string(v) != fmt.Sprint(i) {
+					t.Fatalf("dequeWalk(%v, %v), Expect: element %v, Get: %s", test.from, test.to, i, v)
+				}
+				walked = append(walked, i)
+				return i != test.stop
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := []int{}
+		for i := test.from; ; {
+			expect = append(expect, i)
+			if i == test.to || i == test.stop {
+				break
+			}
+			if test.from <= test.to {
+				i++
+			} else {
+				i--
+			}
+		}
+		if fmt.Sprint(walked) != fmt.Sprint(expect) {
+			t.Errorf("dequeWalk(%v, %v) stop at %v, Expect: %v, Get: %v", test.from, test.to, test.stop, expect, walked)
+		}
+	}
+}
+
+// TestDequeToLinked checks LINSERT and LREM move at most DequeChunk elements of a
+// deque, the list falls back to the linked encoding for the middle of it.
+func TestDequeToLinked(t *testing.T) {
+	db := openTest(t)
+	n := DequeChunk * 4
+	m := listModel{}
+	for i := 0; i < n; i++ {
+		m = append(m, fmt.Sprint(i))
+	}
+	push := func(key []byte) {
+		for _, v := range m {
+			if _, err := db.PushListTail(key, resp.List, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// run runs op in a write context, and returns the number of writes
+	run := func(op string, f func(tx *LevelDB) (int, error), expect int) int {
+		tx := db.Begin()
+		r, err := f(tx)
+		if err != nil {
+			t.Fatalf("%v, %v", op, err)
+		}
+		if r != expect {
+			t.Fatalf("%v, Expect: %v, Get: %v", op, expect, r)
+		}
+		writes := tx.GetWriteBatch().Len()
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		return writes
+	}
+
+	key := []byte("list")
+	push(key)
+	pivot := fmt.Sprint(DequeChunk - 1)
+	lm, expect := m.insert("before", pivot, "x")
+	writes := run("InsertList near the head", func(tx *LevelDB) (int, error) {
+		return tx.InsertList(key, "before", []byte(pivot), []byte("x"))
+	}, expect)
+	if writes > DequeChunk+1 || !db.isDeque(key) {
+		t.Errorf("InsertList near the head, Expect: deque and at most %v writes, Get: %v, %v", DequeChunk+1, db.isDeque(key), writes)
+	}
+	checkDeque(t, db, key, lm, "InsertList near the head")
+
+	pivot = fmt.Sprint(n / 2)
+	lm, expect = lm.insert("after", pivot, "y")
+	run("InsertList in the middle", func(tx *LevelDB) (int, error) {
+		return tx.InsertList(key, "after", []byte(pivot), []byte("y"))
+	}, expect)
+	if db.isDeque(key) {
+		t.Errorf("InsertList in the middle, Expect: linked, Get: deque")
+	}
+	checkDeque(t, db, key, lm, "InsertList in the middle")
+
+	pivot = fmt.Sprint(n/2 + 10)
+	lm, expect = lm.insert("before", pivot, "z")
+	writes = run("InsertList in the middle of linked", func(tx *LevelDB) (int, error) {
+		return tx.InsertList(key, "before", []byte(pivot), []byte("z"))
+	}, expect)
+	if writes > 4 {
+		t.Errorf("InsertList in the middle of linked, Expect: at most 4 writes, Get: %v", writes)
+	}
+	checkDeque(t, db, key, lm, "InsertList in the middle of linked")
+	if v, err := db.GetLindexFromHead(key, uint32(n/2+2)); err != nil || string(v) != lm[n/2+2] {
+		t.Errorf("GetLindexFromHead of linked, Expect: %v, Get: %q, %v", lm[n/2+2], v, err)
+	}
+
+	key = []byte("rem")
+	push(key)
+	value := fmt.Sprint(n / 2)
+	lm, expect = m.rem(1, value)
+	run("RemList in the middle", func(tx *LevelDB) (int, error) {
+		return tx.RemList(key, 1, []byte(value))
+	}, expect)
+	if db.isDeque(key) {
+		t.Errorf("RemList in the middle, Expect: linked, Get: deque")
+	}
+	checkDeque(t, db, key, lm, "RemList in the middle")
+}
+
+// TestLinkedTrim checks LTRIM of a list fallen back to the linked encoding keeps
+// the elements from start to end, the new tail included.
+func TestLinkedTrim(t *testing.T) {
+	db := openTest(t)
+	key := []byte("list")
+	n := DequeChunk*2 + 44
+	m := listModel{}
+	for i := 0; i < n; i++ {
+		if _, err := db.PushListTail(key, resp.List, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		m = append(m, fmt.Sprint(i))
+	}
+	pivot := fmt.Sprint(n / 2)
+	if _, err := db.InsertList(key, "before", []byte(pivot), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = m.insert("before", pivot, "x")
+	if db.isDeque(key) {
+		t.Fatal("InsertList in the middle, Expect: linked, Get: deque")
+	}
+
+	tests := []struct {
+		start, end int
+	}{
+		{0, -2},
+		{1, -1},
+		{2, -3},
+		{5, 5},
+	}
+	for _, test := range tests {
+		if err := db.TrimList(key, test.start, test.end); err != nil {
+			t.Fatal(err)
+		}
+		start, end, _ := listRange(len(m), test.start, test.end)
+		m = m[start : end+1]
+		checkDeque(t, db, key, m, fmt.Sprintf("TrimList(%v, %v)", test.start, test.end))
+		if v, err := db.GetLindexFromTail(key, 0); err != nil || string(v) != m[len(m)-1] {
+			t.Errorf("GetLindexFromTail(0) after TrimList(%v, %v), Expect: %v, Get: %q, %v", test.start, test.end, m[len(m)-1], v, err)
+		}
+	}
+}
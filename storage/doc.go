@@ -15,37 +15,73 @@
 // Metadata format:
 //      first byte: meta data version
 //      second byte: lower 4 bits: RedisType, upper 4 bits: if has expire value
+//      8 bytes big endian: generation
+//      optional 1 byte: encoding of the value keys, the default encoding if absent
 //
-// Valuekey always has a prefix: '-'. For hash/set data type, use '|' as seperator.
+// Valuekey always has a prefix: '-', followed by the length of rKey (4 bytes big endian),
+// rKey and the generation of its metadata, so the value keys of a rKey never collide with
+// others, and all value keys of a rKey are found by the prefix '-' + len(rKey) + rKey + Gen.
+// A new generation is allocated when the rKey is created, so the value keys left by the
+// deleted rKey are never read again.
 //
 // String Type:
-//      +StringKey   -> metadata (2 bytes)
-//      -StringKey   -> string value
+//      +StringKey                   -> metadata (10 bytes)
+//      -len(StringKey)StringKeyGen  -> string value
 //
 // Hash Type:
-//      +HashKey        -> metadata (2 bytes)
-//      -HashKey|Field1 -> value1
-//      -HashKey|Field2 -> value2
-//      -HashKey|Field3 -> value3
+//      +HashKey                      -> metadata (10 bytes)
+//      -len(HashKey)HashKeyGenField1 -> value1
+//      -len(HashKey)HashKeyGenField2 -> value2
+//      -len(HashKey)HashKeyGenField3 -> value3
 //
 // List Type:
-//      +ListKey            -> metadata (2 bytes)
-//      -ListKey|0x00000000 -> attrdata (4 bytes for length + 4 bytes for head + 4 bytes for tail + 4 bytes for counter)
-//      -ListKey|0x00000001 -> 0x00000002|0x00000003|item1 (next|prev|value)
-//      -ListKey|0x00000002 -> 0x00000003|0x00000001|item2 (next|prev|value)
-//      -ListKey|0x00000003 -> 0x00000000|0x00000002|item3 (next|prev|value)
+//      +ListKey                          -> metadata (10 bytes)
+//      -len(ListKey)ListKeyGen0x00000000 -> attrdata (4 bytes for length + 4 bytes for head + 4 bytes for tail + 4 bytes for counter)
+//      -len(ListKey)ListKeyGen0x00000001 -> 0x00000002|0x00000003|item1 (next|prev|value)
+//      -len(ListKey)ListKeyGen0x00000002 -> 0x00000003|0x00000001|item2 (next|prev|value)
+//      -len(ListKey)ListKeyGen0x00000003 -> 0x00000000|0x00000002|item3 (next|prev|value)
+//
+// List Type in deque encoding (0x01), the elements are addressed by sequence numbers, the new
+// lists are in this encoding:
+//      +ListKey                            -> metadata (11 bytes)
+//      -len(ListKey)ListKeyGen0x00         -> attrdata (8 bytes for head + 8 bytes for tail, signed)
+//      -len(ListKey)ListKeyGen0x01Seq      -> item, Seq is 8 bytes big endian with the sign bit
+//                                             flipped, from head to tail (not included)
 //
 // Set Type:
 //      Using hash as the internal data structure, with the value = []byte{"set"}
 //
 // SkipList Type:
-//      +ListKey            -> metadata (2 bytes)
-//      -ListKey|0x00000000 -> attrdata (4 bytes for length + 1 byte for level + 4 bytes for head + 4 bytes for tail + 4 bytes for counter)
-//      -ListKey|0x00000001 -> head ()
+//      +ListKey                          -> metadata (10 bytes)
+//      -len(ListKey)ListKeyGen0x00000000 -> attrdata (4 bytes for length + 4 bytes for level + 1 byte for tail length + tail)
+//      -len(ListKey)ListKeyGen0x00000001 -> head
+//      -len(ListKey)ListKeyGenField      -> score (8 bytes) + backward + levels (forward + span)
+//
+// Legacy Layouts: the keys with metadata version 0x00 use the value keys -rKey for string,
+// and -rKey|Field for others, where a rKey with '|' may collide with the fields of other
+// rKey. The keys with metadata version 0x01 use the value keys -len(rKey)rKey without
+// generation. They are read as is, migrated to the current layout before modified, and by
+// the migrator in background after the leveldb is opened.
+//
+// Generations:
+//      -SYSGeneration| -> reserved generation (8 bytes), generations up to it may be used
+//      -SYSFlushed|    -> flushed generation (8 bytes), the keys before it are deleted by flush
 //
-// Expire Hash: to store expire of keys, using time.Unix value
+// Garbage Queue: the value keys of the deleted rKey, deleted by the background collector
+//      -SYSGarbage|Prefix -> nil, Prefix is the value key prefix of the deleted rKey
+//      -SYSGarbage|       -> nil, the keys before the flushed generation are to be deleted
+//
+// Expire Hash: to store expire of keys, using unix milliseconds
 //      +SYSExpire -> metadata (as hash)
-//      -SYSExpire|rKey -> time.Unix()
+//      -SYSExpire|rKey -> ExpireVersion (1 byte) + unix milliseconds (8 bytes)
+//      The old format without the version byte is 8 bytes of time.Unix(), it is read
+//      as is and converted when the sweeper starts.
+//
+// Expire Index: time ordered index of the expire hash, walked by the background sweeper
+//      -SYSExpireAt|unix milliseconds (8 bytes)|rKey -> nil
+//
+// The system keys never collide with the value keys, as the length 'SYSE', 'SYSF' or 'SYSG'
+// of a value key would be longer than the max length of rKey.
 //
 
 package storage
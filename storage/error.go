@@ -0,0 +1,160 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/libgo/logx"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+// ErrorKind is the kind of a storage error
+type ErrorKind int
+
+const (
+	KindIO            ErrorKind = iota + 1 // the backend failed to read or write
+	KindDiskFull                           // the backend failed to write for no space left
+	KindCorruption                         // the backend data is corrupted
+	KindNotFound                           // an entry of an existing key is missing
+	KindWrongMetadata                      // the metadata of a key can not be parsed
+	KindReadOnly                           // the write is rejected in the read only mode
+)
+
+var kindNames = map[ErrorKind]string{
+	KindIO:            "I/O error",
+	KindDiskFull:      "disk is full",
+	KindCorruption:    "data is corrupted",
+	KindNotFound:      "entry not found",
+	KindWrongMetadata: "wrong metadata",
+	KindReadOnly:      "read only",
+}
+
+// String returns the name of the kind
+func (k ErrorKind) String() string {
+	return kindNames[k]
+}
+
+// Error is the error of a storage operation, returned by the exported functions
+// of LevelDB
+type Error struct {
+	Kind ErrorKind
+	Op   string // the operation failed, like get, write or iterate
+	Err  error  // the error of the backend
+}
+
+// Error implements error
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Kind, e.Op, e.Err)
+}
+
+// Unwrap returns the error of the backend
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError classifies the error of the backend by its kind
+func newError(op string, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	kind := KindIO
+	switch {
+	case err == leveldb.ErrNotFound:
+		kind = KindNotFound
+	case err == ErrMetaFormat:
+		kind = KindWrongMetadata
+	case lerrors.IsCorrupted(err):
+		kind = KindCorruption
+	case errors.Is(err, syscall.ENOSPC):
+		kind = KindDiskFull
+	}
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// readOnly is the server wide read only mode, the writes are rejected once the
+// backend reports disk full or corruption, until the server restarts.
+var readOnly struct {
+	sync.RWMutex
+	cause *Error
+}
+
+// ReadOnly returns the error which turned the server into the read only mode, nil
+// if the server is writable.
+func ReadOnly() error {
+	readOnly.RLock()
+	defer readOnly.RUnlock()
+	if readOnly.cause == nil {
+		return nil
+	}
+	return readOnly.cause
+}
+
+// writable returns the read only error to reject a write, nil if the server is
+// writable.
+func writable(op string) *Error {
+	if err := ReadOnly(); err != nil {
+		return &Error{Kind: KindReadOnly, Op: op, Err: err}
+	}
+	return nil
+}
+
+// fallback turns the server into the read only mode if the backend reports disk
+// full or corruption, as the writes may fail or corrupt more data.
+func fallback(e *Error) {
+	if e.Kind != KindDiskFull && e.Kind != KindCorruption {
+		return
+	}
+
+	readOnly.Lock()
+	defer readOnly.Unlock()
+	if readOnly.cause == nil {
+		readOnly.cause = e
+		logx.Errorf("Storage %v, the server is read only until restart", e)
+	}
+}
+
+// error returns the storage error of the failed operation. The write context
+// fails with it, so nothing of the context is committed.
+func (ldb *LevelDB) error(op string, err error) *Error {
+	e := newError(op, err)
+	fallback(e)
+	if ldb.wb != nil && ldb.wb.err == nil {
+		ldb.wb.err = e
+	}
+	return e
+}
+
+// raise aborts the storage operation with the storage error, the exported
+// function running the operation returns it by catch.
+func (ldb *LevelDB) raise(op string, err error) {
+	panic(ldb.error(op, err))
+}
+
+// catch recovers the storage error which aborts the operation, and sets it to
+// err. It is deferred by the exported functions, so the helpers do not check the
+// error of every read and write, while the callers get it as the returned error.
+func catch(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(*Error)
+		if !ok {
+			panic(r)
+		}
+		*err = e
+	}
+}
+
+// guard calls f, and returns the storage error which aborts f, or the error of
+// f, for the background operations.
+func guard(f func() error) (err error) {
+	defer catch(&err)
+	return f()
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{leveldb.ErrNotFound, KindNotFound},
+		{ErrMetaFormat, KindWrongMetadata},
+		{&lerrors.ErrCorrupted{Err: errors.New("bad block")}, KindCorruption},
+		{&os.PathError{Op: "write", Path: "000001.log", Err: syscall.ENOSPC}, KindDiskFull},
+		{errors.New("closed"), KindIO},
+	}
+	for i, test := range tests {
+		if e := newError("get", test.err); e.Kind != test.kind || e.Err != test.err {
+			t.Errorf("newError[%v](%v), Expect: %v, Get: %v", i, test.err, test.kind, e.Kind)
+		}
+	}
+
+	e := &Error{Kind: KindIO, Op: "get", Err: errors.New("closed")}
+	if newError("write", e) != e {
+		t.Errorf("newError(*Error), Expect: the error itself")
+	}
+}
+
+// resetReadOnly turns the server writable again after a test of the read only mode
+func resetReadOnly() {
+	readOnly.Lock()
+	readOnly.cause = nil
+	readOnly.Unlock()
+}
+
+func TestFallback(t *testing.T) {
+	defer resetReadOnly()
+	db := openTest(t)
+	if err := db.PutString([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	fallback(&Error{Kind: KindIO, Op: "write", Err: errors.New("closed")})
+	fallback(&Error{Kind: KindNotFound, Op: "get", Err: leveldb.ErrNotFound})
+	if err := ReadOnly(); err != nil {
+		t.Fatalf("ReadOnly after I/O errors, Expect: nil, Get: %v", err)
+	}
+
+	full := &Error{Kind: KindDiskFull, Op: "write", Err: syscall.ENOSPC}
+	fallback(full)
+	fallback(&Error{Kind: KindCorruption, Op: "get", Err: errors.New("bad block")})
+	if err := ReadOnly(); err != full {
+		t.Fatalf("ReadOnly after disk full, Expect: %v, Get: %v", full, err)
+	}
+
+	// the writes are rejected, the reads are served
+	err := db.PutString([]byte("b"), []byte("2"))
+	if e, ok := err.(*Error); !ok || e.Kind != KindReadOnly || e.Err != full {
+		t.Errorf("PutString in read only mode, Expect: %v error, Get: %v", KindReadOnly, err)
+	}
+	tx := db.Begin()
+	tx.PutString([]byte("a"), []byte("2")) // pending until commit
+	if err := tx.Commit(); err == nil {
+		t.Errorf("Commit in read only mode, Expect: %v error, Get: nil", KindReadOnly)
+	}
+	if v, err := db.GetString([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("GetString in read only mode, Expect: 1, Get: %q, %v", v, err)
+	}
+	if exist, _, err := db.Has([]byte("b")); err != nil || exist {
+		t.Errorf("Has(b) in read only mode, Expect: false, Get: %v, %v", exist, err)
+	}
+}
+
+func TestReturnError(t *testing.T) {
+	db := openTest(t)
+	key := []byte("broken")
+	if err := db.db.Put(encodeMetaKey(key), []byte{0xff, 's'}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := db.Has(key)
+	if e, ok := err.(*Error); !ok || e.Kind != KindWrongMetadata {
+		t.Errorf("Has on wrong metadata, Expect: %v error, Get: %v", KindWrongMetadata, err)
+	}
+
+	// the failed operation fails the write context, nothing is committed
+	tx := db.Begin()
+	tx.PutString([]byte("a"), []byte("1"))
+	if _, _, err := tx.Has(key); err == nil {
+		t.Fatalf("Has on wrong metadata, Expect: %v error, Get: nil", KindWrongMetadata)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Errorf("Commit after the failed operation, Expect: error, Get: nil")
+	}
+	if exist, _, err := db.Has([]byte("a")); err != nil || exist {
+		t.Errorf("Has(a) after the failed commit, Expect: false, Get: %v, %v", exist, err)
+	}
+}
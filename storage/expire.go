@@ -6,14 +6,53 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
-	ExpireKey []byte = []byte("SYSExpire")
+	ExpireKey      []byte = []byte("SYSExpire")
+	ExpireIndexKey []byte = []byte("SYSExpireAt")
+)
+
+const (
+	// ExpireVersion is the version byte of expire value, the value without the
+	// version byte stores unix seconds.
+	ExpireVersion byte = 0x01
+
+	// ExpireSweepInterval is how often the background sweeper wakes up.
+	ExpireSweepInterval = 100 * time.Millisecond
+	// ExpireSweepBatch is the max number of index entries handled while
+	// holding the locks of their keys, so clients are not starved by a big sweep.
+	ExpireSweepBatch = 128
 )
 
+// ExpireStats is the statistics of the background expire sweeper
+type ExpireStats struct {
+	Runs         uint64        // sweep rounds
+	Scanned      uint64        // index entries visited
+	Expired      uint64        // keys deleted by the sweeper
+	Stale        uint64        // index entries without a matching expire
+	LastRun      time.Time     // start time of the last round
+	LastDuration time.Duration // duration of the last round
+}
+
+// expireSweeper sweeps expired keys of one leveldb in background
+type expireSweeper struct {
+	mu    sync.Mutex
+	stats ExpireStats
+	quit  chan struct{}
+	done  chan struct{}
+}
+
 // encodeExpireKey encodes expire key as -SYSExpire|key
 func encodeExpireKey(key []byte) []byte {
 	expireKey := []byte{ValuePrefix}
@@ -23,30 +62,333 @@ func encodeExpireKey(key []byte) []byte {
 	return expireKey
 }
 
+// encodeExpireIndexKey encodes the time ordered index key as -SYSExpireAt|at|key,
+// at is 8 bytes big endian unix milliseconds, so the index sorts by expire time.
+func encodeExpireIndexKey(at []byte, key []byte) []byte {
+	indexKey := []byte{ValuePrefix}
+	indexKey = append(indexKey, ExpireIndexKey...)
+	indexKey = append(indexKey, Seperator)
+	indexKey = append(indexKey, at...)
+	indexKey = append(indexKey, key...)
+	return indexKey
+}
+
+// encodeExpireAt encodes expire value: ExpireVersion + 8 bytes big endian unix milliseconds
+func encodeExpireAt(ms int64) []byte {
+	v := make([]byte, 9)
+	v[0] = ExpireVersion
+	binary.BigEndian.PutUint64(v[1:], uint64(ms))
+	return v
+}
+
+// decodeExpireAt decodes expire value to unix milliseconds. The 8 bytes value
+// without version byte is the old format, which stores unix seconds.
+func decodeExpireAt(v []byte) (int64, bool) {
+	switch {
+	case len(v) == 8:
+		return int64(binary.BigEndian.Uint64(v)) * 1000, true
+	case len(v) == 9 && v[0] == ExpireVersion:
+		return int64(binary.BigEndian.Uint64(v[1:])), true
+	}
+	return 0, false
+}
+
+// expireIndexAt returns the at part of the index key for an expire value, the
+// old format index uses the unix seconds as is.
+func expireIndexAt(v []byte) []byte {
+	if len(v) == 9 {
+		return v[1:]
+	}
+	return v
+}
+
+// unixMilli converts time.Time to unix milliseconds
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 // GetExpireAt returns expire as time.Time
-func (ldb *LevelDB) GetExpireAt(key []byte) *time.Time {
+func (ldb *LevelDB) GetExpireAt(key []byte) (at *time.Time, err error) {
+	defer catch(&err)
+	return ldb.expireAt(key), nil
+}
+
+// expireAt returns expire as time.Time, nil if the key has no expire
+func (ldb *LevelDB) expireAt(key []byte) *time.Time {
 	at := ldb.get(encodeExpireKey(key))
 	// no expire, return nil
 	if len(at) == 0 {
 		return nil
 	}
 
-	r := time.Unix(int64(binary.BigEndian.Uint64(at)), 0)
+	ms, ok := decodeExpireAt(at)
+	if !ok {
+		return nil
+	}
+	r := time.Unix(0, ms*int64(time.Millisecond))
 	return &r
 }
 
 // ClearExpireAt clears expire
-func (ldb *LevelDB) ClearExpireAt(key []byte) {
-	ldb.delete([][]byte{encodeExpireKey(key)})
+func (ldb *LevelDB) ClearExpireAt(key []byte) (err error) {
+	defer catch(&err)
+	ldb.clearExpireAt(key)
+	return nil
+}
+
+// clearExpireAt clears expire, the storage error is raised
+func (ldb *LevelDB) clearExpireAt(key []byte) {
+	at := ldb.get(encodeExpireKey(key))
+	if len(at) == 0 {
+		return
+	}
+	ldb.touch(key)
+	ldb.delete([][]byte{encodeExpireKey(key), encodeExpireIndexKey(expireIndexAt(at), key)})
 }
 
 // SetExpireAt stores the value to expire
-func (ldb *LevelDB) SetExpireAt(key []byte, at *time.Time) {
+func (ldb *LevelDB) SetExpireAt(key []byte, at *time.Time) (err error) {
+	defer catch(&err)
 	if at == nil || at.IsZero() {
+		return nil
+	}
+	ldb.putExpireAt(key, unixMilli(*at))
+	return nil
+}
+
+// putExpireAt writes expire value and its index entry, and removes the index
+// entry of the old value.
+func (ldb *LevelDB) putExpireAt(key []byte, ms int64) {
+	ldb.touch(key)
+	v := encodeExpireAt(ms)
+
+	batch := new(leveldb.Batch)
+	if old := ldb.get(encodeExpireKey(key)); len(old) != 0 {
+		batch.Delete(encodeExpireIndexKey(expireIndexAt(old), key))
+	}
+	batch.Put(encodeExpireKey(key), v)
+	batch.Put(encodeExpireIndexKey(expireIndexAt(v), key), nil)
+	ldb.write(batch)
+}
+
+// deleteKey deletes a key with all its data by type in one batch, returns the
+// error of the commit out of a write context.
+func (ldb *LevelDB) deleteKey(key []byte, tipe byte) error {
+	return ldb.update(func(tx *LevelDB) {
+		switch tipe {
+		case resp.String:
+			tx.deleteString(key)
+		case resp.Hash:
+			tx.deleteHash(key)
+		case resp.List:
+			tx.deleteList(key)
+		case resp.Set:
+			tx.deleteHash(key)
+		case resp.SortedSet:
+			tx.deleteSkip(key)
+		default:
+			tx.clearExpireAt(key)
+		}
+	})
+}
+
+// activeExpire is 0 if the expire sweepers of all dbs are paused
+var activeExpire int32 = 1
+
+// SetActiveExpire resumes or pauses the expire sweepers of all dbs, as DEBUG
+// SET-ACTIVE-EXPIRE. The expired keys are kept while paused, the reads still see
+// them expired.
+func SetActiveExpire(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&activeExpire, v)
+}
+
+// ExpireStats returns the statistics of the background expire sweeper
+func (ldb *LevelDB) ExpireStats() ExpireStats {
+	if ldb.sweeper == nil {
+		return ExpireStats{}
+	}
+	ldb.sweeper.mu.Lock()
+	defer ldb.sweeper.mu.Unlock()
+	return ldb.sweeper.stats
+}
+
+// startSweeper starts the background goroutine to delete expired keys
+func (ldb *LevelDB) startSweeper(interval time.Duration) {
+	ldb.sweeper = &expireSweeper{quit: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(ldb.sweeper.done)
+
+		ldb.rebuildExpireIndex()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ldb.sweeper.quit:
+				return
+			case <-ticker.C:
+				ldb.sweep()
+			}
+		}
+	}()
+}
+
+// stopSweeper stops the sweeper and waits the running round finished
+func (ldb *LevelDB) stopSweeper() {
+	if ldb.sweeper == nil {
+		return
+	}
+	close(ldb.sweeper.quit)
+	<-ldb.sweeper.done
+}
+
+// rebuildExpireIndex adds the missing index entries for expires written before the
+// index existed, and converts the old unix seconds expires to milliseconds.
+func (ldb *LevelDB) rebuildExpireIndex() {
+	if ReadOnly() != nil {
+		return
+	}
+	ldb.Lock()
+	defer ldb.Unlock()
+
+	prefix := encodeExpireKey(nil)
+	batch := new(leveldb.Batch)
+	iter := ldb.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		key := iter.Key()[len(prefix):]
+		v := iter.Value()
+		if len(v) == 8 { // old format, upgrade it
+			ms, _ := decodeExpireAt(v)
+			batch.Delete(encodeExpireIndexKey(v, key))
+			v = encodeExpireAt(ms)
+			batch.Put(encodeExpireKey(key), v)
+		}
+		batch.Put(encodeExpireIndexKey(expireIndexAt(v), key), nil)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		logx.Errorf("Rebuild expire index error: %v", err)
+		return
+	}
+	if err := ldb.db.Write(batch, nil); err != nil {
+		logx.Errorf("Rebuild expire index error: %v", err)
+	}
+}
+
+// sweep walks the expire index in time order and deletes the expired keys,
+// ExpireSweepBatch entries per lock, until no entry is due. The expired keys are
+// kept in the read only mode, or while the sweepers are paused, the reads still
+// see them expired.
+func (ldb *LevelDB) sweep() {
+	if ReadOnly() != nil || atomic.LoadInt32(&activeExpire) == 0 {
 		return
 	}
 
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, uint64(at.Unix()))
-	ldb.put(encodeExpireKey(key), buf)
+	start := time.Now()
+	var scanned, expired, stale uint64
+
+	err := guard(func() error {
+		for {
+			s, e, t, more, err := ldb.sweepBatch(time.Now())
+			scanned += s
+			expired += e
+			stale += t
+			if err != nil || !more {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		logx.Errorf("Expire sweeper of db %v error: %v", ldb.index, err)
+	}
+
+	ldb.sweeper.mu.Lock()
+	ldb.sweeper.stats.Runs++
+	ldb.sweeper.stats.Scanned += scanned
+	ldb.sweeper.stats.Expired += expired
+	ldb.sweeper.stats.Stale += stale
+	ldb.sweeper.stats.LastRun = start
+	ldb.sweeper.stats.LastDuration = time.Since(start)
+	ldb.sweeper.mu.Unlock()
+
+	if expired != 0 || stale != 0 {
+		logx.Debugf("Expire sweeper deleted %v keys, %v stale index entries in %v", expired, stale, time.Since(start))
+	}
+}
+
+// sweepBatch handles at most ExpireSweepBatch due index entries, more is true if
+// the batch is full and there may be more due entries. The due entries are read
+// without lock, then only the keys of them are locked, and each entry is checked
+// again under the key lock, so the commands on other keys are not stalled.
+func (ldb *LevelDB) sweepBatch(now time.Time) (scanned, expired, stale uint64, more bool, err error) {
+	due := make([]byte, 8)
+	binary.BigEndian.PutUint64(due, uint64(unixMilli(now)))
+
+	prefix := encodeExpireIndexKey(nil, nil)
+	limit := encodeExpireIndexKey(due, nil)
+
+	type entry struct {
+		at  []byte
+		key []byte
+	}
+	entries := []entry{}
+
+	iter := ldb.db.NewIterator(&util.Range{Start: prefix, Limit: limit}, nil)
+	for iter.Next() {
+		if len(entries) == ExpireSweepBatch {
+			more = true
+			break
+		}
+		k := iter.Key()[len(prefix):]
+		if len(k) < 8 {
+			continue
+		}
+		entries = append(entries, entry{append([]byte{}, k[:8]...), append([]byte{}, k[8:]...)})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, 0, 0, false, ldb.error("iterate", err)
+	}
+	if len(entries) == 0 {
+		return 0, 0, 0, false, nil
+	}
+
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = e.key
+	}
+	unlock := ldb.LockKeys(keys, true)
+	defer unlock()
+
+	for _, e := range entries {
+		scanned++
+
+		at := ldb.get(encodeExpireKey(e.key))
+		if !bytes.Equal(expireIndexAt(at), e.at) { // the expire was changed or cleared
+			ldb.delete([][]byte{encodeExpireIndexKey(e.at, e.key)})
+			stale++
+			continue
+		}
+
+		// Index entries of the old unix seconds format always sort before now,
+		// convert them and check the real expire time.
+		if ms, _ := decodeExpireAt(at); ms > unixMilli(now) {
+			ldb.putExpireAt(e.key, ms)
+			continue
+		}
+
+		exist, tipe := ldb.has(encodeMetaKey(e.key))
+		if err := ldb.deleteKey(e.key, tipe); err != nil {
+			return scanned, expired, stale, false, err
+		}
+		if exist {
+			expired++
+		}
+	}
+	return scanned, expired, stale, more, nil
 }
@@ -0,0 +1,383 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	GenerationKey []byte = []byte("SYSGeneration")
+	FlushedKey    []byte = []byte("SYSFlushed")
+	GarbageKey    []byte = []byte("SYSGarbage")
+)
+
+const (
+	// GenerationReserve is the number of generations reserved by one write of
+	// the GenerationKey, the reserved generations are skipped after restart.
+	GenerationReserve = 1024
+
+	// GCInterval is how often the garbage collector wakes up.
+	GCInterval = 100 * time.Millisecond
+	// GCBatch is the max number of entries visited per batch.
+	GCBatch = 1024
+)
+
+// garbageCollector deletes the value keys of the deleted keys in background
+type garbageCollector struct {
+	from []byte // position of the scan for the flushed keys, reset by Flush under the write lock
+	quit chan struct{}
+	done chan struct{}
+}
+
+// encodeSystemKey encodes system key: -Name|suffix
+func encodeSystemKey(name []byte, suffix []byte) []byte {
+	systemKey := []byte{ValuePrefix}
+	systemKey = append(systemKey, name...)
+	systemKey = append(systemKey, Seperator)
+	systemKey = append(systemKey, suffix...)
+	return systemKey
+}
+
+// encodeGarbageKey encodes the garbage queue entry of the value key prefix:
+// -SYSGarbage|prefix, the empty prefix is for the keys deleted by Flush.
+func encodeGarbageKey(prefix []byte) []byte {
+	return encodeSystemKey(GarbageKey, prefix)
+}
+
+// loadGenerations reads the reserved generation and the flushed generation
+func (ldb *LevelDB) loadGenerations() {
+	if v := ldb.get(encodeSystemKey(GenerationKey, nil)); len(v) == 8 {
+		ldb.genReserved = binary.BigEndian.Uint64(v)
+		ldb.gen = ldb.genReserved
+	}
+	if v := ldb.get(encodeSystemKey(FlushedKey, nil)); len(v) == 8 {
+		atomic.StoreUint64(&ldb.flushed, binary.BigEndian.Uint64(v))
+	}
+}
+
+// nextGeneration returns a new generation, which is never used by other keys.
+// The reservation is written to leveldb at once even in a write context, so a
+// generation is never returned again after restart.
+func (ldb *LevelDB) nextGeneration() uint64 {
+	ldb.genMu.Lock()
+	defer ldb.genMu.Unlock()
+
+	ldb.gen++
+	if ldb.gen > ldb.genReserved {
+		ldb.genReserved = ldb.gen + GenerationReserve
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, ldb.genReserved)
+		batch := new(leveldb.Batch)
+		batch.Put(encodeSystemKey(GenerationKey, nil), v)
+		ldb.writeNow("generation", batch)
+	}
+	return ldb.gen
+}
+
+// live returns true if the key of metadata is not deleted by Flush, before the
+// snapshot is taken for a snapshot handle, or by the pending Flush of a write
+// context
+func (ldb *LevelDB) live(metadata []byte) bool {
+	if isLegacy(metadata) {
+		return true
+	}
+	if ldb.snap != nil {
+		return metadataGeneration(metadata) >= ldb.snap.flushed
+	}
+	if ldb.wb != nil && ldb.wb.flushed != 0 {
+		return metadataGeneration(metadata) >= ldb.wb.flushed
+	}
+	return metadataGeneration(metadata) >= atomic.LoadUint64(&ldb.flushed)
+}
+
+// liveMetadata returns the metadata of key, nil if the key does not exist or is
+// deleted by Flush
+func (ldb *LevelDB) liveMetadata(key []byte) []byte {
+	metadata := ldb.metadata(encodeMetaKey(key))
+	if metadata == nil || !ldb.live(metadata) {
+		return nil
+	}
+	return metadata
+}
+
+// newMetadata returns the metadata to write key of tipe. The generation and the
+// encoding of the existing key of tipe are kept, the existing key of other type
+// is dropped.
+// Otherwise the key is counted as created with a new generation, and the expire
+// left by Flush is cleared.
+func (ldb *LevelDB) newMetadata(key []byte, tipe byte) []byte {
+	metadata := ldb.metadata(encodeMetaKey(key))
+	switch {
+	case metadata == nil:
+		ldb.keyCreated(key)
+	case !ldb.live(metadata): // deleted by Flush
+		ldb.keyCreated(key)
+		ldb.clearExpireAt(key)
+	case metadata[1] == tipe:
+		return withEncoding(encodeMetadata(tipe, metadataGeneration(metadata)), metadataEncoding(metadata))
+	default:
+		ldb.write(garbage(key, metadata))
+	}
+	return encodeMetadata(tipe, ldb.nextGeneration())
+}
+
+// garbage returns the batch to queue the value keys of metadata to the garbage
+// collector
+func garbage(key []byte, metadata []byte) *leveldb.Batch {
+	batch := new(leveldb.Batch)
+	batch.Put(encodeGarbageKey(valuePrefix(key, metadata)), nil)
+	return batch
+}
+
+// dropKey deletes the metadata of key, and queues its value keys to the garbage
+// collector, so a key of any size is deleted in O(1).
+func (ldb *LevelDB) dropKey(key []byte) {
+	batch := new(leveldb.Batch)
+	if metadata := ldb.liveMetadata(key); metadata != nil {
+		batch = garbage(key, metadata)
+	}
+	batch.Delete(encodeMetaKey(key))
+	ldb.write(batch)
+}
+
+// Flush deletes all keys in O(1): the keys with generation before the flushed
+// generation are dead, and deleted by the garbage collector in background. The
+// flushed generation is seen by the other handles only after it is committed. The
+// leveldb with keys in the legacy layout is flushed by deleting all entries.
+func (ldb *LevelDB) Flush() (err error) {
+	defer catch(&err)
+	ldb.touchAll()
+	if atomic.LoadInt32(&ldb.legacy) != 0 {
+		return ldb.flushAll()
+	}
+
+	gen := ldb.nextGeneration()
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, gen)
+
+	batch := new(leveldb.Batch)
+	batch.Put(encodeSystemKey(FlushedKey, nil), v)
+	batch.Put(encodeGarbageKey(nil), nil)
+	ldb.write(batch)
+	if ldb.wb != nil {
+		ldb.wb.flushed = gen
+		ldb.wb.keys = nil // the keys counted before are reset, the keys after are counted again
+	}
+	ldb.afterCommit(func() {
+		atomic.StoreUint64(&ldb.flushed, gen)
+		atomic.StoreInt64(&ldb.keys, 0)
+		if ldb.gc != nil {
+			ldb.gc.from = nil // the scan restarts for the new flushed generation
+		}
+	})
+	return nil
+}
+
+// flushAll deletes all entries, but the generations, and the pending writes of
+// the write context
+func (ldb *LevelDB) flushAll() error {
+	if ldb.wb != nil {
+		ldb.wb = newWriteBatch()
+	}
+	if err := writable("flush"); err != nil {
+		return ldb.error("flush", err)
+	}
+	defer ldb.cache.purge() // after the entries are deleted
+	iter := ldb.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if err := ldb.db.Delete(iter.Key(), nil); err != nil {
+			iter.Release()
+			return ldb.error("flush", err)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return ldb.error("flush", err)
+	}
+	atomic.StoreInt64(&ldb.keys, 0)
+	atomic.StoreInt32(&ldb.legacy, 0)
+
+	ldb.genMu.Lock()
+	ldb.genReserved = ldb.gen // reserve again by the next generation
+	ldb.genMu.Unlock()
+	return nil
+}
+
+// startGC starts the background goroutine to delete the garbage
+func (ldb *LevelDB) startGC(interval time.Duration) {
+	ldb.gc = &garbageCollector{quit: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(ldb.gc.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ldb.gc.quit:
+				return
+			case <-ticker.C:
+				ldb.collect()
+			}
+		}
+	}()
+}
+
+// stopGC stops the garbage collector and waits the running batch finished
+func (ldb *LevelDB) stopGC() {
+	if ldb.gc == nil {
+		return
+	}
+	close(ldb.gc.quit)
+	<-ldb.gc.done
+}
+
+// collect deletes the garbage, GCBatch entries per lock, until the garbage queue
+// is empty. The garbage is kept in the read only mode.
+func (ldb *LevelDB) collect() {
+	if ReadOnly() != nil {
+		return
+	}
+
+	start := time.Now()
+	deleted := 0
+	err := guard(func() error {
+		for {
+			n, more := ldb.collectBatch()
+			deleted += n
+			if !more {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		logx.Errorf("Garbage collector of db %v error: %v", ldb.index, err)
+	}
+
+	if deleted != 0 {
+		logx.Debugf("Garbage collector deleted %v entries in %v", deleted, time.Since(start))
+	}
+}
+
+// collectBatch handles the first entry of the garbage queue, at most GCBatch
+// entries are visited. more is false if the queue is empty. The value keys of a
+// queued prefix are of a dead generation, which is never used again, so they are
+// deleted without any lock.
+func (ldb *LevelDB) collectBatch() (deleted int, more bool) {
+	queue := encodeGarbageKey(nil)
+	iter := ldb.db.NewIterator(util.BytesPrefix(queue), nil)
+	if !iter.First() {
+		iter.Release()
+		return 0, false
+	}
+	garbageKey := append([]byte{}, iter.Key()...)
+	iter.Release()
+
+	prefix := garbageKey[len(queue):]
+	if len(prefix) == 0 {
+		return ldb.collectFlushed(garbageKey), true
+	}
+
+	batch := new(leveldb.Batch)
+	iter = ldb.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		if deleted == GCBatch {
+			break
+		}
+		batch.Delete(iter.Key())
+		deleted++
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ldb.raise("iterate", err)
+	}
+	if deleted < GCBatch {
+		batch.Delete(garbageKey)
+	}
+	ldb.writeNow("collect", batch)
+	return deleted, true
+}
+
+// collectFlushed visits at most GCBatch entries from the last position, and
+// deletes the metadata, expires and value keys with generation before the
+// flushed generation. The entries are visited without lock. The value keys of
+// dead generations are deleted as they are, the dead metadata is checked again
+// under the locks of its keys, as the keys may be written again meanwhile. The
+// position and the queue entry are kept if Flush ran meanwhile, the scan restarts
+// for the new flushed generation.
+func (ldb *LevelDB) collectFlushed(garbageKey []byte) int {
+	ldb.RLock()
+	from, flushed := ldb.gc.from, atomic.LoadUint64(&ldb.flushed)
+	ldb.RUnlock()
+
+	batch := new(leveldb.Batch)
+	dead := [][]byte{}
+	var next []byte
+	iter := ldb.db.NewIterator(&util.Range{Start: from}, nil)
+	n := 0
+	for iter.Next() {
+		if n == GCBatch {
+			next = append([]byte{}, iter.Key()...)
+			break
+		}
+		n++
+
+		k := iter.Key()
+		switch k[0] {
+		case MetaPrefix:
+			if !ldb.live(iter.Value()) {
+				dead = append(dead, append([]byte{}, k[1:]...))
+			}
+		case ValuePrefix:
+			// -len(Key)KeyGeneration..., the system keys are too short for the length
+			if len(k) < 5 {
+				continue
+			}
+			l := int(binary.BigEndian.Uint32(k[1:]))
+			if len(k) < 5+l+8 {
+				continue
+			}
+			if binary.BigEndian.Uint64(k[5+l:]) < flushed {
+				batch.Delete(k)
+			}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ldb.raise("iterate", err)
+	}
+
+	unlock := ldb.LockKeys(dead, true)
+	defer unlock()
+	for _, key := range dead {
+		metadata, _ := ldb.lookup(encodeMetaKey(key))
+		if metadata == nil || ldb.live(metadata) { // written again after the scan
+			continue
+		}
+		batch.Delete(encodeMetaKey(key))
+		if at := ldb.get(encodeExpireKey(key)); len(at) != 0 {
+			batch.Delete(encodeExpireKey(key))
+			batch.Delete(encodeExpireIndexKey(expireIndexAt(at), key))
+		}
+	}
+	if atomic.LoadUint64(&ldb.flushed) == flushed {
+		ldb.gc.from = next
+		if next == nil { // all entries are visited
+			batch.Delete(garbageKey)
+		}
+	}
+
+	deleted := batch.Len()
+	ldb.writeNow("collect", batch)
+	return deleted
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+)
+
+// TestFlushCommit checks the flushed generation of a write context is seen by the
+// context at once, and by the other handles only after it is committed.
+func TestFlushCommit(t *testing.T) {
+	db := openTest(t)
+	if err := db.PutString([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if err := tx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _, err := tx.Has([]byte("a")); err != nil || exist {
+		t.Errorf("Has(a) in the context after Flush, Expect: false, Get: %v, %v", exist, err)
+	}
+	if err := tx.PutString([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetString([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("GetString(a) before Commit, Expect: 1, Get: %q, %v", v, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _, err := db.Has([]byte("a")); err != nil || exist {
+		t.Errorf("Has(a) after Commit, Expect: false, Get: %v, %v", exist, err)
+	}
+	if v, err := db.GetString([]byte("b")); err != nil || string(v) != "2" {
+		t.Errorf("GetString(b) after Commit, Expect: 2, Get: %q, %v", v, err)
+	}
+	if n := db.DBSize(); n != 1 {
+		t.Errorf("DBSize after Commit, Expect: 1, Get: %v", n)
+	}
+}
+
+// TestFlushFailed checks the flushed generation is kept if the commit fails
+func TestFlushFailed(t *testing.T) {
+	defer resetReadOnly()
+	db := openTest(t)
+	if err := db.PutString([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	flushed := atomic.LoadUint64(&db.flushed)
+
+	tx := db.Begin()
+	if err := tx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fallback(&Error{Kind: KindDiskFull, Op: "write", Err: syscall.ENOSPC})
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("Commit in read only mode, Expect: %v error, Get: nil", KindReadOnly)
+	}
+	if f := atomic.LoadUint64(&db.flushed); f != flushed {
+		t.Errorf("flushed after the failed Commit, Expect: %v, Get: %v", flushed, f)
+	}
+	if v, err := db.GetString([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("GetString(a) after the failed Commit, Expect: 1, Get: %q, %v", v, err)
+	}
+	if n := db.DBSize(); n != 1 {
+		t.Errorf("DBSize after the failed Commit, Expect: 1, Get: %v", n)
+	}
+}
+
+// TestCollectUnlocked checks the garbage collector and the expire sweeper only lock
+// the keys they delete: they finish while a command holds the lock of another key,
+// and the key written again after Flush is kept.
+func TestCollectUnlocked(t *testing.T) {
+	db := openTest(t)
+	db.gc = &garbageCollector{}
+	other := []byte("other")
+	keys := [][]byte{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if stripe([]byte(key)) != stripe(other) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	a, b, c := keys[0], keys[1], keys[2]
+	past := time.Now().Add(-time.Second)
+	for _, key := range [][]byte{a, b} {
+		if err := db.PutHash(key, resp.Hash, map[string][]byte{"f": []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutHash(b, resp.Hash, map[string][]byte{"g": []byte("w")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutString(c, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetExpireAt(c, &past); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := db.LockKeys([][]byte{other}, true)
+	defer unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.collect()
+		db.sweepBatch(time.Now())
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collect and sweep, Expect: done with another key locked, Get: blocked")
+	}
+
+	if v, err := db.GetHash(b); err != nil || len(v) != 1 || string(v["g"]) != "w" {
+		t.Errorf("GetHash(b) written after Flush, Expect: map[g:w], Get: %q, %v", v, err)
+	}
+	if v, _ := db.lookup(encodeMetaKey(a)); v != nil {
+		t.Errorf("metadata of a flushed, Expect: collected, Get: %q", v)
+	}
+	if v, _ := db.lookup(encodeMetaKey(c)); v != nil {
+		t.Errorf("metadata of c expired, Expect: swept, Get: %q", v)
+	}
+}
@@ -6,8 +6,6 @@
 package storage
 
 import (
-	"strings"
-
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -17,128 +15,154 @@ type Field struct {
 	Value []byte
 }
 
-// encodeFieldKey encodes hash field key: -Key|Field
-func encodeFieldKey(key []byte, field []byte) []byte {
-	fieldKey := []byte{ValuePrefix}
-	fieldKey = append(fieldKey, key...)
-	fieldKey = append(fieldKey, Seperator)
-	fieldKey = append(fieldKey, field...)
-	return fieldKey
+// encodeFieldKey encodes hash field key: value prefix + Field. The nil field
+// returns the prefix of all fields.
+func (ldb *LevelDB) encodeFieldKey(key []byte, field []byte) []byte {
+	return append(ldb.valuePrefix(key), field...)
 }
 
 // DeleteHash deletes all hash data
-func (ldb *LevelDB) DeleteHash(key []byte) {
-	keys := [][]byte{encodeMetaKey(key)}
+func (ldb *LevelDB) DeleteHash(key []byte) (err error) {
+	defer catch(&err)
+	ldb.deleteHash(key)
+	return nil
+}
 
-	// enum fields, and delete all
-	hashPrefix := encodeFieldKey(key, nil)
-	iter := ldb.db.NewIterator(util.BytesPrefix(hashPrefix), nil)
-	for iter.Next() {
-		keys = append(keys, append([]byte{}, iter.Key()...))
-	}
-	iter.Release()
-	ldb.delete(keys)
+// deleteHash deletes all hash data, the storage error is raised
+func (ldb *LevelDB) deleteHash(key []byte) {
+	ldb.modify(key)
+	ldb.keyDeleted(key)
+	ldb.dropKey(key)
+	ldb.clearExpireAt(key)
 }
 
 // PutHash write hash data
-func (ldb *LevelDB) PutHash(key []byte, tipe byte, hash map[string][]byte) {
+func (ldb *LevelDB) PutHash(key []byte, tipe byte, hash map[string][]byte) (err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	metadata := ldb.newMetadata(key, tipe)
+	prefix := valuePrefix(key, metadata)
 	batch := new(leveldb.Batch)
-	batch.Put(encodeMetaKey(key), encodeMetadata(tipe))
+	batch.Put(encodeMetaKey(key), metadata)
 	for k, v := range hash {
-		batch.Put(encodeFieldKey(key, []byte(k)), v)
-	}
-	if err := ldb.db.Write(batch, nil); err != nil {
-		panic(err)
+		batch.Put(append(prefix[:len(prefix):len(prefix)], k...), v)
 	}
+	ldb.write(batch)
+	return nil
 }
 
 // GetHash gets hash data
-func (ldb *LevelDB) GetHash(key []byte) map[string][]byte {
-	hash := make(map[string][]byte)
+func (ldb *LevelDB) GetHash(key []byte) (hash map[string][]byte, err error) {
+	defer catch(&err)
+	hash = make(map[string][]byte)
 
-	hashPrefix := encodeFieldKey(key, nil)
-	iter := ldb.db.NewIterator(util.BytesPrefix(hashPrefix), nil)
+	hashPrefix := ldb.encodeFieldKey(key, nil)
+	owned := ldb.ownedField(key)
+	iter := ldb.newIterator(util.BytesPrefix(hashPrefix))
 	for iter.Next() {
-		// Find the seperator '|'
-		sepIndex := strings.IndexByte(string(iter.Key()), '|')
-		// The field name should be the string after '|'
-		field := append([]byte{}, iter.Key()[sepIndex+1:]...)
+		if !owned(iter.Key()[len(hashPrefix):]) {
+			continue
+		}
+		field := append([]byte{}, iter.Key()[len(hashPrefix):]...)
 		value := append([]byte{}, iter.Value()...)
 		hash[string(field)] = value
 	}
 	iter.Release()
-	return hash
+	return hash, ldb.iterError(iter)
 }
 
 // GetHashAsArray gets hash data as array to ensure the insertion sort
-func (ldb *LevelDB) GetHashAsArray(key []byte) []Field {
-	hash := []Field{}
+func (ldb *LevelDB) GetHashAsArray(key []byte) (hash []Field, err error) {
+	defer catch(&err)
+	hash = []Field{}
 
-	hashPrefix := encodeFieldKey(key, nil)
-	iter := ldb.db.NewIterator(util.BytesPrefix(hashPrefix), nil)
+	hashPrefix := ldb.encodeFieldKey(key, nil)
+	owned := ldb.ownedField(key)
+	iter := ldb.newIterator(util.BytesPrefix(hashPrefix))
 	for iter.Next() {
-		// Find the seperator '|'
-		sepIndex := strings.IndexByte(string(iter.Key()), '|')
-		// The field name should be the string after '|'
-		key := append([]byte{}, iter.Key()[sepIndex+1:]...)
+		if !owned(iter.Key()[len(hashPrefix):]) {
+			continue
+		}
+		key := append([]byte{}, iter.Key()[len(hashPrefix):]...)
 		value := append([]byte{}, iter.Value()...)
 		hash = append(hash, Field{key, value})
 	}
 	iter.Release()
-	return hash
+	return hash, ldb.iterError(iter)
 }
 
 // DeleteHashFields deletes hash fields
-func (ldb *LevelDB) DeleteFields(key []byte, fields [][]byte) {
+func (ldb *LevelDB) DeleteFields(key []byte, fields [][]byte) (err error) {
+	defer catch(&err)
+	ldb.modify(key)
 	// Delete fields
 	keys := [][]byte{}
 	for _, field := range fields {
-		keys = append(keys, encodeFieldKey(key, field))
+		keys = append(keys, ldb.encodeFieldKey(key, field))
 	}
 	ldb.delete(keys)
 
 	// After delete, remove the hash meta entry if no fields in this hash
-	hashPrefix := encodeFieldKey(key, nil)
-	iter := ldb.db.NewIterator(util.BytesPrefix(hashPrefix), nil)
-	if !iter.Next() {
+	hashPrefix := ldb.encodeFieldKey(key, nil)
+	iter := ldb.newIterator(util.BytesPrefix(hashPrefix))
+	empty := !iter.Next()
+	iter.Release()
+	if err := ldb.iterError(iter); err != nil {
+		return err
+	}
+	if empty {
+		ldb.keyDeleted(key)
 		ldb.delete([][]byte{encodeMetaKey(key)}) // No field, delete the hash
+		ldb.clearExpireAt(key)
 	}
-	iter.Release()
+	return nil
 }
 
 // GetFields get hash fields
-func (ldb *LevelDB) GetFields(key []byte, fields [][]byte) map[string][]byte {
-	hash := make(map[string][]byte)
+func (ldb *LevelDB) GetFields(key []byte, fields [][]byte) (hash map[string][]byte, err error) {
+	defer catch(&err)
+	hash = make(map[string][]byte)
+	owned := ldb.ownedField(key)
 	for _, field := range fields {
-		fieldValue := ldb.get(encodeFieldKey(key, field))
+		var fieldValue []byte
+		if owned(field) {
+			fieldValue = ldb.get(ldb.encodeFieldKey(key, field))
+		}
 		hash[string(field)] = fieldValue
 	}
-	return hash
+	return hash, nil
 }
 
 // GetFieldNames gets hash field names
-func (ldb *LevelDB) GetFieldNames(key []byte) [][]byte {
-	fields := [][]byte{}
+func (ldb *LevelDB) GetFieldNames(key []byte) (fields [][]byte, err error) {
+	defer catch(&err)
+	fields = [][]byte{}
 
-	hashPrefix := encodeFieldKey(key, nil)
-	iter := ldb.db.NewIterator(util.BytesPrefix(hashPrefix), nil)
+	hashPrefix := ldb.encodeFieldKey(key, nil)
+	owned := ldb.ownedField(key)
+	iter := ldb.newIterator(util.BytesPrefix(hashPrefix))
 	for iter.Next() {
-		// Find the seperator '|'
-		sepIndex := strings.IndexByte(string(iter.Key()), '|')
-		// The field name should be the string after '|'
-		key := append([]byte{}, iter.Key()[sepIndex+1:]...)
+		if !owned(iter.Key()[len(hashPrefix):]) {
+			continue
+		}
+		key := append([]byte{}, iter.Key()[len(hashPrefix):]...)
 		fields = append(fields, key)
 	}
 	iter.Release()
-	return fields
+	return fields, ldb.iterError(iter)
 }
 
 // GetHashFieldNamesAsArray gets hash fields as array
-func (ldb *LevelDB) GetFieldsAsArray(key []byte, fields [][]byte) []Field {
-	hash := []Field{}
+func (ldb *LevelDB) GetFieldsAsArray(key []byte, fields [][]byte) (hash []Field, err error) {
+	defer catch(&err)
+	hash = []Field{}
+	owned := ldb.ownedField(key)
 	for _, field := range fields {
-		value := ldb.get(encodeFieldKey(key, field))
+		var value []byte
+		if owned(field) {
+			value = ldb.get(ldb.encodeFieldKey(key, field))
+		}
 		hash = append(hash, Field{field, value})
 	}
-	return hash
+	return hash, nil
 }
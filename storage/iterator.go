@@ -0,0 +1,216 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// dbIterator iterates the leveldb entries in key order, it is implemented by the
+// leveldb iterator, and overlayIterator in a write context.
+type dbIterator interface {
+	First() bool
+	Last() bool
+	Seek(key []byte) bool
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Release()
+	Error() error
+}
+
+// newIterator returns the iterator of the entries in r. In a write context, the
+// pending writes are iterated over the written data, a snapshot handle iterates
+// its snapshot.
+func (ldb *LevelDB) newIterator(r *util.Range) dbIterator {
+	if ldb.snap != nil {
+		return ldb.snap.s.NewIterator(r, nil)
+	}
+	iter := ldb.db.NewIterator(r, nil)
+	if ldb.wb == nil {
+		return iter
+	}
+
+	keys := []string{}
+	for key := range ldb.wb.pending {
+		if inRange(r, []byte(key)) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return iter
+	}
+	sort.Strings(keys)
+	return &overlayIterator{iter: iter, keys: keys, values: ldb.wb.pending}
+}
+
+// inRange returns true if key is in r, the nil r is the whole key space
+func inRange(r *util.Range, key []byte) bool {
+	if r == nil {
+		return true
+	}
+	return (r.Start == nil || bytes.Compare(key, r.Start) >= 0) && (r.Limit == nil || bytes.Compare(key, r.Limit) < 0)
+}
+
+// overlayIterator iterates the pending writes over the written data: the written
+// entries of the pending keys are skipped, and the deleted keys are not iterated.
+// It iterates forward only, Last positions at the last entry, and Next ends there.
+type overlayIterator struct {
+	iter       iterator.Iterator // written data
+	keys       []string          // sorted pending keys
+	values     map[string][]byte // pending values, nil for deleted
+	i          int               // position in keys
+	positioned bool
+	backward   bool // positioned by Last
+	fromKeys   bool // the entry is of keys
+	valid      bool
+}
+
+// First moves to the first entry
+func (it *overlayIterator) First() bool {
+	it.iter.First()
+	it.i = 0
+	return it.forward()
+}
+
+// Last moves to the last entry
+func (it *overlayIterator) Last() bool {
+	it.iter.Last()
+	it.i = len(it.keys) - 1
+	it.positioned, it.backward = true, true
+
+	for {
+		written, pending := it.iter.Valid(), it.i >= 0
+		if !written && !pending {
+			it.valid = false
+			return false
+		}
+
+		c := 1 // the written entry is later
+		switch {
+		case !written:
+			c = -1
+		case pending:
+			c = bytes.Compare(it.iter.Key(), []byte(it.keys[it.i]))
+		}
+		if c > 0 {
+			it.fromKeys, it.valid = false, true
+			return true
+		}
+		if c == 0 { // shadowed by the pending write
+			it.iter.Prev()
+		}
+		if it.values[it.keys[it.i]] == nil { // deleted
+			it.i--
+			continue
+		}
+		it.fromKeys, it.valid = true, true
+		return true
+	}
+}
+
+// Seek moves to the first entry not less than key
+func (it *overlayIterator) Seek(key []byte) bool {
+	it.iter.Seek(key)
+	it.i = sort.SearchStrings(it.keys, string(key))
+	return it.forward()
+}
+
+// Next moves to the next entry, or the first entry if not positioned yet
+func (it *overlayIterator) Next() bool {
+	if !it.positioned {
+		return it.First()
+	}
+	if !it.valid || it.backward {
+		it.valid = false
+		return false
+	}
+
+	if it.fromKeys {
+		it.i++
+	} else {
+		it.iter.Next()
+	}
+	return it.forward()
+}
+
+// forward settles at the first visible entry from the positions
+func (it *overlayIterator) forward() bool {
+	it.positioned, it.backward = true, false
+
+	for {
+		written, pending := it.iter.Valid(), it.i < len(it.keys)
+		if !written && !pending {
+			it.valid = false
+			return false
+		}
+
+		c := -1 // the written entry is earlier
+		switch {
+		case !written:
+			c = 1
+		case pending:
+			c = bytes.Compare(it.iter.Key(), []byte(it.keys[it.i]))
+		}
+		if c < 0 {
+			it.fromKeys, it.valid = false, true
+			return true
+		}
+		if c == 0 { // shadowed by the pending write
+			it.iter.Next()
+		}
+		if it.values[it.keys[it.i]] == nil { // deleted
+			it.i++
+			continue
+		}
+		it.fromKeys, it.valid = true, true
+		return true
+	}
+}
+
+// Key returns the key of the entry
+func (it *overlayIterator) Key() []byte {
+	switch {
+	case !it.valid:
+		return nil
+	case it.fromKeys:
+		return []byte(it.keys[it.i])
+	}
+	return it.iter.Key()
+}
+
+// Value returns the value of the entry
+func (it *overlayIterator) Value() []byte {
+	switch {
+	case !it.valid:
+		return nil
+	case it.fromKeys:
+		return it.values[it.keys[it.i]]
+	}
+	return it.iter.Value()
+}
+
+// Release releases the iterator of the written data
+func (it *overlayIterator) Release() {
+	it.iter.Release()
+}
+
+// Error returns the error of the iterator of the written data
+func (it *overlayIterator) Error() error {
+	return it.iter.Error()
+}
+
+// iterError returns the storage error of the iterator, nil if it has no error
+func (ldb *LevelDB) iterError(iter dbIterator) error {
+	if err := iter.Error(); err != nil {
+		return ldb.error("iterate", err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// RandomKeyTries is the max number of keys picked by RandomKey to find a key
+// not expired, before it scans the keys in order for one.
+const RandomKeyTries = 100
+
+// countKeys counts the keys by metadata, it is called when the leveldb is opened
+// after the generations are loaded. The keys deleted by Flush are not counted,
+// the keys in the legacy layout are found as well.
+func (ldb *LevelDB) countKeys() error {
+	n := int64(0)
+	iter := ldb.db.NewIterator(util.BytesPrefix([]byte{MetaPrefix}), nil)
+	for iter.Next() {
+		if !ldb.live(iter.Value()) {
+			continue
+		}
+		n++
+		if isLegacy(iter.Value()) {
+			atomic.StoreInt32(&ldb.legacy, 1)
+		}
+	}
+	iter.Release()
+	atomic.StoreInt64(&ldb.keys, n)
+	return ldb.iterError(iter)
+}
+
+// keyCount is a key counted by a write context, if it exists before the context
+// and after
+type keyCount struct{ was, now bool }
+
+// countKey counts the key as existing or not, it is called before the metadata is
+// written or deleted. In a write context the key counter is changed after the
+// context is committed, by the key before the context and after, so the key is
+// counted once however many times it is written.
+func (ldb *LevelDB) countKey(key []byte, exist bool) {
+	was := ldb.liveMetadata(key) != nil
+	if ldb.wb == nil {
+		atomic.AddInt64(&ldb.keys, keyDelta(was, exist))
+		return
+	}
+	if ldb.wb.keys == nil {
+		keys := make(map[string]keyCount)
+		ldb.wb.keys = keys
+		ldb.afterCommit(func() {
+			for _, c := range keys {
+				atomic.AddInt64(&ldb.keys, keyDelta(c.was, c.now))
+			}
+		})
+	}
+	c, ok := ldb.wb.keys[string(key)]
+	if !ok {
+		c.was = was
+	}
+	c.now = exist
+	ldb.wb.keys[string(key)] = c
+}
+
+// keyDelta returns the change of the key counter by a key existing or not
+func keyDelta(was, now bool) int64 {
+	switch {
+	case !was && now:
+		return 1
+	case was && !now:
+		return -1
+	}
+	return 0
+}
+
+// keyCreated counts the key if it is new, it is called before the metadata is written
+func (ldb *LevelDB) keyCreated(key []byte) {
+	ldb.countKey(key, true)
+}
+
+// keyDeleted uncounts the key if it exists, it is called before the metadata is deleted
+func (ldb *LevelDB) keyDeleted(key []byte) {
+	ldb.countKey(key, false)
+}
+
+// putMetadata writes the metadata of a new key
+func (ldb *LevelDB) putMetadata(key []byte, tipe byte) {
+	ldb.put(encodeMetaKey(key), ldb.newMetadata(key, tipe))
+}
+
+// DBSize returns the number of keys, including the expired keys not deleted yet
+func (ldb *LevelDB) DBSize() int64 {
+	return atomic.LoadInt64(&ldb.keys)
+}
+
+// Keys returns the keys not expired and accepted by match, only the keys starting
+// with prefix are visited.
+func (ldb *LevelDB) Keys(prefix []byte, match func(key []byte) bool) (keys [][]byte, err error) {
+	defer catch(&err)
+	now := time.Now()
+	keys = [][]byte{}
+
+	iter := ldb.newIterator(util.BytesPrefix(encodeMetaKey(prefix)))
+	for iter.Next() {
+		key := iter.Key()[1:]
+		if !ldb.live(iter.Value()) || !match(key) {
+			continue
+		}
+		if at := ldb.expireAt(key); at != nil && !at.After(now) {
+			continue
+		}
+		keys = append(keys, append([]byte{}, key...))
+	}
+	iter.Release()
+	return keys, ldb.iterError(iter)
+}
+
+// RandomKey returns a random key, or nil if there is no key.
+// The key is picked by randomSeek, so it is cheap, and any key may be picked but
+// not uniformly. If RandomKeyTries picks are all expired or deleted by Flush, the
+// keys are scanned from the last position for a live one, wrapping to the first
+// key, so nil means no live key.
+func (ldb *LevelDB) RandomKey() (key []byte, err error) {
+	defer catch(&err)
+	iter := ldb.newIterator(util.BytesPrefix([]byte{MetaPrefix}))
+	defer iter.Release()
+
+	if !iter.First() {
+		return nil, ldb.iterError(iter)
+	}
+
+	now := time.Now()
+	alive := func() []byte {
+		if !ldb.live(iter.Value()) {
+			return nil
+		}
+		key := append([]byte{}, iter.Key()[1:]...)
+		if at := ldb.expireAt(key); at != nil && !at.After(now) {
+			return nil
+		}
+		return key
+	}
+	for i := 0; i < RandomKeyTries; i++ {
+		if !randomSeek(iter, []byte{MetaPrefix}) {
+			iter.First()
+		}
+		if key := alive(); key != nil {
+			return key, nil
+		}
+	}
+
+	start := append([]byte{}, iter.Key()...)
+	for iter.Next() {
+		if key := alive(); key != nil {
+			return key, nil
+		}
+	}
+	for ok := iter.First(); ok && bytes.Compare(iter.Key(), start) < 0; ok = iter.Next() {
+		if key := alive(); key != nil {
+			return key, nil
+		}
+	}
+	return nil, ldb.iterError(iter)
+}
+
+// randomSeek moves iter to a random key with prefix, it returns false if there is
+// no such key. The keys are walked down as a tree by the bytes: at each byte one
+// of the next bytes of the keys is picked at random, or the prefix itself if it
+// is a key, so every key may be picked. A byte shared by all keys of the prefix is
+// not a pick, the prefix is extended to the bytes they share by collapse. It
+// costs a seek per next byte, at most 256 per picked byte.
+func randomSeek(iter dbIterator, prefix []byte) bool {
+	p := append([]byte{}, prefix...)
+	for {
+		if !iter.Seek(p) || !bytes.HasPrefix(iter.Key(), p) {
+			return false
+		}
+		p = collapse(iter, p, append([]byte{}, iter.Key()...))
+
+		picks := []int{} // the next bytes, -1 for the prefix itself
+		ok := iter.Seek(p)
+		if ok && bytes.Equal(iter.Key(), p) {
+			picks = append(picks, -1)
+			ok = iter.Next()
+		}
+		for ok && bytes.HasPrefix(iter.Key(), p) {
+			b := int(iter.Key()[len(p)])
+			picks = append(picks, b)
+			if b == 0xff {
+				break
+			}
+			ok = iter.Seek(append(p[:len(p):len(p)], byte(b+1)))
+		}
+
+		b := picks[rand.Intn(len(picks))]
+		if b == -1 {
+			return iter.Seek(p)
+		}
+		p = append(p, byte(b))
+	}
+}
+
+// collapse returns the longest prefix of key shared by all keys with prefix p, key
+// is the first of them. It is searched by seeking the end of the candidate
+// prefixes, so it costs O(log len(key)) seeks.
+func collapse(iter dbIterator, p []byte, key []byte) []byte {
+	shared := func(m int) bool { // all keys with prefix p have prefix key[:m]
+		limit := util.BytesPrefix(key[:m]).Limit
+		return limit == nil || !iter.Seek(limit) || !bytes.HasPrefix(iter.Key(), p)
+	}
+	lo, hi := len(p), len(key) // shared(lo) is true
+	for lo < hi {
+		m := (lo + hi + 1) / 2
+		if shared(m) {
+			lo = m
+		} else {
+			hi = m - 1
+		}
+	}
+	return key[:lo]
+}
+
+// Delete deletes the key of any type, returns true if the key existed
+func (ldb *LevelDB) Delete(key []byte) (exist bool, err error) {
+	defer catch(&err)
+	exist, tipe := ldb.exists(key)
+	if exist {
+		if err := ldb.deleteKey(key, tipe); err != nil {
+			return false, err
+		}
+	}
+	return exist, nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRandomKeyExpired checks RandomKey finds the only live key among the keys
+// expired and not deleted yet, and returns nil if all keys are expired.
+func TestRandomKeyExpired(t *testing.T) {
+	db := openTest(t)
+	past := time.Now().Add(-time.Second)
+	for i := 0; i < 100*RandomKeyTries; i++ {
+		key := []byte(fmt.Sprintf("key:%05d", i))
+		if err := db.PutString(key, key); err != nil {
+			t.Fatal(err)
+		}
+		if i == 4321 {
+			continue
+		}
+		if err := db.SetExpireAt(key, &past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if key, err := db.RandomKey(); err != nil || string(key) != "key:04321" {
+			t.Fatalf("RandomKey, Expect: key:04321, Get: %q, %v", key, err)
+		}
+	}
+
+	if err := db.SetExpireAt([]byte("key:04321"), &past); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.RandomKey(); err != nil || key != nil {
+		t.Errorf("RandomKey of the keys all expired, Expect: nil, Get: %q, %v", key, err)
+	}
+}
+
+// TestRandomKeySpread checks RandomKey picks many keys of a long shared prefix,
+// and the keys which are prefixes of other keys.
+func TestRandomKeySpread(t *testing.T) {
+	db := openTest(t)
+	n := 5000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("session:%08d", i))
+		if err := db.PutString(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key, err := db.RandomKey()
+		if err != nil || key == nil {
+			t.Fatalf("RandomKey, Expect: a key, Get: %q, %v", key, err)
+		}
+		seen[string(key)]++
+	}
+	if len(seen) < 1000 {
+		t.Errorf("RandomKey 2000 times of %v keys, Expect: at least 1000 distinct keys, Get: %v", n, len(seen))
+	}
+
+	for _, key := range []string{"session", "session:"} {
+		if err := db.PutString([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen = make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key, err := db.RandomKey()
+		if err != nil || key == nil {
+			t.Fatalf("RandomKey, Expect: a key, Get: %q, %v", key, err)
+		}
+		seen[string(key)]++
+	}
+	if seen["session"] == 0 || seen["session:"] == 0 {
+		t.Errorf("RandomKey of the keys which are prefixes, Expect: picked, Get: %v, %v", seen["session"], seen["session:"])
+	}
+}
+
+// TestReadExpired checks the concurrent reads of an expired key leave it to the
+// sweeper, so it is deleted and uncounted once.
+func TestReadExpired(t *testing.T) {
+	db := openTest(t)
+	past := time.Now().Add(-time.Second)
+	for _, key := range []string{"a", "b"} {
+		if err := db.PutString([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetExpireAt([]byte("a"), &past); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if exist, _, err := db.Has([]byte("a")); err != nil || exist {
+					t.Errorf("Has(a) expired, Expect: false, Get: %v, %v", exist, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := db.DBSize(); n != 2 {
+		t.Errorf("DBSize after the reads, Expect: 2 as a is not swept, Get: %v", n)
+	}
+
+	if _, expired, _, _, err := db.sweepBatch(time.Now()); err != nil || expired != 1 {
+		t.Errorf("sweepBatch, Expect: 1 expired, Get: %v, %v", expired, err)
+	}
+	if n := db.DBSize(); n != 1 {
+		t.Errorf("DBSize after the sweep, Expect: 1, Get: %v", n)
+	}
+}
+
+// TestKeyCount checks the keys written by a write context are counted once, and
+// only after the context is committed.
+func TestKeyCount(t *testing.T) {
+	db := openTest(t)
+	for _, key := range []string{"a", "b"} {
+		if err := db.PutString([]byte(key), []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write := func(tx *LevelDB) {
+		for i := 0; i < 3; i++ {
+			if err := tx.PutString([]byte("c"), []byte("c")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.PutString([]byte("a"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx.keyDeleted([]byte("b"))
+		tx.keyDeleted([]byte("b"))
+		if exist, err := tx.Delete([]byte("b")); err != nil || !exist {
+			t.Fatalf("Delete(b), Expect: true, Get: %v, %v", exist, err)
+		}
+	}
+
+	tx := db.Begin()
+	write(tx)
+	if n := db.DBSize(); n != 2 {
+		t.Errorf("DBSize before Commit, Expect: 2, Get: %v", n)
+	}
+	tx.wb.err = &Error{Kind: KindIO, Op: "write", Err: errors.New("closed")}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Commit of the failed context, Expect: error, Get: nil")
+	}
+	if n := db.DBSize(); n != 2 {
+		t.Errorf("DBSize after the failed Commit, Expect: 2, Get: %v", n)
+	}
+
+	tx = db.Begin()
+	write(tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.DBSize(); n != 2 {
+		t.Errorf("DBSize after Commit, Expect: 2 as c is created and b is deleted, Get: %v", n)
+	}
+}
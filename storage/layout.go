@@ -0,0 +1,284 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/libgo/logx"
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// MigrateBatch is the max number of keys visited by the background migration
+// per lock, so clients are not starved by a big migration.
+const MigrateBatch = 128
+
+// migrator migrates the keys in the legacy layout of one leveldb in background
+type migrator struct {
+	quit chan struct{}
+	done chan struct{}
+}
+
+// valuePrefix returns the prefix of all value keys of key in the layout of its
+// metadata: -len(Key)KeyGeneration, len is 4 bytes big endian and generation is
+// 8 bytes big endian. The nil metadata of the key not existing has generation 0,
+// which is never used.
+func valuePrefix(key []byte, metadata []byte) []byte {
+	switch {
+	case len(metadata) != 0 && metadata[0] == LegacyMetaVersion:
+		prefix := append([]byte{ValuePrefix}, key...)
+		return append(prefix, Seperator)
+	case len(metadata) != 0 && metadata[0] == UntaggedMetaVersion:
+		prefix := make([]byte, 1+4+len(key))
+		prefix[0] = ValuePrefix
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(key)))
+		copy(prefix[5:], key)
+		return prefix
+	}
+
+	prefix := make([]byte, 1+4+len(key)+8)
+	prefix[0] = ValuePrefix
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(key)))
+	copy(prefix[5:], key)
+	binary.BigEndian.PutUint64(prefix[5+len(key):], metadataGeneration(metadata))
+	return prefix
+}
+
+// valuePrefix returns the prefix of all value keys of key
+func (ldb *LevelDB) valuePrefix(key []byte) []byte {
+	return valuePrefix(key, ldb.liveMetadata(key))
+}
+
+// modify is called before every modification of key, it marks the watchers
+// dirty, and migrates the key in the legacy layout, so writes always use the
+// current layout.
+func (ldb *LevelDB) modify(key []byte) {
+	ldb.touch(key)
+	ldb.migrateKey(key)
+}
+
+// migrateKey rewrites the value keys of key in the current layout with a new
+// generation. It is written to leveldb at once even in a write context, as the
+// data of the key is not changed. The migrations are serialized, as the value
+// keys of other legacy keys are checked when the legacy keys are found by prefix.
+func (ldb *LevelDB) migrateKey(key []byte) bool {
+	if atomic.LoadInt32(&ldb.legacy) == 0 {
+		return false
+	}
+	ldb.migrateMu.Lock()
+	defer ldb.migrateMu.Unlock()
+
+	metadata, _ := ldb.lookup(encodeMetaKey(key))
+	if !isLegacy(metadata) {
+		return false
+	}
+	tipe := metadata[1]
+	prefix := valuePrefix(key, metadata)
+	current := encodeMetadata(tipe, ldb.nextGeneration())
+
+	batch := new(leveldb.Batch)
+	for _, legacyKey := range ldb.legacyValueKeys(key, tipe, metadata) {
+		value, ok := ldb.lookup(legacyKey)
+		if !ok {
+			continue
+		}
+		suffix := []byte{}
+		if len(legacyKey) > len(prefix) { // not the string key
+			suffix = legacyKey[len(prefix):]
+		}
+		batch.Delete(legacyKey)
+		batch.Put(append(valuePrefix(key, current), suffix...), value)
+	}
+	batch.Put(encodeMetaKey(key), current)
+
+	ldb.writeNow("migrate", batch)
+	return true
+}
+
+// legacyValueKeys returns the value keys of key in the legacy layouts. The list and
+// skiplist nodes are found by walking the links. The fields of hash are found by
+// the prefix, in the LegacyMetaVersion layout the entries of other legacy keys
+// with the prefix -Key|, like the fields of Key|Other, are excluded.
+func (ldb *LevelDB) legacyValueKeys(key []byte, tipe byte, metadata []byte) [][]byte {
+	keys := [][]byte{}
+	switch tipe {
+	case resp.String:
+		keys = append(keys, ldb.encodeStringKey(key))
+	case resp.List:
+		length, head, _, _ := ldb.getListAttr(key)
+		keys = append(keys, ldb.encodeListElementKey(key, 0))
+		for i, id := uint32(0), head; i < length && id != 0; i++ {
+			keys = append(keys, ldb.encodeListElementKey(key, id))
+			id, _, _ = ldb.getListElement(key, id)
+		}
+	case resp.SortedSet:
+		keys = append(keys, ldb.encodeSkipFieldKey(key, SKIPATTR), ldb.encodeSkipFieldKey(key, SKIPHEAD))
+		node := ldb.getSkipNode(key, SKIPHEAD)
+		for node != nil && node.levels[0].forward != nil {
+			keys = append(keys, ldb.encodeSkipFieldKey(key, node.levels[0].forward))
+			node = ldb.getSkipNode(key, node.levels[0].forward)
+		}
+	default:
+		prefix := ldb.encodeFieldKey(key, nil)
+		iter := ldb.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			if metadata[0] != LegacyMetaVersion || ldb.legacyOwned(key, iter.Key()[len(prefix):]) {
+				keys = append(keys, append([]byte{}, iter.Key()...))
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			ldb.raise("iterate", err)
+		}
+	}
+	return keys
+}
+
+// legacyOwned returns true if the legacy value key -Key|rest belongs to key, but
+// not to a legacy string Key|rest, or the legacy Key|r of which rest is r|field.
+func (ldb *LevelDB) legacyOwned(key []byte, rest []byte) bool {
+	if bytes.Equal(key, ExpireKey) || bytes.Equal(key, ExpireIndexKey) { // the expires are not fields
+		return false
+	}
+
+	other := append(append([]byte{}, key...), Seperator)
+	for i := 0; i <= len(rest); i++ {
+		if i < len(rest) && rest[i] != Seperator {
+			continue
+		}
+		metadata, _ := ldb.lookup(encodeMetaKey(append(other, rest[:i]...)))
+		if len(metadata) < 2 || metadata[0] != LegacyMetaVersion {
+			continue
+		}
+		if (i == len(rest)) == (metadata[1] == resp.String) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownedField returns the function to check the field found by the prefix of key
+// belongs to key, the fields of other legacy keys are excluded as legacyOwned
+// does, until key is migrated.
+func (ldb *LevelDB) ownedField(key []byte) func(field []byte) bool {
+	metadata := ldb.liveMetadata(key)
+	if len(metadata) == 0 || metadata[0] != LegacyMetaVersion {
+		return func([]byte) bool { return true }
+	}
+	return func(field []byte) bool { return ldb.legacyOwned(key, field) }
+}
+
+// startMigrator starts the background goroutine to migrate the legacy keys, it
+// does nothing if there is no legacy key.
+func (ldb *LevelDB) startMigrator() {
+	if atomic.LoadInt32(&ldb.legacy) == 0 {
+		return
+	}
+	ldb.migrator = &migrator{quit: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(ldb.migrator.done)
+
+		start := time.Now()
+		var from []byte
+		migrated := 0
+		for {
+			select {
+			case <-ldb.migrator.quit:
+				return
+			default:
+			}
+
+			var next []byte
+			if err := guard(func() error {
+				var n int
+				n, next = ldb.migrateBatch(from)
+				migrated += n
+				return nil
+			}); err != nil { // the legacy keys left are migrated when modified
+				logx.Errorf("Migrator of db %v error: %v", ldb.index, err)
+				return
+			}
+			if next == nil {
+				break
+			}
+			from = next
+		}
+
+		atomic.StoreInt32(&ldb.legacy, 0)
+		logx.Infof("Migrated %v keys of db %v to the current layout in %v", migrated, ldb.index, time.Since(start))
+	}()
+}
+
+// stopMigrator stops the migrator and waits the running batch finished
+func (ldb *LevelDB) stopMigrator() {
+	if ldb.migrator == nil {
+		return
+	}
+	close(ldb.migrator.quit)
+	<-ldb.migrator.done
+}
+
+// migrateBatch visits at most MigrateBatch keys from the metadata key from, and
+// migrates the legacy ones. It returns the position of the next batch, nil if
+// all keys are visited. The keys are visited without lock, only the legacy ones
+// are locked, and migrateKey checks them again under the key lock.
+func (ldb *LevelDB) migrateBatch(from []byte) (int, []byte) {
+	r := util.BytesPrefix([]byte{MetaPrefix})
+	if from != nil {
+		r.Start = from
+	}
+
+	legacy := [][]byte{}
+	var next []byte
+	iter := ldb.db.NewIterator(r, nil)
+	for n := 0; iter.Next(); n++ {
+		if n == MigrateBatch {
+			next = append([]byte{}, iter.Key()...)
+			break
+		}
+		if isLegacy(iter.Value()) {
+			legacy = append(legacy, append([]byte{}, iter.Key()[1:]...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		ldb.raise("iterate", err)
+	}
+	if len(legacy) == 0 {
+		return 0, next
+	}
+
+	unlock := ldb.LockKeys(legacy, true)
+	defer unlock()
+	migrated := 0
+	for _, key := range legacy {
+		if ldb.migrateKey(key) {
+			migrated++
+		}
+	}
+	return migrated, next
+}
+
+// Migrate waits until the keys in the legacy layout of all dbs are migrated, it
+// is the offline migration, as the migration runs in background after Open.
+func Migrate() {
+	for _, ldb := range storage {
+		if ldb.migrator != nil {
+			<-ldb.migrator.done
+		}
+	}
+}
+
+// isLegacy returns true if the metadata is of a key in the legacy layouts
+func isLegacy(metadata []byte) bool {
+	return len(metadata) != 0 && metadata[0] < MetaVersion
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// expireSeconds is the expire of the fixtures, in the old format of unix seconds
+var expireSeconds = time.Now().Add(time.Hour).Unix()
+
+func u32(vs ...uint32) []byte {
+	b := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// skipNode is the record of a skiplist node of one level: score, backward and
+// forward with span 1, and 31 empty levels
+func skipNode(score float64, backward, forward string) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(score))
+	b = append(b, byte(len(backward)))
+	b = append(b, backward...)
+	b = append(b, byte(len(forward)))
+	if forward != "" {
+		b = append(b, forward...)
+		b = append(b, u32(1)...)
+	}
+	return append(b, make([]byte, SKIPLISTMAXLEVEL-1)...)
+}
+
+// legacyFixture returns the records of the keys written in the legacy layout of
+// version by hand: -Key and -Key|Suffix for LegacyMetaVersion, -len(Key)Key and
+// -len(Key)KeySuffix for UntaggedMetaVersion. The keys a|b and k|2 share the
+// prefix of the fields of a and k in the LegacyMetaVersion layout.
+func legacyFixture(version byte) map[string][]byte {
+	value := func(key string, suffix ...byte) string {
+		if version == LegacyMetaVersion {
+			if suffix == nil {
+				return "-" + key
+			}
+			return "-" + key + "|" + string(suffix)
+		}
+		return "-" + string(u32(uint32(len(key)))) + key + string(suffix)
+	}
+	field := func(key, field string) string { return value(key, []byte(field)...) }
+
+	expire := make([]byte, 8)
+	binary.BigEndian.PutUint64(expire, uint64(expireSeconds))
+	return map[string][]byte{
+		"+s":                    {version, resp.String},
+		value("s"):              []byte("string"),
+		"+h":                    {version, resp.Hash},
+		field("h", "f1"):        []byte("v1"),
+		field("h", "f2"):        []byte("v2"),
+		"+st":                   {version, resp.Set},
+		field("st", "m1"):       []byte("set"),
+		field("st", "m2"):       []byte("set"),
+		"+l":                    {version, resp.List},
+		value("l", u32(0)...):   u32(2, 1, 2, 2),
+		value("l", u32(1)...):   append(u32(2, 2), "a"...),
+		value("l", u32(2)...):   append(u32(1, 1), "b"...),
+		"+z":                    {version, resp.SortedSet},
+		value("z", SKIPATTR...): append(u32(2, 1), 1, 'n'),
+		value("z", SKIPHEAD...): skipNode(0, "", "m"),
+		field("z", "m"):         skipNode(1, "", "n"),
+		field("z", "n"):         skipNode(2, "m", ""),
+		"+a":                    {version, resp.Hash},
+		field("a", "x"):         []byte("1"),
+		"+a|b":                  {version, resp.Hash},
+		field("a|b", "f"):       []byte("2"),
+		"+k":                    {version, resp.Hash},
+		field("k", "1"):         []byte("1"),
+		"+k|2":                  {version, resp.String},
+		value("k|2"):            []byte("k|2"),
+		"-SYSExpire|s":          expire,
+		"-SYSExpire|l":          expire,
+	}
+}
+
+// openFixture writes the records to a leveldb in a temporary directory, and
+// opens it as openTest, the directory is returned to reopen it.
+func openFixture(t *testing.T, records map[string][]byte) (*LevelDB, string) {
+	dir, err := ioutil.TempDir("", "rodis-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	for k, v := range records {
+		batch.Put([]byte(k), v)
+	}
+	err = db.Write(batch, nil)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openTestAt(t, dir), dir
+}
+
+// checkFixture checks the data of the fixture is read as written
+func checkFixture(t *testing.T, db *LevelDB) {
+	t.Helper()
+	for key, expect := range map[string]string{"s": "string", "k|2": "k|2"} {
+		if v, err := db.GetString([]byte(key)); err != nil || string(v) != expect {
+			t.Errorf("GetString(%v), Expect: %v, Get: %q, %v", key, expect, v, err)
+		}
+	}
+	hashes := map[string]map[string][]byte{
+		"h":   {"f1": []byte("v1"), "f2": []byte("v2")},
+		"a":   {"x": []byte("1")},
+		"a|b": {"f": []byte("2")},
+		"k":   {"1": []byte("1")},
+	}
+	for key, expect := range hashes {
+		if h, err := db.GetHash([]byte(key)); err != nil || !reflect.DeepEqual(h, expect) {
+			t.Errorf("GetHash(%v), Expect: %q, Get: %q, %v", key, expect, h, err)
+		}
+	}
+	if h, err := db.GetFields([]byte("a"), [][]byte{[]byte("x"), []byte("b|f")}); err != nil || h["b|f"] != nil {
+		t.Errorf("GetFields(a, b|f), Expect: nil, Get: %q, %v", h["b|f"], err)
+	}
+	if fields, err := db.GetFieldNames([]byte("st")); err != nil || fmt.Sprintf("%s", fields) != "[m1 m2]" {
+		t.Errorf("GetFieldNames(st), Expect: [m1 m2], Get: %s, %v", fields, err)
+	}
+	if elements, err := db.GetListRange([]byte("l"), 0, -1); err != nil || fmt.Sprintf("%s", elements) != "[a b]" {
+		t.Errorf("GetListRange(l), Expect: [a b], Get: %s, %v", elements, err)
+	}
+	elements, err := db.GetSkipRange([]byte("z"), 0, -1)
+	if err != nil || fmt.Sprint(elements) != fmt.Sprint([]SkipListElement{{[]byte("m"), 1}, {[]byte("n"), 2}}) {
+		t.Errorf("GetSkipRange(z), Expect: m 1 n 2, Get: %v, %v", elements, err)
+	}
+	for _, key := range []string{"s", "l"} {
+		if at, err := db.GetExpireAt([]byte(key)); err != nil || at == nil || at.Unix() != expireSeconds {
+			t.Errorf("GetExpireAt(%v), Expect: %v, Get: %v, %v", key, expireSeconds, at, err)
+		}
+	}
+	if at, err := db.GetExpireAt([]byte("h")); err != nil || at != nil {
+		t.Errorf("GetExpireAt(h), Expect: nil, Get: %v, %v", at, err)
+	}
+}
+
+// checkMigrated checks all keys are in the current layout, and every value key
+// belongs to the generation of its key, so no legacy value key is left.
+func checkMigrated(t *testing.T, db *LevelDB) {
+	t.Helper()
+	if atomic.LoadInt32(&db.legacy) != 0 {
+		t.Errorf("legacy, Expect: 0 after the migration, Get: 1")
+	}
+
+	generations := map[string]uint64{}
+	iter := db.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		k, v := iter.Key(), iter.Value()
+		switch {
+		case k[0] == MetaPrefix:
+			if len(v) < 10 || v[0] != MetaVersion {
+				t.Errorf("Metadata of %q, Expect: version %v, Get: %v", k[1:], MetaVersion, v)
+			}
+			generations[string(k[1:])] = metadataGeneration(v)
+		case bytes.HasPrefix(k, []byte("-SYS")):
+		default:
+			n := binary.BigEndian.Uint32(k[1:])
+			if len(k) < int(1+4+n+8) {
+				t.Errorf("Value key %q, Expect: the current layout", k)
+				continue
+			}
+			key := string(k[5 : 5+n])
+			gen, ok := generations[key]
+			if !ok || binary.BigEndian.Uint64(k[5+n:]) != gen {
+				t.Errorf("Value key %q, Expect: generation %v of %q", k, gen, key)
+			}
+		}
+	}
+}
+
+// migrate runs the background migrator and waits it finished
+func migrate(t *testing.T, db *LevelDB) {
+	t.Helper()
+	db.startMigrator()
+	if db.migrator == nil {
+		t.Fatal("startMigrator, Expect: migrator started, Get: no legacy key")
+	}
+	<-db.migrator.done
+}
+
+func TestMigrate(t *testing.T) {
+	for _, version := range []byte{LegacyMetaVersion, UntaggedMetaVersion} {
+		t.Run(fmt.Sprintf("version %v", version), func(t *testing.T) {
+			db, _ := openFixture(t, legacyFixture(version))
+			if n := db.DBSize(); n != 9 {
+				t.Errorf("DBSize, Expect: 9, Get: %v", n)
+			}
+			checkFixture(t, db)
+			migrate(t, db)
+			checkFixture(t, db)
+			checkMigrated(t, db)
+		})
+	}
+}
+
+// TestMigrateModify checks the legacy keys are migrated before modified, without
+// the migrator.
+func TestMigrateModify(t *testing.T) {
+	db, _ := openFixture(t, legacyFixture(LegacyMetaVersion))
+	if err := db.PutHash([]byte("k"), resp.Hash, map[string][]byte{"3": []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if h, err := db.GetHash([]byte("k")); err != nil || len(h) != 2 {
+		t.Errorf("GetHash(k) after PutHash, Expect: fields 1 and 3, Get: %q, %v", h, err)
+	}
+	if v, err := db.GetString([]byte("k|2")); err != nil || string(v) != "k|2" {
+		t.Errorf("GetString(k|2) after PutHash(k), Expect: k|2, Get: %q, %v", v, err)
+	}
+	if _, err := db.PushListTail([]byte("l"), resp.List, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if elements, err := db.GetListRange([]byte("l"), 0, -1); err != nil || fmt.Sprintf("%s", elements) != "[a b c]" {
+		t.Errorf("GetListRange(l) after PushListTail, Expect: [a b c], Get: %s, %v", elements, err)
+	}
+	if metadata, _ := db.lookup(encodeMetaKey([]byte("a"))); !isLegacy(metadata) {
+		t.Errorf("Metadata of a, Expect: legacy as not modified, Get: %v", metadata)
+	}
+}
+
+// TestMigrateStopped checks the migration stopped after the first batch, as the
+// server is stopped, is continued after restart.
+func TestMigrateStopped(t *testing.T) {
+	records := legacyFixture(LegacyMetaVersion)
+	for i := 0; i < 2*MigrateBatch; i++ {
+		key := fmt.Sprintf("string:%03d", i)
+		records["+"+key] = []byte{LegacyMetaVersion, resp.String}
+		records["-"+key] = []byte(key)
+	}
+	db, dir := openFixture(t, records)
+
+	var next []byte
+	if err := guard(func() error {
+		_, next = db.migrateBatch(nil)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if next == nil {
+		t.Fatal("migrateBatch, Expect: more batches, Get: nil")
+	}
+	checkFixture(t, db)
+
+	// the migrator is stopped at any batch
+	db.startMigrator()
+	db.close()
+
+	db = openTestAt(t, dir)
+	if atomic.LoadInt32(&db.legacy) == 0 {
+		t.Fatal("legacy after restart, Expect: 1, Get: 0")
+	}
+	migrate(t, db)
+	checkFixture(t, db)
+	checkMigrated(t, db)
+
+	keys, err := db.Keys([]byte("string:"), func([]byte) bool { return true })
+	if err != nil || len(keys) != 2*MigrateBatch {
+		t.Fatalf("Keys(string:), Expect: %v keys, Get: %v, %v", 2*MigrateBatch, len(keys), err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	for _, key := range keys {
+		if v, err := db.GetString(key); err != nil || !bytes.Equal(v, key) {
+			t.Errorf("GetString(%s), Expect: %s, Get: %q, %v", key, key, v, err)
+		}
+	}
+}
+
+func TestLegacyOwned(t *testing.T) {
+	db, _ := openFixture(t, legacyFixture(LegacyMetaVersion))
+	tests := []struct {
+		key, rest string
+		owned     bool
+	}{
+		{"a", "x", true},
+		{"a", "b|f", false}, // the field f of a|b
+		{"a|b", "f", true},
+		{"k", "1", true},
+		{"k", "2", false},  // the string k|2
+		{"k", "2|x", true}, // k|2 is a string, with no fields
+		{"SYSExpire", "s", false},
+	}
+	for i, test := range tests {
+		owned := false
+		if err := guard(func() error {
+			owned = db.legacyOwned([]byte(test.key), []byte(test.rest))
+			return nil
+		}); err != nil || owned != test.owned {
+			t.Errorf("legacyOwned[%v](%v, %v), Expect: %v, Get: %v, %v", i, test.key, test.rest, test.owned, owned, err)
+		}
+	}
+}
@@ -8,92 +8,111 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
-
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-// encodeFieldKey encodes hash field key: -Key|Number
+// encodeListElementKey encodes list element key as a field key of Number
 // Number=0 means the element to store attributes(length, head, tail, counter)
-func encodeListElementKey(key []byte, num uint32) []byte {
-	elementKey := []byte{ValuePrefix}
-	elementKey = append(elementKey, key...)
-	elementKey = append(elementKey, Seperator)
-
+func (ldb *LevelDB) encodeListElementKey(key []byte, num uint32) []byte {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, num)
-	elementKey = append(elementKey, b...)
-
-	return elementKey
+	return ldb.encodeFieldKey(key, b)
 }
 
 // DeleteList
-func (ldb *LevelDB) DeleteList(key []byte) {
-	keys := [][]byte{encodeMetaKey(key)}
+func (ldb *LevelDB) DeleteList(key []byte) (err error) {
+	defer catch(&err)
+	ldb.deleteList(key)
+	return nil
+}
 
-	keyPrefix := []byte{ValuePrefix}
-	keyPrefix = append(keyPrefix, key...)
+// deleteList deletes the list, the storage error is raised
+func (ldb *LevelDB) deleteList(key []byte) {
+	ldb.modify(key)
+	ldb.keyDeleted(key)
+	ldb.dropKey(key)
+	ldb.clearExpireAt(key)
+}
 
-	iter := ldb.db.NewIterator(util.BytesPrefix(keyPrefix), nil)
-	for iter.Next() {
-		keys = append(keys, append([]byte{}, iter.Key()...))
-	}
-	iter.Release()
+// listAttr is the decoded attributes of list
+type listAttr struct {
+	length, head, tail, counter uint32
+}
 
-	ldb.delete(keys)
+// listElement is the decoded list element
+type listElement struct {
+	next, prev uint32
+	value      []byte
 }
 
 // getListAttr
 func (ldb *LevelDB) getListAttr(key []byte) (uint32, uint32, uint32, uint32) {
-	m := ldb.get(encodeListElementKey(key, 0))
+	attr := ldb.cached(ldb.encodeListElementKey(key, 0), recordListAttr, decodeListAttr).(listAttr)
+	return attr.length, attr.head, attr.tail, attr.counter
+}
+
+// decodeListAttr decodes the list attributes record
+func decodeListAttr(m []byte) interface{} {
 	if len(m) < 16 { //no attr or invalid
-		return 0, 0, 0, 0
+		return listAttr{}
 	}
 
 	length := binary.BigEndian.Uint32(m[0:])
 	head := binary.BigEndian.Uint32(m[4:])
 	tail := binary.BigEndian.Uint32(m[8:])
 	counter := binary.BigEndian.Uint32(m[12:])
-	return length, head, tail, counter
+	return listAttr{length, head, tail, counter}
 }
 
-// putListAttr
-func (ldb *LevelDB) putListAttr(key []byte, length uint32, head uint32, tail uint32, counter uint32) {
+// encodeListAttr encodes the list attributes record
+func encodeListAttr(length uint32, head uint32, tail uint32, counter uint32) []byte {
 	r := make([]byte, 4+4+4+4)
 	binary.BigEndian.PutUint32(r[0:], length)
 	binary.BigEndian.PutUint32(r[4:], head)
 	binary.BigEndian.PutUint32(r[8:], tail)
 	binary.BigEndian.PutUint32(r[12:], counter)
+	return r
+}
 
-	ldb.put(encodeListElementKey(key, 0), r)
+// putListAttr
+func (ldb *LevelDB) putListAttr(key []byte, length uint32, head uint32, tail uint32, counter uint32) {
+	ldb.put(ldb.encodeListElementKey(key, 0), encodeListAttr(length, head, tail, counter))
 }
 
-// putListElement
-func (ldb *LevelDB) putListElement(key []byte, i uint32, next uint32, prev uint32, v []byte) {
+// encodeListElement encodes the list element record
+func encodeListElement(next uint32, prev uint32, v []byte) []byte {
 	r := make([]byte, 4+4+len(v))
 	binary.BigEndian.PutUint32(r[0:], next)
 	binary.BigEndian.PutUint32(r[4:], prev)
 	copy(r[8:], v)
+	return r
+}
 
-	ldb.put(encodeListElementKey(key, i), r)
+// putListElement
+func (ldb *LevelDB) putListElement(key []byte, i uint32, next uint32, prev uint32, v []byte) {
+	ldb.put(ldb.encodeListElementKey(key, i), encodeListElement(next, prev, v))
 }
 
 // getListElement
 func (ldb *LevelDB) getListElement(key []byte, i uint32) (uint32, uint32, []byte) {
-	r := ldb.get(encodeListElementKey(key, i))
+	e := ldb.cached(ldb.encodeListElementKey(key, i), recordListElement, decodeListElement).(listElement)
+	return e.next, e.prev, e.value
+}
+
+// decodeListElement decodes the list element record
+func decodeListElement(r []byte) interface{} {
 	if len(r) == 0 {
-		return 0, 0, nil
+		return listElement{}
 	}
 
 	next := binary.BigEndian.Uint32(r[0:])
 	prev := binary.BigEndian.Uint32(r[4:])
-	return next, prev, r[8:]
+	return listElement{next, prev, r[8:]}
 }
 
 // delListElement
 func (ldb *LevelDB) delListElement(key []byte, i uint32) {
 	next, prev, v := ldb.getListElement(key, i)
-	ldb.delete([][]byte{encodeListElementKey(key, i)})
+	ldb.delete([][]byte{ldb.encodeListElementKey(key, i)})
 
 	if next == i {
 		return
@@ -106,14 +125,19 @@ func (ldb *LevelDB) delListElement(key []byte, i uint32) {
 	ldb.putListElement(key, next, nextNext, prev, v)
 }
 
-// SetListElement with index
-func (ldb *LevelDB) SetListElement(key []byte, index int, v []byte) error {
+// SetListElement with index, ok is false if the index is out of range
+func (ldb *LevelDB) SetListElement(key []byte, index int, v []byte) (ok bool, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		return ldb.dequeSet(key, index, v), nil
+	}
 	length, head, _, _ := ldb.getListAttr(key)
 	if index < 0 {
 		index = index + int(length)
 	}
 	if index >= int(length) || index < 0 {
-		return fmt.Errorf("ERR index out of range")
+		return false, nil
 	}
 	next := head
 	for i := 0; i < index; i++ {
@@ -123,11 +147,15 @@ func (ldb *LevelDB) SetListElement(key []byte, index int, v []byte) error {
 	next, prev, _ := ldb.getListElement(key, curr)
 	ldb.putListElement(key, curr, next, prev, v)
 
-	return nil
+	return true, nil
 }
 
 // GetListRange
-func (ldb *LevelDB) GetListRange(key []byte, start int, end int) [][]byte {
+func (ldb *LevelDB) GetListRange(key []byte, start int, end int) (elements [][]byte, err error) {
+	defer catch(&err)
+	if ldb.isDeque(key) {
+		return ldb.dequeRange(key, start, end), nil
+	}
 	length, head, _, _ := ldb.getListAttr(key)
 
 	l := int(length)
@@ -144,7 +172,7 @@ func (ldb *LevelDB) GetListRange(key []byte, start int, end int) [][]byte {
 		start = 0
 	}
 	if start >= l {
-		return r
+		return r, nil
 	}
 	if end < 0 {
 		end = 0
@@ -153,7 +181,7 @@ func (ldb *LevelDB) GetListRange(key []byte, start int, end int) [][]byte {
 		end = l - 1
 	}
 	if start > end {
-		return r
+		return r, nil
 	}
 
 	next := head
@@ -167,11 +195,17 @@ func (ldb *LevelDB) GetListRange(key []byte, start int, end int) [][]byte {
 		next, _, v = ldb.getListElement(key, curr)
 		r = append(r, v)
 	}
-	return r
+	return r, nil
 }
 
 // TrimList
-func (ldb *LevelDB) TrimList(key []byte, start int, end int) {
+func (ldb *LevelDB) TrimList(key []byte, start int, end int) (err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		ldb.dequeTrim(key, start, end)
+		return nil
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	l := int(length)
@@ -193,14 +227,14 @@ func (ldb *LevelDB) TrimList(key []byte, start int, end int) {
 	}
 
 	if start >= l || start > end {
-		ldb.DeleteList(key)
-		return
+		ldb.deleteList(key)
+		return nil
 	}
 
 	trims := [][]byte{}
 	next := head
 	for i := 0; i < start; i++ {
-		trims = append(trims, encodeListElementKey(key, next))
+		trims = append(trims, ldb.encodeListElementKey(key, next))
 		next, _, _ = ldb.getListElement(key, next)
 	}
 
@@ -211,8 +245,10 @@ func (ldb *LevelDB) TrimList(key []byte, start int, end int) {
 	}
 	newTail := next
 
-	for ; next != tail; next, _, _ = ldb.getListElement(key, next) {
-		trims = append(trims, encodeListElementKey(key, next))
+	// the elements after the new tail to the tail are trimmed
+	for next != tail {
+		next, _, _ = ldb.getListElement(key, next)
+		trims = append(trims, ldb.encodeListElementKey(key, next))
 	}
 
 	ldb.delete(trims)
@@ -221,12 +257,20 @@ func (ldb *LevelDB) TrimList(key []byte, start int, end int) {
 	next, prev, v = ldb.getListElement(key, newTail)
 	ldb.putListElement(key, newTail, newHead, prev, v)
 	ldb.putListAttr(key, uint32(end-start+1), newHead, newTail, counter)
+	return nil
 }
 
 // RemList
-func (ldb *LevelDB) RemList(key []byte, count int, value []byte) int {
+func (ldb *LevelDB) RemList(key []byte, count int, value []byte) (n int, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		if r, done := ldb.dequeRem(key, count, value); done {
+			return r, nil
+		}
+	}
 	if count == 0 {
-		return 0
+		return 0, nil
 	}
 
 	r := 0
@@ -245,8 +289,8 @@ func (ldb *LevelDB) RemList(key []byte, count int, value []byte) int {
 			r++
 			// empty list, remove meta & attr, return r
 			if r == int(length) {
-				ldb.DeleteList(key)
-				return r
+				ldb.deleteList(key)
+				return r, nil
 			}
 
 			// remove the element
@@ -268,14 +312,18 @@ func (ldb *LevelDB) RemList(key []byte, count int, value []byte) int {
 	}
 
 	ldb.putListAttr(key, length-uint32(r), head, tail, counter)
-	return r
+	return r, nil
 }
 
 // GetLindexFromHead
-func (ldb *LevelDB) GetLindexFromHead(key []byte, l uint32) []byte {
+func (ldb *LevelDB) GetLindexFromHead(key []byte, l uint32) (element []byte, err error) {
+	defer catch(&err)
+	if ldb.isDeque(key) {
+		return ldb.dequeIndex(key, l, false), nil
+	}
 	length, head, _, _ := ldb.getListAttr(key)
 	if length < l+1 {
-		return nil
+		return nil, nil
 	}
 
 	next := head
@@ -286,14 +334,18 @@ func (ldb *LevelDB) GetLindexFromHead(key []byte, l uint32) []byte {
 	}
 
 	_, _, v = ldb.getListElement(key, next)
-	return v
+	return v, nil
 }
 
 // GetLindexFromTail
-func (ldb *LevelDB) GetLindexFromTail(key []byte, l uint32) []byte {
+func (ldb *LevelDB) GetLindexFromTail(key []byte, l uint32) (element []byte, err error) {
+	defer catch(&err)
+	if ldb.isDeque(key) {
+		return ldb.dequeIndex(key, l, true), nil
+	}
 	length, _, tail, _ := ldb.getListAttr(key)
 	if length < uint32(l+1) {
-		return nil
+		return nil, nil
 	}
 
 	prev := tail
@@ -304,11 +356,18 @@ func (ldb *LevelDB) GetLindexFromTail(key []byte, l uint32) []byte {
 	}
 
 	_, _, v = ldb.getListElement(key, prev)
-	return v
+	return v, nil
 }
 
 // InsertList
-func (ldb *LevelDB) InsertList(key []byte, d string, pivot []byte, value []byte) int {
+func (ldb *LevelDB) InsertList(key []byte, d string, pivot []byte, value []byte) (n int, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		if n, done := ldb.dequeInsert(key, d, pivot, value); done {
+			return n, nil
+		}
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	curr := head
@@ -327,7 +386,7 @@ func (ldb *LevelDB) InsertList(key []byte, d string, pivot []byte, value []byte)
 	}
 
 	if !found {
-		return -1
+		return -1, nil
 	}
 
 	counter++
@@ -363,17 +422,22 @@ func (ldb *LevelDB) InsertList(key []byte, d string, pivot []byte, value []byte)
 		ldb.putListAttr(key, length, head, tail, counter)
 	}
 
-	return int(length)
+	return int(length), nil
 }
 
 // PushListHead
-func (ldb *LevelDB) PushListHead(key []byte, tipe byte, v []byte) uint32 {
+func (ldb *LevelDB) PushListHead(key []byte, tipe byte, v []byte) (n uint32, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		return ldb.dequePush(key, tipe, v, true), nil
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	length++
 	counter++
 	if length == 1 { // empty list
-		ldb.put(encodeMetaKey(key), encodeMetadata(tipe))
+		ldb.putMetadata(key, tipe)
 		head = counter
 		tail = counter
 	}
@@ -395,18 +459,24 @@ func (ldb *LevelDB) PushListHead(key []byte, tipe byte, v []byte) uint32 {
 
 	// update attr
 	ldb.putListAttr(key, length, counter, tail, counter)
+	ldb.signal(key)
 
-	return length
+	return length, nil
 }
 
 // PushListTail
-func (ldb *LevelDB) PushListTail(key []byte, tipe byte, v []byte) uint32 {
+func (ldb *LevelDB) PushListTail(key []byte, tipe byte, v []byte) (n uint32, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		return ldb.dequePush(key, tipe, v, false), nil
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	length++
 	counter++
 	if length == 1 { // empty list
-		ldb.put(encodeMetaKey(key), encodeMetadata(tipe))
+		ldb.putMetadata(key, tipe)
 		head = counter
 		tail = counter
 	}
@@ -428,21 +498,29 @@ func (ldb *LevelDB) PushListTail(key []byte, tipe byte, v []byte) uint32 {
 
 	// update attr
 	ldb.putListAttr(key, length, head, counter, counter)
+	ldb.signal(key)
 
-	return length
+	return length, nil
 }
 
 // PopListHead
-func (ldb *LevelDB) PopListHead(key []byte) []byte {
+func (ldb *LevelDB) PopListHead(key []byte) (v []byte, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		return ldb.dequePop(key, true), nil
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	if length == 0 {
-		return nil
+		return nil, nil
 	}
 
 	headNext, _, headV := ldb.getListElement(key, head)
 	if length == 1 {
-		ldb.delete([][]byte{encodeMetaKey(key), encodeListElementKey(key, head), encodeListElementKey(key, 0)})
+		ldb.keyDeleted(key)
+		ldb.delete([][]byte{encodeMetaKey(key), ldb.encodeListElementKey(key, head), ldb.encodeListElementKey(key, 0)})
+		ldb.clearExpireAt(key)
 	} else {
 		_, tailPrev, tailV := ldb.getListElement(key, tail)
 		ldb.putListElement(key, tail, headNext, tailPrev, tailV)
@@ -456,20 +534,27 @@ func (ldb *LevelDB) PopListHead(key []byte) []byte {
 		ldb.putListAttr(key, length, headNext, tail, counter)
 	}
 
-	return headV
+	return headV, nil
 }
 
 // PopListTail
-func (ldb *LevelDB) PopListTail(key []byte) []byte {
+func (ldb *LevelDB) PopListTail(key []byte) (v []byte, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if ldb.isDeque(key) {
+		return ldb.dequePop(key, false), nil
+	}
 	length, head, tail, counter := ldb.getListAttr(key)
 
 	if length == 0 {
-		return nil
+		return nil, nil
 	}
 
 	_, tailPrev, tailV := ldb.getListElement(key, tail)
 	if length == 1 {
-		ldb.delete([][]byte{encodeMetaKey(key), encodeListElementKey(key, tail), encodeListElementKey(key, 0)})
+		ldb.keyDeleted(key)
+		ldb.delete([][]byte{encodeMetaKey(key), ldb.encodeListElementKey(key, tail), ldb.encodeListElementKey(key, 0)})
+		ldb.clearExpireAt(key)
 	} else {
 		headNext, _, headV := ldb.getListElement(key, head)
 		ldb.putListElement(key, head, headNext, tailPrev, headV)
@@ -483,13 +568,17 @@ func (ldb *LevelDB) PopListTail(key []byte) []byte {
 		ldb.putListAttr(key, length, head, tailPrev, counter)
 	}
 
-	return tailV
+	return tailV, nil
 }
 
-// PopListHead
-func (ldb *LevelDB) GetListLength(key []byte) uint32 {
+// GetListLength
+func (ldb *LevelDB) GetListLength(key []byte) (n uint32, err error) {
+	defer catch(&err)
+	if ldb.isDeque(key) {
+		return uint32(ldb.getDequeAttr(key).length()), nil
+	}
 	length, _, _, _ := ldb.getListAttr(key)
-	return length
+	return length, nil
 }
 
 func abs(n int) int {
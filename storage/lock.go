@@ -0,0 +1,62 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// LockStripes is the number of key locks of one leveldb, a key is locked by the
+// stripe of its hash, so the commands on different keys seldom wait each other.
+const LockStripes = 1024
+
+// keyLocks is the striped key locks of one leveldb
+type keyLocks [LockStripes]sync.RWMutex
+
+// stripe returns the index of the key lock of key
+func stripe(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % LockStripes)
+}
+
+// LockKeys locks the keys for a command, and returns the unlock function. The
+// leveldb is read locked, so the commands on different keys run in parallel and
+// only wait the operations holding the write lock of the leveldb, like Flush.
+// The stripes are locked in the order of stripe index to avoid dead lock, with
+// the write lock if write is true.
+func (ldb *LevelDB) LockKeys(keys [][]byte, write bool) func() {
+	stripes := []int{}
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		if i := stripe(key); !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+
+	ldb.rwm.RLock()
+	for _, i := range stripes {
+		if write {
+			ldb.locks[i].Lock()
+		} else {
+			ldb.locks[i].RLock()
+		}
+	}
+	return func() {
+		for j := len(stripes) - 1; j >= 0; j-- {
+			if write {
+				ldb.locks[stripes[j]].Unlock()
+			} else {
+				ldb.locks[stripes[j]].RUnlock()
+			}
+		}
+		ldb.rwm.RUnlock()
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	CursorKey []byte = []byte("SYSCursor")
+)
+
+const (
+	// cursorKeyLen is the max length of the position kept in a cursor exactly
+	cursorKeyLen = 7
+	// cursorTailLen is the max length of the tail of a longer position kept in
+	// the cursor, after the hash of the rest
+	cursorTailLen = 3
+	// cursorLong is the bit of the lowest byte telling the cursor of a longer position
+	cursorLong = 0x80
+)
+
+// cursorDict is the dictionary of the position prefixes kept in the cursors of the
+// longer positions by their hash. The entries are written to leveldb, so a cursor
+// is valid for any client and after a restart.
+type cursorDict struct {
+	mu      sync.Mutex
+	entries map[uint32][]byte // the entries not written in the read only mode
+}
+
+// encodeCursorKey encodes the dictionary entry of the hash: -SYSCursor|hash
+func encodeCursorKey(h uint32) []byte {
+	suffix := make([]byte, 4)
+	binary.BigEndian.PutUint32(suffix, h)
+	return encodeSystemKey(CursorKey, suffix)
+}
+
+// prefixHash returns the hash of the position prefix in the dictionary
+func prefixHash(d []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(d)
+	return h.Sum32()
+}
+
+// cursorPrefix returns the position prefix of the hash in the dictionary
+func (ldb *LevelDB) cursorPrefix(h uint32) ([]byte, bool) {
+	ldb.cursors.mu.Lock()
+	defer ldb.cursors.mu.Unlock()
+	return ldb.lookupCursorPrefix(h)
+}
+
+func (ldb *LevelDB) lookupCursorPrefix(h uint32) ([]byte, bool) {
+	if d, ok := ldb.cursors.entries[h]; ok {
+		return d, true
+	}
+	d, err := ldb.db.Get(encodeCursorKey(h), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false
+	} else if err != nil {
+		ldb.raise("scan", err)
+	}
+	return d, true
+}
+
+// addCursorPrefix adds the position prefix to the dictionary, it returns the hash
+// of the prefix, and false if the hash is of another prefix. The entry is kept in
+// memory in the read only mode.
+func (ldb *LevelDB) addCursorPrefix(d []byte) (uint32, bool) {
+	h := prefixHash(d)
+
+	ldb.cursors.mu.Lock()
+	defer ldb.cursors.mu.Unlock()
+	if old, ok := ldb.lookupCursorPrefix(h); ok {
+		return h, bytes.Equal(old, d)
+	}
+	if ReadOnly() != nil {
+		if ldb.cursors.entries == nil {
+			ldb.cursors.entries = make(map[uint32][]byte)
+		}
+		ldb.cursors.entries[h] = append([]byte{}, d...)
+		return h, true
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(encodeCursorKey(h), d)
+	ldb.writeNow("scan", batch)
+	return h, true
+}
+
+// encodeCursor returns the cursor where the scan resumes after the entry at last,
+// next is the position of the entry after it, the positions are the entries after
+// the prefix. The cursor keeps the shortest position between them, from which the
+// scan resumes at next by one seek, so it is never 0. A position up to
+// cursorKeyLen bytes is kept in the high bytes, and its length plus 1 in the
+// lowest byte. For a longer one the high bytes keep the hash of the position but
+// its last cursorTailLen bytes at most, and the tail, the lowest byte keeps the
+// length of the tail with the cursorLong bit. The hashed prefix is added to the
+// dictionary, where it is shared by the cursors of the positions differing in the
+// tail. It returns false if the hash is of another prefix for any length of the
+// tail, then the scan stops at the next entry instead.
+func (ldb *LevelDB) encodeCursor(last, next []byte) (uint64, bool) {
+	n := 0
+	for n < len(last) && last[n] == next[n] {
+		n++
+	}
+	position := next
+	if last != nil {
+		position = next[:n+1]
+	}
+
+	var b [8]byte
+	if len(position) <= cursorKeyLen {
+		copy(b[:], position)
+		b[7] = byte(len(position)) + 1
+		return binary.BigEndian.Uint64(b[:]), true
+	}
+	for t := cursorTailLen; t >= 0; t-- {
+		d := position[:len(position)-t]
+		if h, ok := ldb.addCursorPrefix(d); ok {
+			binary.BigEndian.PutUint32(b[:], h)
+			copy(b[4:], position[len(d):])
+			b[7] = cursorLong | byte(t)
+			return binary.BigEndian.Uint64(b[:]), true
+		}
+	}
+	return 0, false
+}
+
+// decodeCursor returns the position of the cursor by encodeCursor
+func (ldb *LevelDB) decodeCursor(cursor uint64) ([]byte, bool) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], cursor)
+	if b[7]&cursorLong != 0 {
+		t := int(b[7] &^ cursorLong)
+		if t > cursorTailLen || !zeros(b[4+t:7]) {
+			return nil, false
+		}
+		d, ok := ldb.cursorPrefix(binary.BigEndian.Uint32(b[:4]))
+		if !ok {
+			return nil, false
+		}
+		return append(append([]byte{}, d...), b[4:4+t]...), true
+	}
+	n := int(b[7]) - 1
+	if n < 0 || n > cursorKeyLen || !zeros(b[n:7]) {
+		return nil, false
+	}
+	return b[:n], true
+}
+
+// zeros returns true if all bytes of b are 0
+func zeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scan iterates at most count entries with the prefix, from the position of the
+// cursor. It returns the cursor of the next entry, or 0 if no more entries. The
+// scan resumes by one seek, so each call visits count entries. Only if the hash
+// of the position of the cursor is of another prefix in the dictionary, the scan
+// goes on after count until the next entry.
+func (ldb *LevelDB) scan(prefix []byte, cursor uint64, count int, f func(key, value []byte)) (uint64, error) {
+	r := util.BytesPrefix(prefix)
+	iter := ldb.newIterator(r)
+	defer iter.Release()
+
+	var ok bool
+	if cursor == 0 {
+		ok = iter.First()
+	} else if position, valid := ldb.decodeCursor(cursor); !valid {
+		return 0, ErrInvalidCursor
+	} else {
+		ok = iter.Seek(append(append([]byte{}, prefix...), position...))
+	}
+
+	var last []byte // the position of the last returned entry
+	n := 0
+	for ; ok; ok = iter.Next() {
+		position := iter.Key()[len(prefix):]
+		if n >= count {
+			if next, stop := ldb.encodeCursor(last, position); stop {
+				return next, nil
+			}
+		}
+		f(iter.Key(), iter.Value())
+		last = append(last[:0], position...)
+		n++
+	}
+	return 0, ldb.iterError(iter)
+}
+
+// Scan iterates the keys from the cursor, count is the number of keys to visit,
+// the keys not expired and accepted by match are returned.
+func (ldb *LevelDB) Scan(cursor uint64, count int, match func(key []byte, tipe byte) bool) (next uint64, keys [][]byte, err error) {
+	defer catch(&err)
+	now := time.Now()
+	keys = [][]byte{}
+	next, err = ldb.scan([]byte{MetaPrefix}, cursor, count, func(metaKey, metadata []byte) {
+		key := metaKey[1:]
+		tipe, err := parseMetadata(metadata)
+		if err != nil || !ldb.live(metadata) || !match(key, tipe) {
+			return
+		}
+		if at := ldb.expireAt(key); at != nil && !at.After(now) {
+			return
+		}
+		keys = append(keys, append([]byte{}, key...))
+	})
+	return next, keys, err
+}
+
+// ScanFields iterates the fields of hash/set from the cursor, count is the number
+// of fields to visit.
+func (ldb *LevelDB) ScanFields(key []byte, cursor uint64, count int) (next uint64, fields []Field, err error) {
+	defer catch(&err)
+	prefix := ldb.encodeFieldKey(key, nil)
+	owned := ldb.ownedField(key)
+	fields = []Field{}
+	next, err = ldb.scan(prefix, cursor, count, func(fieldKey, value []byte) {
+		if !owned(fieldKey[len(prefix):]) {
+			return
+		}
+		field := append([]byte{}, fieldKey[len(prefix):]...)
+		fields = append(fields, Field{field, append([]byte{}, value...)})
+	})
+	return next, fields, err
+}
+
+// ScanSkip iterates the elements of skiplist from the cursor, in the order of
+// field, count is the number of elements to visit.
+func (ldb *LevelDB) ScanSkip(key []byte, cursor uint64, count int) (next uint64, elements []SkipListElement, err error) {
+	defer catch(&err)
+	prefix := ldb.encodeSkipFieldKey(key, nil)
+	elements = []SkipListElement{}
+	next, err = ldb.scan(prefix, cursor, count, func(fieldKey, value []byte) {
+		field := fieldKey[len(prefix):]
+		if bytes.Equal(field, SKIPATTR) || bytes.Equal(field, SKIPHEAD) || len(value) < 8 {
+			return
+		}
+		elements = append(elements, SkipListElement{append([]byte{}, field...), byteToFloat64(value)})
+	})
+	return next, elements, err
+}
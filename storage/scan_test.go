@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestCursor(t *testing.T) {
+	db := openTest(t)
+	tests := []struct {
+		last, next, position string
+	}{
+		{"a", "b", "b"},
+		{"", "abc", "abc"},
+		{"ab", "abc", "abc"},
+		{"abcdefg", "abcdefh", "abcdefh"},
+		{"abcdefgh", "abcdefgi", "abcdefgi"},
+		{"ab", "abcdefghij", "abc"},
+		{"", "abcdefghij", "abcdefghij"},
+		{"session:00000109", "session:00000110", "session:0000011"},
+		{"session:00000199", "session:00000200", "session:000002"},
+	}
+	for i, test := range tests {
+		var last []byte
+		if test.last != "" {
+			last = []byte(test.last)
+		}
+		cursor, ok := db.encodeCursor(last, []byte(test.next))
+		if !ok || cursor == 0 {
+			t.Errorf("encodeCursor[%v](%q, %q), Expect: a cursor, Get: %v, %v", i, test.last, test.next, cursor, ok)
+			continue
+		}
+		if position, ok := db.decodeCursor(cursor); !ok || string(position) != test.position {
+			t.Errorf("decodeCursor[%v](%#x), Expect: %q, Get: %q, %v", i, cursor, test.position, position, ok)
+		}
+	}
+	for _, cursor := range []uint64{12345678, 0x0100000000000001, 0x09, 0x0100, 0x84, 0x0180, 0x1234567800000081} {
+		if position, ok := db.decodeCursor(cursor); ok {
+			t.Errorf("decodeCursor(%#x), Expect: invalid, Get: %q", cursor, position)
+		}
+	}
+}
+
+// TestCursorConflict checks a cursor keeps a shorter hashed prefix if the hash is
+// of another prefix in the dictionary, and the scan goes on after count if the
+// hashes of all the prefixes are taken.
+func TestCursorConflict(t *testing.T) {
+	db := openTest(t)
+	position := "session:0000001"
+	take := func(d string) {
+		if err := db.db.Put(encodeCursorKey(prefixHash([]byte(d))), []byte("other"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	take(position[:len(position)-cursorTailLen])
+	cursor, ok := db.encodeCursor([]byte("session:00000009"), []byte("session:00000010"))
+	if got, valid := db.decodeCursor(cursor); !ok || !valid || string(got) != position {
+		t.Fatalf("decodeCursor(encodeCursor) of a taken hash, Expect: %q, Get: %q, %v, %v", position, got, ok, valid)
+	}
+	if cursor&0xff != cursorLong|(cursorTailLen-1) {
+		t.Errorf("encodeCursor of a taken hash, Expect: tail of %v bytes, Get: %#x", cursorTailLen-1, cursor&0xff)
+	}
+
+	for i := 0; i < cursorTailLen; i++ {
+		take(position[:len(position)-i])
+	}
+	if cursor, ok := db.encodeCursor([]byte("session:00000009"), []byte("session:00000010")); ok {
+		t.Errorf("encodeCursor of all hashes taken, Expect: false, Get: %#x", cursor)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.PutString([]byte(fmt.Sprintf("session:%08d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next, keys, err := db.Scan(0, 10, func([]byte, byte) bool { return true })
+	if err != nil || next == 0 || len(keys) != 11 {
+		t.Fatalf("Scan(0, 10) of all hashes taken, Expect: 11 keys, Get: %v, %v, %v", next, len(keys), err)
+	}
+	seen := make(map[string]int)
+	scanAll(t, db, next, 10, seen)
+	if len(seen) != 9 || seen["session:00000010"] != 0 || seen["session:00000011"] != 1 {
+		t.Errorf("Scan after the taken hashes, Expect: 9 keys from session:00000011, Get: %v", seen)
+	}
+}
+
+// scanAll scans db by count from the cursor, and counts the keys returned
+func scanAll(t *testing.T, db *LevelDB, cursor uint64, count int, seen map[string]int) {
+	for {
+		next, keys, err := db.Scan(cursor, count, func([]byte, byte) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func TestScanRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rodis-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openTestAt(t, dir)
+	for i := 0; i < 50; i++ {
+		if err := db.PutString([]byte(fmt.Sprintf("long:key:%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	for i := 0; i < 3; i++ {
+		next, keys, err := db.Scan(cursor, 7, func([]byte, byte) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		cursor = next
+	}
+
+	// the cursor is continued by the reopened leveldb
+	db.close()
+	db = openTestAt(t, dir)
+	scanAll(t, db, cursor, 7, seen)
+	if len(seen) != 50 {
+		t.Errorf("Scan after restart, Expect: 50 keys, Get: %v", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("Scan after restart, Expect: %v once, Get: %v times", key, n)
+		}
+	}
+}
+
+// TestScanSharedPrefix checks the keys and fields sharing a prefix longer than
+// the position kept in a cursor are scanned by count, each once.
+func TestScanSharedPrefix(t *testing.T) {
+	db := openTest(t)
+	n := 1000
+	hash := map[string][]byte{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("session:%04d", i)
+		if err := db.PutString([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		hash["field:"+key] = []byte("v")
+	}
+	if err := db.PutHash([]byte("hash"), resp.Hash, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	for cursor := uint64(0); ; {
+		next, keys, err := db.Scan(cursor, 10, func([]byte, byte) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 10 {
+			t.Fatalf("Scan(%v, 10), Expect: at most 10 keys, Get: %v", cursor, len(keys))
+		}
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	for cursor := uint64(0); ; {
+		next, fields, err := db.ScanFields([]byte("hash"), cursor, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) > 10 {
+			t.Fatalf("ScanFields(%v, 10), Expect: at most 10 fields, Get: %v", cursor, len(fields))
+		}
+		for _, field := range fields {
+			seen[string(field.Key)]++
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	if len(seen) != 2*n+1 {
+		t.Errorf("Scan of shared prefix, Expect: %v keys and fields, Get: %v", 2*n+1, len(seen))
+	}
+	for key, c := range seen {
+		if c != 1 {
+			t.Errorf("Scan of shared prefix, Expect: %v once, Get: %v times", key, c)
+		}
+	}
+}
+
+// TestScanLargeGroup checks a large group of keys sharing a long prefix is
+// scanned by count, each call resuming at its cursor, and the cursors share few
+// prefixes in the dictionary.
+func TestScanLargeGroup(t *testing.T) {
+	db := openTest(t)
+	n := 20000
+	for i := 0; i < n; i++ {
+		if err := db.PutString([]byte(fmt.Sprintf("session:user:%08d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]int)
+	calls := 0
+	for cursor := uint64(0); ; {
+		next, keys, err := db.Scan(cursor, 10, func([]byte, byte) bool { return true })
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		if next != 0 && len(keys) != 10 || len(keys) > 10 {
+			t.Fatalf("Scan(%#x, 10), Expect: 10 keys, Get: %v", cursor, len(keys))
+		}
+		for _, key := range keys {
+			seen[string(key)]++
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if calls != n/10 || len(seen) != n {
+		t.Errorf("Scan of large group, Expect: %v keys by %v calls, Get: %v by %v", n, n/10, len(seen), calls)
+	}
+	for key, c := range seen {
+		if c != 1 {
+			t.Errorf("Scan of large group, Expect: %v once, Get: %v times", key, c)
+		}
+	}
+
+	iter := db.db.NewIterator(util.BytesPrefix(encodeSystemKey(CursorKey, nil)), nil)
+	entries := 0
+	for iter.Next() {
+		entries++
+	}
+	iter.Release()
+	if entries > 100 {
+		t.Errorf("Scan of large group, Expect: at most 100 prefixes in dictionary, Get: %v", entries)
+	}
+}
+
+// TestScanDeleted checks the scan resumes after its cursor, if the key at the
+// cursor is deleted between the calls, and in the read only mode.
+func TestScanDeleted(t *testing.T) {
+	defer resetReadOnly()
+	db := openTest(t)
+	for i := 0; i < 30; i++ {
+		if err := db.PutString([]byte(fmt.Sprintf("session:user:%08d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next, _, err := db.Scan(0, 10, func([]byte, byte) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Delete([]byte("session:user:00000010")); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	scanAll(t, db, next, 10, seen)
+	if len(seen) != 19 || seen["session:user:00000011"] != 1 {
+		t.Errorf("Scan after the key at the cursor deleted, Expect: 19 keys from session:user:00000011, Get: %v", seen)
+	}
+
+	// the prefixes of the cursors are kept in memory
+	fallback(&Error{Kind: KindDiskFull, Op: "write", Err: syscall.ENOSPC})
+	seen = make(map[string]int)
+	scanAll(t, db, 0, 7, seen)
+	if len(seen) != 29 {
+		t.Errorf("Scan in read only mode, Expect: 29 keys, Get: %v", len(seen))
+	}
+}
@@ -9,13 +9,12 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"math"
 	"math/rand"
 	"time"
 
 	"github.com/libgo/logx"
-	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -51,33 +50,29 @@ type skipListNode struct {
 	levels   []skipListLevel
 }
 
-// encodeSkipFieldKey encodes hash field key: -Key|Field
-// Number=0 means the element to store attributes(length, head, tail, counter)
-func encodeSkipFieldKey(key []byte, field []byte) []byte {
-	fieldKey := make([]byte, 1 /* '-' */ +len(key)+1 /* '|' */ +len(field) /* num */)
-	fieldKey[0] = ValuePrefix
-	copy(fieldKey[1:], key)
-	fieldKey[1+len(key)] = Seperator
-	copy(fieldKey[1+len(key)+1:], field)
-	return fieldKey
+// encodeSkipFieldKey encodes skiplist node key as a field key
+// Field=SKIPATTR means the node to store attributes(length, level, tail)
+func (ldb *LevelDB) encodeSkipFieldKey(key []byte, field []byte) []byte {
+	return ldb.encodeFieldKey(key, field)
 }
 
 // DeleteSkip
-func (ldb *LevelDB) DeleteSkip(key []byte) {
-	keys := [][]byte{encodeMetaKey(key)}
-
-	keyPrefix := append([]byte{ValuePrefix}, key...)
-	iter := ldb.db.NewIterator(util.BytesPrefix(keyPrefix), nil)
-	for iter.Next() {
-		keys = append(keys, append([]byte{}, iter.Key()...))
-	}
-	iter.Release()
+func (ldb *LevelDB) DeleteSkip(key []byte) (err error) {
+	defer catch(&err)
+	ldb.deleteSkip(key)
+	return nil
+}
 
-	ldb.delete(keys)
+// deleteSkip deletes the skiplist, the storage error is raised
+func (ldb *LevelDB) deleteSkip(key []byte) {
+	ldb.modify(key)
+	ldb.keyDeleted(key)
+	ldb.dropKey(key)
+	ldb.clearExpireAt(key)
 }
 
-// deleteSkipNode
-func (ldb *LevelDB) deleteSkipNode(key []byte, attr *skipListAttr, head *skipListNode, node *skipListNode, update []*skipListNode) {
+// deleteSkipNode, the empty skiplist is deleted unless keepEmpty
+func (ldb *LevelDB) deleteSkipNode(key []byte, attr *skipListAttr, head *skipListNode, node *skipListNode, update []*skipListNode, keepEmpty bool) {
 	for i := 0; i < int(attr.level); i++ {
 		if bytes.Equal(update[i].levels[i].forward, node.field) {
 			update[i].levels[i].span = update[i].levels[i].span + node.levels[i].span - 1
@@ -108,12 +103,12 @@ func (ldb *LevelDB) deleteSkipNode(key []byte, attr *skipListAttr, head *skipLis
 	}
 	attr.length = attr.length - 1
 
-	if attr.length == 0 {
-		ldb.DeleteSkip(key)
+	if attr.length == 0 && !keepEmpty {
+		ldb.deleteSkip(key)
 	} else {
 		ldb.putSkipNode(key, head)
 		ldb.putSkipAttr(key, attr)
-		ldb.delete([][]byte{encodeSkipFieldKey(key, node.field)})
+		ldb.delete([][]byte{ldb.encodeSkipFieldKey(key, node.field)})
 	}
 }
 
@@ -147,20 +142,30 @@ func dumpNode(n *skipListNode) {
 }
 
 // GetSkipLength
-func (ldb *LevelDB) GetSkipLength(key []byte) uint32 {
+func (ldb *LevelDB) GetSkipLength(key []byte) (n uint32, err error) {
+	defer catch(&err)
 	attr := ldb.getSkipAttr(key)
 	if attr == nil {
-		return 0
+		return 0, nil
 	}
-	return attr.length
+	return attr.length, nil
 }
 
-// getSkipAttr
+// getSkipAttr returns a copy of the attributes, which can be modified
 func (ldb *LevelDB) getSkipAttr(key []byte) *skipListAttr {
-	m := ldb.get(encodeSkipFieldKey(key, []byte{0x00, 0x00, 0x00, 0x00}))
-	if len(m) < 5 { //no attr or invalid
+	attr := ldb.cached(ldb.encodeSkipFieldKey(key, SKIPATTR), recordSkipAttr, decodeSkipAttr).(*skipListAttr)
+	if attr == nil {
 		return nil
 	}
+	r := *attr
+	return &r
+}
+
+// decodeSkipAttr decodes the skiplist attributes record
+func decodeSkipAttr(m []byte) interface{} {
+	if len(m) < 5 { //no attr or invalid
+		return (*skipListAttr)(nil)
+	}
 
 	length := binary.BigEndian.Uint32(m[0:])
 	level := binary.BigEndian.Uint32(m[4:])
@@ -174,7 +179,7 @@ func (ldb *LevelDB) getSkipAttr(key []byte) *skipListAttr {
 
 // putSkipAttr
 func (ldb *LevelDB) putSkipAttr(key []byte, attr *skipListAttr) {
-	attrKey := encodeSkipFieldKey(key, []byte{0x00, 0x00, 0x00, 0x00})
+	attrKey := ldb.encodeSkipFieldKey(key, []byte{0x00, 0x00, 0x00, 0x00})
 
 	m := make([]byte, 8)
 	binary.BigEndian.PutUint32(m, attr.length)
@@ -186,9 +191,24 @@ func (ldb *LevelDB) putSkipAttr(key []byte, attr *skipListAttr) {
 	ldb.put(attrKey, m)
 }
 
-// getSkipNode
+// getSkipNode returns a copy of the node, which can be modified
 func (ldb *LevelDB) getSkipNode(key []byte, field []byte) *skipListNode {
-	m := ldb.get(encodeSkipFieldKey(key, field))
+	if field == nil { // the end of forward or backward
+		return nil
+	}
+	node := ldb.cached(ldb.encodeSkipFieldKey(key, field), recordSkipNode, func(m []byte) interface{} {
+		return decodeSkipNode(field, m)
+	}).(*skipListNode)
+	if node == nil {
+		return nil
+	}
+	r := *node
+	r.levels = append([]skipListLevel{}, node.levels...)
+	return &r
+}
+
+// decodeSkipNode decodes the skiplist node record of field
+func decodeSkipNode(field []byte, m []byte) *skipListNode {
 	if len(m) == 0 {
 		return nil
 	}
@@ -217,7 +237,7 @@ func (ldb *LevelDB) getSkipNode(key []byte, field []byte) *skipListNode {
 
 		levels = append(levels, skipListLevel{forward, span})
 	}
-	r := skipListNode{field, score, backward, levels}
+	r := skipListNode{append([]byte{}, field...), score, backward, levels}
 	return &r
 }
 
@@ -226,7 +246,7 @@ func (ldb *LevelDB) putSkipNode(key []byte, node *skipListNode) {
 	if node == nil {
 		return
 	}
-	nodeKey := encodeSkipFieldKey(key, node.field)
+	nodeKey := ldb.encodeSkipFieldKey(key, node.field)
 
 	m := float64ToByte(node.score)
 	m = append(m, uint8(len(node.backward)))
@@ -255,18 +275,36 @@ func (ldb *LevelDB) initSkipNode(field []byte) *skipListNode {
 	return &skipListNode{field, float64(0.0), nil, levels}
 }
 
-// AddSkipField
-func (ldb *LevelDB) AddSkipField(key []byte, tipe byte, field []byte, score float64) {
+// AddSkipField adds the field or updates its score, returns true if the field is new
+func (ldb *LevelDB) AddSkipField(key []byte, tipe byte, field []byte, score float64) (added bool, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	if old := ldb.getSkipNode(key, field); old != nil {
+		if old.score == score {
+			return false, nil
+		}
+		// remove the node, and insert it again with the new score
+		ldb.deleteSkipField(key, field, true)
+		ldb.insertSkipNode(key, tipe, field, score)
+		return false, nil
+	}
+
+	ldb.insertSkipNode(key, tipe, field, score)
+	return true, nil
+}
+
+// insertSkipNode inserts a new node of the field
+func (ldb *LevelDB) insertSkipNode(key []byte, tipe byte, field []byte, score float64) {
 	attr := ldb.getSkipAttr(key)
 	if attr == nil {
-		ldb.put(encodeMetaKey(key), encodeMetadata(tipe))
+		ldb.putMetadata(key, tipe)
 		attr = &skipListAttr{0, 1, nil}
 		ldb.putSkipAttr(key, attr)
 
 		ldb.putSkipNode(key, ldb.initSkipNode(SKIPHEAD))
 	}
 
-	head := ldb.getSkipNode(key, SKIPHEAD)
+	head := ldb.getSkipHead(key)
 
 	update := make([]*skipListNode, SKIPLISTMAXLEVEL)
 	rank := make([]uint32, SKIPLISTMAXLEVEL)
@@ -336,19 +374,20 @@ func (ldb *LevelDB) AddSkipField(key []byte, tipe byte, field []byte, score floa
 	}
 }
 
-// GetSkipFieldRank
-func (ldb *LevelDB) GetSkipFieldRank(key []byte, field []byte) (int, error) {
+// GetSkipFieldRank returns the rank of field, ok is false if the field does not exist
+func (ldb *LevelDB) GetSkipFieldRank(key []byte, field []byte) (n int, ok bool, err error) {
+	defer catch(&err)
 	x := ldb.getSkipNode(key, field)
 	if x == nil {
-		return 0, fmt.Errorf("Not found this field")
+		return 0, false, nil
 	}
 
 	attr := ldb.getSkipAttr(key)
 	if attr == nil {
-		return 0, fmt.Errorf("Not found this zset")
+		return 0, false, nil
 	}
 
-	head := ldb.getSkipNode(key, SKIPHEAD)
+	head := ldb.getSkipHead(key)
 	rank := make([]uint32, SKIPLISTMAXLEVEL)
 
 	node := head
@@ -369,11 +408,18 @@ func (ldb *LevelDB) GetSkipFieldRank(key []byte, field []byte) (int, error) {
 		}
 	}
 
-	return int(rank[0]), nil
+	return int(rank[0]), true, nil
 }
 
-// DeleteSkipField
-func (ldb *LevelDB) DeleteSkipField(key []byte, field []byte) int {
+// DeleteSkipField deletes the field, returns 1 if the field is deleted
+func (ldb *LevelDB) DeleteSkipField(key []byte, field []byte) (n int, err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	return ldb.deleteSkipField(key, field, false), nil
+}
+
+// deleteSkipField deletes the field, the empty skiplist is deleted unless keepEmpty
+func (ldb *LevelDB) deleteSkipField(key []byte, field []byte, keepEmpty bool) int {
 	attr := ldb.getSkipAttr(key)
 	if attr == nil {
 		return 0
@@ -383,7 +429,7 @@ func (ldb *LevelDB) DeleteSkipField(key []byte, field []byte) int {
 		return 0
 	}
 
-	head := ldb.getSkipNode(key, SKIPHEAD)
+	head := ldb.getSkipHead(key)
 	update := make([]*skipListNode, SKIPLISTMAXLEVEL)
 
 	x := head
@@ -399,100 +445,241 @@ func (ldb *LevelDB) DeleteSkipField(key []byte, field []byte) int {
 		update[i] = x
 	}
 
-	ldb.deleteSkipNode(key, attr, head, node, update)
+	ldb.deleteSkipNode(key, attr, head, node, update, keepEmpty)
 	return 1
 }
 
-// GetSkipRange
-func (ldb *LevelDB) GetSkipRange(key []byte, start int, end int) []SkipListElement {
-	attr := ldb.getSkipAttr(key)
-
-	l := int(attr.length)
+// skipRangeIndex normalizes the start and end index of a range, the negative
+// index counts from the tail. ok is false for an empty range.
+func skipRangeIndex(l int, start int, end int) (int, int, bool) {
 	if start < 0 {
 		start = l + start
 	}
 	if end < 0 {
 		end = l + end
 	}
-
-	r := []SkipListElement{}
-
 	if start < 0 {
 		start = 0
 	}
-	if start >= l {
-		return r
-	}
-	if end < 0 {
-		end = 0
-	}
 	if end >= l {
 		end = l - 1
 	}
-	if start > end {
-		return r
+	if start >= l || end < 0 || start > end {
+		return 0, 0, false
 	}
+	return start, end, true
+}
 
-	node := ldb.getSkipNode(key, SKIPHEAD)
-	forward := node.levels[0].forward
-	for i := 0; i < start; i++ {
-		if forward == nil {
-			return r
+// getSkipNodeByRank returns the node of the 1-based rank, following the spans
+// from the highest level, so it needs O(log(N)) node reads.
+// getSkipHead returns the head node of the skiplist of the existing key, the
+// missing head is a storage error.
+func (ldb *LevelDB) getSkipHead(key []byte) *skipListNode {
+	head := ldb.getSkipNode(key, SKIPHEAD)
+	if head == nil {
+		ldb.raise("skiplist head", leveldb.ErrNotFound)
+	}
+	return head
+}
+
+func (ldb *LevelDB) getSkipNodeByRank(key []byte, attr *skipListAttr, rank uint32) *skipListNode {
+	node := ldb.getSkipHead(key)
+	traversed := uint32(0)
+	for i := int(attr.level - 1); i >= 0; i-- {
+		for node.levels[i].forward != nil && traversed+node.levels[i].span <= rank {
+			traversed += node.levels[i].span
+			node = ldb.getSkipNode(key, node.levels[i].forward)
+		}
+		if traversed == rank {
+			return node
 		}
-		node = ldb.getSkipNode(key, forward)
-		forward = node.levels[0].forward
 	}
+	return nil
+}
 
-	for i := start; i <= end; i++ {
-		if forward == nil {
-			return r
+// seekSkip walks the nodes while before returns true, before must be true for
+// a prefix of the skiplist. It returns the number of nodes walked and the last
+// one, which is the head if no node is walked.
+func (ldb *LevelDB) seekSkip(key []byte, attr *skipListAttr, before func(n *skipListNode) bool) (uint32, *skipListNode) {
+	node := ldb.getSkipHead(key)
+	rank := uint32(0)
+	for i := int(attr.level - 1); i >= 0; i-- {
+		for node.levels[i].forward != nil {
+			forward := ldb.getSkipNode(key, node.levels[i].forward)
+			if !before(forward) {
+				break
+			}
+			rank += node.levels[i].span
+			node = forward
 		}
-		node = ldb.getSkipNode(key, forward)
-		forward = node.levels[0].forward
+	}
+	return rank, node
+}
+
+// GetSkipScore returns the score of field, ok is false if the field does not exist
+func (ldb *LevelDB) GetSkipScore(key []byte, field []byte) (score float64, ok bool, err error) {
+	defer catch(&err)
+	node := ldb.getSkipNode(key, field)
+	if node == nil {
+		return 0, false, nil
+	}
+	return node.score, true, nil
+}
+
+// GetSkipRange returns the elements between start and end index in score order
+func (ldb *LevelDB) GetSkipRange(key []byte, start int, end int) (elements []SkipListElement, err error) {
+	defer catch(&err)
+	r := []SkipListElement{}
+
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return r, nil
+	}
+	start, end, ok := skipRangeIndex(int(attr.length), start, end)
+	if !ok {
+		return r, nil
+	}
+
+	node := ldb.getSkipNodeByRank(key, attr, uint32(start+1))
+	for i := start; i <= end && node != nil; i++ {
+		r = append(r, SkipListElement{node.field, node.score})
+		node = ldb.getSkipNode(key, node.levels[0].forward)
+	}
+	return r, nil
+}
+
+// GetSkipRevRange returns the elements between start and end index in reverse
+// score order, walking backward from the tail.
+func (ldb *LevelDB) GetSkipRevRange(key []byte, start int, end int) (elements []SkipListElement, err error) {
+	defer catch(&err)
+	r := []SkipListElement{}
+
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return r, nil
+	}
+	l := int(attr.length)
+	start, end, ok := skipRangeIndex(l, start, end)
+	if !ok {
+		return r, nil
+	}
+
+	node := ldb.getSkipNodeByRank(key, attr, uint32(l-start))
+	for i := start; i <= end && node != nil; i++ {
 		r = append(r, SkipListElement{node.field, node.score})
+		node = ldb.getSkipNode(key, node.backward)
 	}
-	return r
+	return r, nil
 }
 
-// GetSkipRangeByScore
-func (ldb *LevelDB) GetSkipRangeByScore(key []byte, min float64, minex bool, max float64, maxex bool) []SkipListElement {
+// GetSkipRangeByScore returns the elements between min and max score
+func (ldb *LevelDB) GetSkipRangeByScore(key []byte, min float64, minex bool, max float64, maxex bool) (elements []SkipListElement, err error) {
+	defer catch(&err)
 	r := []SkipListElement{}
 
 	if min > max {
-		return r
+		return r, nil
 	}
 
 	if min == max && (minex || maxex) {
-		return r
+		return r, nil
 	}
 
 	attr := ldb.getSkipAttr(key)
 	if attr == nil {
-		return r
+		return r, nil
 	}
 
-	node := ldb.getSkipNode(key, SKIPHEAD)
-	for i := int(attr.level - 1); i >= 0; i-- {
-		for node.levels[i].forward != nil {
-			forward := ldb.getSkipNode(key, node.levels[i].forward)
-			if !scoreGteMin(forward.score, min, minex) {
-				node = forward
-			} else {
-				break
-			}
-		}
+	_, node := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return !scoreGteMin(n.score, min, minex) })
+	node = ldb.getSkipNode(key, node.levels[0].forward)
+	for node != nil && scoreLteMax(node.score, max, maxex) {
+		r = append(r, SkipListElement{node.field, node.score})
+		node = ldb.getSkipNode(key, node.levels[0].forward)
 	}
+	return r, nil
+}
 
+// GetSkipRevRangeByScore returns the elements between max and min score in
+// reverse score order
+func (ldb *LevelDB) GetSkipRevRangeByScore(key []byte, max float64, maxex bool, min float64, minex bool) (elements []SkipListElement, err error) {
+	defer catch(&err)
+	r := []SkipListElement{}
+
+	if min > max {
+		return r, nil
+	}
+
+	if min == max && (minex || maxex) {
+		return r, nil
+	}
+
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return r, nil
+	}
+
+	rank, node := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return scoreLteMax(n.score, max, maxex) })
+	if rank == 0 {
+		return r, nil
+	}
+	for node != nil && scoreGteMin(node.score, min, minex) {
+		r = append(r, SkipListElement{node.field, node.score})
+		node = ldb.getSkipNode(key, node.backward)
+	}
+	return r, nil
+}
+
+// GetSkipCountByScore returns the number of elements between min and max score,
+// it is the difference of two ranks, without walking the elements.
+func (ldb *LevelDB) GetSkipCountByScore(key []byte, min float64, minex bool, max float64, maxex bool) (n int, err error) {
+	defer catch(&err)
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return 0, nil
+	}
+
+	before, _ := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return !scoreGteMin(n.score, min, minex) })
+	last, _ := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return scoreLteMax(n.score, max, maxex) })
+	if last <= before {
+		return 0, nil
+	}
+	return int(last - before), nil
+}
+
+// GetSkipRangeByLex returns the elements between min and max field, all
+// elements should have the same score. nil min or max is unbounded.
+func (ldb *LevelDB) GetSkipRangeByLex(key []byte, min []byte, minex bool, max []byte, maxex bool) (elements []SkipListElement, err error) {
+	defer catch(&err)
+	r := []SkipListElement{}
+
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return r, nil
+	}
+
+	_, node := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return !lexGteMin(n.field, min, minex) })
 	node = ldb.getSkipNode(key, node.levels[0].forward)
-	for node != nil {
-		if scoreLteMax(node.score, max, maxex) {
-			r = append(r, SkipListElement{node.field, node.score})
-			node = ldb.getSkipNode(key, node.levels[0].forward)
-		} else {
-			break
-		}
+	for node != nil && lexLteMax(node.field, max, maxex) {
+		r = append(r, SkipListElement{node.field, node.score})
+		node = ldb.getSkipNode(key, node.levels[0].forward)
+	}
+	return r, nil
+}
+
+// GetSkipCountByLex returns the number of elements between min and max field
+func (ldb *LevelDB) GetSkipCountByLex(key []byte, min []byte, minex bool, max []byte, maxex bool) (n int, err error) {
+	defer catch(&err)
+	attr := ldb.getSkipAttr(key)
+	if attr == nil {
+		return 0, nil
+	}
+
+	before, _ := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return !lexGteMin(n.field, min, minex) })
+	last, _ := ldb.seekSkip(key, attr, func(n *skipListNode) bool { return lexLteMax(n.field, max, maxex) })
+	if last <= before {
+		return 0, nil
 	}
-	return r
+	return int(last - before), nil
 }
 
 func randomLevel() uint32 {
@@ -523,18 +710,42 @@ func byteToFloat64(bytes []byte) float64 {
 	return math.Float64frombits(bits)
 }
 
+// scoreGteMin returns true if score is in the range of min, minex is true for exclusive
 func scoreGteMin(score float64, min float64, minex bool) bool {
-	if !minex {
+	if minex {
 		return score > min
 	}
 
 	return score >= min
 }
 
+// scoreLteMax returns true if score is in the range of max, maxex is true for exclusive
 func scoreLteMax(score float64, max float64, maxex bool) bool {
-	if !maxex {
+	if maxex {
 		return score < max
 	}
 
 	return score <= max
 }
+
+// lexGteMin returns true if field is in the range of min, nil min is -inf
+func lexGteMin(field []byte, min []byte, minex bool) bool {
+	if min == nil {
+		return true
+	}
+	if minex {
+		return bytes.Compare(field, min) > 0
+	}
+	return bytes.Compare(field, min) >= 0
+}
+
+// lexLteMax returns true if field is in the range of max, nil max is +inf
+func lexLteMax(field []byte, max []byte, maxex bool) bool {
+	if max == nil {
+		return true
+	}
+	if maxex {
+		return bytes.Compare(field, max) < 0
+	}
+	return bytes.Compare(field, max) <= 0
+}
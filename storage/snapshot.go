@@ -0,0 +1,67 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// snapshot is the leveldb snapshot read by a snapshot handle, with the flushed
+// generation when it is taken, so the keys flushed later are still live in it.
+type snapshot struct {
+	s       *leveldb.Snapshot
+	flushed uint64
+}
+
+// Snapshot returns a read only handle of the leveldb at this moment, the reads
+// of the handle never see the later writes. The caller must hold the lock of
+// the whole db to take a consistent snapshot, and Release the handle when done.
+// The handle must not be written.
+func (ldb *LevelDB) Snapshot() (*LevelDB, error) {
+	s, err := ldb.db.GetSnapshot()
+	if err != nil {
+		return nil, ldb.error("snapshot", err)
+	}
+	snap := &snapshot{s: s, flushed: atomic.LoadUint64(&ldb.flushed)}
+	return &LevelDB{database: ldb.database, snap: snap}, nil
+}
+
+// Release releases the snapshot of a snapshot handle
+func (ldb *LevelDB) Release() {
+	if ldb.snap != nil {
+		ldb.snap.s.Release()
+	}
+}
+
+// Each calls f with the keys not expired in key order, and their types and
+// expires, the nil expire for the key without expire. It stops at the first
+// error of f, which is returned.
+func (ldb *LevelDB) Each(f func(key []byte, tipe byte, at *time.Time) error) (err error) {
+	defer catch(&err)
+	now := time.Now()
+	iter := ldb.newIterator(util.BytesPrefix([]byte{MetaPrefix}))
+	defer iter.Release()
+
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()[1:]...)
+		tipe, err := parseMetadata(iter.Value())
+		if err != nil || !ldb.live(iter.Value()) {
+			continue
+		}
+		at := ldb.expireAt(key)
+		if at != nil && !at.After(now) {
+			continue
+		}
+		if err := f(key, tipe, at); err != nil {
+			return err
+		}
+	}
+	return ldb.iterError(iter)
+}
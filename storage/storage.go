@@ -6,7 +6,6 @@
 package storage
 
 import (
-	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -18,14 +17,28 @@ import (
 
 var storage [16]*LevelDB
 
-func Open(dbPath string, options *opt.Options) error {
+// Open opens the 16 leveldbs in dbPath, each caches at most cacheSize decoded
+// records, like the metadata of keys and the nodes of lists and skiplists.
+func Open(dbPath string, options *opt.Options, cacheSize int) error {
 	for i := 0; i < 16; i++ {
 		d := dbPath + fmt.Sprintf("/%d", i)
 		db, err := open(d, options)
 		if err != nil {
 			return err
 		}
+		db.index = i
+		db.cache = newRecordCache(cacheSize)
+		err = guard(func() error {
+			db.loadGenerations()
+			return db.countKeys()
+		})
+		if err != nil && ReadOnly() == nil { // opened read only if corrupted
+			return err
+		}
 		storage[i] = db
+		db.startSweeper(ExpireSweepInterval)
+		db.startMigrator()
+		db.startGC(GCInterval)
 	}
 	return nil
 }
@@ -40,14 +53,43 @@ func Close() {
 	}
 }
 
+// LevelDB is a handle of a leveldb: the database shared by all handles, and the
+// pending writes of a write context by Begin, or the snapshot read by the handle
+// by Snapshot, both nil for the handle by Select.
 type LevelDB struct {
-	db  *leveldb.DB
-	rwm *sync.RWMutex
+	*database
+	wb   *writeBatch
+	snap *snapshot
+}
+
+// database is a leveldb with its state shared by the handles
+type database struct {
+	db       *leveldb.DB
+	index    int
+	rwm      *sync.RWMutex // write locked by the operations on all keys
+	locks    *keyLocks     // read locked with rwm by the commands on some keys
+	sweeper  *expireSweeper
+	legacy   int32 // 1 if there may be keys in the legacy layout
+	migrator *migrator
+	keys     int64 // number of keys, maintained by the metadata writes
+	waiters  listWaiters
+	gc       *garbageCollector
+	cache    *recordCache // decoded records, nil if not cached
+	cursors  cursorDict   // the position prefixes kept in the scan cursors
+
+	migrateMu sync.Mutex // serializes the migrations of the legacy keys
+
+	genMu       sync.Mutex // protects gen and genReserved
+	gen         uint64     // the last generation
+	genReserved uint64     // the generations up to it are reserved in leveldb
+	flushed     uint64     // the keys with generation before it are deleted by Flush
+
+	wmu     sync.Mutex // protects watches
+	watches map[string]map[*Watcher]struct{}
 }
 
 const STRBYTE byte = 0x00
 
-var ErrLevelDB = errors.New("Backend Level DB Error")
 var ErrNotFound = leveldb.ErrNotFound
 
 // open/exist/get/put/delete/close are helpers for access internal data of leveldb.
@@ -59,23 +101,24 @@ func open(dbPath string, options *opt.Options) (*LevelDB, error) {
 
 	var rwmutex sync.RWMutex
 
-	return &LevelDB{db: db, rwm: &rwmutex}, nil
+	return &LevelDB{database: &database{
+		db:      db,
+		rwm:     &rwmutex,
+		locks:   &keyLocks{},
+		waiters: listWaiters{queues: make(map[string][]*ListWaiter), ready: make(map[string]struct{})},
+		watches: make(map[string]map[*Watcher]struct{}),
+	}}, nil
 }
 
 func (ldb *LevelDB) has(metaKey []byte) (bool, byte) {
-	metadata, err := ldb.db.Get(metaKey, nil)
-
-	if err != nil && err != leveldb.ErrNotFound {
-		panic(err)
-	}
-
-	if err == leveldb.ErrNotFound {
+	metadata := ldb.metadata(metaKey)
+	if metadata == nil || !ldb.live(metadata) {
 		return false, resp.None
 	}
 
 	tipe, err := parseMetadata(metadata)
 	if err != nil {
-		panic(err)
+		ldb.raise("metadata", err)
 	}
 	return true, tipe
 }
@@ -85,45 +128,41 @@ func (ldb *LevelDB) delete(keys [][]byte) {
 	for _, key := range keys {
 		batch.Delete(key)
 	}
-	if err := ldb.db.Write(batch, nil); err != nil && err != leveldb.ErrNotFound {
-		panic(err)
-	}
+	ldb.write(batch)
 }
 
 func (ldb *LevelDB) get(key []byte) []byte {
-	value, err := ldb.db.Get(key, nil)
-	if err != nil && err != ErrNotFound {
-		panic(err)
-	}
+	value, _ := ldb.lookup(key)
 	return value
 }
 
 func (ldb *LevelDB) put(key []byte, value []byte) {
-	err := ldb.db.Put(key, value, nil)
-	if err != nil {
-		panic(err)
-	}
+	batch := new(leveldb.Batch)
+	batch.Put(key, value)
+	ldb.write(batch)
 }
 
 func (ldb *LevelDB) close() {
+	ldb.stopGC()
+	ldb.stopMigrator()
+	ldb.stopSweeper()
 	if ldb.db != nil {
 		ldb.db.Close()
 	}
 }
 
-// Flush is to flush leveldb
-func (ldb *LevelDB) Flush() error {
-	iter := ldb.db.NewIterator(nil, nil)
-	for iter.Next() {
-		key := iter.Key()
-		ldb.db.Delete(key, nil)
-	}
-	iter.Release()
-	return iter.Error()
+// Has is to determine if a key exists
+func (ldb *LevelDB) Has(key []byte) (exist bool, tipe byte, err error) {
+	defer catch(&err)
+	exist, tipe = ldb.exists(key)
+	return exist, tipe, nil
 }
 
-// Has is to determine if a key exists
-func (ldb *LevelDB) Has(key []byte) (bool, byte) {
+// exists returns true and the type if the key exists and is not expired. The
+// expired key is deleted in a write context, whose caller holds the write lock of
+// the key, unless in the read only mode. The reads hold the shared lock only, so
+// they leave it to the expire sweeper.
+func (ldb *LevelDB) exists(key []byte) (bool, byte) {
 	metaKey := encodeMetaKey(key)
 	exist, tipe := ldb.has(metaKey)
 
@@ -131,28 +170,23 @@ func (ldb *LevelDB) Has(key []byte) (bool, byte) {
 		return exist, tipe
 	}
 
-	at := ldb.GetExpireAt(key)
+	at := ldb.expireAt(key)
 
 	if at == nil || at.After(time.Now()) {
 		return true, tipe
 	}
 
-	switch tipe {
-	case resp.String:
-		ldb.DeleteString(key)
-	case resp.Hash:
-		ldb.DeleteHash(key)
-	case resp.List:
-		ldb.DeleteList(key)
-	case resp.Set:
-		ldb.DeleteHash(key)
-	case resp.SortedSet:
-		ldb.DeleteSkip(key)
+	if ldb.wb != nil && ReadOnly() == nil { // the expired key is kept in the read only mode
+		ldb.deleteKey(key, tipe) // joins the write context, nothing is committed here
 	}
-
 	return false, tipe
 }
 
+// Index returns the index of the leveldb, as in Select
+func (ldb *LevelDB) Index() int {
+	return ldb.index
+}
+
 // Lock/Unlock functions
 func (ldb *LevelDB) RLock() {
 	ldb.rwm.RLock()
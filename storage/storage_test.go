@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// openTest opens a leveldb in a temporary directory as Open does, without the
+// background sweeper, migrator and gc, so the tests run them by hand.
+func openTest(t *testing.T) *LevelDB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rodis-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return openTestAt(t, dir)
+}
+
+// openTestAt opens the leveldb in dir as openTest, to reopen it as a restart
+func openTestAt(t *testing.T, dir string) *LevelDB {
+	t.Helper()
+	db, err := open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.cache = newRecordCache(1024)
+	err = guard(func() error {
+		db.loadGenerations()
+		return db.countKeys()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.db.Close() }) // closed again if the test closed it to reopen
+	return db
+}
@@ -10,27 +10,45 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
-// encodeStringKey encodes string type key
-func encodeStringKey(key []byte) []byte {
-	return append([]byte{ValuePrefix}, key...)
+// encodeStringKey encodes string type key as the value prefix, -Key in the
+// LegacyMetaVersion layout
+func (ldb *LevelDB) encodeStringKey(key []byte) []byte {
+	metadata := ldb.liveMetadata(key)
+	if len(metadata) != 0 && metadata[0] == LegacyMetaVersion {
+		return append([]byte{ValuePrefix}, key...)
+	}
+	return valuePrefix(key, metadata)
 }
 
 // DeleteString deletes string data
-func (ldb *LevelDB) DeleteString(key []byte) {
-	ldb.delete([][]byte{encodeMetaKey(key), encodeStringKey(key)})
+func (ldb *LevelDB) DeleteString(key []byte) (err error) {
+	defer catch(&err)
+	ldb.deleteString(key)
+	return nil
+}
+
+// deleteString deletes string data, the storage error is raised
+func (ldb *LevelDB) deleteString(key []byte) {
+	ldb.modify(key)
+	ldb.keyDeleted(key)
+	ldb.delete([][]byte{encodeMetaKey(key), ldb.encodeStringKey(key)})
+	ldb.clearExpireAt(key)
 }
 
 // GetString retrieves string data
-func (ldb *LevelDB) GetString(key []byte) []byte {
-	return ldb.get(encodeStringKey(key))
+func (ldb *LevelDB) GetString(key []byte) (value []byte, err error) {
+	defer catch(&err)
+	return ldb.get(ldb.encodeStringKey(key)), nil
 }
 
 // PutString writes string data to leveldb
-func (ldb *LevelDB) PutString(key []byte, value []byte) {
+func (ldb *LevelDB) PutString(key []byte, value []byte) (err error) {
+	defer catch(&err)
+	ldb.modify(key)
+	metadata := ldb.newMetadata(key, resp.String)
 	batch := new(leveldb.Batch)
-	batch.Put(encodeMetaKey(key), encodeMetadata(resp.String))
-	batch.Put(encodeStringKey(key), value)
-	if err := ldb.db.Write(batch, nil); err != nil {
-		panic(err)
-	}
+	batch.Put(encodeMetaKey(key), metadata)
+	batch.Put(valuePrefix(key, metadata), value)
+	ldb.write(batch)
+	return nil
 }
@@ -6,23 +6,38 @@
 package storage
 
 import (
+	"encoding/binary"
 	"errors"
 
 	"github.com/rod6/rodis/resp"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
+// RodisData is the pending writes of a write context, implemented by LevelDB
 type RodisData interface {
 	GetWriteBatch() *leveldb.Batch
 }
 
 const (
-	MetaVersion byte = 0x00
+	// LegacyMetaVersion is the metadata version of the keys in the legacy value key
+	// layout, -Key and -Key|Suffix, which are migrated to MetaVersion.
+	LegacyMetaVersion byte = 0x00
+	// UntaggedMetaVersion is the metadata version of the keys in the length prefixed
+	// value key layout without generation, which are migrated to MetaVersion.
+	UntaggedMetaVersion byte = 0x01
+	MetaVersion         byte = 0x02
+
 	MetaPrefix  byte = '+'
 	ValuePrefix byte = '-'
 	Seperator   byte = '|'
 )
 
+// encodings of list, the byte after the generation of the list metadata
+const (
+	ListLinked byte = 0x00 // the elements are linked by id, the metadata without encoding
+	ListDeque  byte = 0x01 // the elements are by sequence number from head to tail
+)
+
 var (
 	ErrMetaFormat = errors.New("Meta data format is wrong")
 )
@@ -34,15 +49,47 @@ func encodeMetaKey(key []byte) []byte {
 	return metaKey
 }
 
-func encodeMetadata(tipe byte) []byte {
-	return []byte{MetaVersion, tipe}
+// encodeMetadata encodes metadata: MetaVersion + type + generation (8 bytes big endian),
+// it may be followed by the encoding byte, see withEncoding.
+func encodeMetadata(tipe byte, gen uint64) []byte {
+	metadata := make([]byte, 10)
+	metadata[0] = MetaVersion
+	metadata[1] = tipe
+	binary.BigEndian.PutUint64(metadata[2:], gen)
+	return metadata
+}
+
+// withEncoding returns metadata with the encoding byte after the generation, the
+// default encoding 0 is not written.
+func withEncoding(metadata []byte, encoding byte) []byte {
+	if encoding == 0 {
+		return metadata
+	}
+	return append(metadata[:10:10], encoding)
+}
+
+// metadataEncoding returns the encoding of the value keys in metadata, 0 for the
+// default encoding of the type
+func metadataEncoding(metadata []byte) byte {
+	if len(metadata) < 11 || metadata[0] != MetaVersion {
+		return 0
+	}
+	return metadata[10]
+}
+
+// metadataGeneration returns the generation of metadata, 0 for the legacy versions
+func metadataGeneration(metadata []byte) uint64 {
+	if len(metadata) < 10 || metadata[0] != MetaVersion {
+		return 0
+	}
+	return binary.BigEndian.Uint64(metadata[2:])
 }
 
 func parseMetadata(metadata []byte) (byte, error) {
 	if len(metadata) < 2 {
 		return resp.None, ErrMetaFormat
 	}
-	if metadata[0] != MetaVersion {
+	if metadata[0] > MetaVersion {
 		return resp.None, ErrMetaFormat
 	}
 
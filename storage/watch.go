@@ -0,0 +1,103 @@
+// Copyright (c) 2020, Rod Dong <rod.dong@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by The MIT License.
+
+package storage
+
+import (
+	"sync"
+)
+
+// Watcher is the optimistic lock of a transaction (WATCH), it becomes dirty when
+// any of the watched keys is modified after being watched.
+type Watcher struct {
+	mu    sync.Mutex
+	dirty bool
+	dbs   map[*LevelDB][][]byte
+}
+
+// NewWatcher returns a Watcher without any key
+func NewWatcher() *Watcher {
+	return &Watcher{dbs: make(map[*LevelDB][][]byte)}
+}
+
+// Dirty returns true if any watched key was modified
+func (w *Watcher) Dirty() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dirty
+}
+
+// Unwatch forgets all watched keys and clears the dirty flag
+func (w *Watcher) Unwatch() {
+	w.mu.Lock()
+	dbs := w.dbs
+	w.dbs = make(map[*LevelDB][][]byte)
+	w.dirty = false
+	w.mu.Unlock()
+
+	for ldb, keys := range dbs {
+		ldb.unwatch(w, keys)
+	}
+}
+
+// Watch adds key to the watcher
+func (ldb *LevelDB) Watch(w *Watcher, key []byte) {
+	ldb.wmu.Lock()
+	defer ldb.wmu.Unlock()
+
+	watchers, ok := ldb.watches[string(key)]
+	if !ok {
+		watchers = make(map[*Watcher]struct{})
+		ldb.watches[string(key)] = watchers
+	}
+	if _, ok := watchers[w]; ok {
+		return
+	}
+	watchers[w] = struct{}{}
+
+	w.mu.Lock()
+	w.dbs[ldb] = append(w.dbs[ldb], append([]byte{}, key...))
+	w.mu.Unlock()
+}
+
+// unwatch removes the watcher of the keys
+func (ldb *LevelDB) unwatch(w *Watcher, keys [][]byte) {
+	ldb.wmu.Lock()
+	defer ldb.wmu.Unlock()
+
+	for _, key := range keys {
+		watchers := ldb.watches[string(key)]
+		delete(watchers, w)
+		if len(watchers) == 0 {
+			delete(ldb.watches, string(key))
+		}
+	}
+}
+
+// touch marks the watchers of the key dirty, it is called by every modification.
+func (ldb *LevelDB) touch(key []byte) {
+	ldb.wmu.Lock()
+	defer ldb.wmu.Unlock()
+
+	for w := range ldb.watches[string(key)] {
+		w.mu.Lock()
+		w.dirty = true
+		w.mu.Unlock()
+	}
+}
+
+// touchAll marks all watchers of the leveldb dirty, for flush.
+func (ldb *LevelDB) touchAll() {
+	ldb.wmu.Lock()
+	defer ldb.wmu.Unlock()
+
+	for _, watchers := range ldb.watches {
+		for w := range watchers {
+			w.mu.Lock()
+			w.dirty = true
+			w.mu.Unlock()
+		}
+	}
+}
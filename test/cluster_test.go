@@ -0,0 +1,103 @@
+package test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// cluster group
+func TestClusterDisabled(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"cluster", "info"}, replyType{"Error", "ERR This instance has cluster support disabled"}},
+		{[]interface{}{"asking"}, replyType{"Error", "ERR This instance has cluster support disabled"}},
+	}
+	runTest("CLUSTER", tests, t)
+}
+
+func TestMigrate(t *testing.T) {
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	tests := []rodisTest{
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1"}, replyType{"Error", "ERR wrong number of arguments for 'migrate' command"}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1", "1000", "keys", "b"}, replyType{"Error", "ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1", "1000", "foo"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1", "1000"}, replyType{"SimpleString", "NOKEY"}},
+		{[]interface{}{"set", "a", "foo"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"rpush", "b", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1", "1000", "copy"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "a"}, b("foo")},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "a", "1", "1000"}, replyType{"Error", "ERR Target instance replied with error: BUSYKEY Target key name already exists."}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "", "1", "1000", "replace", "keys", "a", "b", "c"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "a", "b"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"select", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "a"}, b("foo")},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("2")}}},
+		{[]interface{}{"del", "a", "b"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"select", "0"}, replyType{"SimpleString", "OK"}},
+	}
+	runTest("MIGRATE", tests, t)
+}
+
+// TestCluster starts a rodis in cluster mode at :6381, serving the slots 0-8191,
+// with the other slots served by the tested server
+func TestCluster(t *testing.T) {
+	c, stop := startRodis(t, 6381, `clusterenabled = true
+clusternodes = ["127.0.0.1:6381 0-8191", "127.0.0.1:6379 8192-16383"]
+`)
+	defer stop()
+
+	id := sha1.Sum([]byte("127.0.0.1:6381"))
+	myself := hex.EncodeToString(id[:])
+	id = sha1.Sum([]byte("127.0.0.1:6379"))
+	other := hex.EncodeToString(id[:])
+	re.Do("DEL", "bar")
+
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	i := func(n int64) replyType { return replyType{"Integer", n} }
+	tests := []rodisTest{
+		{[]interface{}{"cluster", "keyslot", "somekey"}, i(11058)},
+		{[]interface{}{"cluster", "keyslot", "foo{hash_tag}"}, i(2515)},
+		{[]interface{}{"cluster", "keyslot", "foo{}{bar}"}, i(8363)},
+		{[]interface{}{"cluster", "foo"}, replyType{"Error", "ERR Unknown subcommand or wrong number of arguments for 'foo'. Try CLUSTER HELP."}},
+		{[]interface{}{"cluster", "myid"}, b(myself)},
+		{[]interface{}{"cluster", "slots"}, replyType{"Array", []replyType{
+			{"Array", []replyType{i(0), i(8191), {"Array", []replyType{b("127.0.0.1"), i(6381), b(myself)}}}},
+			{"Array", []replyType{i(8192), i(16383), {"Array", []replyType{b("127.0.0.1"), i(6379), b(other)}}}},
+		}}},
+		{[]interface{}{"set", "foo", "1"}, replyType{"Error", "MOVED 12182 127.0.0.1:6379"}},
+		{[]interface{}{"set", "bar", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"mset", "bar", "1", "baz", "2"}, replyType{"Error", "CROSSSLOT Keys in request don't hash to the same slot"}},
+		{[]interface{}{"mset", "{bar}1", "1", "{bar}2", "2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"select", "1"}, replyType{"Error", "ERR SELECT is not allowed in cluster mode"}},
+		{[]interface{}{"cluster", "countkeysinslot", "5061"}, i(3)},
+		{[]interface{}{"cluster", "getkeysinslot", "5061", "1"}, replyType{"Array", []replyType{b("bar")}}},
+		{[]interface{}{"cluster", "addslots", "8192"}, replyType{"Error", "ERR Slot 8192 is already busy"}},
+		{[]interface{}{"cluster", "setslot", "8192", "migrating", other}, replyType{"Error", "ERR I'm not the owner of hash slot 8192"}},
+		{[]interface{}{"cluster", "setslot", "5061", "migrating", other}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "{bar}3"}, replyType{"Error", "ASK 5061 127.0.0.1:6379"}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "bar", "0", "1000"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "bar"}, replyType{"Error", "ASK 5061 127.0.0.1:6379"}},
+		{[]interface{}{"mget", "bar", "{bar}1"}, replyType{"Error", "TRYAGAIN Multiple keys request during rehashing of slot"}},
+		{[]interface{}{"get", "{bar}1"}, b("1")},
+		{[]interface{}{"cluster", "setslot", "5061", "node", other}, replyType{"Error", "ERR Can't assign hashslot 5061 to a different node while I still hold keys for this hash slot."}},
+		{[]interface{}{"migrate", "127.0.0.1", "6379", "", "0", "1000", "keys", "{bar}1", "{bar}2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"cluster", "setslot", "5061", "node", other}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "bar"}, replyType{"Error", "MOVED 5061 127.0.0.1:6379"}},
+		{[]interface{}{"cluster", "delslots", "0"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "{bar}3"}, replyType{"Error", "MOVED 5061 127.0.0.1:6379"}},
+		{[]interface{}{"get", "la2"}, replyType{"Error", "CLUSTERDOWN Hash slot not served"}},
+	}
+	for n, test := range tests {
+		r, _ := c.Do(test.command[0].(string), test.command[1:]...)
+		if !check(r, test.reply) {
+			t.Errorf("Error CLUSTER[%v](%v), Expect: %v,  Get: %#v", n, test.command, test.reply, r)
+		}
+	}
+
+	if r, err := redis.Strings(re.Do("MGET", "bar", "{bar}1", "{bar}2")); err != nil || len(r) != 3 || r[0] != "1" || r[1] != "1" || r[2] != "2" {
+		t.Errorf("Error MIGRATE, Expect: [1 1 2], Get: %v, %v", r, err)
+	}
+	re.Do("DEL", "bar", "{bar}1", "{bar}2")
+}
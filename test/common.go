@@ -1,6 +1,11 @@
 package test
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -105,3 +110,69 @@ func runTest(name string, tests []rodisTest, t *testing.T) {
 		}
 	}
 }
+
+// startRodis builds and starts another rodis listening on port, with the extra
+// lines of config, returns a connection to it and the function to stop it
+func startRodis(t *testing.T, port int, config string) (redis.Conn, func()) {
+	dir, err := ioutil.TempDir("", "rodis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := false
+	defer func() {
+		if !started {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	bin, conf := buildRodis(t, dir, port, config)
+	c, stop := runRodis(t, bin, conf, port)
+	started = true
+	return c, func() {
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// buildRodis builds rodis in dir, and writes the config listening on port with the
+// extra lines of config, the data and the logs are kept in dir. It returns the
+// paths of the binary and the config.
+func buildRodis(t *testing.T, dir string, port int, config string) (string, string) {
+	bin := filepath.Join(dir, "rodis")
+	if out, err := exec.Command("go", "build", "-o", bin, "../cmd").CombinedOutput(); err != nil {
+		t.Fatalf("Error build rodis: %v, %s", err, out)
+	}
+	conf := filepath.Join(dir, "rodis.toml")
+	content := fmt.Sprintf("listen = \":%d\"\nloglevel = \"error\"\nleveldbpath = %q\ndir = %q\n%s", port, filepath.Join(dir, "db"), dir, config)
+	if err := ioutil.WriteFile(conf, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return bin, conf
+}
+
+// runRodis starts the rodis built by buildRodis listening on port, returns a
+// connection to it and the function to stop it
+func runRodis(t *testing.T, bin string, conf string, port int) (redis.Conn, func()) {
+	cmd := exec.Command(bin, "-c", conf)
+	cmd.Dir = filepath.Dir(conf) // rodis.log is written in the working directory
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if c, err := redis.Dial("tcp", fmt.Sprintf(":%d", port)); err == nil {
+			return c, func() {
+				c.Close()
+				stop()
+			}
+		}
+	}
+	stop()
+	t.Fatalf("Error rodis at :%d is not started", port)
+	return nil, nil
+}
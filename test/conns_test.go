@@ -1,7 +1,14 @@
 package test
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rod6/rodis/storage"
 )
 
 // connection group
@@ -13,6 +20,78 @@ func TestPing(t *testing.T) {
 	runTest("PING", tests, t)
 }
 
+func TestDbsize(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "a", "foobaz"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hset", "b", "f", "v"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hset", "b", "g", "v"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"rpush", "c", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"sadd", "d", "1"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"zadd", "e", "1", "x"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(5)}},
+		{[]interface{}{"del", "a", "z"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hdel", "b", "f", "g"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"lpop", "c"}, replyType{"BulkString", []byte("1")}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"rpop", "c"}, replyType{"BulkString", []byte("2")}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"flushdb"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(0)}},
+	}
+	runTest("DBSIZE", tests, t)
+}
+
+// TestInfo checks the keys expired are deleted by the sweeper without reads, as
+// DBSIZE and the stats of INFO show.
+func TestInfo(t *testing.T) {
+	re.Do("FLUSHDB")
+	stats := func() map[string]int64 {
+		r, err := redis.String(re.Do("INFO", "stats"))
+		if err != nil {
+			t.Fatalf("Error INFO stats: %v", err)
+		}
+		m := map[string]int64{}
+		for _, line := range strings.Split(r, "\r\n") {
+			if i := strings.IndexByte(line, ':'); i > 0 {
+				m[line[:i]], _ = strconv.ParseInt(line[i+1:], 10, 64)
+			}
+		}
+		return m
+	}
+	before := stats()
+
+	for i := 0; i < 100; i++ {
+		re.Do("SET", fmt.Sprintf("expire:%d", i), "v", "PX", "50")
+	}
+	if n, err := redis.Int64(re.Do("DBSIZE")); err != nil || n != 100 {
+		t.Errorf("Error DBSIZE, Expect: 100, Get: %v, %v", n, err)
+	}
+	time.Sleep(50*time.Millisecond + 3*storage.ExpireSweepInterval)
+
+	if n, err := redis.Int64(re.Do("DBSIZE")); err != nil || n != 0 {
+		t.Errorf("Error DBSIZE after the sweep, Expect: 0, Get: %v, %v", n, err)
+	}
+	after := stats()
+	if n := after["expired_keys"] - before["expired_keys"]; n != 100 {
+		t.Errorf("Error INFO expired_keys, Expect: 100 more, Get: %v", n)
+	}
+	if after["expire_sweeps"] <= before["expire_sweeps"] || after["expire_last_sweep"] < time.Now().Unix()-1 {
+		t.Errorf("Error INFO expire_sweeps, Expect: sweeps now, Get: %v", after)
+	}
+
+	if r, err := redis.String(re.Do("INFO", "keyspace")); err != nil || strings.Contains(r, "db0:") {
+		t.Errorf("Error INFO keyspace, Expect: no db0, Get: %q, %v", r, err)
+	}
+	if r, err := redis.String(re.Do("INFO")); err != nil || !strings.Contains(r, "# Server\r\nredis_version:") || !strings.Contains(r, "# Stats\r\n") {
+		t.Errorf("Error INFO, Expect: sections server and stats, Get: %q, %v", r, err)
+	}
+	if _, err := re.Do("INFO", "stats", "x"); err == nil || err.Error() != "ERR syntax error" {
+		t.Errorf("Error INFO stats x, Expect: ERR syntax error, Get: %v", err)
+	}
+}
+
 func TestEcho(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"echo"}, replyType{"Error", "ERR wrong number of arguments for 'echo' command"}},
@@ -32,3 +111,89 @@ func TestSelect(t *testing.T) {
 	}
 	runTest("SELECT", tests, t)
 }
+
+func TestSave(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"save", "x"}, replyType{"Error", "ERR wrong number of arguments for 'save' command"}},
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"rpush", "b", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"zadd", "c", "1.5", "x"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"save"}, replyType{"SimpleString", "OK"}},
+	}
+	runTest("SAVE", tests, t)
+
+	last, err := redis.Int64(re.Do("LASTSAVE"))
+	if err != nil || last < time.Now().Unix()-1 {
+		t.Errorf("Error LASTSAVE, Expect: now, Get: %v, %v", last, err)
+	}
+}
+
+func TestBgsave(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"bgsave"}, replyType{"SimpleString", "Background saving started"}},
+	}
+	runTest("BGSAVE", tests, t)
+
+	// the save is done in background
+	for i := 0; i < 100; i++ {
+		if r, err := redis.String(re.Do("SAVE")); err == nil && r == "OK" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Error BGSAVE, the background save is not done")
+}
+
+func TestDebugReload(t *testing.T) {
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	tests := []rodisTest{
+		{[]interface{}{"debug", "foo"}, replyType{"Error", "ERR Unknown subcommand or wrong number of arguments for 'foo'. Try DEBUG HELP."}},
+		{[]interface{}{"debug", "reload", "foo"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"debug", "set-active-expire"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"debug", "set-active-expire", "2"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"debug", "set-active-expire", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"expire", "a", "100"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"rpush", "b", "1", "2", "3"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"sadd", "c", "x"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hset", "d", "f", "v"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"zadd", "e", "1.5", "x", "-2", "y"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"debug", "reload"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(5)}},
+		{[]interface{}{"get", "a"}, b("foobar")},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("2"), b("3")}}},
+		{[]interface{}{"smembers", "c"}, replyType{"Array", []replyType{b("x")}}},
+		{[]interface{}{"hgetall", "d"}, replyType{"Array", []replyType{b("f"), b("v")}}},
+		{[]interface{}{"zrange", "e", "0", "-1", "withscores"}, replyType{"Array", []replyType{b("y"), b("-2"), b("x"), b("1.5")}}},
+		{[]interface{}{"set", "f", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"debug", "reload", "nosave", "noflush"}, replyType{"Error", `ERR Error trying to load the RDB dump: rdb: duplicate key "a" in db 0`}},
+		{[]interface{}{"debug", "reload", "nosave", "noflush", "merge"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "f"}, b("1")},
+		{[]interface{}{"debug", "reload", "nosave"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "f"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(5)}},
+	}
+	runTest("DEBUG RELOAD", tests, t)
+
+	if ttl, err := redis.Int(re.Do("TTL", "a")); err != nil || ttl < 98 || ttl > 100 {
+		t.Errorf("Error DEBUG RELOAD, Expect: TTL 100, Get: %v, %v", ttl, err)
+	}
+}
+
+func TestBgrewriteaof(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"bgrewriteaof"}, replyType{"SimpleString", "Background append only file rewriting started"}},
+	}
+	runTest("BGREWRITEAOF", tests, t)
+
+	// the rewrite is done in background
+	for i := 0; i < 100; i++ {
+		if r, err := redis.String(re.Do("BGREWRITEAOF")); err == nil && r == "Background append only file rewriting started" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Error BGREWRITEAOF, the background rewrite is not done")
+}
@@ -1,7 +1,10 @@
 package test
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestHdel(t *testing.T) {
@@ -155,6 +158,36 @@ func TestHmset(t *testing.T) {
 	runTest("HMSET", tests, t)
 }
 
+func TestHscan(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"hscan", "a"}, replyType{"Error", "ERR wrong number of arguments for 'hscan' command"}},
+		{[]interface{}{"hscan", "a", "0"}, replyType{"Array", []replyType{{"BulkString", []byte("0")}, {"Array", []replyType{}}}}},
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hscan", "a", "0"}, replyType{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{[]interface{}{"hmset", "b", "f1", "v1", "f2", "v2", "g1", "v3"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hscan", "b", "0", "type", "hash"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"hscan", "b", "0", "match", "f*"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("0")},
+			{"Array", []replyType{
+				{"BulkString", []byte("f1")},
+				{"BulkString", []byte("v1")},
+				{"BulkString", []byte("f2")},
+				{"BulkString", []byte("v2")},
+			}},
+		}}},
+	}
+	runTest("HSCAN", tests, t)
+
+	r, _ := redis.Values(re.Do("HSCAN", "b", "0", "COUNT", "2"))
+	if fields, _ := redis.Strings(r[1], nil); len(fields) != 4 {
+		t.Errorf("Error HSCAN, Expect: 2 fields, Get: %v", fields)
+	}
+	r, _ = redis.Values(re.Do("HSCAN", "b", r[0], "COUNT", "2"))
+	if fields, _ := redis.Strings(r[1], nil); string(r[0].([]byte)) != "0" || strings.Join(fields, ",") != "g1,v3" {
+		t.Errorf("Error HSCAN, Expect: 0 [g1 v3], Get: %s %v", r[0], fields)
+	}
+}
+
 func TestHset(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"hset"}, replyType{"Error", "ERR wrong number of arguments for 'hset' command"}},
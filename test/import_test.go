@@ -0,0 +1,105 @@
+package test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rod6/rodis/rdb"
+)
+
+// rdbString returns the string of the RDB format with a length of 6 bits
+func rdbString(s string) string {
+	return string(rune(len(s))) + s
+}
+
+// import group, rodis -c rodis.toml import dump.rdb [replace] on a RDB file in
+// the format of Redis
+func TestImportCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rodis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expire := func(at time.Time) string {
+		b := make([]byte, 9)
+		b[0] = rdb.OpExpireTimeMs
+		binary.LittleEndian.PutUint64(b[1:], uint64(at.UnixNano()/int64(time.Millisecond)))
+		return string(b)
+	}
+	intset := "\x02\x00\x00\x00\x02\x00\x00\x00\x01\x00\x02\x00"                // 1, 2
+	ziplist := "\x10\x00\x00\x00\x0d\x00\x00\x00\x02\x00\x00\x01f\x03\x01v\xff" // f, v
+	listpack := "\x0c\x00\x00\x00\x02\x00\x81a\x02\xc3\xe8\x02\xff"             // a, 1000
+	file := "REDIS0009" +
+		"\xfa" + rdbString("redis-ver") + rdbString("6.0.0") +
+		"\xfe\x00" +
+		"\x00" + rdbString("s") + rdbString("string") +
+		expire(time.Now().Add(time.Hour)) + "\x00" + rdbString("ttl") + "\xc0\x07" +
+		expire(time.Now().Add(-time.Hour)) + "\x00" + rdbString("expired") + rdbString("x") +
+		"\x0b" + rdbString("set") + rdbString(intset) +
+		"\x0d" + rdbString("hash") + rdbString(ziplist) +
+		"\xfe\x02" +
+		"\x12" + rdbString("list") + "\x01\x02" + rdbString(listpack) +
+		"\xff"
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, rdb.CRC64(0, []byte(file)))
+	path := filepath.Join(dir, "dump.rdb")
+	if err := ioutil.WriteFile(path, append([]byte(file), sum...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin, conf := buildRodis(t, dir, 6383, "")
+	run := func(fail bool, args ...string) string {
+		cmd := exec.Command(bin, append([]string{"-c", conf, "import", path}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if (err != nil) != fail {
+			t.Fatalf("Error rodis import, Expect failure: %v, Get: %v, %s", fail, err, out)
+		}
+		return string(out)
+	}
+	if out := run(false); !strings.Contains(out, "Imported 5 keys") {
+		t.Fatalf("Error rodis import, Expect: Imported 5 keys, Get: %s", out)
+	}
+	if out := run(true); !strings.Contains(out, `duplicate key "s" in db 0`) {
+		t.Errorf("Error rodis import again, Expect: duplicate key s, Get: %s", out)
+	}
+	if out := run(false, "replace"); !strings.Contains(out, "Imported 5 keys") {
+		t.Errorf("Error rodis import replace, Expect: Imported 5 keys, Get: %s", out)
+	}
+
+	c, stop := runRodis(t, bin, conf, 6383)
+	defer stop()
+	if v, err := redis.String(c.Do("GET", "s")); err != nil || v != "string" {
+		t.Errorf("Error GET s, Expect: string, Get: %v, %v", v, err)
+	}
+	if v, err := redis.String(c.Do("GET", "ttl")); err != nil || v != "7" {
+		t.Errorf("Error GET ttl, Expect: 7, Get: %v, %v", v, err)
+	}
+	if ttl, err := redis.Int64(c.Do("TTL", "ttl")); err != nil || ttl <= 3500 || ttl > 3600 {
+		t.Errorf("Error TTL ttl, Expect: about 3600, Get: %v, %v", ttl, err)
+	}
+	if n, err := redis.Int(c.Do("EXISTS", "expired")); err != nil || n != 0 {
+		t.Errorf("Error EXISTS expired, Expect: 0, Get: %v, %v", n, err)
+	}
+	if v, err := redis.Strings(c.Do("SMEMBERS", "set")); err != nil || strings.Join(v, ",") != "1,2" {
+		t.Errorf("Error SMEMBERS set, Expect: 1,2, Get: %v, %v", v, err)
+	}
+	if v, err := redis.Strings(c.Do("HGETALL", "hash")); err != nil || strings.Join(v, ",") != "f,v" {
+		t.Errorf("Error HGETALL hash, Expect: f,v, Get: %v, %v", v, err)
+	}
+	if n, err := redis.Int(c.Do("DBSIZE")); err != nil || n != 4 {
+		t.Errorf("Error DBSIZE of db 0, Expect: 4, Get: %v, %v", n, err)
+	}
+	c.Do("SELECT", "2")
+	if v, err := redis.Strings(c.Do("LRANGE", "list", "0", "-1")); err != nil || strings.Join(v, ",") != "a,1000" {
+		t.Errorf("Error LRANGE list of db 2, Expect: a,1000, Get: %v, %v", v, err)
+	}
+}
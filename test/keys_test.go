@@ -1,11 +1,56 @@
 package test
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rod6/rodis/storage"
 )
 
+func TestCopy(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"copy", "a"}, replyType{"Error", "ERR wrong number of arguments for 'copy' command"}},
+		{[]interface{}{"copy", "a", "a"}, replyType{"Error", "ERR source and destination objects are the same"}},
+		{[]interface{}{"copy", "a", "b", "db"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"copy", "a", "b", "db", "16"}, replyType{"Error", "ERR DB index is out of range"}},
+		{[]interface{}{"copy", "a", "b"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"rpush", "a", "1", "2", "3"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"expire", "a", "100"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"copy", "a", "b"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("1")},
+			{"BulkString", []byte("2")},
+			{"BulkString", []byte("3")},
+		}}},
+		{[]interface{}{"ttl", "b"}, replyType{"Integer", int64(99)}},
+		{[]interface{}{"rpush", "b", "4"}, replyType{"Integer", int64(4)}},
+		{[]interface{}{"llen", "a"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"zadd", "c", "1", "x", "2", "y"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"copy", "c", "b"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"copy", "c", "b", "replace"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"type", "b"}, replyType{"SimpleString", "zset"}},
+		{[]interface{}{"ttl", "b"}, replyType{"Integer", int64(-1)}},
+		{[]interface{}{"zrange", "b", "0", "-1", "withscores"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("x")},
+			{"BulkString", []byte("1")},
+			{"BulkString", []byte("y")},
+			{"BulkString", []byte("2")},
+		}}},
+		{[]interface{}{"copy", "c", "c", "db", "1"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"select", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"zcard", "c"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"del", "c"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"select", "0"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(3)}},
+	}
+	runTest("COPY", tests, t)
+}
+
 func TestDel(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"del"}, replyType{"Error", "ERR wrong number of arguments for 'del' command"}},
@@ -20,10 +65,38 @@ func TestDel(t *testing.T) {
 		{[]interface{}{"get", "a"}, replyType{"BulkString", nil}},
 		{[]interface{}{"get", "b"}, replyType{"BulkString", nil}},
 		{[]interface{}{"get", "c"}, replyType{"BulkString", nil}},
+		{[]interface{}{"hmset", "h", "f", "1", "g", "2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"expire", "h", "100"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"del", "h"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hset", "h", "f", "3"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hgetall", "h"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("f")},
+			{"BulkString", []byte("3")},
+		}}},
+		{[]interface{}{"ttl", "h"}, replyType{"Integer", int64(-1)}},
+		{[]interface{}{"expire", "h", "100"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"flushdb"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "h"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"hset", "h", "g", "4"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hgetall", "h"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("g")},
+			{"BulkString", []byte("4")},
+		}}},
+		{[]interface{}{"ttl", "h"}, replyType{"Integer", int64(-1)}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(1)}},
 	}
 	runTest("DEL", tests, t)
 }
 
+func TestDump(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"dump", "a"}, replyType{"BulkString", nil}},
+		{[]interface{}{"set", "a", "10"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"dump", "a"}, replyType{"BulkString", []byte("\x00\x0210\x09\x00\x04\x74\xac\xcf\x0a\xf3\xed\x6d")}},
+	}
+	runTest("DUMP", tests, t)
+}
+
 func TestExists(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"exists"}, replyType{"Error", "ERR wrong number of arguments for 'exists' command"}},
@@ -39,6 +112,47 @@ func TestExists(t *testing.T) {
 	runTest("EXISTS", tests, t)
 }
 
+// the clients reading the expired keys at the same time leave them to the expire
+// sweeper, which uncounts them once
+func TestExistsExpired(t *testing.T) {
+	re.Do("FLUSHDB")
+	re.Do("DEBUG", "SET-ACTIVE-EXPIRE", "0")
+	defer re.Do("DEBUG", "SET-ACTIVE-EXPIRE", "1")
+	for i := 0; i < 20; i++ {
+		re.Do("SET", fmt.Sprintf("expired:%d", i), "v", "PX", "20")
+	}
+	if n, err := redis.Int64(re.Do("DBSIZE")); err != nil || n != 20 {
+		t.Errorf("Error DBSIZE before the reads, Expect: 20, Get: %v, %v", n, err)
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := redisPool.Get()
+			defer c.Close()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("expired:%d", j)
+				c.Do("GET", key)
+				c.Do("EXISTS", key)
+				c.Do("TTL", key)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := redis.Int64(re.Do("DBSIZE")); err != nil || n != 20 {
+		t.Errorf("Error DBSIZE after the reads, Expect: 20, Get: %v, %v", n, err)
+	}
+
+	re.Do("DEBUG", "SET-ACTIVE-EXPIRE", "1")
+	time.Sleep(3 * storage.ExpireSweepInterval)
+	if n, err := redis.Int64(re.Do("DBSIZE")); err != nil || n != 0 {
+		t.Errorf("Error DBSIZE after the sweep, Expect: 0, Get: %v, %v", n, err)
+	}
+}
+
 func TestExpire(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
@@ -60,6 +174,63 @@ func TestExpireat(t *testing.T) {
 	runTest("EXPIREAT", tests, t)
 }
 
+func TestKeys(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"keys"}, replyType{"Error", "ERR wrong number of arguments for 'keys' command"}},
+		{[]interface{}{"keys", "*"}, replyType{"Array", []replyType{}}},
+		{[]interface{}{"mset", "one", "1", "two", "2", "three", "3"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hset", "four", "f", "4"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"set", "expired", "5", "px", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"keys", "*o*"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("four")},
+			{"BulkString", []byte("one")},
+			{"BulkString", []byte("two")},
+		}}},
+		{[]interface{}{"keys", "t??"}, replyType{"Array", []replyType{{"BulkString", []byte("two")}}}},
+		{[]interface{}{"keys", "t[h]*"}, replyType{"Array", []replyType{{"BulkString", []byte("three")}}}},
+	}
+	runTest("KEYS", tests, t)
+
+	// expired keys are skipped
+	time.Sleep(10 * time.Millisecond)
+	r, _ := redis.Strings(re.Do("KEYS", "*"))
+	if strings.Join(r, ",") != "four,one,three,two" {
+		t.Errorf("Error KEYS, Expect: four,one,three,two, Get: %v", r)
+	}
+}
+
+func TestMove(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"move", "a", "x"}, replyType{"Error", "ERR value is not an integer or out of range"}},
+		{[]interface{}{"move", "a", "0"}, replyType{"Error", "ERR source and destination objects are the same"}},
+		{[]interface{}{"move", "a", "1"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"hmset", "a", "f1", "v1", "f2", "v2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"pexpire", "a", "100000"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"move", "a", "1"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"exists", "a"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"select", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hgetall", "a"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("f1")},
+			{"BulkString", []byte("v1")},
+			{"BulkString", []byte("f2")},
+			{"BulkString", []byte("v2")},
+		}}},
+		{[]interface{}{"ttl", "a"}, replyType{"Integer", int64(99)}},
+		{[]interface{}{"move", "a", "0"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"select", "0"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "b", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"select", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "b", "2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"move", "b", "0"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"del", "b"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"select", "0"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hlen", "a"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"get", "b"}, replyType{"BulkString", []byte("1")}},
+	}
+	runTest("MOVE", tests, t)
+}
+
 func TestPexpire(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
@@ -71,7 +242,15 @@ func TestPexpire(t *testing.T) {
 }
 
 func TestPexpireat(t *testing.T) {
-	// TODO
+	at := time.Now().Add(10*time.Second).UnixNano() / int64(time.Millisecond)
+	tests := []rodisTest{
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"pexpireat", "a"}, replyType{"Error", "ERR wrong number of arguments for 'pexpireat' command"}},
+		{[]interface{}{"pexpireat", "a", strconv.FormatInt(at, 10)}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"pexpireat", "a", "a"}, replyType{"Error", "ERR value is not an integer or out of range"}},
+		{[]interface{}{"ttl", "a"}, replyType{"Integer", int64(9)}},
+	}
+	runTest("PEXPIREAT", tests, t)
 }
 
 func TestPttl(t *testing.T) {
@@ -82,6 +261,202 @@ func TestPttl(t *testing.T) {
 		{[]interface{}{"pttl", "a", "b"}, replyType{"Error", "ERR wrong number of arguments for 'pttl' command"}},
 	}
 	runTest("PTTL", tests, t)
+
+	// sub-second expire should not be rounded to seconds
+	re.Do("PSETEX", "b", "500", "foobar")
+	pttl, _ := re.Do("PTTL", "b")
+	if ms, ok := pttl.(int64); !ok || ms <= 0 || ms > 500 {
+		t.Errorf("Error PTTL, Expect: (0, 500], Get: %#v", pttl)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if r, _ := re.Do("GET", "b"); r != nil {
+		t.Errorf("Error PTTL, Expect: key expired, Get: %#v", r)
+	}
+}
+
+func TestRandomkey(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"randomkey"}, replyType{"BulkString", nil}},
+		{[]interface{}{"set", "a", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"randomkey"}, replyType{"BulkString", []byte("a")}},
+	}
+	runTest("RANDOMKEY", tests, t)
+
+	re.Do("MSET", "b", "1", "c", "2", "d", "3")
+	for i := 0; i < 10; i++ {
+		if r, _ := redis.String(re.Do("RANDOMKEY")); !strings.Contains("abcd", r) || r == "" {
+			t.Errorf("Error RANDOMKEY, Expect: one of a,b,c,d, Get: %v", r)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"rename", "a"}, replyType{"Error", "ERR wrong number of arguments for 'rename' command"}},
+		{[]interface{}{"rename", "a", "b"}, replyType{"Error", "ERR no such key"}},
+		{[]interface{}{"sadd", "a", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"rename", "a", "a"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"rename", "a", "b"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "a"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"smembers", "b"}, replyType{"Array", []replyType{{"BulkString", []byte("1")}, {"BulkString", []byte("2")}}}},
+		{[]interface{}{"set", "c", "foobar", "ex", "100"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"rename", "c", "b"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "b"}, replyType{"BulkString", []byte("foobar")}},
+		{[]interface{}{"ttl", "b"}, replyType{"Integer", int64(99)}},
+		{[]interface{}{"ttl", "c"}, replyType{"Integer", int64(-1)}},
+		{[]interface{}{"dbsize"}, replyType{"Integer", int64(1)}},
+	}
+	runTest("RENAME", tests, t)
+}
+
+func TestRenamenx(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"renamenx", "a", "b"}, replyType{"Error", "ERR no such key"}},
+		{[]interface{}{"rpush", "a", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"set", "b", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"renamenx", "a", "b"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"renamenx", "a", "c"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"lpop", "c"}, replyType{"BulkString", []byte("1")}},
+		{[]interface{}{"rpush", "c", "3"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"lrange", "c", "0", "-1"}, replyType{"Array", []replyType{{"BulkString", []byte("2")}, {"BulkString", []byte("3")}}}},
+	}
+	runTest("RENAMENX", tests, t)
+}
+
+func TestRestore(t *testing.T) {
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	redisDump := "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n" // by Redis for the integer 10
+	tests := []rodisTest{
+		{[]interface{}{"restore", "a", "0"}, replyType{"Error", "ERR wrong number of arguments for 'restore' command"}},
+		{[]interface{}{"restore", "a", "-1", redisDump}, replyType{"Error", "ERR Invalid TTL value, must be >= 0"}},
+		{[]interface{}{"restore", "a", "0", redisDump, "idletime"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"restore", "a", "0", "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\x0b"}, replyType{"Error", "ERR DUMP payload version or checksum are wrong"}},
+		{[]interface{}{"restore", "a", "0", redisDump, "idletime", "10", "freq", "5"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "a"}, b("10")},
+		{[]interface{}{"restore", "a", "0", redisDump}, replyType{"Error", "BUSYKEY Target key name already exists."}},
+		{[]interface{}{"restore", "a", "1000", redisDump, "replace"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"restore", "a", "1", redisDump, "replace", "absttl"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "a"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"rpush", "b", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"sadd", "c", "x"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"hset", "d", "f", "v"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"zadd", "e", "1.5", "x", "-2", "y"}, replyType{"Integer", int64(2)}},
+	}
+	runTest("RESTORE", tests, t)
+
+	for _, key := range []string{"b", "c", "d", "e"} {
+		payload, err := redis.Bytes(re.Do("DUMP", key))
+		if err != nil {
+			t.Fatalf("Error DUMP %v: %v", key, err)
+		}
+		if r, err := redis.String(re.Do("RESTORE", key, "0", payload, "REPLACE")); err != nil || r != "OK" {
+			t.Errorf("Error RESTORE %v, Expect: OK, Get: %v, %v", key, r, err)
+		}
+	}
+	tests = []rodisTest{
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("2")}}},
+		{[]interface{}{"smembers", "c"}, replyType{"Array", []replyType{b("x")}}},
+		{[]interface{}{"hgetall", "d"}, replyType{"Array", []replyType{b("f"), b("v")}}},
+		{[]interface{}{"zrange", "e", "0", "-1", "withscores"}, replyType{"Array", []replyType{b("y"), b("-2"), b("x"), b("1.5")}}},
+	}
+	for i, test := range tests {
+		r, _ := re.Do(test.command[0].(string), test.command[1:]...)
+		if !check(r, test.reply) {
+			t.Errorf("Error RESTORE[%v](%v), Expect: %v,  Get: %#v", i, test.command, test.reply, r)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"scan"}, replyType{"Error", "ERR wrong number of arguments for 'scan' command"}},
+		{[]interface{}{"scan", "a"}, replyType{"Error", "ERR invalid cursor"}},
+		{[]interface{}{"scan", "0", "count"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"scan", "0", "count", "0"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"scan", "12345678"}, replyType{"Error", "ERR invalid cursor"}},
+		{[]interface{}{"scan", "0"}, replyType{"Array", []replyType{{"BulkString", []byte("0")}, {"Array", []replyType{}}}}},
+		{[]interface{}{"set", "a1", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "a2", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hset", "b1", "f", "v"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"set", "c1", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"scan", "0", "match", "a*"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("0")},
+			{"Array", []replyType{{"BulkString", []byte("a1")}, {"BulkString", []byte("a2")}}},
+		}}},
+		{[]interface{}{"scan", "0", "type", "hash"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("0")},
+			{"Array", []replyType{{"BulkString", []byte("b1")}}},
+		}}},
+	}
+	runTest("SCAN", tests, t)
+
+	// iterate with small count, all keys are returned once
+	keys := []string{}
+	cursor := "0"
+	for {
+		r, err := redis.Values(re.Do("SCAN", cursor, "COUNT", "3"))
+		if err != nil {
+			t.Fatalf("Error SCAN, %v", err)
+		}
+		cursor = string(r[0].([]byte))
+		ks, _ := redis.Strings(r[1], nil)
+		keys = append(keys, ks...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "a1,a2,b1,c1" {
+		t.Errorf("Error SCAN, Expect: a1,a2,b1,c1, Get: %v", keys)
+	}
+
+	// the cursors of clients scanning at the same time are independent, a cursor
+	// may be continued by another client
+	re.Do("FLUSHDB")
+	for i := 0; i < 100; i++ {
+		re.Do("SET", fmt.Sprintf("%03d:interleaved", i), "v")
+	}
+	clients := []redis.Conn{redisPool.Get(), redisPool.Get(), redisPool.Get()}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	cursors := []string{"0", "0", "0"}
+	seen := []map[string]int{{}, {}, {}}
+	for round, done := 0, 0; done < len(clients); round++ {
+		done = 0
+		for i := range clients {
+			if cursors[i] == "end" {
+				done++
+				continue
+			}
+			c := clients[(i+round)%len(clients)]
+			r, err := redis.Values(c.Do("SCAN", cursors[i], "COUNT", i+5))
+			if err != nil {
+				t.Fatalf("Error SCAN, %v", err)
+			}
+			ks, _ := redis.Strings(r[1], nil)
+			if len(ks) > i+5 { // the keys share a prefix longer than a cursor keeps
+				t.Errorf("Error SCAN COUNT %v, Expect: at most %v keys, Get: %v", i+5, i+5, len(ks))
+			}
+			for _, k := range ks {
+				seen[i][k]++
+			}
+			if cursors[i] = string(r[0].([]byte)); cursors[i] == "0" {
+				cursors[i] = "end"
+			}
+		}
+	}
+	for i := range clients {
+		if len(seen[i]) != 100 {
+			t.Errorf("Error SCAN[%v] interleaved, Expect: 100 keys, Get: %v", i, len(seen[i]))
+		}
+		for k, n := range seen[i] {
+			if n != 1 {
+				t.Errorf("Error SCAN[%v] interleaved, Expect: %v once, Get: %v times", i, k, n)
+			}
+		}
+	}
 }
 
 func TestTtl(t *testing.T) {
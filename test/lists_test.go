@@ -0,0 +1,171 @@
+package test
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// pushLater pushes the values to the list by another connection after d
+func pushLater(d time.Duration, key string, values ...interface{}) {
+	go func() {
+		time.Sleep(d)
+		c := redisPool.Get()
+		defer c.Close()
+		c.Do("RPUSH", append([]interface{}{key}, values...)...)
+	}()
+}
+
+func TestBlmove(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"blmove", "a", "b", "left", "up", "0"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"blmove", "a", "b", "left", "right", "x"}, replyType{"Error", "ERR timeout is not a float or out of range"}},
+		{[]interface{}{"blmove", "a", "b", "left", "right", "-1"}, replyType{"Error", "ERR timeout is negative"}},
+		{[]interface{}{"blmove", "a", "b", "left", "right", "0.01"}, replyType{"Array", nil}},
+		{[]interface{}{"rpush", "a", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"set", "c", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"blmove", "a", "c", "left", "right", "0"}, replyType{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{[]interface{}{"blmove", "a", "b", "left", "right", "0"}, replyType{"BulkString", []byte("1")}},
+		{[]interface{}{"blmove", "a", "b", "right", "left", "0"}, replyType{"BulkString", []byte("2")}},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{{"BulkString", []byte("2")}, {"BulkString", []byte("1")}}}},
+	}
+	runTest("BLMOVE", tests, t)
+
+	pushLater(50*time.Millisecond, "a", "3")
+	if r, err := redis.String(re.Do("BLMOVE", "a", "b", "LEFT", "LEFT", "1")); err != nil || r != "3" {
+		t.Errorf("Error BLMOVE, Expect: 3, Get: %v, %v", r, err)
+	}
+}
+
+func TestBlpop(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"blpop", "a"}, replyType{"Error", "ERR wrong number of arguments for 'blpop' command"}},
+		{[]interface{}{"blpop", "a", "0.01"}, replyType{"Array", nil}},
+		{[]interface{}{"rpush", "b", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"blpop", "a", "b", "0"}, replyType{"Array", []replyType{{"BulkString", []byte("b")}, {"BulkString", []byte("1")}}}},
+		{[]interface{}{"set", "c", "foobar"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"blpop", "c", "b", "0"}, replyType{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"blpop", "a", "0"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Array", []replyType{{"Array", nil}}}},
+	}
+	runTest("BLPOP", tests, t)
+
+	pushLater(50*time.Millisecond, "a", "x", "y")
+	r, err := redis.Strings(re.Do("BLPOP", "a", "0"))
+	if err != nil || len(r) != 2 || r[0] != "a" || r[1] != "x" {
+		t.Errorf("Error BLPOP, Expect: [a x], Get: %v, %v", r, err)
+	}
+}
+
+func TestBlpopFIFO(t *testing.T) {
+	re.Do("FLUSHDB")
+
+	// the clients are served in the order they are blocked
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		c := redisPool.Get()
+		defer c.Close()
+		go func(c redis.Conn, name string) {
+			r, _ := redis.Strings(c.Do("BLPOP", "a", "1"))
+			if len(r) == 2 {
+				results <- name + r[1]
+			} else {
+				results <- name
+			}
+		}(c, string('A'+byte(i)))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	re.Do("RPUSH", "a", "1", "2")
+	r := []string{<-results, <-results, <-results}
+	sort.Strings(r)
+	if strings.Join(r, ",") != "A1,B2,C" {
+		t.Errorf("Error BLPOP, Expect: A1,B2,C, Get: %v", r)
+	}
+}
+
+func TestBlpopDisconnect(t *testing.T) {
+	re.Do("FLUSHDB")
+
+	// the element is not given to the client disconnected
+	c, err := redis.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	c.Send("BLPOP", "a", "0")
+	c.Flush()
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	re.Do("RPUSH", "a", "1")
+	if r, err := redis.Int(re.Do("LLEN", "a")); err != nil || r != 1 {
+		t.Errorf("Error BLPOP, Expect: 1, Get: %v, %v", r, err)
+	}
+}
+
+func TestBrpop(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"brpop", "a"}, replyType{"Error", "ERR wrong number of arguments for 'brpop' command"}},
+		{[]interface{}{"brpop", "a", "0.01"}, replyType{"Array", nil}},
+		{[]interface{}{"rpush", "b", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"brpop", "a", "b", "0"}, replyType{"Array", []replyType{{"BulkString", []byte("b")}, {"BulkString", []byte("2")}}}},
+	}
+	runTest("BRPOP", tests, t)
+
+	pushLater(50*time.Millisecond, "a", "x", "y")
+	r, err := redis.Strings(re.Do("BRPOP", "a", "0"))
+	if err != nil || len(r) != 2 || r[0] != "a" || r[1] != "y" {
+		t.Errorf("Error BRPOP, Expect: [a y], Get: %v, %v", r, err)
+	}
+}
+
+func TestBrpoplpush(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"brpoplpush", "a", "b"}, replyType{"Error", "ERR wrong number of arguments for 'brpoplpush' command"}},
+		{[]interface{}{"brpoplpush", "a", "b", "0.01"}, replyType{"Array", nil}},
+		{[]interface{}{"rpush", "a", "1", "2"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"brpoplpush", "a", "b", "0"}, replyType{"BulkString", []byte("2")}},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{{"BulkString", []byte("2")}}}},
+	}
+	runTest("BRPOPLPUSH", tests, t)
+
+	re.Do("DEL", "a")
+	pushLater(50*time.Millisecond, "a", "3")
+	if r, err := redis.String(re.Do("BRPOPLPUSH", "a", "b", "1")); err != nil || r != "3" {
+		t.Errorf("Error BRPOPLPUSH, Expect: 3, Get: %v, %v", r, err)
+	}
+}
+
+func TestListEdit(t *testing.T) {
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	tests := []rodisTest{
+		{[]interface{}{"rpush", "a", "1", "2", "3", "4", "5"}, replyType{"Integer", int64(5)}},
+		{[]interface{}{"lpush", "a", "0"}, replyType{"Integer", int64(6)}},
+		{[]interface{}{"lindex", "a", "0"}, b("0")},
+		{[]interface{}{"lindex", "a", "-1"}, b("5")},
+		{[]interface{}{"lindex", "a", "6"}, replyType{"BulkString", nil}},
+		{[]interface{}{"lset", "a", "-2", "x"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"lset", "a", "6", "x"}, replyType{"Error", "ERR index out of range"}},
+		{[]interface{}{"linsert", "a", "before", "2", "y"}, replyType{"Integer", int64(7)}},
+		{[]interface{}{"linsert", "a", "after", "x", "z"}, replyType{"Integer", int64(8)}},
+		{[]interface{}{"linsert", "a", "after", "none", "z"}, replyType{"Integer", int64(-1)}},
+		{[]interface{}{"lrange", "a", "0", "-1"}, replyType{"Array", []replyType{b("0"), b("1"), b("y"), b("2"), b("3"), b("x"), b("z"), b("5")}}},
+		{[]interface{}{"rpush", "a", "y", "1"}, replyType{"Integer", int64(10)}},
+		{[]interface{}{"lrem", "a", "-1", "1"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"lrem", "a", "2", "y"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"lrange", "a", "2", "-3"}, replyType{"Array", []replyType{b("2"), b("3"), b("x")}}},
+		{[]interface{}{"ltrim", "a", "1", "-2"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"lrange", "a", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("2"), b("3"), b("x"), b("z")}}},
+		{[]interface{}{"llen", "a"}, replyType{"Integer", int64(5)}},
+		{[]interface{}{"lrem", "a", "1", "2"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"lrange", "a", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("3"), b("x"), b("z")}}},
+		{[]interface{}{"ltrim", "a", "5", "-1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"exists", "a"}, replyType{"Integer", int64(0)}},
+	}
+	runTest("LIST EDIT", tests, t)
+}
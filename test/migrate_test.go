@@ -0,0 +1,85 @@
+package test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/rod6/rodis/resp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// migrate group, rodis -c rodis.toml migrate on the keys in the legacy layout
+func TestMigrateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rodis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the keys of db 0 in the legacy layout, as the old versions wrote them: the
+	// string h|x has the value key of the field x of the hash h
+	expire := make([]byte, 8)
+	binary.BigEndian.PutUint64(expire, uint64(time.Now().Add(time.Hour).Unix()))
+	records := map[string][]byte{
+		"+s":           {0x00, resp.String},
+		"-s":           []byte("string"),
+		"+h":           {0x00, resp.Hash},
+		"-h|f":         []byte("v"),
+		"+h|x":         {0x00, resp.String},
+		"-h|x":         []byte("x"),
+		"-SYSExpire|s": expire,
+	}
+	db, err := leveldb.OpenFile(filepath.Join(dir, "db", "0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range records {
+		db.Put([]byte(k), v, nil)
+	}
+	db.Close()
+
+	bin, conf := buildRodis(t, dir, 6382, "")
+	cmd := exec.Command(bin, "-c", conf, "migrate")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Migrated 3 keys of db 0") {
+		t.Fatalf("Error rodis migrate, Expect: Migrated 3 keys of db 0, Get: %v, %s", err, out)
+	}
+
+	// the metadata are in the current layout after rodis exits
+	db, err = leveldb.OpenFile(filepath.Join(dir, "db", "0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := db.NewIterator(util.BytesPrefix([]byte("+")), nil)
+	for iter.Next() {
+		if v := iter.Value(); len(v) < 10 || v[0] != 0x02 {
+			t.Errorf("Error rodis migrate, Expect: metadata version 2 of %q, Get: %v", iter.Key(), v)
+		}
+	}
+	iter.Release()
+	db.Close()
+
+	c, stop := runRodis(t, bin, conf, 6382)
+	defer stop()
+	if v, err := redis.String(c.Do("GET", "s")); err != nil || v != "string" {
+		t.Errorf("Error GET s, Expect: string, Get: %v, %v", v, err)
+	}
+	if v, err := redis.String(c.Do("GET", "h|x")); err != nil || v != "x" {
+		t.Errorf("Error GET h|x, Expect: x, Get: %v, %v", v, err)
+	}
+	if v, err := redis.Strings(c.Do("HGETALL", "h")); err != nil || strings.Join(v, ",") != "f,v" {
+		t.Errorf("Error HGETALL h, Expect: f,v, Get: %v, %v", v, err)
+	}
+	if ttl, err := redis.Int64(c.Do("TTL", "s")); err != nil || ttl <= 3500 || ttl > 3600 {
+		t.Errorf("Error TTL s, Expect: about 3600, Get: %v, %v", ttl, err)
+	}
+}
@@ -0,0 +1,67 @@
+package test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// protocol group, the requests and the replies are raw bytes
+func TestProtocol(t *testing.T) {
+	big := strings.Repeat("x", 300000)
+	tests := []struct {
+		request string
+		reply   string
+	}{
+		{"*2\r\n$4\r\nECHO\r\n$3\r\nabc\r\n", "$3\r\nabc\r\n"},
+		{"\r\n*0\r\n*-1\r\nPING\n", "+PONG\r\n"},
+		{"echo \"x\\x41\\n\"\r\necho 'it\\'s'\r\n", "$3\r\nxA\n\r\n$4\r\nit's\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nbig\r\n$300000\r\n" + big + "\r\n*2\r\n$6\r\nSTRLEN\r\n$3\r\nbig\r\n*2\r\n$3\r\nDEL\r\n$3\r\nbig\r\n", "+OK\r\n:300000\r\n:1\r\n"},
+	}
+	closed := []struct {
+		request string
+		reply   string
+	}{
+		{"*1x\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*+1\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*2000000\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$-5\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$536870913\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n:4\r\n", "-ERR Protocol error: expected '$', got ':'\r\n"},
+		{"*1\r\n$4\r\nPINGxx", "-ERR Protocol error: expected '\\r\\n' after bulk string\r\n"},
+		{"*" + strings.Repeat("1", 70000), "-ERR Protocol error: too big mbulk count string\r\n"},
+		{"get a\r\nget \"a\r\n", "$-1\r\n-ERR Protocol error: unbalanced quotes in request\r\n"},
+		{"echo \"a\"b\r\n", "-ERR Protocol error: unbalanced quotes in request\r\n"},
+	}
+
+	request := func(req string) net.Conn {
+		conn, err := net.Dial("tcp", ":6379")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Write([]byte(req)) // the server may close before reading all
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		return conn
+	}
+
+	re.Do("DEL", "a")
+	for i, test := range tests {
+		conn := request(test.request)
+		r := make([]byte, len(test.reply))
+		if _, err := io.ReadFull(conn, r); err != nil || string(r) != test.reply {
+			t.Errorf("Error PROTOCOL[%v](%q), Expect: %q, Get: %q, %v", i, test.request, test.reply, r, err)
+		}
+		conn.Close()
+	}
+	for i, test := range closed {
+		conn := request(test.request)
+		r, err := ioutil.ReadAll(conn)
+		if string(r) != test.reply {
+			t.Errorf("Error PROTOCOL[%v](%.20q), Expect: %q and closed, Get: %q, %v", i, test.request, test.reply, r, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// subscriber dials a new connection, pooled connections should not be used in
+// subscriber mode.
+func subscriber(t *testing.T) redis.PubSubConn {
+	c, err := redis.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	return redis.PubSubConn{Conn: c}
+}
+
+func receive(name string, psc redis.PubSubConn, expect interface{}, t *testing.T) {
+	if r := psc.ReceiveWithTimeout(time.Second); !reflect.DeepEqual(r, expect) {
+		t.Errorf("Error %v, Expect: %#v, Get: %#v", name, expect, r)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	psc := subscriber(t)
+	defer psc.Close()
+
+	psc.Subscribe("news", "sports")
+	receive("SUBSCRIBE", psc, redis.Subscription{Kind: "subscribe", Channel: "news", Count: 1}, t)
+	receive("SUBSCRIBE", psc, redis.Subscription{Kind: "subscribe", Channel: "sports", Count: 2}, t)
+
+	tests := []rodisTest{
+		{[]interface{}{"publish", "news", "hello"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"publish", "weather", "sunny"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"pubsub", "numsub", "news", "weather"}, replyType{"Array", []replyType{
+			{"BulkString", []byte("news")},
+			{"Integer", int64(1)},
+			{"BulkString", []byte("weather")},
+			{"Integer", int64(0)},
+		}}},
+		{[]interface{}{"pubsub", "channels", "s*"}, replyType{"Array", []replyType{{"BulkString", []byte("sports")}}}},
+		{[]interface{}{"pubsub", "foo"}, replyType{"Error", "ERR Unknown subcommand or wrong number of arguments for 'foo'. Try PUBSUB HELP."}},
+	}
+	runTest("PUBLISH", tests, t)
+	receive("PUBLISH", psc, redis.Message{Channel: "news", Data: []byte("hello")}, t)
+
+	// only pub/sub commands are allowed in subscriber mode
+	psc.Conn.Send("GET", "a")
+	psc.Conn.Flush()
+	if _, err := psc.Conn.Receive(); err == nil || err.Error() != "ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context" {
+		t.Errorf("Error SUBSCRIBE, Expect: error, Get: %v", err)
+	}
+
+	psc.Unsubscribe()
+	receive("UNSUBSCRIBE", psc, redis.Subscription{Kind: "unsubscribe", Channel: "news", Count: 1}, t)
+	receive("UNSUBSCRIBE", psc, redis.Subscription{Kind: "unsubscribe", Channel: "sports", Count: 0}, t)
+
+	if r, err := redis.String(psc.Conn.Do("SET", "a", "1")); err != nil || r != "OK" {
+		t.Errorf("Error UNSUBSCRIBE, Expect: OK, Get: %v, %v", r, err)
+	}
+}
+
+func TestPSubscribe(t *testing.T) {
+	psc := subscriber(t)
+	defer psc.Close()
+
+	psc.PSubscribe("news.*", "h[ae]llo")
+	receive("PSUBSCRIBE", psc, redis.Subscription{Kind: "psubscribe", Channel: "news.*", Count: 1}, t)
+	receive("PSUBSCRIBE", psc, redis.Subscription{Kind: "psubscribe", Channel: "h[ae]llo", Count: 2}, t)
+
+	tests := []rodisTest{
+		{[]interface{}{"publish", "news.tech", "go"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"publish", "hillo", "x"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"publish", "hallo", "y"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"pubsub", "numpat"}, replyType{"Integer", int64(2)}},
+	}
+	runTest("PSUBSCRIBE", tests, t)
+	receive("PSUBSCRIBE", psc, redis.PMessage{Pattern: "news.*", Channel: "news.tech", Data: []byte("go")}, t)
+	receive("PSUBSCRIBE", psc, redis.PMessage{Pattern: "h[ae]llo", Channel: "hallo", Data: []byte("y")}, t)
+
+	psc.PUnsubscribe("news.*")
+	receive("PUNSUBSCRIBE", psc, redis.Subscription{Kind: "punsubscribe", Channel: "news.*", Count: 1}, t)
+
+	// subscriptions are removed when the connection is closed
+	psc.Close()
+	time.Sleep(100 * time.Millisecond)
+	runTest("PUNSUBSCRIBE", []rodisTest{{[]interface{}{"pubsub", "numpat"}, replyType{"Integer", int64(0)}}}, t)
+}
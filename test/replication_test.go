@@ -0,0 +1,139 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// replication group
+func TestReplicaof(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"replicaof", "127.0.0.1"}, replyType{"Error", "ERR wrong number of arguments for 'replicaof' command"}},
+		{[]interface{}{"replicaof", "127.0.0.1", "foo"}, replyType{"Error", "ERR Invalid master port"}},
+		{[]interface{}{"replicaof", "no", "one"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"replconf", "foo", "bar"}, replyType{"Error", "ERR Unrecognized REPLCONF option: foo"}},
+		{[]interface{}{"psync", "?", "x"}, replyType{"Error", "ERR value is not an integer or out of range"}},
+	}
+	runTest("REPLICAOF", tests, t)
+}
+
+// TestReplica starts a rodis replica of the tested server at :6380
+func TestReplica(t *testing.T) {
+	replica, stop := startRodis(t, 6380, "")
+	defer stop()
+
+	re.Do("FLUSHDB")
+	re.Do("SET", "a", "foo")
+	re.Do("RPUSH", "b", "1", "2")
+	if r, err := redis.String(replica.Do("REPLICAOF", "127.0.0.1", "6379")); err != nil || r != "OK" {
+		t.Fatalf("Error REPLICAOF, Expect: OK, Get: %v, %v", r, err)
+	}
+	re.Do("SET", "c", "bar")
+	re.Do("EXPIRE", "c", "100")
+
+	// the full sync and the stream are done in background
+	synced := false
+	for i := 0; i < 200 && !synced; i++ {
+		time.Sleep(20 * time.Millisecond)
+		r, _ := redis.String(replica.Do("GET", "c"))
+		synced = r == "bar"
+	}
+	if !synced {
+		t.Fatal("Error replica, the write of master is not replicated")
+	}
+
+	b := func(s string) replyType { return replyType{"BulkString", []byte(s)} }
+	tests := []rodisTest{
+		{[]interface{}{"get", "a"}, b("foo")},
+		{[]interface{}{"lrange", "b", "0", "-1"}, replyType{"Array", []replyType{b("1"), b("2")}}},
+		{[]interface{}{"set", "a", "bar"}, replyType{"Error", "READONLY You can't write against a read only replica."}},
+		{[]interface{}{"replicaof", "127.0.0.1", "6379"}, replyType{"SimpleString", "OK Already connected to specified master"}},
+	}
+	for i, test := range tests {
+		r, _ := replica.Do(test.command[0].(string), test.command[1:]...)
+		if !check(r, test.reply) {
+			t.Errorf("Error REPLICA[%v](%v), Expect: %v,  Get: %#v", i, test.command, test.reply, r)
+		}
+	}
+	if ttl, err := redis.Int(replica.Do("TTL", "c")); err != nil || ttl < 98 || ttl > 100 {
+		t.Errorf("Error REPLICA, Expect: TTL 100, Get: %v, %v", ttl, err)
+	}
+
+	role, err := redis.Values(replica.Do("ROLE"))
+	if err != nil || len(role) != 5 || string(role[0].([]byte)) != "slave" || string(role[3].([]byte)) != "connected" {
+		t.Errorf("Error ROLE of replica, Get: %v, %v", role, err)
+	}
+	role, err = redis.Values(re.Do("ROLE"))
+	if err != nil || len(role) != 3 || string(role[0].([]byte)) != "master" {
+		t.Errorf("Error ROLE of master, Get: %v, %v", role, err)
+	}
+
+	tests = []rodisTest{
+		{[]interface{}{"replicaof", "no", "one"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "a", "bar"}, replyType{"SimpleString", "OK"}},
+	}
+	for i, test := range tests {
+		r, _ := replica.Do(test.command[0].(string), test.command[1:]...)
+		if !check(r, test.reply) {
+			t.Errorf("Error REPLICA[%v](%v), Expect: %v,  Get: %#v", i, test.command, test.reply, r)
+		}
+	}
+}
+
+// TestPsync runs PSYNC as a replica, a partial resync continues the stream from
+// the offset of the full sync
+func TestPsync(t *testing.T) {
+	psync := func(replid, offset string) (*bufio.Reader, net.Conn, string) {
+		conn, err := net.Dial("tcp", ":6379")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "*3\r\n$5\r\nPSYNC\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(replid), replid, len(offset), offset)
+		br := bufio.NewReader(conn)
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return br, conn, strings.TrimSpace(line)
+	}
+
+	_, conn, line := psync("?", "-1")
+	conn.Close()
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		t.Fatalf("Error PSYNC, Expect: +FULLRESYNC, Get: %v", line)
+	}
+
+	re.Do("SET", "a", "foo")
+	var offset int64
+	fmt.Sscan(fields[2], &offset)
+	br, conn2, line := psync(fields[1], fmt.Sprint(offset+1))
+	defer conn2.Close()
+	if line != "+CONTINUE "+fields[1] {
+		t.Fatalf("Error PSYNC, Expect: +CONTINUE %v, Get: %v", fields[1], line)
+	}
+	stream := ""
+	for !strings.Contains(stream, "foo") {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error PSYNC, the stream is %q, %v", stream, err)
+		}
+		stream += line
+	}
+	if !strings.HasSuffix(stream, "*3\r\n$3\r\nset\r\n$1\r\na\r\n$3\r\nfoo\r\n") {
+		t.Errorf("Error PSYNC, Expect: SET a foo, Get: %q", stream)
+	}
+
+	_, conn, line = psync("foo", fmt.Sprint(offset+1))
+	conn.Close()
+	if !strings.HasPrefix(line, "+FULLRESYNC "+fields[1]) {
+		t.Errorf("Error PSYNC, Expect: +FULLRESYNC, Get: %v", line)
+	}
+}
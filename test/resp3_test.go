@@ -0,0 +1,68 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// resp3 group, the replies are checked as raw bytes, as redigo knows RESP2 only
+func TestHello(t *testing.T) {
+	conn, err := net.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	re.Do("DEL", "h", "s", "z")
+	re.Do("HSET", "h", "a", "1")
+	re.Do("SADD", "s", "x")
+	re.Do("ZADD", "z", "1.5", "m", "2", "n")
+
+	hello := func(proto int) string {
+		return "%6\r\n$6\r\nserver\r\n$5\r\nrodis\r\n$7\r\nversion\r\n$5\r\n6.0.0\r\n" +
+			fmt.Sprintf("$5\r\nproto\r\n:%d\r\n", proto) +
+			"$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+	}
+	tests := []struct {
+		command []string
+		reply   string
+	}{
+		{[]string{"hello", "4"}, "-NOPROTO unsupported protocol version\r\n"},
+		{[]string{"hello", "x"}, "-ERR Protocol version is not an integer or out of range\r\n"},
+		{[]string{"hello", "3", "setname"}, "-ERR Syntax error in HELLO option 'setname'\r\n"},
+		{[]string{"hello", "3"}, hello(3)},
+		{[]string{"hgetall", "h"}, "%1\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"hgetall", "nokey"}, "%0\r\n"},
+		{[]string{"smembers", "s"}, "~1\r\n$1\r\nx\r\n"},
+		{[]string{"zscore", "z", "m"}, ",1.5\r\n"},
+		{[]string{"zrange", "z", "0", "-1", "withscores"}, "*2\r\n*2\r\n$1\r\nm\r\n,1.5\r\n*2\r\n$1\r\nn\r\n,2\r\n"},
+		{[]string{"zrange", "z", "0", "0"}, "*1\r\n$1\r\nm\r\n"},
+		{[]string{"get", "nokey"}, "_\r\n"},
+		{[]string{"mget", "nokey", "h"}, "*2\r\n_\r\n_\r\n"},
+		{[]string{"pubsub", "numsub", "ch"}, "%1\r\n$2\r\nch\r\n:0\r\n"},
+		{[]string{"subscribe", "ch"}, ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"},
+		{[]string{"ping"}, "+PONG\r\n"},
+		{[]string{"unsubscribe"}, ">3\r\n$11\r\nunsubscribe\r\n$2\r\nch\r\n:0\r\n"},
+		{[]string{"hello", "2"}, "*12\r\n" + hello(2)[4:]},
+		{[]string{"hgetall", "h"}, "*2\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		{[]string{"zrange", "z", "0", "-1", "withscores"}, "*4\r\n$1\r\nm\r\n$3\r\n1.5\r\n$1\r\nn\r\n$1\r\n2\r\n"},
+		{[]string{"get", "nokey"}, "$-1\r\n"},
+	}
+	for i, test := range tests {
+		fmt.Fprintf(conn, "*%d\r\n", len(test.command))
+		for _, arg := range test.command {
+			fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		r := make([]byte, len(test.reply))
+		if _, err := io.ReadFull(br, r); err != nil || string(r) != test.reply {
+			t.Fatalf("Error HELLO[%v](%v), Expect: %q, Get: %q, %v", i, test.command, test.reply, r, err)
+		}
+	}
+	re.Do("DEL", "h", "s", "z")
+}
@@ -1,7 +1,10 @@
 package test
 
 import (
+	"sync"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 // string group
@@ -274,6 +277,33 @@ func TestIncr(t *testing.T) {
 	runTest("INCR", tests, t)
 }
 
+func TestIncrConcurrent(t *testing.T) {
+	re.Do("FLUSHDB")
+
+	// the clients increase the keys in parallel, no increment is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		c := redisPool.Get()
+		defer c.Close()
+		wg.Add(1)
+		go func(c redis.Conn) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Do("INCR", "a")
+				c.Do("MSET", "b", j, "c", j)
+				c.Do("INCR", "d")
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	for _, key := range []string{"a", "d"} {
+		if r, err := redis.Int(re.Do("GET", key)); err != nil || r != 800 {
+			t.Errorf("Error INCR %v, Expect: 800, Get: %v, %v", key, r, err)
+		}
+	}
+}
+
 func TestIncrby(t *testing.T) {
 	tests := []rodisTest{
 		{[]interface{}{"incrby"}, replyType{"Error", "ERR wrong number of arguments for 'incrby' command"}},
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"testing"
+)
+
+func TestMulti(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"multi"}, replyType{"Error", "ERR MULTI calls can not be nested"}},
+		{[]interface{}{"set", "a", "1"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"incr", "a"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"get", "a"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Array", []replyType{
+			{"SimpleString", "OK"},
+			{"Integer", int64(2)},
+			{"BulkString", []byte("2")},
+		}}},
+		{[]interface{}{"exec"}, replyType{"Error", "ERR EXEC without MULTI"}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"hset", "a", "f", "v"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"incr", "a"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Array", []replyType{
+			{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"},
+			{"Integer", int64(3)},
+		}}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"del", "a"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"hmset", "h", "f", "1", "g", "2"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"hdel", "h", "f"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"hgetall", "h"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"keys", "*"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Array", []replyType{
+			{"Integer", int64(1)},
+			{"SimpleString", "OK"},
+			{"Integer", int64(1)},
+			{"Array", []replyType{{"BulkString", []byte("g")}, {"BulkString", []byte("2")}}},
+			{"Array", []replyType{{"BulkString", []byte("h")}}},
+		}}},
+	}
+	runTest("MULTI", tests, t)
+}
+
+func TestDiscard(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"discard"}, replyType{"Error", "ERR DISCARD without MULTI"}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"set", "a", "1"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"discard"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get", "a"}, replyType{"BulkString", nil}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"get"}, replyType{"Error", "ERR wrong number of arguments for 'get' command"}},
+		{[]interface{}{"set", "a", "1"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Error", "EXECABORT Transaction discarded because of previous errors."}},
+		{[]interface{}{"get", "a"}, replyType{"BulkString", nil}},
+	}
+	runTest("DISCARD", tests, t)
+}
+
+func TestWatch(t *testing.T) {
+	other := redisPool.Get()
+	defer other.Close()
+
+	tests := []rodisTest{
+		{[]interface{}{"watch"}, replyType{"Error", "ERR wrong number of arguments for 'watch' command"}},
+		{[]interface{}{"set", "a", "1"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"watch", "a", "b"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"watch", "a"}, replyType{"Error", "ERR WATCH inside MULTI is not allowed"}},
+		{[]interface{}{"incr", "a"}, replyType{"SimpleString", "QUEUED"}},
+		{[]interface{}{"exec"}, replyType{"Array", []replyType{{"Integer", int64(2)}}}},
+		{[]interface{}{"watch", "a"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"unwatch"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"watch", "b"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"multi"}, replyType{"SimpleString", "OK"}},
+		{[]interface{}{"incr", "a"}, replyType{"SimpleString", "QUEUED"}},
+	}
+	runTest("WATCH", tests, t)
+
+	// modify the watched key from another connection, EXEC should fail
+	other.Do("SET", "b", "1")
+	if r, err := re.Do("EXEC"); r != nil || err != nil {
+		t.Errorf("Error WATCH, Expect: nil, Get: %#v, %v", r, err)
+	}
+	if r, _ := re.Do("GET", "a"); string(r.([]byte)) != "2" {
+		t.Errorf("Error WATCH, Expect: 2, Get: %#v", r)
+	}
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"testing"
+)
+
+// bulks returns the array reply of bulk strings
+func bulks(values ...string) replyType {
+	arr := []replyType{}
+	for _, v := range values {
+		arr = append(arr, replyType{"BulkString", []byte(v)})
+	}
+	return replyType{"Array", arr}
+}
+
+// zsetTest prepends the commands to add a, b, c, d and e with scores 1 to 5 to z
+func zsetTest(tests ...rodisTest) []rodisTest {
+	return append([]rodisTest{
+		{[]interface{}{"zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e"}, replyType{"Integer", int64(5)}},
+	}, tests...)
+}
+
+func TestZadd(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"zadd", "z", "1"}, replyType{"Error", "ERR wrong number of arguments for 'zadd' command"}},
+		{[]interface{}{"zadd", "z", "x", "a"}, replyType{"Error", "ERR value is not a valid float"}},
+		{[]interface{}{"zadd", "z", "1", "a", "2", "b"}, replyType{"Integer", int64(2)}},
+		{[]interface{}{"zadd", "z", "3", "a", "3", "c"}, replyType{"Integer", int64(1)}},
+		{[]interface{}{"zadd", "z", "3", "a"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"zcard", "z"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"zrange", "z", "0", "-1", "withscores"}, bulks("b", "2", "a", "3", "c", "3")},
+		{[]interface{}{"zadd", "z", "-inf", "c"}, replyType{"Integer", int64(0)}},
+		{[]interface{}{"zrange", "z", "0", "0", "withscores"}, bulks("c", "-inf")},
+	}
+	runTest("ZADD", tests, t)
+}
+
+func TestZcount(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zcount", "z", "x", "3"}, replyType{"Error", "ERR min or max is not a float"}},
+		rodisTest{[]interface{}{"zcount", "z", "2", "4"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"zcount", "z", "(2", "(4"}, replyType{"Integer", int64(1)}},
+		rodisTest{[]interface{}{"zcount", "z", "-inf", "+inf"}, replyType{"Integer", int64(5)}},
+		rodisTest{[]interface{}{"zcount", "z", "4", "2"}, replyType{"Integer", int64(0)}},
+		rodisTest{[]interface{}{"zcount", "y", "-inf", "+inf"}, replyType{"Integer", int64(0)}},
+	)
+	runTest("ZCOUNT", tests, t)
+}
+
+func TestZincrby(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"zincrby", "z", "x", "a"}, replyType{"Error", "ERR value is not a valid float"}},
+		{[]interface{}{"zincrby", "z", "1.5", "a"}, replyType{"BulkString", []byte("1.5")}},
+		{[]interface{}{"zincrby", "z", "-3", "a"}, replyType{"BulkString", []byte("-1.5")}},
+		{[]interface{}{"zincrby", "z", "inf", "a"}, replyType{"BulkString", []byte("inf")}},
+		{[]interface{}{"zincrby", "z", "-inf", "a"}, replyType{"Error", "ERR resulting score is not a number (NaN)"}},
+		{[]interface{}{"zscore", "z", "a"}, replyType{"BulkString", []byte("inf")}},
+		{[]interface{}{"zcard", "z"}, replyType{"Integer", int64(1)}},
+	}
+	runTest("ZINCRBY", tests, t)
+}
+
+func TestZpop(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zpopmin", "z"}, bulks("a", "1")},
+		rodisTest{[]interface{}{"zpopmax", "z", "2"}, bulks("e", "5", "d", "4")},
+		rodisTest{[]interface{}{"zpopmin", "z", "5"}, bulks("b", "2", "c", "3")},
+		rodisTest{[]interface{}{"exists", "z"}, replyType{"Integer", int64(0)}},
+		rodisTest{[]interface{}{"zpopmax", "z"}, bulks()},
+	)
+	runTest("ZPOP", tests, t)
+}
+
+func TestZrangebylex(t *testing.T) {
+	tests := []rodisTest{
+		{[]interface{}{"zadd", "z", "0", "a", "0", "b", "0", "c", "0", "d"}, replyType{"Integer", int64(4)}},
+		{[]interface{}{"zrangebylex", "z", "a", "c"}, replyType{"Error", "ERR min or max not valid string range item"}},
+		{[]interface{}{"zrangebylex", "z", "-", "+"}, bulks("a", "b", "c", "d")},
+		{[]interface{}{"zrangebylex", "z", "[b", "(d"}, bulks("b", "c")},
+		{[]interface{}{"zrangebylex", "z", "(a", "+", "limit", "1", "1"}, bulks("c")},
+		{[]interface{}{"zrangebylex", "z", "-", "+", "withscores"}, replyType{"Error", "ERR syntax error"}},
+		{[]interface{}{"zlexcount", "z", "[b", "+"}, replyType{"Integer", int64(3)}},
+		{[]interface{}{"zlexcount", "z", "(d", "+"}, replyType{"Integer", int64(0)}},
+	}
+	runTest("ZRANGEBYLEX", tests, t)
+}
+
+func TestZrangebyscore(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zrangebyscore", "z", "2", "4"}, bulks("b", "c", "d")},
+		rodisTest{[]interface{}{"zrangebyscore", "z", "(2", "4", "withscores"}, bulks("c", "3", "d", "4")},
+		rodisTest{[]interface{}{"zrangebyscore", "z", "-inf", "+inf", "limit", "1", "2"}, bulks("b", "c")},
+		rodisTest{[]interface{}{"zrangebyscore", "z", "-inf", "+inf", "limit", "3", "-1"}, bulks("d", "e")},
+		rodisTest{[]interface{}{"zrangebyscore", "z", "1", "2", "limit", "1"}, replyType{"Error", "ERR syntax error"}},
+		rodisTest{[]interface{}{"zrevrangebyscore", "z", "4", "(2"}, bulks("d", "c")},
+		rodisTest{[]interface{}{"zrevrangebyscore", "z", "+inf", "-inf", "withscores", "limit", "0", "1"}, bulks("e", "5")},
+		rodisTest{[]interface{}{"zrevrangebyscore", "z", "2", "4"}, bulks()},
+	)
+	runTest("ZRANGEBYSCORE", tests, t)
+}
+
+func TestZrank(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zrank", "z", "a"}, replyType{"Integer", int64(0)}},
+		rodisTest{[]interface{}{"zrank", "z", "d"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"zrevrank", "z", "d"}, replyType{"Integer", int64(1)}},
+		rodisTest{[]interface{}{"zrevrank", "z", "x"}, replyType{"BulkString", nil}},
+		rodisTest{[]interface{}{"set", "s", "foobar"}, replyType{"SimpleString", "OK"}},
+		rodisTest{[]interface{}{"zrevrank", "s", "a"}, replyType{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+	)
+	runTest("ZRANK", tests, t)
+}
+
+func TestZrem(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zrem", "z"}, replyType{"Error", "ERR wrong number of arguments for 'zrem' command"}},
+		rodisTest{[]interface{}{"zrem", "z", "a", "c", "x"}, replyType{"Integer", int64(2)}},
+		rodisTest{[]interface{}{"zremrangebyrank", "z", "0", "0"}, replyType{"Integer", int64(1)}},
+		rodisTest{[]interface{}{"zrange", "z", "0", "-1"}, bulks("d", "e")},
+		rodisTest{[]interface{}{"zremrangebyscore", "z", "(4", "+inf"}, replyType{"Integer", int64(1)}},
+		rodisTest{[]interface{}{"zremrangebyrank", "z", "0", "-1"}, replyType{"Integer", int64(1)}},
+		rodisTest{[]interface{}{"exists", "z"}, replyType{"Integer", int64(0)}},
+	)
+	runTest("ZREM", tests, t)
+}
+
+func TestZrevrange(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zrevrange", "z", "0", "1"}, bulks("e", "d")},
+		rodisTest{[]interface{}{"zrevrange", "z", "-2", "-1", "withscores"}, bulks("b", "2", "a", "1")},
+		rodisTest{[]interface{}{"zrevrange", "z", "3", "100"}, bulks("b", "a")},
+		rodisTest{[]interface{}{"zrevrange", "z", "5", "6"}, bulks()},
+		rodisTest{[]interface{}{"zrange", "z", "1", "2"}, bulks("b", "c")},
+	)
+	runTest("ZREVRANGE", tests, t)
+}
+
+func TestZscore(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zscore", "z", "c"}, replyType{"BulkString", []byte("3")}},
+		rodisTest{[]interface{}{"zscore", "z", "x"}, replyType{"BulkString", nil}},
+		rodisTest{[]interface{}{"zscore", "y", "a"}, replyType{"BulkString", nil}},
+	)
+	runTest("ZSCORE", tests, t)
+}
+
+func TestZdiff(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"sadd", "s", "a", "c", "x"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"zdiff", "2", "z", "s"}, bulks("b", "d", "e")},
+		rodisTest{[]interface{}{"zdiff", "2", "z", "s", "withscores"}, bulks("b", "2", "d", "4", "e", "5")},
+		rodisTest{[]interface{}{"zdiff", "2", "s", "z"}, bulks("x")},
+		rodisTest{[]interface{}{"zdiff", "2", "z", "s", "weights", "1", "1"}, replyType{"Error", "ERR syntax error"}},
+	)
+	runTest("ZDIFF", tests, t)
+}
+
+func TestZinterstore(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zadd", "y", "10", "b", "20", "c", "30", "x"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"sadd", "s", "b", "c", "d"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"zinterstore", "o", "0", "z"}, replyType{"Error", "ERR at least 1 input key is needed for 'zinterstore' command"}},
+		rodisTest{[]interface{}{"zinterstore", "o", "2", "z", "y"}, replyType{"Integer", int64(2)}},
+		rodisTest{[]interface{}{"zrange", "o", "0", "-1", "withscores"}, bulks("b", "12", "c", "23")},
+		rodisTest{[]interface{}{"zinterstore", "o", "3", "z", "y", "s", "aggregate", "max"}, replyType{"Integer", int64(2)}},
+		rodisTest{[]interface{}{"zrange", "o", "0", "-1", "withscores"}, bulks("b", "10", "c", "20")},
+		rodisTest{[]interface{}{"zinter", "2", "z", "s", "weights", "2", "0.5", "aggregate", "min", "withscores"}, bulks("b", "0.5", "c", "0.5", "d", "0.5")},
+		rodisTest{[]interface{}{"zinterstore", "o", "2", "z", "x"}, replyType{"Integer", int64(0)}},
+		rodisTest{[]interface{}{"exists", "o"}, replyType{"Integer", int64(0)}},
+	)
+	runTest("ZINTERSTORE", tests, t)
+}
+
+func TestZunionstore(t *testing.T) {
+	tests := zsetTest(
+		rodisTest{[]interface{}{"zadd", "y", "10", "b", "20", "c", "30", "x"}, replyType{"Integer", int64(3)}},
+		rodisTest{[]interface{}{"set", "str", "foobar"}, replyType{"SimpleString", "OK"}},
+		rodisTest{[]interface{}{"zunionstore", "o", "2", "z", "str"}, replyType{"Error", "WRONGTYPE Operation against a key holding the wrong kind of value"}},
+		rodisTest{[]interface{}{"zunionstore", "o", "3", "z", "y"}, replyType{"Error", "ERR syntax error"}},
+		rodisTest{[]interface{}{"zunionstore", "o", "2", "z", "y", "weights", "1", "x"}, replyType{"Error", "ERR weight value is not a float"}},
+		rodisTest{[]interface{}{"zunionstore", "o", "2", "z", "y", "aggregate", "avg"}, replyType{"Error", "ERR syntax error"}},
+		rodisTest{[]interface{}{"zunionstore", "o", "2", "z", "y"}, replyType{"Integer", int64(6)}},
+		rodisTest{[]interface{}{"zrange", "o", "0", "-1", "withscores"}, bulks("a", "1", "d", "4", "e", "5", "b", "12", "c", "23", "x", "30")},
+		rodisTest{[]interface{}{"zunionstore", "str", "2", "z", "y", "weights", "2", "-1", "aggregate", "min"}, replyType{"Integer", int64(6)}},
+		rodisTest{[]interface{}{"zrange", "str", "0", "-1", "withscores"}, bulks("x", "-30", "c", "-20", "b", "-10", "a", "2", "d", "8", "e", "10")},
+		rodisTest{[]interface{}{"zunion", "2", "z", "nosuchkey"}, bulks("a", "b", "c", "d", "e")},
+		rodisTest{[]interface{}{"zunionstore", "z", "2", "z", "z"}, replyType{"Integer", int64(5)}},
+		rodisTest{[]interface{}{"zrange", "z", "0", "0", "withscores"}, bulks("a", "2")},
+	)
+	runTest("ZUNIONSTORE", tests, t)
+}